@@ -0,0 +1,105 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// abciQuery is named abci query of store path (eg, '/store/bank/key') with hex-encoded data (eg, store key)
+type abciQuery struct {
+	name string
+	path string
+	data string
+}
+
+// abciScraper runs abci queries once at each of given heights, and then at the latest height every interval (0 disables it), until ctx cancelled
+// results are stored in abci_queries collection, keyed by query name and height, with both raw (base64-encoded) key and value as returned by the node
+func abciScraper(ctx context.Context, rsc bcSource, col *mongo.Collection, queries []abciQuery, heights []int, interval time.Duration) {
+	run := func(ctx context.Context, h int) error {
+		for _, q := range queries {
+			if err := runABCIQuery(ctx, rsc, col, q, h); err != nil {
+				if errors.Is(err, context.Canceled) {
+					return err
+				}
+				stdLogger.Printf("error running abci query %s at height %d (skipping): %v", q.name, h, err)
+			}
+		}
+		return nil
+	}
+	for _, h := range heights {
+		if err := run(ctx, h); err != nil {
+			return
+		}
+	}
+	if interval > 0 {
+		periodically(ctx, "abci queries", interval, func(ctx context.Context) error { return run(ctx, 0) })
+	}
+}
+
+// runABCIQuery stores result of abci query q at height h (0 means latest)
+func runABCIQuery(ctx context.Context, rsc bcSource, col *mongo.Collection, q abciQuery, h int) error {
+	// ref: https://docs.tendermint.com/v0.34/rpc/#/ABCI/abci_query
+	params := url.Values{}
+	params.Set("path", `"`+q.path+`"`)
+	if q.data != "" {
+		params.Set("data", "0x"+q.data)
+	}
+	if h > 0 {
+		params.Set("height", strconv.Itoa(h))
+	}
+	res, err := queryAt(ctx, rsc, "/abci_query", params, h, bcRetry)
+	if err != nil {
+		return err
+	}
+	var r struct {
+		Response struct {
+			Code      int    `json:"code"`
+			Log       string `json:"log"`
+			Codespace string `json:"codespace"`
+			Key       string `json:"key"`
+			Value     string `json:"value"`
+			Height    string `json:"height"`
+		} `json:"response"`
+	}
+	if err := json.Unmarshal(res, &r); err != nil {
+		return fmt.Errorf("error unmarshalling abci query response - got response:\n%s: %v", string(res), err)
+	}
+	if r.Response.Code != 0 {
+		return fmt.Errorf("abci query failed with code %d (codespace %q): %s", r.Response.Code, r.Response.Codespace, r.Response.Log)
+	}
+	height, err := strconv.Atoi(r.Response.Height)
+	if err != nil {
+		return fmt.Errorf("error decoding abci query response height - got response:\n%s: %v", string(res), err)
+	}
+
+	id := fmt.Sprintf("%s/%d", q.name, height)
+	extra := bson.M{"name": q.name, "path": q.path, "data": q.data, "height": height, "scraped_at": time.Now().UTC()}
+	if err := upsert(ctx, col, id, res, extra); err != nil {
+		return fmt.Errorf("error storing abci query %s result: %v", id, err)
+	}
+	return nil
+}
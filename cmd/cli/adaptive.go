@@ -0,0 +1,195 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	adaptiveErrorRate     = 0.05 // error rate above which workers are halved
+	adaptiveLatencyFactor = 2    // latency, relative to baseline, above which workers are reduced by a quarter
+	adaptiveGrowth        = 0.25 // fraction of running workers added while healthy
+
+	adaptiveMinLatency = 10 * time.Millisecond // latency below which it's considered low, regardless of baseline (ie, noise)
+)
+
+// opStats tracks latency and errors of operations (ie, node requests or database writes) since last taken
+type opStats struct {
+	mu    sync.Mutex
+	n     int
+	errs  int
+	total time.Duration
+}
+
+// nodeOps and dbOps track node requests and database writes for adaptive workers
+var nodeOps, dbOps = &opStats{}, &opStats{}
+
+// observe records operation that took d and failed with err, if not nil
+func (s *opStats) observe(d time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+	s.total += d
+	if err != nil {
+		s.errs++
+	}
+}
+
+// take returns number of operations, error rate and average latency since last taken, and resets them
+func (s *opStats) take() (n int, errRate float64, avg time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n = s.n
+	if n > 0 {
+		errRate = float64(s.errs) / float64(n)
+		avg = s.total / time.Duration(n)
+	}
+	s.n, s.errs, s.total = 0, 0, 0
+	return n, errRate, avg
+}
+
+// meteredSource is bcSource that records latency and errors of requests made using underlying bcSource in nodeOps
+// only errors indicating node is struggling (ie, rate limited, 5xx, timeout and connection errors) are counted
+type meteredSource struct {
+	bcSource
+}
+
+// block returns block at height
+func (s meteredSource) block(height string) ([]byte, error) {
+	start := time.Now()
+	res, err := s.bcSource.block(height)
+	s.observe(start, err)
+	return res, err
+}
+
+// txs returns single page of transactions at height
+func (s meteredSource) txs(height, key string, offset int) ([]byte, error) {
+	start := time.Now()
+	res, err := s.bcSource.txs(height, key, offset)
+	s.observe(start, err)
+	return res, err
+}
+
+// blockResults returns block results at height
+func (s meteredSource) blockResults(height string) ([]byte, error) {
+	start := time.Now()
+	res, err := s.bcSource.blockResults(height)
+	s.observe(start, err)
+	return res, err
+}
+
+// query returns response for api path with params at height
+func (s meteredSource) query(path string, params url.Values, height int) ([]byte, error) {
+	start := time.Now()
+	res, err := s.bcSource.query(path, params, height)
+	s.observe(start, err)
+	return res, err
+}
+
+// observe records request started at start that failed with err, if not nil
+func (s meteredSource) observe(start time.Time, err error) {
+	if err != nil {
+		switch errorClass(err) {
+		case "rate limited", "5xx", "timeout", "connection":
+		default:
+			err = nil
+		}
+	}
+	nodeOps.observe(time.Since(start), err)
+}
+
+// scaler adaptively scales pool's workers between 1 and max, based on latency and error rate of its operations and depth of its queue
+type scaler struct {
+	name string
+	pool *workerPool
+	ops  *opStats
+	grow func() bool // returns true if there's queued work that more workers could take
+
+	baseline time.Duration // lowest average latency seen, slowly drifting up to follow changed conditions
+}
+
+// initialWorkers returns number of workers adaptive scaling starts with, out of max
+func initialWorkers(max int) int {
+	if n := max / 4; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// adaptiveScaling scales requests and persists workers every interval, until ctx cancelled
+// requesters grow while requests are queued and persisters keep up, and persisters grow while persists are piling up
+func adaptiveScaling(ctx context.Context, reqPool, perPool *workerPool, reqChan chan request, perChan chan persist, interval time.Duration) {
+	scalers := []*scaler{
+		{name: "requests", pool: reqPool, ops: nodeOps, grow: func() bool {
+			return len(reqChan) > 0 && len(perChan) < cap(perChan)
+		}},
+		{name: "persists", pool: perPool, ops: dbOps, grow: func() bool {
+			return len(perChan) >= cap(perChan)/2
+		}},
+	}
+	periodically(ctx, "adaptive workers", interval, func(ctx context.Context) error {
+		for _, s := range scalers {
+			if err := s.scale(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scale resizes pool as per its operations since last scaling
+func (s *scaler) scale(ctx context.Context) error {
+	size, max := s.pool.workers(), s.pool.maxWorkers()
+	n, errRate, avg := s.ops.take()
+	if n < size {
+		// not enough operations for meaningful latency and error rate (eg, waiting for new blocks)
+		return nil
+	}
+	if errRate == 0 && (s.baseline == 0 || avg < s.baseline) {
+		s.baseline = avg
+	} else if errRate == 0 {
+		s.baseline += (avg - s.baseline) / 20
+	}
+
+	target, reason := size, ""
+	switch {
+	case errRate > adaptiveErrorRate:
+		target, reason = size/2, "high error rate"
+	case s.baseline > 0 && avg > adaptiveLatencyFactor*s.baseline && avg > adaptiveMinLatency:
+		target, reason = size-size/4, "high latency"
+	case s.grow():
+		target, reason = size+int(float64(size)*adaptiveGrowth+0.5), "queued work"
+		if target == size {
+			target++
+		}
+	}
+	if target < 1 {
+		target = 1
+	}
+	if target > max {
+		target = max
+	}
+	if target == size {
+		return nil
+	}
+	stdLogger.Printf("adaptive workers: scaling %s workers from %d to %d (%s: %d operations, average latency %s, baseline %s, error rate %.1f%%)", s.name, size, target, reason, n, avg.Round(time.Millisecond), s.baseline.Round(time.Millisecond), errRate*100)
+	return s.pool.resize(ctx, target)
+}
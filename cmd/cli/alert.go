@@ -0,0 +1,202 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// pagerDutyURL is pagerduty events api v2 endpoint, used if alert webhook is not set
+// ref: https://developer.pagerduty.com/docs/events-api-v2/trigger-events/
+const pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// alertMsg is alert posted to webhook (in json format)
+type alertMsg struct {
+	Source   string      `json:"source"`
+	Instance string      `json:"instance"`
+	Kind     string      `json:"kind"`
+	Summary  string      `json:"summary"`
+	Details  interface{} `json:"details,omitempty"`
+	Resolved bool        `json:"resolved,omitempty"`
+	Time     time.Time   `json:"time"`
+}
+
+// alert posts alert of kind with summary and optional details to alert webhook, if set (or to pagerduty, if alert format is pagerduty)
+// errors are only logged, as alerting must not affect scraping
+func alert(ctx context.Context, kind, summary string, details interface{}) {
+	sendAlert(ctx, alertMsg{Kind: kind, Summary: summary, Details: details})
+}
+
+// resolve posts resolution of alert of kind with summary, like alert
+func resolve(ctx context.Context, kind, summary string) {
+	sendAlert(ctx, alertMsg{Kind: kind, Summary: summary, Resolved: true})
+}
+
+// sendAlert completes and posts msg in alert format
+func sendAlert(ctx context.Context, msg alertMsg) {
+	url := alertWebhook
+	if url == "" && alertFormat == "pagerduty" {
+		url = pagerDutyURL
+	}
+	if url == "" {
+		return
+	}
+	msg.Source, msg.Instance, msg.Time = "cosmos-scraper", instanceID(), time.Now().UTC()
+	if instanceName != "" {
+		msg.Instance = instanceName + " (" + msg.Instance + ")"
+	}
+	if err := postAlert(ctx, url, alertBody(msg)); err != nil {
+		stdLogger.Printf("warn: error sending %s alert: %v", msg.Kind, err)
+	}
+}
+
+// alertBody returns msg formatted as per alert format: json (as is), slack (incoming webhook) or pagerduty (events api v2)
+func alertBody(msg alertMsg) interface{} {
+	switch alertFormat {
+	case "slack":
+		// ref: https://api.slack.com/messaging/webhooks
+		icon := ":rotating_light:"
+		if msg.Resolved {
+			icon = ":white_check_mark: resolved:"
+		}
+		text := fmt.Sprintf("%s *%s* on %s: %s", icon, msg.Kind, msg.Instance, msg.Summary)
+		if msg.Details != nil {
+			if d, err := json.MarshalIndent(msg.Details, "", "  "); err == nil {
+				text += "\n```" + string(d) + "```"
+			}
+		}
+		return map[string]string{"text": text}
+	case "pagerduty":
+		action := "trigger"
+		if msg.Resolved {
+			action = "resolve"
+		}
+		return map[string]interface{}{
+			"routing_key":  alertRoutingKey,
+			"event_action": action,
+			"dedup_key":    msg.Instance + "/" + msg.Kind, // so resolution matches the alert
+			"payload": map[string]interface{}{
+				"summary":        msg.Summary,
+				"source":         msg.Instance,
+				"severity":       "critical",
+				"component":      msg.Source,
+				"class":          msg.Kind,
+				"timestamp":      msg.Time.Format(time.RFC3339),
+				"custom_details": msg.Details,
+			},
+		}
+	default:
+		return msg
+	}
+}
+
+// postAlert posts alert body as json to url
+func postAlert(ctx context.Context, url string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("error encoding alert: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("error creating alert request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting alert: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("error posting alert: %s", resp.Status)
+	}
+	return nil
+}
+
+// alertPanic posts alert with stack trace, and reports it to sentry, if configured, if r is recovered panic (ie, not nil)
+// note: must be called from deferred function
+func alertPanic(r interface{}) {
+	if r == nil {
+		return
+	}
+	sentry.report("fatal", "panic", fmt.Sprint(r), panicFrames(), nil)
+	alert(context.Background(), "panic", fmt.Sprint(r), map[string]string{"stack": string(debug.Stack())})
+}
+
+// alertOnPanic, if deferred, posts alert on panic and then panics again (ie, it doesn't recover)
+func alertOnPanic() {
+	if r := recover(); r != nil {
+		alertPanic(r)
+		panic(r)
+	}
+}
+
+// outage tracks ongoing outage of dependency (ie, consecutive retryable errors), raising alert once it lasts for outageAlert, and resolving it once dependency recovers
+type outage struct {
+	name string
+
+	mu      sync.Mutex
+	since   time.Time // start of ongoing outage, zero if none
+	alerted bool
+}
+
+var (
+	nodeOutage = &outage{name: "node"}
+	dbOutage   = &outage{name: "database"}
+)
+
+// failed records dependency failure with err, also counting it by error class
+func (o *outage) failed(err error) {
+	errStats.count(o.name, err)
+	if outageAlert <= 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.since.IsZero() {
+		o.since = time.Now()
+		return
+	}
+	if d := time.Since(o.since); d >= outageAlert && !o.alerted {
+		o.alerted = true
+		summary := fmt.Sprintf("%s outage: failing for %s: %v", o.name, d.Round(time.Second), err)
+		stdLogger.Printf("error: !!! %s !!!", summary)
+		go alert(context.Background(), o.name+"_outage", summary, nil)
+	}
+}
+
+// recovered records dependency success, ending ongoing outage, if any
+func (o *outage) recovered() {
+	if outageAlert <= 0 {
+		return
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.alerted {
+		summary := fmt.Sprintf("%s recovered after %s outage", o.name, time.Since(o.since).Round(time.Second))
+		stdLogger.Println(summary)
+		go resolve(context.Background(), o.name+"_outage", summary)
+	}
+	o.since, o.alerted = time.Time{}, false
+}
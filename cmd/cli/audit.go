@@ -0,0 +1,309 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// auditIssue is a single problem found by audit, reported as json line
+type auditIssue struct {
+	Height   int    `json:"height"`
+	Issue    string `json:"issue"` // one of: missing, duplicate, hash_mismatch, tx_count_mismatch
+	Datatype string `json:"datatype"`
+	Stored   string `json:"stored,omitempty"`
+	Chain    string `json:"chain,omitempty"`
+}
+
+// auditReport summarises audit, reported as the last json line
+type auditReport struct {
+	From     int  `json:"from"`
+	To       int  `json:"to"`
+	Checked  int  `json:"checked"`
+	Issues   int  `json:"issues"`
+	Repaired bool `json:"repaired"`
+}
+
+// auditArgs parses verify command args (ie, [--from H1] [--to H2] [--repair]), where 0 heights default to the stored range
+func auditArgs(args []string) (from, to int, repair bool, err error) {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.IntVar(&from, "from", 0, "first height to verify (default: lowest stored)")
+	fs.IntVar(&to, "to", 0, "last height to verify (default: highest stored)")
+	fs.BoolVar(&repair, "repair", false, "remove duplicates and re-scrape heights with issues")
+	if err := fs.Parse(args); err != nil {
+		return 0, 0, false, err
+	}
+	if fs.NArg() > 0 {
+		return 0, 0, false, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if from < 0 || to < 0 || (to > 0 && to < from) {
+		return 0, 0, false, fmt.Errorf("invalid range [%d..%d]", from, to)
+	}
+	return from, to, repair, nil
+}
+
+// audit checks stored blocks and transactions in [from..to] heights range for completeness and integrity against the chain, and writes issues found and the final report to w, as json lines
+// it checks for missing blocks and transactions, duplicate blocks (ie, stored under other _id than their height), and block hashes and numbers of transactions that differ from the chain's
+// if repair is set, duplicates are removed and heights with other issues are re-scraped, as per rescrape
+// note: duplicates are only detected among uncompressed blocks
+func audit(ctx context.Context, w io.Writer, from, to int, repair bool) error {
+	if dbType != "mongo" {
+		return fmt.Errorf("verify requires mongo database")
+	}
+	dbc, bxs, txs, _ := initDB(ctx, dbHost, dbPort, dbUser, dbPass, dbRetry)
+	defer dbc.Disconnect(context.Background())
+
+	if from == 0 || to == 0 {
+		lo, hi, err := storedRange(ctx, bxs)
+		if err != nil {
+			return err
+		}
+		if from == 0 {
+			from = lo
+		}
+		if to == 0 {
+			to = hi
+		}
+	}
+	if from == 0 || to < from {
+		return fmt.Errorf("no stored blocks to verify in range [%d..%d]", from, to)
+	}
+
+	bcc, _ := newBCClients(ctx, bcProtocol, bcNode, bcPort)
+	stdLogger.Printf("verifying stored blocks [%d..%d]", from, to)
+
+	var mu sync.Mutex
+	var issues []auditIssue
+	report := func(i auditIssue) {
+		mu.Lock()
+		defer mu.Unlock()
+		issues = append(issues, i)
+	}
+
+	dups, err := duplicateBlocks(ctx, bxs, from, to)
+	if err != nil {
+		return err
+	}
+	for _, h := range dups {
+		report(auditIssue{Height: h, Issue: "duplicate", Datatype: "block"})
+	}
+
+	heights := make(chan int, maxReqWorkers)
+	errc := make(chan error, maxReqWorkers)
+	var wg sync.WaitGroup
+	for i := 0; i < maxReqWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h := range heights {
+				if err := auditHeight(ctx, bcc, bxs, txs, h, report); err != nil {
+					errc <- err
+					return
+				}
+			}
+		}()
+	}
+	var failed error
+	checked := 0
+feed:
+	for h := from; h <= to && ctx.Err() == nil; h++ {
+		select {
+		case heights <- h:
+			checked++
+		case failed = <-errc:
+			break feed
+		}
+	}
+	close(heights)
+	wg.Wait()
+	if failed == nil && len(errc) > 0 {
+		failed = <-errc
+	}
+	if failed == nil {
+		failed = ctx.Err()
+	}
+	if failed != nil {
+		return failed
+	}
+
+	sort.Slice(issues, func(i, j int) bool { return issues[i].Height < issues[j].Height })
+	enc := json.NewEncoder(w)
+	for _, i := range issues {
+		if err := enc.Encode(i); err != nil {
+			return err
+		}
+	}
+
+	var redo []int
+	if repair && len(issues) > 0 {
+		if len(dups) > 0 {
+			if err := removeDuplicates(ctx, bxs, dups); err != nil {
+				return err
+			}
+		}
+		seen := map[int]bool{}
+		for _, i := range issues {
+			if i.Issue != "duplicate" && !seen[i.Height] {
+				seen[i.Height] = true
+				redo = append(redo, i.Height)
+			}
+		}
+	}
+	if err := enc.Encode(auditReport{From: from, To: to, Checked: checked, Issues: len(issues), Repaired: repair && len(issues) > 0}); err != nil {
+		return err
+	}
+	if len(redo) > 0 {
+		return rescrape(ctx, redo)
+	}
+	return nil
+}
+
+// auditHeight checks stored block and transactions at height h against the chain, calling report for each issue found
+func auditHeight(ctx context.Context, bcc bcSource, bxs, txs *mongo.Collection, h int, report func(auditIssue)) error {
+	raw, err := blockAt(ctx, bcc, fmt.Sprint(h), bcRetry)
+	if err != nil {
+		return fmt.Errorf("error getting block at height %d from chain: %v", h, err)
+	}
+	var chain blockLink
+	if err := json.Unmarshal(raw, &chain); err != nil {
+		return fmt.Errorf("error unmarshalling block at height %d from chain: %v", h, err)
+	}
+	n := numTxs(raw)
+
+	var stored blockLink
+	err = findStored(ctx, bxs, h, &stored)
+	switch {
+	case errors.Is(err, mongo.ErrNoDocuments):
+		report(auditIssue{Height: h, Issue: "missing", Datatype: "block"})
+	case err != nil:
+		return fmt.Errorf("error reading stored block at height %d: %v", h, err)
+	case !bytes.Equal(decodeHash(stored.BlockID.Hash), decodeHash(chain.BlockID.Hash)):
+		report(auditIssue{Height: h, Issue: "hash_mismatch", Datatype: "block", Stored: stored.BlockID.Hash, Chain: chain.BlockID.Hash})
+	}
+
+	m, err := storedTxCount(ctx, txs, h)
+	if err != nil {
+		return err
+	}
+	switch {
+	case m < 0 && n > 0:
+		report(auditIssue{Height: h, Issue: "missing", Datatype: "transactions"})
+	case m >= 0 && m != n:
+		report(auditIssue{Height: h, Issue: "tx_count_mismatch", Datatype: "transactions", Stored: strconv.Itoa(m), Chain: strconv.Itoa(n)})
+	}
+	return nil
+}
+
+// storedTxCount returns number of transactions stored at height h, or -1 if none are stored
+func storedTxCount(ctx context.Context, txs *mongo.Collection, h int) (int, error) {
+	if dbTxDocs {
+		n, err := txs.CountDocuments(ctx, bson.M{"height": strconv.Itoa(h)})
+		if err != nil {
+			return 0, fmt.Errorf("error counting stored transactions at height %d: %v", h, err)
+		}
+		if n == 0 {
+			return -1, nil
+		}
+		return int(n), nil
+	}
+	var t struct {
+		TxResponses []interface{} `json:"tx_responses" bson:"tx_responses"`
+	}
+	err := findStored(ctx, txs, h, &t)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error reading stored transactions at height %d: %v", h, err)
+	}
+	return len(t.TxResponses), nil
+}
+
+// storedRange returns the lowest and highest height of blocks stored in bxs (keyed by height), or zeros if none
+func storedRange(ctx context.Context, bxs *mongo.Collection) (lo, hi int, err error) {
+	for _, dir := range []int{1, -1} {
+		var d struct {
+			ID int `bson:"_id"`
+		}
+		err := bxs.FindOne(ctx, bson.M{"_id": bson.M{"$type": "number"}}, options.FindOne().SetSort(bson.M{"_id": dir}).SetProjection(bson.M{"_id": 1})).Decode(&d)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return 0, 0, nil
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("error getting stored blocks range: %v", err)
+		}
+		if dir == 1 {
+			lo = d.ID
+		} else {
+			hi = d.ID
+		}
+	}
+	return lo, hi, nil
+}
+
+// duplicateBlocks returns heights in [from..to] range of uncompressed blocks stored more than once in bxs
+func duplicateBlocks(ctx context.Context, bxs *mongo.Collection, from, to int) ([]int, error) {
+	cur, err := bxs.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"block.header.height": bson.M{"$exists": true}}}},
+		{{Key: "$group", Value: bson.M{"_id": bson.M{"$toLong": "$block.header.height"}, "n": bson.M{"$sum": 1}}}},
+		{{Key: "$match", Value: bson.M{"n": bson.M{"$gt": 1}, "_id": bson.M{"$gte": from, "$lte": to}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, fmt.Errorf("error finding duplicate blocks: %v", err)
+	}
+	defer cur.Close(ctx)
+	var heights []int
+	for cur.Next(ctx) {
+		var d struct {
+			ID int `bson:"_id"`
+		}
+		if err := cur.Decode(&d); err != nil {
+			return nil, fmt.Errorf("error decoding duplicate block height: %v", err)
+		}
+		heights = append(heights, d.ID)
+	}
+	if err := cur.Err(); err != nil {
+		return nil, fmt.Errorf("error finding duplicate blocks: %v", err)
+	}
+	return heights, nil
+}
+
+// removeDuplicates deletes blocks at heights from bxs that are not keyed by their height (eg, stored before blocks were keyed by height)
+func removeDuplicates(ctx context.Context, bxs *mongo.Collection, heights []int) error {
+	for _, h := range heights {
+		res, err := bxs.DeleteMany(ctx, bson.M{"block.header.height": strconv.Itoa(h), "_id": bson.M{"$ne": h}})
+		if err != nil {
+			return fmt.Errorf("error removing duplicate blocks at height %d: %v", h, err)
+		}
+		stdLogger.Printf("removed %d duplicate blocks at height %d", res.DeletedCount, h)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// backfillArgs parses backfill command args (ie, --from H1 --to H2 [--distributed]) and returns heights range and if it should be distributed
+func backfillArgs(args []string) (from, to int, distributed bool, err error) {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.IntVar(&from, "from", 0, "first height to scrape")
+	fs.IntVar(&to, "to", 0, "last height to scrape")
+	fs.BoolVar(&distributed, "distributed", false, "cooperate with other instances backfilling the same range")
+	if err := fs.Parse(args); err != nil {
+		return 0, 0, false, err
+	}
+	if fs.NArg() > 0 {
+		return 0, 0, false, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if from < 1 || to < from {
+		return 0, 0, false, fmt.Errorf("invalid range [%d..%d]", from, to)
+	}
+	return from, to, distributed, nil
+}
+
+// backfill scrapes blocks and transactions in [from..to] heights range, independently of the main scrape process, as per scrapeHeights
+func backfill(ctx context.Context, from, to int) error {
+	return scrapeHeights(ctx, fmt.Sprintf("[%d..%d]", from, to), to, heightsRange(from, to))
+}
+
+// heightsRange returns iterator over [from..to] heights range
+func heightsRange(from, to int) func() (int, bool) {
+	h := from
+	return func() (int, bool) {
+		if h > to {
+			return 0, false
+		}
+		h++
+		return h - 1, true
+	}
+}
+
+// rescrapeArgs parses rescrape command args (ie, --heights H1,H2,... and/or --file path, having single height per line), where heights can also be given as ranges (eg, H1-H2) and returns sorted unique heights
+func rescrapeArgs(args []string) ([]int, error) {
+	fs := flag.NewFlagSet("rescrape", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	list := fs.String("heights", "", "comma-separated heights (or height ranges, as 'from-to') to scrape")
+	file := fs.String("file", "", "file with heights (or height ranges, as 'from-to') to scrape, one per line")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	fields := strings.Split(*list, ",")
+	if *file != "" {
+		content, err := os.ReadFile(*file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading heights file %s: %v", *file, err)
+		}
+		for _, l := range strings.Split(string(content), "\n") {
+			if l = strings.TrimSpace(l); !strings.HasPrefix(l, "#") {
+				fields = append(fields, l)
+			}
+		}
+	}
+	seen := map[int]bool{}
+	var heights []int
+	for _, f := range fields {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		r := strings.SplitN(f, "-", 2)
+		from, err := strconv.Atoi(r[0])
+		to := from
+		if err == nil && len(r) == 2 {
+			to, err = strconv.Atoi(r[1])
+		}
+		if err != nil || from < 1 || to < from {
+			return nil, fmt.Errorf("invalid height %q", f)
+		}
+		for h := from; h <= to; h++ {
+			if !seen[h] {
+				seen[h] = true
+				heights = append(heights, h)
+			}
+		}
+	}
+	if len(heights) == 0 {
+		return nil, fmt.Errorf("no heights given")
+	}
+	sort.Ints(heights)
+	return heights, nil
+}
+
+// rescrape scrapes blocks and transactions at heights (sorted), independently of the main scrape process, as per scrapeHeights
+func rescrape(ctx context.Context, heights []int) error {
+	i := 0
+	return scrapeHeights(ctx, fmt.Sprintf("%d heights", len(heights)), heights[len(heights)-1], func() (int, bool) {
+		if i >= len(heights) {
+			return 0, false
+		}
+		i++
+		return heights[i-1], true
+	})
+}
+
+// scrapeHeights scrapes blocks and transactions at heights returned by next (until it returns false), up to last, described by desc for logging, as per heightsScraper
+func scrapeHeights(ctx context.Context, desc string, last int, next func() (int, bool)) error {
+	s, err := newHeightsScraper(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	h, err := bcHeight(ctx, s.bcc, bcRetry)
+	if err != nil {
+		return fmt.Errorf("error getting current blockchain height: %v", err)
+	}
+	if last > h {
+		return fmt.Errorf("last height %d is greater than current blockchain height %d", last, h)
+	}
+	return s.scrape(ctx, desc, next)
+}
+
+// heightsScraper scrapes blocks and transactions at arbitrary heights, independently of the main scrape process (ie, its log and scrape state are neither read nor updated), so it can run alongside it
+// data already stored for those heights is overwritten, and processed heights are logged to std logger's output (ie, stdout) only
+// note: block hash continuity is not checked, as it relies on blocks being scraped sequentially from the last processed one
+type heightsScraper struct {
+	st            storage
+	dbc           *mongo.Client // nil if not using mongo database
+	bxs, txs, brs *mongo.Collection
+	bcc, rsc      bcSource
+	vrf           *verifier
+	evm           *evmClient
+	ut            *uptime
+	ibc           *mongo.Collection
+	dlq           *deadLetters
+	tr            *tracer
+}
+
+// newHeightsScraper returns heightsScraper using configured storage and blockchain node
+func newHeightsScraper(ctx context.Context) (*heightsScraper, error) {
+	// main log file might be locked by running scrape process, so log to std logger's output instead
+	out := stdLogger.Writer()
+	bxsLogger = log.New(out, logPrefix("bxs"), log.LstdFlags|log.LUTC)
+	txsLogger = log.New(out, logPrefix("txs"), log.LstdFlags|log.LUTC)
+	brsLogger = log.New(out, logPrefix("brs"), log.LstdFlags|log.LUTC)
+
+	s := &heightsScraper{}
+	s.st, s.dbc, s.bxs, s.txs, s.brs, s.dlq = openStorage(ctx)
+	s.bcc, s.rsc = newBCClients(ctx, bcProtocol, bcNode, bcPort)
+
+	var err error
+	if verifyBlocks != "off" {
+		vsc, err := rpcSource(ctx, s.bcc, bcProtocol, bcNode, "block verification")
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("error creating blockchain client for block verification: %v", err)
+		}
+		s.vrf = newVerifier(vsc)
+	}
+	if s.dbc != nil {
+		db := s.dbc.Database(dbName)
+		if evmRPCURL != "" {
+			if s.evm, err = newEVMClient(evmRPCURL, db); err != nil {
+				s.close()
+				return nil, fmt.Errorf("error creating evm json-rpc client: %v", err)
+			}
+		}
+		if trackUptime {
+			s.ut = newUptime(db)
+		}
+		if ibcPackets {
+			s.ibc = collection(db, "ibc_packets")
+		}
+	}
+	if otlpEndpoint != "" {
+		s.tr = newTracer(otlpEndpoint, traceSample)
+	}
+	return s, nil
+}
+
+// scrape scrapes heights returned by next (until it returns false), described by desc for logging, returning once all are stored
+func (s *heightsScraper) scrape(ctx context.Context, desc string, next func() (int, bool)) error {
+	stdLogger.Printf("scraping blocks %s", desc)
+	reqChan := make(chan request, maxReqWorkers)
+	perChan := make(chan persist, maxPerWorkers)
+	var wgr, wgp sync.WaitGroup
+	for i := 0; i < maxReqWorkers; i++ {
+		wgr.Add(1)
+		go func() {
+			defer wgr.Done()
+			defer alertOnPanic()
+			reqWorker(ctx, s.bcc, s.rsc, s.vrf, nil, s.evm, s.ut, nil, s.tr, s.bxs, s.txs, s.brs, reqChan, perChan, bcRetry)
+		}()
+	}
+	for i := 0; i < maxPerWorkers; i++ {
+		wgp.Add(1)
+		go func() {
+			defer wgp.Done()
+			defer alertOnPanic()
+			perWorker(ctx, perChan, s.st, s.ibc, s.dlq)
+		}()
+	}
+
+	for h, ok := next(); ok && ctx.Err() == nil; h, ok = next() {
+		reqChan <- request{height: h}
+	}
+	close(reqChan)
+	wgr.Wait()
+	close(perChan)
+	wgp.Wait()
+
+	if ctx.Err() != nil {
+		return fmt.Errorf("scraping blocks %s interrupted: %v", desc, ctx.Err())
+	}
+	stdLogger.Printf("scraped blocks %s", desc)
+	return nil
+}
+
+// close closes storage and tracer, if used
+func (s *heightsScraper) close() {
+	if s.tr != nil {
+		s.tr.close()
+	}
+	if err := s.st.close(context.Background()); err != nil {
+		stdLogger.Printf("error closing database: %v", err)
+	}
+}
@@ -0,0 +1,169 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// rangeBatcher batches scraped data by height ranges of size heights, by datatype, and writes each batch once complete, or once older than flush interval (eg, for sparse transactions or at chain head), and on close
+// if write fails, batch is kept (and height is not added again if retried), so no data is lost
+// note: batches are kept in memory until written, so data of incomplete batches is lost if scraper is stopped forcibly
+type rangeBatcher struct {
+	size  int
+	write func(context.Context, *heightBatch) error
+	name  string // for logging
+
+	mu      sync.Mutex
+	batches map[string]*heightBatch // by datatype and height range start
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// heightBatch is batch of raw data of single datatype in height range
+type heightBatch struct {
+	datatype string
+	items    map[int][]byte // by height
+	from, to int            // actual first and last heights in batch
+	created  time.Time
+}
+
+// heights returns batch heights in ascending order
+func (b *heightBatch) heights() []int {
+	hs := make([]int, 0, len(b.items))
+	for h := range b.items {
+		hs = append(hs, h)
+	}
+	sort.Ints(hs)
+	return hs
+}
+
+// newRangeBatcher returns range batcher using write for complete batches, and flushing idle ones every flush interval
+func newRangeBatcher(name string, size int, flush time.Duration, write func(context.Context, *heightBatch) error) *rangeBatcher {
+	r := &rangeBatcher{
+		size:    size,
+		write:   write,
+		name:    name,
+		batches: map[string]*heightBatch{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go r.flusher(flush)
+	return r
+}
+
+// add adds raw datatype at height to its batch, writing the batch if complete
+func (r *rangeBatcher) add(ctx context.Context, datatype string, height int, raw []byte) error {
+	id := fmt.Sprintf("%s/%d", datatype, height-height%r.size)
+
+	r.mu.Lock()
+	b, ok := r.batches[id]
+	if !ok {
+		b = &heightBatch{datatype: datatype, items: map[int][]byte{}, from: height, to: height, created: time.Now()}
+		r.batches[id] = b
+	}
+	b.items[height] = raw
+	if height < b.from {
+		b.from = height
+	}
+	if height > b.to {
+		b.to = height
+	}
+	full := len(b.items) >= r.size
+	if full {
+		delete(r.batches, id)
+	}
+	r.mu.Unlock()
+
+	if !full {
+		return nil
+	}
+	if err := r.write(ctx, b); err != nil {
+		r.restore(id, b)
+		return err
+	}
+	return nil
+}
+
+// flusher writes batches older than flush interval, until stopped
+func (r *rangeBatcher) flusher(flush time.Duration) {
+	defer close(r.done)
+	t := time.NewTicker(flush)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-t.C:
+			r.flush(time.Now().Add(-flush))
+		}
+	}
+}
+
+// flush writes batches created before t
+func (r *rangeBatcher) flush(t time.Time) error {
+	r.mu.Lock()
+	idle := map[string]*heightBatch{}
+	for id, b := range r.batches {
+		if b.created.Before(t) {
+			idle[id] = b
+			delete(r.batches, id)
+		}
+	}
+	r.mu.Unlock()
+
+	var last error
+	for id, b := range idle {
+		if err := r.write(context.Background(), b); err != nil {
+			stdLogger.Printf("error writing %s %s batch [%d..%d] (will retry): %v", r.name, b.datatype, b.from, b.to, err)
+			r.restore(id, b)
+			last = err
+		}
+	}
+	return last
+}
+
+// restore puts back batch b that failed to be written, merging it with any new batch for the same range
+// restored batch is considered new, so it's retried after flush interval
+func (r *rangeBatcher) restore(id string, b *heightBatch) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if nb, ok := r.batches[id]; ok {
+		for h, raw := range nb.items {
+			b.items[h] = raw
+		}
+		if nb.from < b.from {
+			b.from = nb.from
+		}
+		if nb.to > b.to {
+			b.to = nb.to
+		}
+	}
+	b.created = time.Now()
+	r.batches[id] = b
+}
+
+// close stops flusher and writes all remaining batches
+func (r *rangeBatcher) close() error {
+	close(r.stop)
+	<-r.done
+	return r.flush(time.Now().Add(time.Hour))
+}
@@ -17,96 +17,576 @@ limitations under the License.
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// bcSource is implemented by clients for each of the supported blockchain protocols
+// all returned data is json-encoded, matching the cosmos rest api responses
+type bcSource interface {
+	// block returns block at height; special height value of "latest" references latest block
+	block(height string) ([]byte, error)
+	// txs returns single page of transactions at height, starting from pagination key, if not empty, or offset otherwise
+	txs(height, key string, offset int) ([]byte, error)
+	// blockResults returns block results (ie, begin/end block events and txs results) at height; only supported by tendermint rpc
+	blockResults(height string) ([]byte, error)
+	// query returns response for api path with params at height (0 means latest); paths are as per cosmos rest api, or tendermint rpc for rpc protocol
+	query(path string, params url.Values, height int) ([]byte, error)
+}
+
+// errUnsupported is returned by bcSource for requests not supported by its protocol
+var errUnsupported = errors.New("not supported by protocol")
+
+// errTooLarge is returned by bcSource for responses exceeding bcMaxResponseSize
+var errTooLarge = errors.New("response too large")
+
+// newBCSource returns bcSource for protocol referencing host and port
+// host can be prefixed with scheme (ie, "http://" or "https://"; defaults to "http") to use tls, and suffixed with path prefix (eg, "/rest") for nodes behind gateways
+// co-located nodes can also be referenced by unix domain socket path, as "unix:///path/to/socket"
+// host can also be a comma-separated list of endpoints (as host or host:port, with port defaulting to port), in which case requests are load balanced across them, with failover
+func newBCSource(ctx context.Context, protocol, host, port string) (bcSource, error) {
+	if strings.Contains(host, ",") {
+		return newMultiSource(ctx, protocol, host, port)
+	}
+	scheme, host, port, prefix := splitEndpoint(host, port)
+	socket := ""
+	if scheme == "unix" {
+		socket, host, port, prefix = host, "localhost", "0", ""
+	}
+	var tlsConfig *tls.Config
+	if scheme == "https" {
+		var err error
+		if tlsConfig, err = bcTLSConfig(); err != nil {
+			return nil, err
+		}
+	} else if scheme != "http" && scheme != "unix" {
+		return nil, fmt.Errorf("unsupported scheme %q", scheme)
+	}
+	var src bcSource
+	var err error
+	switch protocol {
+	case "rest":
+		c := newBCClient(host, port, prefix, tlsConfig)
+		c.viaUnixSocket(socket)
+		src = c
+	case "grpc":
+		if prefix != "" {
+			return nil, fmt.Errorf("path prefix %q is not supported with grpc protocol", prefix)
+		}
+		src, err = newGRPCClient(host, port, socket, tlsConfig)
+	case "rpc":
+		c := newRPCClient(host, port, prefix, tlsConfig)
+		c.viaUnixSocket(socket)
+		src = c
+	default:
+		return nil, fmt.Errorf("unsupported blockchain protocol %q", protocol)
+	}
+	if err != nil {
+		return nil, err
+	}
+	name := scheme + "://" + net.JoinHostPort(host, port) + prefix
+	if socket != "" {
+		name = "unix://" + socket
+	}
+	return &throttledSource{bcSource: src, ctx: ctx, name: name}, nil
+}
+
+// splitEndpoint splits endpoint in form of [scheme://]host[:port][/prefix] into its parts, using "http" and defPort as defaults
+// returned path prefix has no trailing slash
+// for "unix" scheme, host is the socket path
+func splitEndpoint(endpoint, defPort string) (scheme, host, port, prefix string) {
+	scheme, host, port = "http", endpoint, defPort
+	if i := strings.Index(host, "://"); i >= 0 {
+		scheme, host = host[:i], host[i+3:]
+	}
+	if scheme == "unix" {
+		return scheme, host, "", ""
+	}
+	if i := strings.Index(host, "/"); i >= 0 {
+		host, prefix = host[:i], strings.TrimRight(host[i:], "/")
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	return scheme, host, port, prefix
+}
+
+// bcTLSConfig returns tls config for blockchain endpoints, using optional custom root ca bundle and client certificate
+func bcTLSConfig() (*tls.Config, error) {
+	c := tls.Config{InsecureSkipVerify: bcTLSInsecure}
+	if bcTLSCAFile != "" {
+		ca, err := os.ReadFile(bcTLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca file %s: %v", bcTLSCAFile, err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("error parsing ca file %s: no certificates found", bcTLSCAFile)
+		}
+		c.RootCAs = pool
+	}
+	if bcTLSCertFile != "" || bcTLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(bcTLSCertFile, bcTLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate %s and key %s: %v", bcTLSCertFile, bcTLSKeyFile, err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	return &c, nil
+}
+
+// bcClient is bcSource using cosmos rest api via light client daemon
+// it's also used as a base for other http-based clients
 type bcClient struct {
 	url        url.URL
 	httpClient *http.Client
 }
 
-// newBCClient returns bcClient referencing host and port
-func newBCClient(host, port string) *bcClient {
+// newBCClient returns bcClient referencing host and port, with optional path prefix for all requests, using https if tlsConfig is not nil
+func newBCClient(host, port, prefix string, tlsConfig *tls.Config) *bcClient {
 	var c bcClient
-	c.url = url.URL{Host: fmt.Sprintf("%s:%s", host, port), Scheme: "http"}
-	c.httpClient = &http.Client{}
+	c.url = url.URL{Host: net.JoinHostPort(host, port), Path: prefix, Scheme: "http"}
+	if tlsConfig != nil {
+		c.url.Scheme = "https"
+	}
+	c.httpClient = &http.Client{Timeout: bcTimeout, Transport: newTransport(tlsConfig)}
 	return &c
 }
 
+// newTransport returns http transport with configured timeouts and connection pool size, using tlsConfig for https
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		Proxy: bcProxy,
+		DialContext: (&net.Dialer{
+			Timeout:   bcDialTimeout,
+			KeepAlive: bcKeepAlive,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        bcMaxIdleConns,
+		MaxIdleConnsPerHost: bcMaxIdleConns, // default of 2 is too low for concurrent workers requesting the same node
+		IdleConnTimeout:     bcIdleConnTimeout,
+		TLSHandshakeTimeout: bcDialTimeout,
+		TLSClientConfig:     tlsConfig,
+	}
+}
+
+// viaUnixSocket makes client connect to node over unix domain socket at path, instead of tcp, unless path is empty
+func (c *bcClient) viaUnixSocket(path string) {
+	if path == "" {
+		return
+	}
+	t := c.httpClient.Transport.(*http.Transport)
+	t.Proxy = nil
+	t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{Timeout: bcDialTimeout}).DialContext(ctx, "unix", path)
+	}
+}
+
 // request makes http request with specified path and optional query
 func (c *bcClient) request(path string, query string) ([]byte, error) {
+	return c.requestAt(path, query, 0)
+}
+
+// requestAt makes http request with specified path and optional query at height (0 means latest)
+// ref: https://docs.cosmos.network/master/run-node/interact-node.html#query-for-historical-state-using-rest
+func (c *bcClient) requestAt(path string, query string, height int) ([]byte, error) {
+	var res []byte
+	err := c.requestWith(path, query, height, func(body []byte) error {
+		res = append(make([]byte, 0, len(body)), body...)
+		return nil
+	})
+	return res, err
+}
+
+// requestWith makes http request with specified path and optional query at height (0 means latest), passing response body to decode
+// body is read into pooled buffer, so it's only valid until decode returns, and must be copied if retained
+func (c *bcClient) requestWith(path string, query string, height int, decode func(body []byte) error) error {
 	// avoid race condition with concurrent overwrites: work with copy of bcClient's url object for each request!
 	ref := c.url
-	ref.Path = path
+	ref.Path += path
 	ref.RawQuery = query
 	url := ref.ResolveReference(&ref).String()
 
 	req, err := http.NewRequest("GET", url, nil) // will slow down exit while waiting for timeouts, but using http.NewRequestWithContext would more likely create inconsistencies when interrupted with context.Canceled
 	if err != nil {
-		return nil, fmt.Errorf("error creating request %s: %v", url, err)
+		return fmt.Errorf("error creating request %s: %v", url, err)
 	}
 
 	req.Header.Add("Accept", "application/json")
 	req.Header.Add("Content-Type", "application/json")
+	for k, v := range bcHeaders {
+		req.Header[k] = v
+	}
+	if height > 0 {
+		req.Header.Set("x-cosmos-block-height", strconv.Itoa(height))
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return nil, fmt.Errorf("error making request %s: %v", url, err)
+		return fmt.Errorf("error making request %s: %v", url, err)
 	}
 	defer resp.Body.Close()
 
+	buf := getBuffer()
+	defer putBuffer(buf)
+
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("error making request %s: %s: %s", url, resp.Status, strings.ReplaceAll(strings.ReplaceAll(string(body), "\n", ""), "  ", " "))
+		buf.ReadFrom(resp.Body)
+		return &statusError{url: url, code: resp.StatusCode, status: resp.Status, body: squash(buf.Bytes()), retryAfter: retryAfter(resp.Header.Get("Retry-After"))}
 	}
 
-	return io.ReadAll(resp.Body)
+	if err := readBody(resp, buf); err != nil {
+		return fmt.Errorf("error reading response %s: %w", url, err)
+	}
+	return decode(buf.Bytes())
 }
 
-// initBC returns client and unprocessed blocks range from log and blockchain
-func initBC(ctx context.Context, bcNode, bcPort string) (bcc *bcClient, gapTail, gapHead int) {
-	stdLogger.Printf("connecting to bc node at %s:%s...", bcNode, bcPort)
+// readBody reads response body into buf, up to bcMaxResponseSize (if set), growing buffer for known content length to avoid reallocations with large responses
+// note: body is not streamed, so larger responses are rejected with errTooLarge (and their heights skipped) rather than decoded incrementally
+func readBody(resp *http.Response, buf *bytes.Buffer) error {
+	var r io.Reader = resp.Body
+	if bcMaxResponseSize > 0 {
+		if resp.ContentLength > bcMaxResponseSize {
+			return fmt.Errorf("%w: %d bytes (max %d)", errTooLarge, resp.ContentLength, bcMaxResponseSize)
+		}
+		r = io.LimitReader(r, bcMaxResponseSize+1)
+	}
+	if resp.ContentLength > 0 {
+		buf.Grow(int(resp.ContentLength) + bytes.MinRead)
+	}
+	if _, err := buf.ReadFrom(r); err != nil {
+		return err
+	}
+	if bcMaxResponseSize > 0 && int64(buf.Len()) > bcMaxResponseSize {
+		return fmt.Errorf("%w: over %d bytes", errTooLarge, bcMaxResponseSize)
+	}
+	return nil
+}
+
+// blockResults is not supported by rest api
+func (c *bcClient) blockResults(height string) ([]byte, error) {
+	return nil, errUnsupported
+}
+
+// query returns response for api path with params at height
+func (c *bcClient) query(path string, params url.Values, height int) ([]byte, error) {
+	return c.requestAt(path, params.Encode(), height)
+}
+
+// statusError is returned for non-ok api responses
+type statusError struct {
+	url        string
+	code       int
+	status     string
+	body       string
+	retryAfter time.Duration // optional server-requested pause before next request (eg, with '429 Too Many Requests')
+}
 
-	bcc = newBCClient(bcNode, bcPort)
+func (e *statusError) Error() string {
+	return fmt.Sprintf("error making request %s: %s: %s", e.url, e.status, e.body)
+}
+
+// badRequest returns true if err is '400 Bad Request' api response, checking status code of statusError without formatting its message
+func badRequest(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code == http.StatusBadRequest
+	}
+	return strings.Contains(err.Error(), "400 Bad Request")
+}
 
-	h, err := bcHeight(ctx, bcc, napTime) // last unprocessed block
+// retryAfter returns duration from Retry-After header value given either in seconds or as http date, or 0 if not set or invalid
+func retryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// block returns block at height
+func (c *bcClient) block(height string) ([]byte, error) {
+	// ref: https://v1.cosmos.network/rpc
+	return c.request(strings.ReplaceAll(bcBlockPath, "{height}", height), "")
+}
+
+// txs returns single page of transactions at height
+func (c *bcClient) txs(height, key string, offset int) ([]byte, error) {
+	// ref: https://v1.cosmos.network/rpc
+	param := bcTxsParam
+	if param == "" {
+		param = "events"
+	}
+	query := param + "=tx.height=" + height
+	if key != "" {
+		query += "&pagination.key=" + url.QueryEscape(key)
+	} else if offset > 0 {
+		query += "&pagination.offset=" + strconv.Itoa(offset)
+	}
+	return c.request(bcTxsPath, query)
+}
+
+// detectTxsParam returns txs search query parameter name supported by node's cosmos sdk version: "query" for v0.50+ and "events" for older versions
+// it will retry on api response error as per retry policy, unless ctx cancelled
+// ref: https://github.com/cosmos/cosmos-sdk/blob/v0.50.1/UPGRADING.md
+func detectTxsParam(ctx context.Context, bcc bcSource, rp retryPolicy) (param, version string, err error) {
+	res, err := queryAt(ctx, bcc, "/cosmos/base/tendermint/v1beta1/node_info", nil, 0, rp)
+	if err != nil {
+		return "", "", err
+	}
+	var ni struct {
+		ApplicationVersion struct {
+			CosmosSDKVersion string `json:"cosmos_sdk_version"`
+		} `json:"application_version"`
+	}
+	if err := json.Unmarshal(res, &ni); err != nil {
+		return "", "", fmt.Errorf("error unmarshalling node info - got response:\n%s: %v", string(res), err)
+	}
+	version = ni.ApplicationVersion.CosmosSDKVersion
+	if major, minor, ok := semver(version); ok && (major > 0 || minor >= 50) {
+		return "query", version, nil
+	}
+	return "events", version, nil
+}
+
+// semver returns major and minor numbers of version in form of [v]major.minor[.patch][-suffix], and false if it cannot be parsed
+func semver(version string) (major, minor int, ok bool) {
+	parts := strings.SplitN(strings.TrimPrefix(version, "v"), ".", 3)
+	if len(parts) < 2 {
+		return 0, 0, false
+	}
+	var err error
+	if major, err = strconv.Atoi(parts[0]); err != nil {
+		return 0, 0, false
+	}
+	if minor, err = strconv.Atoi(strings.SplitN(parts[1], "-", 2)[0]); err != nil {
+		return 0, 0, false
+	}
+	return major, minor, true
+}
+
+// initBC returns client, resume point from saved scrape state (if not nil) or log, and unprocessed blocks range from it and blockchain
+// if block results are enabled, it also returns client to get them (ie, using tendermint rpc), otherwise nil
+func initBC(ctx context.Context, bcProtocol, bcNode, bcPort string, saved *resumePoint) (bcc, rsc bcSource, rp resumePoint, gapTail, gapHead int) {
+	bcc, rsc = newBCClients(ctx, bcProtocol, bcNode, bcPort)
+
+	if err := checkSync(ctx, bcc, bcProtocol); err != nil {
+		stdLogger.Panicf("error checking node sync status: %v", err)
+	}
+
+	h, err := bcHeight(ctx, bcc, bcRetry) // last unprocessed block
 	if err != nil {
 		stdLogger.Panicf("error getting current blockchain height: %v", err)
 	}
 	stdLogger.Printf("current blockchain height is: %d", h)
 	gapHead = h
 
-	l, err := logHeight(logFile, logCheckpoint) // last processed block
-	if err != nil {
-		stdLogger.Panicf("error determining last processed block from log: %v", err)
+	if saved != nil {
+		rp = *saved
+		stdLogger.Printf("current scrape state height is: %d; log checkpoint is: %d", rp.highest, logCheckpoint)
+	} else {
+		if rp, err = logHeight(logFile, logCheckpoint, blockResults); err != nil {
+			stdLogger.Panicf("error determining last processed block from log: %v", err)
+		}
+		stdLogger.Printf("current log height is: %d; log checkpoint is: %d", rp.highest, logCheckpoint)
 	}
-	stdLogger.Printf("current log height is: %d; log checkpoint is: %d", l, logCheckpoint)
 
-	if l < logCheckpoint {
-		if l > 0 || logCheckpoint > 0 { // only warn if not first start or if log checkpoint > 0
-			stdLogger.Println("warn: log checkpoint is greater than current log height: will use checkpoint value as starting height")
+	if rp.highest < logCheckpoint && rp.highest > 0 { // only warn if not first start
+		stdLogger.Println("warn: log checkpoint is greater than current log height: will use checkpoint value as starting height")
+		alert(ctx, "checkpoint", fmt.Sprintf("log checkpoint %d is greater than last processed height %d: heights in between will not be scraped", logCheckpoint, rp.highest), nil)
+	}
+	if rp.highest > h {
+		// eg, scrape state or log of another chain, or node not synced
+		stdLogger.Printf("warn: last processed height %d is greater than current blockchain height %d", rp.highest, h)
+		alert(ctx, "checkpoint", fmt.Sprintf("last processed height %d is greater than current blockchain height %d", rp.highest, h), nil)
+	}
+	rp = rp.from(logCheckpoint)
+	if follow {
+		if from := h - headLag - followBehind; from-1 > rp.highest {
+			// note: logged, so log and scrape state consider skipped heights as processed
+			stdLogger.Printf("%d skipped (following chain head: historical blocks up to it are not scraped)", from-1)
+			rp = resumePoint{watermark: from - 1, highest: from - 1}
 		}
-		l = logCheckpoint
 	}
-	if l > h {
+	if rp.highest > h {
 		stdLogger.Panicln("current log height is greater than current blockchain height: cannot continue - check parameters and try again")
 	}
-	gapTail = l + 1 // first unprocessed block
+	gapTail = rp.highest + 1 // first unprocessed block
 
-	return bcc, gapTail, gapHead
+	return bcc, rsc, rp, gapTail, gapHead
 }
 
+// newBCClients returns client for bcProtocol node, and, if block results are enabled, client to get them (ie, using tendermint rpc), otherwise nil
+func newBCClients(ctx context.Context, bcProtocol, bcNode, bcPort string) (bcc, rsc bcSource) {
+	stdLogger.Printf("connecting to bc node at %s:%s using %s...", bcNode, bcPort, bcProtocol)
+
+	bcc, err := newBCSource(ctx, bcProtocol, bcNode, bcPort)
+	if err != nil {
+		stdLogger.Panicf("error creating blockchain client: %v", err)
+	}
+	if adaptiveWorkers {
+		bcc = meteredSource{bcc}
+	}
+	if bcBreakerThreshold > 0 {
+		bcc = newBreakerSource(ctx, bcc, bcBreakerThreshold)
+	}
+	if bcRateLimit > 0 {
+		stdLogger.Printf("limiting requests to %v per second (burst %d)", bcRateLimit, bcRateBurst)
+	}
+	// note: limiter is set even if not limiting requests, so limit can be changed on config reload
+	bcc = &limitedSource{bcSource: bcc, ctx: ctx, limiter: newLimiter(bcRateLimit, bcRateBurst)}
+
+	if bcProtocol != "rpc" && bcTxsParam == "" {
+		param, version, err := detectTxsParam(ctx, bcc, bcRetry)
+		if err != nil {
+			stdLogger.Panicf("error detecting cosmos sdk version: %v", err)
+		}
+		bcTxsParam = param
+		stdLogger.Printf("detected cosmos sdk version %q: using %q txs query parameter", version, param)
+	}
+
+	if heightProbe == "status" {
+		if statusSource, err = rpcSource(ctx, bcc, bcProtocol, bcNode, "height probes"); err != nil {
+			stdLogger.Panicf("error creating blockchain client for height probes: %v", err)
+		}
+	}
+
+	if blockResults {
+		if rsc, err = rpcSource(ctx, bcc, bcProtocol, bcNode, "block results"); err != nil {
+			stdLogger.Panicf("error creating blockchain client for block results: %v", err)
+		}
+	}
+
+	return bcc, rsc
+}
+
+// rpcSource returns bcc if using rpc protocol already, otherwise new rpc client for the same bc node(s) on bcRPCPort, sharing bcc's rate limiter, if any
+// purpose is only used for logging
+func rpcSource(ctx context.Context, bcc bcSource, bcProtocol, bcNode, purpose string) (bcSource, error) {
+	if bcProtocol == "rpc" {
+		return bcc, nil
+	}
+	stdLogger.Printf("connecting to bc node at %s:%s using rpc for %s...", bcNode, bcRPCPort, purpose)
+	src, err := newBCSource(ctx, "rpc", bcNode, bcRPCPort)
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := bcc.(*limitedSource); ok {
+		src = &limitedSource{bcSource: src, ctx: l.ctx, limiter: l.limiter}
+	}
+	return src, nil
+}
+
+// blockResultsAt returns block results at height
+// it will retry on api response error as per retry policy, unless ctx cancelled
+func blockResultsAt(ctx context.Context, bcc bcSource, height string, rp retryPolicy) ([]byte, error) {
+	return fetch(ctx, "block results at height "+height, rp, func() ([]byte, error) { return bcc.blockResults(height) })
+}
+
+// queryAt returns response for api path with params at height (0 means latest)
+// it will retry on api response error as per retry policy, unless ctx cancelled
+func queryAt(ctx context.Context, bcc bcSource, path string, params url.Values, height int, rp retryPolicy) ([]byte, error) {
+	return fetch(ctx, path, rp, func() ([]byte, error) { return bcc.query(path, params, height) })
+}
+
+// queryAll returns all items of (paginated) api path response's field at height (0 means latest), following pagination.next_key
+// it will retry on api response error as per retry policy, unless ctx cancelled or due to unmarshalling errors
+func queryAll(ctx context.Context, bcc bcSource, path string, params url.Values, field string, height int, rp retryPolicy) ([]json.RawMessage, error) {
+	var items []json.RawMessage
+	p := url.Values{}
+	for k, v := range params {
+		p[k] = v
+	}
+	for {
+		res, err := queryAt(ctx, bcc, path, p, height, rp)
+		if err != nil {
+			return nil, err
+		}
+		var r map[string]json.RawMessage
+		if err := json.Unmarshal(res, &r); err != nil {
+			return nil, fmt.Errorf("error unmarshalling %s - got response:\n%s: %v", path, string(res), err)
+		}
+		var page []json.RawMessage
+		if v, ok := r[field]; ok {
+			if err := json.Unmarshal(v, &page); err != nil {
+				return nil, fmt.Errorf("error unmarshalling %s in %s - got response:\n%s: %v", field, path, string(res), err)
+			}
+		}
+		items = append(items, page...)
+
+		var pagination struct {
+			NextKey string `json:"next_key"`
+		}
+		if v, ok := r["pagination"]; ok {
+			json.Unmarshal(v, &pagination)
+		}
+		if pagination.NextKey == "" || len(page) == 0 {
+			return items, nil
+		}
+		p.Set("pagination.key", pagination.NextKey)
+	}
+}
+
+// fetch returns response of request described by what (used for logging)
+// it will retry on request error as per retry policy, unless ctx cancelled or error is unretryable (ie, '400 Bad Request', unsupported request or too large response)
+func fetch(ctx context.Context, what string, rp retryPolicy, request func() ([]byte, error)) ([]byte, error) {
+	for n := 1; ; n++ {
+		res, err := request()
+		if err != nil {
+			// return unretryable error
+			if errors.Is(err, errUnsupported) || errors.Is(err, errTooLarge) || badRequest(err) {
+				return nil, err
+			}
+			nodeOutage.failed(err)
+			d, rerr := rp.retry(n)
+			if rerr != nil {
+				return nil, fmt.Errorf("error getting %s: %v: %v", what, rerr, err)
+			}
+			stdLogger.Printf("error getting %s (will retry in %s): %v", what, d, err)
+			if err := wait(ctx, d); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		nodeOutage.recovered()
+		return res, nil
+	}
+}
+
+// statusSource is tendermint rpc source used to get latest block height from node status, instead of the latest block, if set
+var statusSource bcSource
+
 // bcHeight returns latest block height or error
-func bcHeight(ctx context.Context, bcc *bcClient, napTime time.Duration) (int, error) {
-	blk, err := blockAt(ctx, bcc, "latest", napTime)
+// if statusSource is set, it's used to get height from node status instead of downloading the whole latest block
+func bcHeight(ctx context.Context, bcc bcSource, rp retryPolicy) (int, error) {
+	if statusSource != nil {
+		return statusHeight(ctx, statusSource, rp)
+	}
+
+	blk, err := blockAt(ctx, bcc, "latest", rp)
 	if err != nil {
 		return -1, err
 	}
@@ -133,60 +613,183 @@ func bcHeight(ctx context.Context, bcc *bcClient, napTime time.Duration) (int, e
 	return h, nil
 }
 
-// blockAt returns block at height
-// special height value of "latest" references latest block
-// it will retry indefinitely on api response error, pausing for napTime between retries, unless ctx cancelled
-func blockAt(ctx context.Context, bcc *bcClient, height string, napTime time.Duration) ([]byte, error) {
+// syncing returns true if node reports it's still catching up with the network, using syncing endpoint for rest and grpc, or status for rpc
+func syncing(bcc bcSource, protocol string) (bool, error) {
+	if protocol == "rpc" {
+		// ref: https://docs.tendermint.com/v0.34/rpc/#/Info/status
+		res, err := bcc.query("/status", nil, 0)
+		if err != nil {
+			return false, err
+		}
+		var s struct {
+			SyncInfo struct {
+				CatchingUp bool `json:"catching_up"`
+			} `json:"sync_info"`
+		}
+		if err := json.Unmarshal(res, &s); err != nil {
+			return false, fmt.Errorf("error unmarshalling status - got response:\n%s: %v", string(res), err)
+		}
+		return s.SyncInfo.CatchingUp, nil
+	}
+
+	res, err := bcc.query("/cosmos/base/tendermint/v1beta1/syncing", nil, 0)
+	if err != nil {
+		return false, err
+	}
+	var s struct {
+		Syncing bool `json:"syncing"`
+	}
+	if err := json.Unmarshal(res, &s); err != nil {
+		return false, fmt.Errorf("error unmarshalling syncing status - got response:\n%s: %v", string(res), err)
+	}
+	return s.Syncing, nil
+}
+
+// checkSync checks if node is still catching up with the network, as per bcSyncCheck mode:
+// with "pause", it waits (checking every napTime) until node catches up, unless ctx cancelled, and with "warn" it only warns
+// failed checks (eg, if node doesn't expose its sync status) are logged and otherwise ignored
+func checkSync(ctx context.Context, bcc bcSource, protocol string) error {
+	if bcSyncCheck == "off" {
+		return nil
+	}
 	for {
-		// ref: https://v1.cosmos.network/rpc
-		res, err := bcc.request("/cosmos/base/tendermint/v1beta1/blocks/"+height, "")
+		s, err := syncing(bcc, protocol)
 		if err != nil {
-			// return unretryable error
-			if strings.Contains(err.Error(), "400 Bad Request") {
-				return nil, err
-			}
-			stdLogger.Printf("error getting block at height %s (will retry in %s): %v", height, napTime, err)
-			select {
-			case <-ctx.Done():
-				return nil, ctx.Err()
-			case <-time.After(napTime):
-				continue
-			}
+			stdLogger.Printf("warn: cannot determine node sync status (ignoring): %v", err)
+			return nil
+		}
+		if !s {
+			return nil
+		}
+		if bcSyncCheck != "pause" {
+			stdLogger.Println("warn: node is still catching up - its latest height and responses might be stale or incomplete")
+			return nil
+		}
+		stdLogger.Printf("node is still catching up - pausing for %s", nap())
+		if err := wait(ctx, nap()); err != nil {
+			return err
 		}
-		return res, nil
 	}
 }
 
+// statusHeight returns latest block height from tendermint rpc node status
+func statusHeight(ctx context.Context, rsc bcSource, rp retryPolicy) (int, error) {
+	// ref: https://docs.tendermint.com/v0.34/rpc/#/Info/status
+	res, err := queryAt(ctx, rsc, "/status", nil, 0, rp)
+	if err != nil {
+		return -1, err
+	}
+	var s struct {
+		SyncInfo struct {
+			LatestBlockHeight string `json:"latest_block_height"`
+		} `json:"sync_info"`
+	}
+	if err := json.Unmarshal(res, &s); err != nil {
+		return -1, fmt.Errorf("error unmarshalling status - got response:\n%s: %v", string(res), err)
+	}
+	h, err := strconv.Atoi(s.SyncInfo.LatestBlockHeight)
+	if err != nil {
+		return -1, fmt.Errorf("error decoding latest block height - got response:\n%s: %v", string(res), err)
+	}
+	return h, nil
+}
+
+// blockAt returns block at height
+// special height value of "latest" references latest block
+// it will retry on api response error as per retry policy, unless ctx cancelled
+func blockAt(ctx context.Context, bcc bcSource, height string, rp retryPolicy) ([]byte, error) {
+	return fetch(ctx, "block at height "+height, rp, func() ([]byte, error) { return bcc.block(height) })
+}
+
 // transactionsAt returns transactions at height or error
-// it will retry indefinitely on api response error, pausing for napTime between retries, unless ctx cancelled or due to unmarshalling errors
-func transactionsAt(ctx context.Context, bcc *bcClient, height string, napTime time.Duration) ([]byte, error) {
-	for {
-		// ref: https://v1.cosmos.network/rpc
-		res, err := bcc.request("/cosmos/tx/v1beta1/txs", "events=tx.height="+height)
+// paginated responses are followed (using pagination.next_key, if provided, or offset otherwise) and merged into a single response
+// it will retry on api response error as per retry policy, unless ctx cancelled or due to unmarshalling errors
+func transactionsAt(ctx context.Context, bcc bcSource, height string, rp retryPolicy) ([]byte, error) {
+	var first []byte               // first page, used as a template for the merged response
+	var txs, txr []json.RawMessage // merged txs and tx_responses from all pages
+	key := ""                      // pagination key for the next page
+	for n := 1; ; n++ {
+		res, err := bcc.txs(height, key, len(txr))
 		if err != nil {
-			stdLogger.Printf("error getting transactions at height %s (will retry in %s): %v", height, napTime, err)
-			select {
-			case <-ctx.Done():
-				return nil, ctx.Err()
-			case <-time.After(napTime):
-				continue
+			if errors.Is(err, errTooLarge) {
+				return nil, err
 			}
+			nodeOutage.failed(err)
+			d, rerr := rp.retry(n)
+			if rerr != nil {
+				return nil, fmt.Errorf("error getting transactions at height %s: %v: %v", height, rerr, err)
+			}
+			stdLogger.Printf("error getting transactions at height %s (will retry in %s): %v", height, d, err)
+			if err := wait(ctx, d); err != nil {
+				return nil, err
+			}
+			continue
 		}
+		nodeOutage.recovered()
+		n = 0 // reset retries for the next page
 
+		// tx_responses are only counted here, so that single page responses are returned without copying their transactions
 		var t struct {
-			Pagination struct {
-				Total   string      `json:"total"`
-				NextKey interface{} `json:"next_key"`
+			TxResponses []ignored `json:"tx_responses"`
+			Total       string    `json:"total"` // sdk v0.46+ (with pagination being null)
+			Pagination  struct {
+				Total   string `json:"total"`
+				NextKey string `json:"next_key"`
 			} `json:"pagination"`
 		}
 		if err := json.Unmarshal(res, &t); err != nil {
 			return nil, err
 		}
+		if t.Pagination.Total == "" {
+			t.Pagination.Total = t.Total
+		}
 		if t.Pagination.Total == "0" {
 			return nil, nil
 		}
-		// TODO: handle paginated response
+		// return response as-is if pagination is unknown
+		if t.Pagination.Total == "" && first == nil {
+			return res, nil
+		}
 
-		return res, nil
+		total, err := strconv.Atoi(t.Pagination.Total)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding total number of transactions at height %s - got response:\n%s: %v", height, string(res), err)
+		}
+		// stop when all transactions are collected, or on empty page to avoid looping forever on inconsistent responses
+		if first == nil {
+			if len(t.TxResponses) >= total || len(t.TxResponses) == 0 {
+				return res, nil
+			}
+			first = res
+		}
+		var page struct {
+			Txs         []json.RawMessage `json:"txs"`
+			TxResponses []json.RawMessage `json:"tx_responses"`
+		}
+		if err := json.Unmarshal(res, &page); err != nil {
+			return nil, err
+		}
+		txs = append(txs, page.Txs...)
+		txr = append(txr, page.TxResponses...)
+		if len(txr) >= total || len(page.TxResponses) == 0 {
+			break
+		}
+		key = t.Pagination.NextKey
+	}
+
+	return mergeTxs(first, txs, txr)
+}
+
+// mergeTxs returns first page of paginated transactions response with txs and tx_responses replaced by respective merged values from all pages
+func mergeTxs(first []byte, txs, txr []json.RawMessage) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := json.Unmarshal(first, &doc); err != nil {
+		return nil, err
+	}
+	doc["txs"] = txs
+	doc["tx_responses"] = txr
+	if p, ok := doc["pagination"].(map[string]interface{}); ok {
+		p["next_key"] = nil
 	}
+	return json.Marshal(doc)
 }
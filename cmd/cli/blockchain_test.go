@@ -0,0 +1,400 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// txsPage returns transactions response page with txs numbered from..to (inclusive), next pagination key and total
+// total is given as pagination.total, or as top-level total with null pagination (as with sdk v0.46+) if v046 is set
+func txsPage(from, to int, next, total string, v046 bool) string {
+	var txs, txr []string
+	for i := from; i <= to; i++ {
+		txs = append(txs, strconv.Itoa(i))
+		txr = append(txr, fmt.Sprintf(`{"n":%d}`, i))
+	}
+	if next != "" {
+		next = strconv.Quote(next)
+	} else {
+		next = "null"
+	}
+	pagination := fmt.Sprintf(`{"next_key":%s,"total":%q}`, next, total)
+	if v046 {
+		return fmt.Sprintf(`{"txs":[%s],"tx_responses":[%s],"pagination":null,"total":%q}`, strings.Join(txs, ","), strings.Join(txr, ","), total)
+	}
+	return fmt.Sprintf(`{"txs":[%s],"tx_responses":[%s],"pagination":%s}`, strings.Join(txs, ","), strings.Join(txr, ","), pagination)
+}
+
+// txsServer serves pages of transactions, selected by pagination key (ie, "pN" for page N) or offset (as per offsets), failing each page fails times first
+type txsServer struct {
+	pages   []string
+	offsets map[string]int // offset -> page index
+	fails   int
+
+	mu       sync.Mutex
+	failed   map[int]int
+	requests []int // indexes of requested pages
+}
+
+// start starts server, closed on test cleanup, and returns its host and port
+func (s *txsServer) start(t *testing.T) (host, port string) {
+	s.failed = map[int]int{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != bcTxsPath {
+			http.NotFound(w, r)
+			return
+		}
+		q := r.URL.Query()
+		page := 0
+		if key := q.Get("pagination.key"); key != "" {
+			page, _ = strconv.Atoi(strings.TrimPrefix(key, "p"))
+		} else if off := q.Get("pagination.offset"); off != "" {
+			var ok bool
+			if page, ok = s.offsets[off]; !ok {
+				http.Error(w, "unexpected offset "+off, http.StatusBadRequest)
+				return
+			}
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, page)
+		fail := s.failed[page] < s.fails
+		if fail {
+			s.failed[page]++
+		}
+		s.mu.Unlock()
+		if fail {
+			http.Error(w, "temporary failure", http.StatusServiceUnavailable)
+			return
+		}
+		if page >= len(s.pages) {
+			http.Error(w, "no such page", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(s.pages[page]))
+	}))
+	t.Cleanup(srv.Close)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port
+}
+
+// mergedTxs is transactions response as merged by transactionsAt
+type mergedTxs struct {
+	Txs         []int `json:"txs"`
+	TxResponses []struct {
+		N int `json:"n"`
+	} `json:"tx_responses"`
+	Pagination *struct {
+		NextKey *string `json:"next_key"`
+	} `json:"pagination"`
+}
+
+func TestTransactionsAt(t *testing.T) {
+	tests := []struct {
+		name     string
+		pages    []string
+		offsets  map[string]int
+		fails    int
+		want     []int // merged txs, nil if response is expected to be returned as-is
+		asIs     int   // index of page expected to be returned as-is
+		requests []int
+		empty    bool // no transactions expected
+		err      bool
+	}{
+		{
+			name:     "single page",
+			pages:    []string{txsPage(1, 3, "", "3", false)},
+			asIs:     0,
+			requests: []int{0},
+		},
+		{
+			name:     "two pages by key",
+			pages:    []string{txsPage(1, 2, "p1", "3", false), txsPage(3, 3, "", "3", false)},
+			want:     []int{1, 2, 3},
+			requests: []int{0, 1},
+		},
+		{
+			name: "n pages by offset",
+			pages: []string{
+				txsPage(1, 2, "", "7", false),
+				txsPage(3, 4, "", "7", false),
+				txsPage(5, 6, "", "7", false),
+				txsPage(7, 7, "", "7", false),
+			},
+			offsets:  map[string]int{"2": 1, "4": 2, "6": 3},
+			want:     []int{1, 2, 3, 4, 5, 6, 7},
+			requests: []int{0, 1, 2, 3},
+		},
+		{
+			name:     "sdk v0.46 total",
+			pages:    []string{txsPage(1, 2, "", "4", true), txsPage(3, 4, "", "4", true)},
+			offsets:  map[string]int{"2": 1},
+			want:     []int{1, 2, 3, 4},
+			requests: []int{0, 1},
+		},
+		{
+			name:     "no transactions",
+			pages:    []string{txsPage(1, 0, "", "0", false)},
+			empty:    true,
+			requests: []int{0},
+		},
+		{
+			name:     "unknown pagination",
+			pages:    []string{`{"txs":[1],"tx_responses":[{"n":1}]}`},
+			asIs:     0,
+			requests: []int{0},
+		},
+		{
+			name:     "empty page stops",
+			pages:    []string{txsPage(1, 2, "p1", "5", false), txsPage(1, 0, "p2", "5", false), txsPage(3, 5, "", "5", false)},
+			want:     []int{1, 2},
+			requests: []int{0, 1},
+		},
+		{
+			name:     "total lower than first page",
+			pages:    []string{txsPage(1, 3, "p1", "2", false)},
+			asIs:     0,
+			requests: []int{0},
+		},
+		{
+			name:     "inconsistent total",
+			pages:    []string{txsPage(1, 2, "p1", "3", false), txsPage(3, 3, "", "x", false)},
+			err:      true,
+			requests: []int{0, 1},
+		},
+		{
+			name:     "retries reset per page",
+			pages:    []string{txsPage(1, 1, "p1", "3", false), txsPage(2, 2, "p2", "3", false), txsPage(3, 3, "", "3", false)},
+			fails:    1,
+			want:     []int{1, 2, 3},
+			requests: []int{0, 0, 1, 1, 2, 2},
+		},
+	}
+	// two attempts per page, so retries must be reset for each page
+	rp := retryPolicy{min: time.Millisecond, max: time.Millisecond, factor: 1, attempts: 2}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &txsServer{pages: tc.pages, offsets: tc.offsets, fails: tc.fails}
+			host, port := s.start(t)
+			res, err := transactionsAt(context.Background(), newBCClient(host, port, "", nil), "5", rp)
+			if !reflect.DeepEqual(s.requests, tc.requests) {
+				t.Errorf("requested pages %v, want %v", s.requests, tc.requests)
+			}
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got response %s", res)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch {
+			case tc.empty:
+				if res != nil {
+					t.Fatalf("expected no response, got %s", res)
+				}
+			case tc.want == nil:
+				if string(res) != tc.pages[tc.asIs] {
+					t.Fatalf("expected page %d as-is, got %s", tc.asIs, res)
+				}
+			default:
+				var m mergedTxs
+				if err := json.Unmarshal(res, &m); err != nil {
+					t.Fatalf("error unmarshalling merged response %s: %v", res, err)
+				}
+				if !reflect.DeepEqual(m.Txs, tc.want) {
+					t.Errorf("merged txs %v, want %v", m.Txs, tc.want)
+				}
+				if len(m.TxResponses) != len(tc.want) {
+					t.Fatalf("merged %d tx_responses, want %d", len(m.TxResponses), len(tc.want))
+				}
+				for i, r := range m.TxResponses {
+					if r.N != tc.want[i] {
+						t.Errorf("tx_responses[%d] is %d, want %d", i, r.N, tc.want[i])
+					}
+				}
+				if m.Pagination != nil && m.Pagination.NextKey != nil {
+					t.Errorf("merged next_key %q, want null", *m.Pagination.NextKey)
+				}
+			}
+		})
+	}
+}
+
+// nodeServer serves static responses by path, with Content-Length set, or in chunks (ie, with unknown length) if chunked is set
+func nodeServer(t testing.TB, chunked bool, responses map[string]string) (host, port string) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		res, ok := responses[r.URL.Path]
+		if !ok {
+			http.Error(w, "{\n  \"code\": 3,\n    \"message\": \"not found\"\n}", http.StatusBadRequest)
+			return
+		}
+		if !chunked {
+			w.Header().Set("Content-Length", strconv.Itoa(len(res)))
+			w.Write([]byte(res))
+			return
+		}
+		for len(res) > 0 {
+			n := 32 << 10
+			if n > len(res) {
+				n = len(res)
+			}
+			w.Write([]byte(res[:n]))
+			w.(http.Flusher).Flush()
+			res = res[n:]
+		}
+	}))
+	t.Cleanup(srv.Close)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port
+}
+
+func TestRequestAt(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		t.Run(fmt.Sprint("chunked=", chunked), func(t *testing.T) {
+			a, b := strings.Repeat("a", 100<<10), strings.Repeat("b", 100<<10)
+			host, port := nodeServer(t, chunked, map[string]string{"/a": a, "/b": b})
+			c := newBCClient(host, port, "", nil)
+
+			resA, err := c.request("/a", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			// responses are read into pooled buffers, so returned ones must not be overwritten by subsequent requests
+			for i := 0; i < 10; i++ {
+				resB, err := c.request("/b", "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(resB) != b {
+					t.Fatalf("got response of %d bytes, want %d bytes of b", len(resB), len(b))
+				}
+			}
+			if string(resA) != a {
+				t.Fatalf("first response was overwritten")
+			}
+
+			_, err = c.request("/missing", "")
+			if !badRequest(err) {
+				t.Fatalf("expected bad request error, got %v", err)
+			}
+			want := `{ "code": 3,  "message": "not found"}`
+			if se := err.(*statusError); se.body != want {
+				t.Errorf("got error body %q, want %q", se.body, want)
+			}
+		})
+	}
+}
+
+func TestTransactionsAtAsIs(t *testing.T) {
+	// transactions are counted without decoding them, so single page is returned as-is regardless of their content
+	page := `{"txs":[{"a":"]"}],"tx_responses":[{"logs":[{"events":[]}],"raw_log":"[{\"x\":1}]"},{"n":[[1],{"m":"}"}]}],"pagination":{"next_key":null,"total":"2"}}`
+	host, port := nodeServer(t, false, map[string]string{bcTxsPath: page})
+	res, err := transactionsAt(context.Background(), newBCClient(host, port, "", nil), "5", retryPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != page {
+		t.Errorf("expected page as-is, got %s", res)
+	}
+}
+
+// benchmarkFetch benchmarks fetching block and transactions with n transactions from rest api, and block from rpc
+func benchmarkFetch(b *testing.B, chunked bool, n int) {
+	var txs, txr, raw []string
+	for i := 0; i < n; i++ {
+		raw = append(raw, strconv.Quote(strings.Repeat("A", 400)))
+		txs = append(txs, fmt.Sprintf(`{"body":{"memo":%q}}`, strings.Repeat("m", 200)))
+		txr = append(txr, fmt.Sprintf(`{"height":"5","txhash":"%064d","raw_log":%q}`, i, strings.Repeat("l", 300)))
+	}
+	block := fmt.Sprintf(`{"block_id":{"hash":"X"},"block":{"header":{"height":"5"},"data":{"txs":[%s]}}}`, strings.Join(raw, ","))
+	host, port := nodeServer(b, chunked, map[string]string{
+		strings.ReplaceAll(bcBlockPath, "{height}", "5"): block,
+		bcTxsPath: fmt.Sprintf(`{"txs":[%s],"tx_responses":[%s],"pagination":{"next_key":null,"total":"%d"}}`, strings.Join(txs, ","), strings.Join(txr, ","), n),
+		"/block":  `{"jsonrpc":"2.0","id":-1,"result":` + block + `}`,
+	})
+	rest := newBCClient(host, port, "", nil)
+	rpc := &rpcClient{bcClient: newBCClient(host, port, "", nil)}
+	ctx := context.Background()
+
+	b.Run("rest", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			blk, err := blockAt(ctx, rest, "5", retryPolicy{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if numTxs(blk) != n {
+				b.Fatalf("got %d txs, want %d", numTxs(blk), n)
+			}
+			if _, err := transactionsAt(ctx, rest, "5", retryPolicy{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("rpc", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := rpc.block("5"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFetch(b *testing.B) {
+	b.Run("content-length", func(b *testing.B) { benchmarkFetch(b, false, 2000) })
+	b.Run("chunked", func(b *testing.B) { benchmarkFetch(b, true, 2000) })
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		v        string
+		min, max time.Duration
+	}{
+		{v: ""},
+		{v: "0"},
+		{v: "-5"},
+		{v: "invalid"},
+		{v: "120", min: 120 * time.Second, max: 120 * time.Second},
+		{v: time.Now().Add(time.Hour).UTC().Format(http.TimeFormat), min: 59 * time.Minute, max: time.Hour},
+		{v: time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)},
+	}
+	for _, tc := range tests {
+		if got := retryAfter(tc.v); got < tc.min || got > tc.max {
+			t.Errorf("retryAfter(%q) = %s, want between %s and %s", tc.v, got, tc.min, tc.max)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltBuckets are embedded database buckets, by datatype
+var boltBuckets = map[string]string{
+	"block":         "blocks",
+	"transactions":  "transactions",
+	"block_results": "block_results",
+}
+
+// boltStorage is storage using embedded (single file) database, for lightweight deployments without mongo database server
+// raw blocks, transactions and block results json are stored in respective buckets, keyed by (big-endian) height, so they are kept ordered
+type boltStorage struct {
+	db *bolt.DB
+}
+
+// openBolt opens (or creates, if not existing) embedded database file at path
+func openBolt(path string) (*boltStorage, error) {
+	stdLogger.Printf("opening embedded database at %s...", path)
+	// note: file is locked while open, so timeout is used to fail instead of hanging if another instance is using it
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("error opening embedded database %s: %v", path, err)
+	}
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range boltBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(b)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating embedded database buckets: %v", err)
+	}
+	return &boltStorage{db: db}, nil
+}
+
+// put stores raw json of each datatype at height, replacing any existing ones, all in the same write transaction
+// concurrent puts are batched into a single write transaction, so persist workers don't have to wait for each other's disk sync
+func (b *boltStorage) put(parts ...persist) error {
+	for _, p := range parts {
+		if _, ok := boltBuckets[p.datatype]; !ok {
+			return fmt.Errorf("unknown datatype %q", p.datatype)
+		}
+	}
+	return b.db.Batch(func(tx *bolt.Tx) error {
+		for _, p := range parts {
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(p.height))
+			if err := tx.Bucket([]byte(boltBuckets[p.datatype])).Put(key, p.raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// storeBlock stores block into blocks bucket
+func (b *boltStorage) storeBlock(ctx context.Context, height int, raw []byte) (interface{}, error) {
+	return height, b.put(persist{height: height, datatype: "block", raw: raw})
+}
+
+// storeTxs stores transactions into transactions bucket
+func (b *boltStorage) storeTxs(ctx context.Context, height int, raw []byte) (interface{}, error) {
+	return height, b.put(persist{height: height, datatype: "transactions", raw: raw})
+}
+
+// storeBlockResults stores block results into block_results bucket
+func (b *boltStorage) storeBlockResults(ctx context.Context, height int, raw []byte) (interface{}, error) {
+	return height, b.put(persist{height: height, datatype: "block_results", raw: raw})
+}
+
+// storeHeight stores block, block results and transactions at height atomically, in the same write transaction
+func (b *boltStorage) storeHeight(ctx context.Context, height int, parts []persist) (interface{}, error) {
+	return height, b.put(parts...)
+}
+
+// lastHeight returns height of the last block in blocks bucket
+func (b *boltStorage) lastHeight(ctx context.Context) (int, error) {
+	var h int
+	err := b.db.View(func(tx *bolt.Tx) error {
+		if k, _ := tx.Bucket([]byte(boltBuckets["block"])).Cursor().Last(); k != nil {
+			h = int(binary.BigEndian.Uint64(k))
+		}
+		return nil
+	})
+	return h, err
+}
+
+// close closes embedded database
+func (b *boltStorage) close(ctx context.Context) error {
+	return b.db.Close()
+}
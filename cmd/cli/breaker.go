@@ -0,0 +1,148 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/url"
+	"sync"
+)
+
+// breakerSource is bcSource with circuit breaker: after threshold consecutive node failures, it opens and blocks all requests
+// while open, underlying bcSource is probed (by requesting latest block) every napTime, and breaker closes again once the probe succeeds
+// blocked requests and probing stop once ctx is cancelled
+type breakerSource struct {
+	bcSource
+	ctx       context.Context
+	threshold int
+
+	mu       sync.Mutex
+	failures int           // consecutive node failures
+	closed   chan struct{} // closed when breaker is closed; nil while breaker was never opened
+}
+
+// newBreakerSource returns breakerSource for src, opening after threshold consecutive failures
+func newBreakerSource(ctx context.Context, src bcSource, threshold int) *breakerSource {
+	return &breakerSource{bcSource: src, ctx: ctx, threshold: threshold}
+}
+
+// block returns block at height once breaker is closed
+func (b *breakerSource) block(height string) ([]byte, error) {
+	if err := b.wait(b.ctx); err != nil {
+		return nil, err
+	}
+	res, err := b.bcSource.block(height)
+	b.check(err)
+	return res, err
+}
+
+// txs returns single page of transactions at height once breaker is closed
+func (b *breakerSource) txs(height, key string, offset int) ([]byte, error) {
+	if err := b.wait(b.ctx); err != nil {
+		return nil, err
+	}
+	res, err := b.bcSource.txs(height, key, offset)
+	b.check(err)
+	return res, err
+}
+
+// blockResults returns block results at height once breaker is closed
+func (b *breakerSource) blockResults(height string) ([]byte, error) {
+	if err := b.wait(b.ctx); err != nil {
+		return nil, err
+	}
+	res, err := b.bcSource.blockResults(height)
+	b.check(err)
+	return res, err
+}
+
+// query returns response for api path with params at height once breaker is closed
+func (b *breakerSource) query(path string, params url.Values, height int) ([]byte, error) {
+	if err := b.wait(b.ctx); err != nil {
+		return nil, err
+	}
+	res, err := b.bcSource.query(path, params, height)
+	b.check(err)
+	return res, err
+}
+
+// wait blocks while breaker is open, unless ctx is cancelled
+func (b *breakerSource) wait(ctx context.Context) error {
+	b.mu.Lock()
+	closed := b.closed
+	b.mu.Unlock()
+	if closed == nil {
+		return nil
+	}
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// check counts consecutive node failures and opens breaker once threshold is reached
+func (b *breakerSource) check(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil || !nodeFailure(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures < b.threshold || b.open() {
+		return
+	}
+	stdLogger.Printf("circuit breaker opened after %d consecutive failures (pausing all requests and probing node every %s): %v", b.failures, nap(), err)
+	b.closed = make(chan struct{})
+	go b.probe(b.ctx, b.closed)
+}
+
+// open returns true if breaker is open
+// note: must be called with b.mu held
+func (b *breakerSource) open() bool {
+	if b.closed == nil {
+		return false
+	}
+	select {
+	case <-b.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// probe probes node every napTime until it responds, then closes breaker by closing closed channel
+// it stops, leaving breaker open, once ctx is cancelled
+func (b *breakerSource) probe(ctx context.Context, closed chan struct{}) {
+	for {
+		if wait(ctx, nap()) != nil {
+			return
+		}
+		if _, err := b.bcSource.block("latest"); err != nil {
+			stdLogger.Printf("circuit breaker probe failed (will retry in %s): %v", nap(), err)
+			continue
+		}
+		b.mu.Lock()
+		b.failures = 0
+		close(closed)
+		b.mu.Unlock()
+		stdLogger.Println("circuit breaker closed: node recovered, resuming requests")
+		return
+	}
+}
@@ -0,0 +1,150 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBreakerSource(t *testing.T) {
+	setNap(t, 10*time.Millisecond)
+	failure := errors.New("connection refused")
+	src := &fakeSource{}
+	setErr := func(err error) {
+		src.mu.Lock()
+		src.err = err
+		src.mu.Unlock()
+	}
+	calls := func() int {
+		src.mu.Lock()
+		defer src.mu.Unlock()
+		return src.calls
+	}
+	b := newBreakerSource(context.Background(), src, 3)
+	isOpen := func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return b.open()
+	}
+
+	// failures below threshold, or interrupted by success, don't open breaker
+	setErr(failure)
+	b.block("1")
+	b.block("1")
+	setErr(nil)
+	b.block("1")
+	setErr(failure)
+	b.block("1")
+	b.block("1")
+	if isOpen() {
+		t.Fatal("breaker opened below threshold")
+	}
+	// request errors are not node failures
+	setErr(&statusError{code: http.StatusBadRequest, status: "400 Bad Request"})
+	b.block("1")
+	setErr(failure)
+	b.block("1")
+	b.block("1")
+	if isOpen() {
+		t.Fatal("breaker opened counting request errors")
+	}
+
+	b.block("1")
+	if !isOpen() {
+		t.Fatal("breaker not opened at threshold")
+	}
+
+	// requests block while open, and node is probed
+	done := make(chan error)
+	go func() {
+		_, err := b.block("1")
+		done <- err
+	}()
+	n := calls()
+	waitFor(t, "failed probes", func() bool { return calls() >= n+2 })
+	select {
+	case <-done:
+		t.Fatal("request not blocked while breaker is open")
+	default:
+	}
+
+	// breaker closes after successful probe, releasing blocked requests
+	setErr(nil)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("breaker not closed after successful probe")
+	}
+	if isOpen() {
+		t.Error("breaker still open")
+	}
+	b.mu.Lock()
+	failures := b.failures
+	b.mu.Unlock()
+	if failures != 0 {
+		t.Errorf("got %d failures after closing, want 0", failures)
+	}
+}
+
+func TestBreakerSourceCancelled(t *testing.T) {
+	setNap(t, 10*time.Millisecond)
+	src := &fakeSource{err: errors.New("connection refused")}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := newBreakerSource(ctx, src, 1)
+	b.block("1")
+	b.mu.Lock()
+	open := b.open()
+	b.mu.Unlock()
+	if !open {
+		t.Fatal("breaker not opened at threshold")
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := b.block("1")
+		done <- err
+	}()
+	time.Sleep(30 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("got error %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request still blocked after ctx cancelled")
+	}
+
+	// probing stops
+	time.Sleep(30 * time.Millisecond)
+	src.mu.Lock()
+	n := src.calls
+	src.mu.Unlock()
+	time.Sleep(50 * time.Millisecond)
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.calls != n {
+		t.Errorf("node probed %d more times after ctx cancelled", src.calls-n)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+)
+
+// maxPooledBuffer is capacity of the largest buffer kept for reuse, so that occasional huge responses don't stay in memory
+const maxPooledBuffer = 8 << 20
+
+// bufferPool holds buffers reused for reading node responses, to reduce allocations and gc pressure with many concurrent workers
+var bufferPool = sync.Pool{New: func() interface{} { return new(bytes.Buffer) }}
+
+// getBuffer returns empty buffer from pool
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+// putBuffer returns buffer to pool, unless it's too large; buffer must not be used afterwards
+func putBuffer(b *bytes.Buffer) {
+	if b.Cap() > maxPooledBuffer {
+		return
+	}
+	b.Reset()
+	bufferPool.Put(b)
+}
+
+// squash returns b as string with newlines removed and then each pair of spaces replaced with one, in a single pass
+// it's equivalent to strings.ReplaceAll(strings.ReplaceAll(string(b), "\n", ""), "  ", " ")
+func squash(b []byte) string {
+	var s strings.Builder
+	s.Grow(len(b))
+	space := false // pending space, not yet paired
+	for _, c := range b {
+		switch {
+		case c == '\n':
+		case c == ' ':
+			if space {
+				s.WriteByte(' ')
+			}
+			space = !space
+		default:
+			if space {
+				s.WriteByte(' ')
+				space = false
+			}
+			s.WriteByte(c)
+		}
+	}
+	if space {
+		s.WriteByte(' ')
+	}
+	return s.String()
+}
+
+// ignored is json value decoded without copying or allocating, for arrays only counted (eg, as []ignored)
+type ignored struct{}
+
+func (*ignored) UnmarshalJSON([]byte) error { return nil }
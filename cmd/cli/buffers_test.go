@@ -0,0 +1,110 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSquash(t *testing.T) {
+	tests := []string{
+		"",
+		"plain",
+		"a b",
+		"a  b",
+		"a   b",
+		"a    b",
+		"  lead and trail  ",
+		" ",
+		"\n",
+		"a \n b",
+		"a  \n  b",
+		"{\n  \"code\": 3,\n  \"message\": \"height 1 is not available\",\n  \"details\": [\n  ]\n}",
+		"\r\n\ttabs\tand\r\nreturns",
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		b := make([]byte, r.Intn(20))
+		for j := range b {
+			b[j] = " \nx"[r.Intn(3)]
+		}
+		tests = append(tests, string(b))
+	}
+	for _, s := range tests {
+		want := strings.ReplaceAll(strings.ReplaceAll(s, "\n", ""), "  ", " ")
+		if got := squash([]byte(s)); got != want {
+			t.Errorf("squash(%q) = %q, want %q", s, got, want)
+		}
+	}
+}
+
+func TestIgnored(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want int
+		err  bool
+	}{
+		{raw: `{}`, want: 0},
+		{raw: `{"a":null}`, want: 0},
+		{raw: `{"a":[]}`, want: 0},
+		{raw: `{"a":["x","]","\"[",""]}`, want: 4},
+		{raw: `{"a":[1,-2.5e3,true,false,null]}`, want: 5},
+		{raw: `{"a":[{"b":[1,{"c":"}"}]},[[],[{}]],{}]}`, want: 3},
+		{raw: `{"a":[1,}`, err: true},
+		{raw: `{"a":{}}`, err: true},
+	}
+	for _, tc := range tests {
+		var v struct {
+			A []ignored `json:"a"`
+		}
+		err := json.Unmarshal([]byte(tc.raw), &v)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected error", tc.raw)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.raw, err)
+			continue
+		}
+		if len(v.A) != tc.want {
+			t.Errorf("%s: counted %d, want %d", tc.raw, len(v.A), tc.want)
+		}
+	}
+}
+
+func TestPutBuffer(t *testing.T) {
+	b := getBuffer()
+	b.WriteString("data")
+	putBuffer(b)
+	if b.Len() != 0 {
+		t.Errorf("pooled buffer not reset: %q", b.String())
+	}
+
+	// oversized buffers are dropped (there's no way to check pool content directly, so just make sure it doesn't panic and buffer is left as is)
+	large := getBuffer()
+	large.Grow(maxPooledBuffer + 1)
+	large.WriteString("data")
+	putBuffer(large)
+	if large.String() != "data" {
+		t.Errorf("oversized buffer modified: %q", large.String())
+	}
+}
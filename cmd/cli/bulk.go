@@ -0,0 +1,184 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// bulkWriter groups concurrent upserts into collection into bulk writes of up to size docs, waiting up to wait for more docs to arrive
+// each caller still waits for its own doc to be written, so persist workers keep logging processed heights only once stored, while round trips are cut during backfill
+type bulkWriter struct {
+	ctx  context.Context // used for retry waits
+	col  *mongo.Collection
+	size int
+	wait time.Duration
+	reqs chan *bulkReq
+	done chan struct{}
+}
+
+// bulkReq is single write request, of one or more write models, with channel to return its result
+type bulkReq struct {
+	models []mongo.WriteModel
+	done   chan error
+}
+
+// newBulkWriter returns running bulk writer for collection col
+func newBulkWriter(ctx context.Context, col *mongo.Collection, size int, wait time.Duration) *bulkWriter {
+	if size < 1 {
+		size = 1
+	}
+	w := &bulkWriter{ctx: ctx, col: col, size: size, wait: wait, reqs: make(chan *bulkReq, size), done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+// upsert replaces (or inserts, if not existing) doc with _id in collection with raw json, returning once written
+func (w *bulkWriter) upsert(id interface{}, raw []byte) error {
+	m, err := replaceModel(w.col, id, raw)
+	if err != nil {
+		return err
+	}
+	return w.write(m)
+}
+
+// replaceModel returns write model replacing (or inserting, if not existing) doc with _id in col with raw json, compressed if configured (see compressedDoc)
+// oversized docs are stored in gridfs, and replaced with stub doc referencing it (see storeLarge)
+func replaceModel(col *mongo.Collection, id interface{}, raw []byte) (mongo.WriteModel, error) {
+	var extra bson.M
+	if dbCollectionType == "timeseries" {
+		// time series collections are insert-only, with storing time as time field
+		extra = bson.M{"cs_time": time.Now().UTC()}
+	}
+	var doc interface{}
+	if dbCompression != "" {
+		cdoc, err := compressedDoc(id, dbCompression, raw)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range extra {
+			cdoc[k] = v
+		}
+		doc = cdoc
+	} else {
+		jdoc, err := jsonDoc(id, raw, extra)
+		if err != nil {
+			return nil, err
+		}
+		doc = jdoc
+	}
+	if oversized(doc, raw) {
+		stub, err := storeLarge(col, id, raw)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range extra {
+			stub[k] = v
+		}
+		doc = stub
+	}
+	if dbCollectionType == "timeseries" {
+		return mongo.NewInsertOneModel().SetDocument(doc), nil
+	}
+	return mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": id}).SetReplacement(doc).SetUpsert(true), nil
+}
+
+// write applies write models to collection, returning once written
+func (w *bulkWriter) write(models ...mongo.WriteModel) error {
+	if len(models) == 0 {
+		return nil
+	}
+	req := &bulkReq{models: models, done: make(chan error, 1)}
+	w.reqs <- req
+	return <-req.done
+}
+
+// run collects requests into batches and writes them, until closed
+func (w *bulkWriter) run() {
+	defer close(w.done)
+	for req := range w.reqs {
+		batch := []*bulkReq{req}
+		timer := time.NewTimer(w.wait)
+	collect:
+		for len(batch) < w.size {
+			select {
+			case r, ok := <-w.reqs:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, r)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		w.flush(batch)
+	}
+}
+
+// flush writes batch using unordered bulk write, returning result to each request
+// it will retry on database error as per db retry policy, unless ctx cancelled, while errors of individual docs (eg, too large) are returned to respective requests only
+func (w *bulkWriter) flush(batch []*bulkReq) {
+	var models []mongo.WriteModel
+	reqs := []int{} // request index of each model
+	for i, r := range batch {
+		models = append(models, r.models...)
+		for range r.models {
+			reqs = append(reqs, i)
+		}
+	}
+	for n := 1; ; n++ {
+		_, err := w.col.BulkWrite(context.Background(), models, options.BulkWrite().SetOrdered(false))
+		var bwe mongo.BulkWriteException
+		if err == nil || (errors.As(err, &bwe) && bwe.WriteConcernError == nil && len(bwe.WriteErrors) > 0) {
+			errs := make([]error, len(batch))
+			for _, we := range bwe.WriteErrors {
+				errs[reqs[we.Index]] = fmt.Errorf("error writing into database: %v", we)
+			}
+			for i, r := range batch {
+				r.done <- errs[i]
+			}
+			dbOutage.recovered()
+			return
+		}
+		dbOutage.failed(err)
+		d, rerr := dbRetry.retry(n)
+		if rerr == nil {
+			stdLogger.Printf("error bulk writing %d docs into database (will retry in %s): %v", len(batch), d, err)
+			rerr = wait(w.ctx, d)
+		}
+		if rerr != nil {
+			for _, r := range batch {
+				r.done <- fmt.Errorf("error bulk writing into database: %v: %v", rerr, err)
+			}
+			return
+		}
+	}
+}
+
+// close writes pending requests and stops bulk writer
+func (w *bulkWriter) close() {
+	close(w.reqs)
+	<-w.done
+}
@@ -0,0 +1,195 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// clickhouseTables are clickhouse tables ddl, optimised for time-series queries: partitioned by month and ordered by height
+// ReplacingMergeTree engine eventually removes duplicates (eg, of re-scraped heights) with the same sorting key
+var clickhouseTables = []string{
+	`CREATE TABLE IF NOT EXISTS %s.blocks (
+		height UInt64,
+		time DateTime64(9, 'UTC'),
+		chain_id LowCardinality(String),
+		hash String,
+		proposer_address LowCardinality(String),
+		num_txs UInt32
+	) ENGINE = ReplacingMergeTree PARTITION BY toYYYYMM(time) ORDER BY height`,
+	`CREATE TABLE IF NOT EXISTS %s.transactions (
+		height UInt64,
+		time DateTime64(9, 'UTC'),
+		txhash String,
+		code UInt32,
+		gas_wanted UInt64,
+		gas_used UInt64,
+		msg_type LowCardinality(String),
+		msg_types Array(LowCardinality(String)),
+		signer String,
+		fee String,
+		memo String,
+		raw String CODEC(ZSTD)
+	) ENGINE = ReplacingMergeTree PARTITION BY toYYYYMM(time) ORDER BY (height, txhash)`,
+}
+
+// clickhouseSink inserts scraped blocks and transactions into clickhouse tables in batches (see rangeBatcher), using clickhouse http interface
+// note: block results are not inserted, and transactions time is not available with rpc protocol
+type clickhouseSink struct {
+	*rangeBatcher
+	url      string
+	database string
+	user     string
+	password string
+	client   *http.Client
+}
+
+// newClickhouseSink returns clickhouse sink for http interface url (eg, "http://localhost:8123") and database, creating database and tables if not existing
+func newClickhouseSink(ctx context.Context, url, database, user, password string, size int, flush time.Duration) (*clickhouseSink, error) {
+	stdLogger.Printf("connecting to clickhouse at %s...", url)
+	s := &clickhouseSink{
+		url:      strings.TrimSuffix(url, "/"),
+		database: database,
+		user:     user,
+		password: password,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}
+	if err := s.exec(ctx, "CREATE DATABASE IF NOT EXISTS "+database, nil); err != nil {
+		return nil, fmt.Errorf("error creating database %s: %v", database, err)
+	}
+	for _, ddl := range clickhouseTables {
+		if err := s.exec(ctx, fmt.Sprintf(ddl, database), nil); err != nil {
+			return nil, fmt.Errorf("error creating table: %v", err)
+		}
+	}
+	s.rangeBatcher = newRangeBatcher("clickhouse", size, flush, s.insert)
+	return s, nil
+}
+
+// publish adds raw datatype at height to its batch, inserting the batch if complete
+func (s *clickhouseSink) publish(ctx context.Context, datatype string, height int, raw []byte) error {
+	if datatype != "block" && datatype != "transactions" {
+		return nil
+	}
+	return s.add(ctx, datatype, height, raw)
+}
+
+// insert inserts batch b rows into respective table
+func (s *clickhouseSink) insert(ctx context.Context, b *heightBatch) error {
+	var rows bytes.Buffer
+	enc := json.NewEncoder(&rows)
+	table := "blocks"
+	for _, h := range b.heights() {
+		if b.datatype == "block" {
+			r, err := blockRow(h, b.items[h])
+			if err != nil {
+				return err
+			}
+			if err := enc.Encode(map[string]interface{}{
+				"height":           r.Height,
+				"time":             clickhouseTime(r.Time),
+				"chain_id":         r.ChainID,
+				"hash":             r.Hash,
+				"proposer_address": r.ProposerAddress,
+				"num_txs":          r.NumTxs,
+			}); err != nil {
+				return err
+			}
+			continue
+		}
+		table = "transactions"
+		txs, err := txRows(h, b.items[h])
+		if err != nil {
+			return err
+		}
+		for _, row := range txs {
+			r := row.(parquetTx)
+			types := []string{}
+			if r.MsgTypes != "" {
+				types = strings.Split(r.MsgTypes, ",")
+			}
+			msgType := ""
+			if len(types) > 0 {
+				msgType = types[0]
+			}
+			if err := enc.Encode(map[string]interface{}{
+				"height":     r.Height,
+				"time":       clickhouseTime(r.Timestamp),
+				"txhash":     r.TxHash,
+				"code":       r.Code,
+				"gas_wanted": r.GasWanted,
+				"gas_used":   r.GasUsed,
+				"msg_type":   msgType,
+				"msg_types":  types,
+				"signer":     r.Signer,
+				"fee":        r.Fee,
+				"memo":       r.Memo,
+				"raw":        r.Raw,
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	if rows.Len() == 0 {
+		return nil
+	}
+	if err := s.exec(ctx, fmt.Sprintf("INSERT INTO %s.%s FORMAT JSONEachRow", s.database, table), &rows); err != nil {
+		return fmt.Errorf("error inserting %s [%d..%d]: %v", b.datatype, b.from, b.to, err)
+	}
+	return nil
+}
+
+// exec executes query with optional body (eg, insert data)
+func (s *clickhouseSink) exec(ctx context.Context, query string, body io.Reader) error {
+	params := url.Values{}
+	params.Set("query", query)
+	params.Set("date_time_input_format", "best_effort") // accept rfc3339 times
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url+"/?"+params.Encode(), body)
+	if err != nil {
+		return err
+	}
+	if s.user != "" {
+		req.Header.Set("X-ClickHouse-User", s.user)
+		req.Header.Set("X-ClickHouse-Key", s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// clickhouseTime returns rfc3339 time t, or unix epoch if unknown
+func clickhouseTime(t string) string {
+	if t == "" {
+		return "1970-01-01T00:00:00Z"
+	}
+	return t
+}
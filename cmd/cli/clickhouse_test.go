@@ -0,0 +1,242 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBlock returns rest api block at height h with single transaction
+func testBlock(h int) []byte {
+	return []byte(fmt.Sprintf(`{"block_id": {"hash": "q80="}, "block": {"header": {"chain_id": "test-1", "height": "%d", "time": "2022-01-01T00:00:%02dZ", "proposer_address": "3q0="}, "data": {"txs": ["dHgx"]}}}`, h, h%60))
+}
+
+// testTxs are rest api transactions (with two messages) and rpc transaction (without timestamp and decoded tx)
+const testTxs = `{"tx_responses": [
+	{"txhash": "AB12", "code": 0, "gas_wanted": "100", "gas_used": "80", "timestamp": "2022-01-01T00:00:04Z",
+		"events": [{"type": "message", "attributes": [{"key": "action", "value": "send"}, {"key": "sender", "value": "cosmos1x"}]}],
+		"tx": {"body": {"memo": "hi", "messages": [{"@type": "/cosmos.bank.v1beta1.MsgSend"}, {"@type": "/cosmos.gov.v1beta1.MsgVote"}]}, "auth_info": {"fee": {"amount": [{"denom": "uatom", "amount": "5"}]}}}},
+	{"hash": "CD34", "height": "4", "tx": "dHgx", "tx_result": {"code": 5, "gas_wanted": "10", "gas_used": "9", "events": [{"type": "transfer", "attributes": [{"key": "cmVjaXBpZW50", "value": "Y29zbW9zMXk="}]}]}}
+]}`
+
+// clickhouseServer starts clickhouse http interface mock, returning executed queries with their (json lines) rows and function to make inserts fail
+func clickhouseServer(t *testing.T) (url string, queries func() map[string][][]map[string]interface{}, fail func(bool)) {
+	var mu sync.Mutex
+	executed := map[string][][]map[string]interface{}{} // rows of each execution, by query
+	failing := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		if r.Method != http.MethodPost || r.Header.Get("X-ClickHouse-User") != "scraper" || r.Header.Get("X-ClickHouse-Key") != "secret" {
+			http.Error(w, "Code: 516. DB::Exception: Authentication failed", http.StatusUnauthorized)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if failing && strings.HasPrefix(query, "INSERT") {
+			http.Error(w, "Code: 242. DB::Exception: Table is in readonly mode", http.StatusInternalServerError)
+			return
+		}
+		rows := []map[string]interface{}{}
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			var row map[string]interface{}
+			if err := json.Unmarshal(sc.Bytes(), &row); err != nil {
+				http.Error(w, "Code: 117. DB::Exception: Cannot parse JSON", http.StatusBadRequest)
+				return
+			}
+			rows = append(rows, row)
+		}
+		executed[query] = append(executed[query], rows)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func() map[string][][]map[string]interface{} {
+			mu.Lock()
+			defer mu.Unlock()
+			c := map[string][][]map[string]interface{}{}
+			for q, rows := range executed {
+				c[q] = append([][]map[string]interface{}(nil), rows...)
+			}
+			return c
+		}, func(f bool) {
+			mu.Lock()
+			defer mu.Unlock()
+			failing = f
+		}
+}
+
+func TestClickhouseSink(t *testing.T) {
+	url, queries, fail := clickhouseServer(t)
+	ctx := context.Background()
+
+	if _, err := newClickhouseSink(ctx, url, "cosmos", "", "", 3, time.Hour); err == nil {
+		t.Fatal("expected error for failed authentication")
+	}
+	s, err := newClickhouseSink(ctx, url+"/", "cosmos", "scraper", "secret", 3, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := queries()
+	if len(q) != 3 || q["CREATE DATABASE IF NOT EXISTS cosmos"] == nil || q[fmt.Sprintf(clickhouseTables[0], "cosmos")] == nil || q[fmt.Sprintf(clickhouseTables[1], "cosmos")] == nil {
+		t.Fatalf("got queries %v, want database and tables created", q)
+	}
+
+	// batches are inserted only once their height range [3..5] is complete, and unsupported datatypes are ignored
+	const blocks, txs = "INSERT INTO cosmos.blocks FORMAT JSONEachRow", "INSERT INTO cosmos.transactions FORMAT JSONEachRow"
+	for _, h := range []int{4, 3, 6} {
+		if err := s.publish(ctx, "block", h, testBlock(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.publish(ctx, "block_results", 4, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.publish(ctx, "transactions", 4, []byte(testTxs)); err != nil {
+		t.Fatal(err)
+	}
+	if q := queries(); q[blocks] != nil || q[txs] != nil {
+		t.Fatalf("got inserts %v before batches were complete", q)
+	}
+	if err := s.publish(ctx, "block", 5, testBlock(5)); err != nil {
+		t.Fatal(err)
+	}
+	q = queries()
+	if len(q[blocks]) != 1 {
+		t.Fatalf("got %d block inserts, want 1", len(q[blocks]))
+	}
+	var heights []float64
+	for _, row := range q[blocks][0] {
+		heights = append(heights, row["height"].(float64))
+	}
+	if !reflect.DeepEqual(heights, []float64{3, 4, 5}) {
+		t.Errorf("got block heights %v, want [3 4 5] in order", heights)
+	}
+	want := map[string]interface{}{"height": 5.0, "time": "2022-01-01T00:00:05Z", "chain_id": "test-1", "hash": "ABCD", "proposer_address": "DEAD", "num_txs": 1.0}
+	if got := q[blocks][0][2]; !reflect.DeepEqual(got, want) {
+		t.Errorf("got block row %v, want %v", got, want)
+	}
+
+	// failed insert is retried on next flush, and batch is kept meanwhile
+	fail(true)
+	if err := s.publish(ctx, "block", 7, testBlock(7)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.publish(ctx, "block", 8, testBlock(8)); err == nil {
+		t.Fatal("expected error for failed insert of complete batch")
+	}
+	for _, h := range []int{9, 10} {
+		if err := s.publish(ctx, "block", h, testBlock(h)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.close(); err == nil {
+		t.Error("expected error closing with failing inserts")
+	}
+	fail(false)
+	if err := s.flush(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	q = queries()
+	var inserted [][]float64
+	for _, rows := range q[blocks] {
+		var hs []float64
+		for _, row := range rows {
+			hs = append(hs, row["height"].(float64))
+		}
+		inserted = append(inserted, hs)
+	}
+	got := map[string]bool{}
+	for _, hs := range inserted {
+		got[fmt.Sprint(hs)] = true
+	}
+	if len(inserted) != 3 || !got["[3 4 5]"] || !got["[6 7 8]"] || !got["[9 10]"] {
+		t.Errorf("got block inserts %v, want [3 4 5], [6 7 8] and [9 10]", inserted)
+	}
+
+	if len(q[txs]) != 1 || len(q[txs][0]) != 2 {
+		t.Fatalf("got transactions inserts %v, want single insert of 2 rows", q[txs])
+	}
+	wantTxs := []map[string]interface{}{
+		{"height": 4.0, "time": "2022-01-01T00:00:04Z", "txhash": "AB12", "code": 0.0, "gas_wanted": 100.0, "gas_used": 80.0, "msg_type": "/cosmos.bank.v1beta1.MsgSend", "msg_types": []interface{}{"/cosmos.bank.v1beta1.MsgSend", "/cosmos.gov.v1beta1.MsgVote"}, "signer": "cosmos1x", "fee": "5uatom", "memo": "hi"},
+		{"height": 4.0, "time": "1970-01-01T00:00:00Z", "txhash": "CD34", "code": 5.0, "gas_wanted": 10.0, "gas_used": 9.0, "msg_type": "", "msg_types": []interface{}{}, "signer": "", "fee": "", "memo": ""},
+	}
+	for i, row := range q[txs][0] {
+		var raw bytes.Buffer
+		if err := json.Compact(&raw, []byte(row["raw"].(string))); err != nil {
+			t.Errorf("transaction %d: invalid raw json: %v", i, err)
+		}
+		delete(row, "raw")
+		if !reflect.DeepEqual(row, wantTxs[i]) {
+			t.Errorf("got transaction row %v, want %v", row, wantTxs[i])
+		}
+	}
+}
+
+func TestRangeBatcherFlush(t *testing.T) {
+	var mu sync.Mutex
+	var written []string
+	r := newRangeBatcher("test", 100, 10*time.Millisecond, func(ctx context.Context, b *heightBatch) error {
+		mu.Lock()
+		defer mu.Unlock()
+		written = append(written, fmt.Sprintf("%s [%d..%d]", b.datatype, b.from, b.to))
+		return nil
+	})
+	ctx := context.Background()
+
+	// sparse heights of incomplete batch are written once idle for flush interval
+	for _, h := range []int{150, 120} {
+		if err := r.add(ctx, "transactions", h, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "idle batch flush", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(written) == 1
+	})
+	if written[0] != "transactions [120..150]" {
+		t.Errorf("got %s, want transactions [120..150]", written[0])
+	}
+
+	// heights from different ranges are batched separately
+	for _, h := range []int{199, 200} {
+		if err := r.add(ctx, "transactions", h, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.close(); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(written)
+	if want := []string{"transactions [120..150]", "transactions [199..199]", "transactions [200..200]"}; !reflect.DeepEqual(written, want) {
+		t.Errorf("got %v, want %v", written, want)
+	}
+}
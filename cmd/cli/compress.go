@@ -0,0 +1,99 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// zstd encoder and decoder are safe for concurrent use (via EncodeAll and DecodeAll), so they are shared and created once needed
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+)
+
+// initZstd creates shared zstd encoder and decoder
+func initZstd() {
+	zstdOnce.Do(func() {
+		zstdEnc, _ = zstd.NewWriter(nil)
+		zstdDec, _ = zstd.NewReader(nil)
+	})
+}
+
+// compress returns raw compressed with codec ("zstd" or "snappy")
+func compress(codec string, raw []byte) ([]byte, error) {
+	switch codec {
+	case "zstd":
+		initZstd()
+		return zstdEnc.EncodeAll(raw, nil), nil
+	case "snappy":
+		return s2.EncodeSnappy(nil, raw), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+}
+
+// decompress returns data decompressed with codec ("zstd" or "snappy")
+func decompress(codec string, data []byte) ([]byte, error) {
+	switch codec {
+	case "zstd":
+		initZstd()
+		return zstdDec.DecodeAll(data, nil)
+	case "snappy":
+		// note: s2 decoder also decodes snappy
+		return s2.Decode(nil, data)
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+}
+
+// compressedDoc returns doc with _id storing raw json compressed with codec, as binary "cs_data" field, with "cs_codec" field as codec marker
+func compressedDoc(id interface{}, codec string, raw []byte) (bson.M, error) {
+	data, err := compress(codec, raw)
+	if err != nil {
+		return nil, fmt.Errorf("error compressing %v: %v", id, err)
+	}
+	return bson.M{"_id": id, "cs_codec": codec, "cs_data": data}, nil
+}
+
+// storedJSON returns original raw json of stored doc, if it's compressed doc (see compressedDoc) or gridfs stub doc (see storeLarge)
+// ok is false for other (ie, plain) docs
+func storedJSON(col *mongo.Collection, doc bson.Raw) (raw []byte, ok bool, err error) {
+	if codec, ok := doc.Lookup("cs_codec").StringValueOK(); ok {
+		_, data, ok := doc.Lookup("cs_data").BinaryOK()
+		if !ok {
+			return nil, false, fmt.Errorf("error reading compressed data")
+		}
+		raw, err := decompress(codec, data)
+		if err != nil {
+			return nil, false, fmt.Errorf("error decompressing data: %v", err)
+		}
+		return raw, true, nil
+	}
+	if name, ok := doc.Lookup("cs_gridfs").StringValueOK(); ok {
+		raw, err := loadLarge(col, name)
+		return raw, err == nil, err
+	}
+	return nil, false, nil
+}
@@ -0,0 +1,96 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// listSeparators are separators of list config values, by key, if not comma
+var listSeparators = map[string]string{
+	"cs_event_queries": ";",
+	"cs_abci_queries":  ";",
+}
+
+// loadConfigFile sets config values from structured config file (yaml, toml or json, as per its extension), not set otherwise (ie, in .env file, environment variables or command-line flags)
+// keys can be flat (eg, 'cs_bc_node: ...' or 'bc_node: ...') or nested (eg, 'bc: {node: ..., retry: {min: ...}}'), and list values are joined (eg, kafka brokers)
+// multiple chains can be configured in chains section, by name, each overriding shared (ie, top-level) values, and one of them must then be selected with chain
+func loadConfigFile(file, chain string) error {
+	v := viper.New()
+	v.SetConfigFile(file)
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("error reading config file %s: %v", file, err)
+	}
+
+	values := map[string]interface{}{}
+	chains := map[string]bool{}
+	for _, k := range v.AllKeys() {
+		if strings.HasPrefix(k, "chains.") {
+			chains[strings.SplitN(k, ".", 3)[1]] = true
+			continue
+		}
+		values[configFileKey(k)] = v.Get(k)
+	}
+	if len(chains) > 0 || chain != "" {
+		names := make([]string, 0, len(chains))
+		for n := range chains {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		if chain == "" {
+			return fmt.Errorf("config file %s defines chains %v: select one with cs_chain", file, names)
+		}
+		if !chains[strings.ToLower(chain)] {
+			return fmt.Errorf("chain %q not found in config file %s: select one of %v with cs_chain", chain, file, names)
+		}
+		sub := v.Sub("chains." + strings.ToLower(chain))
+		for _, k := range sub.AllKeys() {
+			values[configFileKey(k)] = sub.Get(k)
+		}
+	}
+
+	for k, val := range values {
+		if list, ok := val.([]interface{}); ok {
+			sep := ","
+			if s, ok := listSeparators[k]; ok {
+				sep = s
+			}
+			items := make([]string, len(list))
+			for i, item := range list {
+				items[i] = fmt.Sprint(item)
+			}
+			val = strings.Join(items, sep)
+		}
+		viper.SetDefault(k, val)
+		configSources[k] = "config file"
+	}
+	stdLogger.Printf("loaded config file %s (chain: %q)", file, chain)
+	return nil
+}
+
+// configFileKey returns config key for (flat or nested) config file key (eg, 'cs_bc_node' for 'bc.node')
+func configFileKey(k string) string {
+	k = strings.ReplaceAll(k, ".", "_")
+	if !strings.HasPrefix(k, "cs_") {
+		k = "cs_" + k
+	}
+	return k
+}
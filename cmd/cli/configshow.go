@@ -0,0 +1,301 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/viper"
+)
+
+// configVars maps config keys to variables holding their effective values
+var configVars = map[string]interface{}{
+	"cs_abci_interval":             &abciInterval,
+	"cs_alert_format":              &alertFormat,
+	"cs_alert_routing_key":         &alertRoutingKey,
+	"cs_alert_webhook":             &alertWebhook,
+	"cs_bc_api_key":                &bcAPIKey,
+	"cs_bc_api_key_header":         &bcAPIKeyHeader,
+	"cs_bc_block_path":             &bcBlockPath,
+	"cs_bc_breaker_threshold":      &bcBreakerThreshold,
+	"cs_bc_dial_timeout":           &bcDialTimeout,
+	"cs_bc_idle_conn_timeout":      &bcIdleConnTimeout,
+	"cs_bc_keep_alive":             &bcKeepAlive,
+	"cs_bc_max_idle_conns":         &bcMaxIdleConns,
+	"cs_bc_max_response_size":      &bcMaxResponseSize,
+	"cs_bc_node":                   &bcNode,
+	"cs_bc_port":                   &bcPort,
+	"cs_bc_protocol":               &bcProtocol,
+	"cs_bc_proxy":                  &bcProxyURL,
+	"cs_bc_rate_burst":             &bcRateBurst,
+	"cs_bc_rate_limit":             &bcRateLimit,
+	"cs_bc_rpc_port":               &bcRPCPort,
+	"cs_bc_sync_check":             &bcSyncCheck,
+	"cs_bc_timeout":                &bcTimeout,
+	"cs_bc_tls_ca_file":            &bcTLSCAFile,
+	"cs_bc_tls_cert_file":          &bcTLSCertFile,
+	"cs_bc_tls_insecure":           &bcTLSInsecure,
+	"cs_bc_tls_key_file":           &bcTLSKeyFile,
+	"cs_bc_txs_param":              &bcTxsParam,
+	"cs_bc_txs_path":               &bcTxsPath,
+	"cs_bc_ws_timeout":             &bcWSTimeout,
+	"cs_bc_ws_url":                 &bcWSURL,
+	"cs_block_results":             &blockResults,
+	"cs_check_continuity":          &checkContinuity,
+	"cs_clickhouse_batch":          &clickhouseBatchSize,
+	"cs_clickhouse_database":       &clickhouseDatabase,
+	"cs_clickhouse_flush_interval": &clickhouseFlushInterval,
+	"cs_clickhouse_pass":           &clickhousePass,
+	"cs_clickhouse_url":            &clickhouseURL,
+	"cs_clickhouse_user":           &clickhouseUser,
+	"cs_confirmations":             &confirmations,
+	"cs_tip_workers":               &tipWorkers,
+	"cs_tip_window":                &tipWindow,
+	"cs_db_atomic":                 &dbAtomic,
+	"cs_db_batch_size":             &dbBatchSize,
+	"cs_db_batch_wait":             &dbBatchWait,
+	"cs_db_capped_max":             &dbCappedMax,
+	"cs_db_capped_size":            &dbCappedSize,
+	"cs_db_connect_timeout":        &dbConnectTimeout,
+	"cs_db_host":                   &dbHost,
+	"cs_db_indexes":                &dbIndexes,
+	"cs_db_max_pool_size":          &dbMaxPoolSize,
+	"cs_db_name":                   &dbName,
+	"cs_db_pass":                   &dbPass,
+	"cs_db_path":                   &dbPath,
+	"cs_db_port":                   &dbPort,
+	"cs_db_prefix":                 &dbPrefix,
+	"cs_db_socket_timeout":         &dbSocketTimeout,
+	"cs_db_tx_docs":                &dbTxDocs,
+	"cs_db_user":                   &dbUser,
+	"cs_db_write_concern":          &dbWriteConcern,
+	"cs_dead_letter_file":          &deadLetterFile,
+	"cs_dead_letters":              &deadLetterQueue,
+	"cs_debug_endpoints":           &debugEndpoints,
+	"cs_pid_file":                  &pidFile,
+	"cs_drain_timeout":             &drainTimeout,
+	"cs_elastic_batch":             &elasticBatchSize,
+	"cs_elastic_flush_interval":    &elasticFlushInterval,
+	"cs_elastic_index":             &elasticIndex,
+	"cs_elastic_pass":              &elasticPass,
+	"cs_elastic_url":               &elasticURL,
+	"cs_elastic_user":              &elasticUser,
+	"cs_error_summary_interval":    &errorSummaryInterval,
+	"cs_event_from":                &eventFrom,
+	"cs_event_interval":            &eventInterval,
+	"cs_event_span":                &eventSpan,
+	"cs_evm_rpc_url":               &evmRPCURL,
+	"cs_follow":                    &follow,
+	"cs_follow_behind":             &followBehind,
+	"cs_tui":                       &tui,
+	"cs_gap_scan":                  &gapScan,
+	"cs_gap_scan_interval":         &gapScanInterval,
+	"cs_gov_api_version":           &govAPIVersion,
+	"cs_gov_interval":              &govInterval,
+	"cs_head_lag":                  &headLag,
+	"cs_heartbeat_interval":        &heartbeatInterval,
+	"cs_height_ledger":             &heightLedger,
+	"cs_height_probe":              &heightProbe,
+	"cs_http_addr":                 &httpAddr,
+	"cs_ibc_interval":              &ibcInterval,
+	"cs_ibc_packets":               &ibcPackets,
+	"cs_jsonl_dir":                 &jsonlDir,
+	"cs_jsonl_max_size":            &jsonlMaxSize,
+	"cs_kafka_schema_registry":     &kafkaSchemaRegistry,
+	"cs_leader_election":           &leaderElection,
+	"cs_leader_ttl":                &leaderTTL,
+	"cs_lease_size":                &leaseSize,
+	"cs_lease_ttl":                 &leaseTTL,
+	"cs_log_checkpoint":            &logCheckpoint,
+	"cs_instance_name":             &instanceName,
+	"cs_log_level":                 &logLevel,
+	"cs_log_file":                  &logFile,
+	"cs_adaptive_workers":          &adaptiveWorkers,
+	"cs_adaptive_interval":         &adaptiveInterval,
+	"cs_max_per_workers":           &maxPerWorkers,
+	"cs_max_req_workers":           &maxReqWorkers,
+	"cs_mempool_interval":          &mempoolInterval,
+	"cs_naptime":                   &napTime,
+	"cs_nats_dedup_window":         &natsDedupWindow,
+	"cs_nats_stream":               &natsStream,
+	"cs_nats_url":                  &natsURL,
+	"cs_net_info_interval":         &netInfoInterval,
+	"cs_otlp_endpoint":             &otlpEndpoint,
+	"cs_outage_alert":              &outageAlert,
+	"cs_params_interval":           &paramsInterval,
+	"cs_parquet_batch":             &parquetBatchSize,
+	"cs_parquet_dir":               &parquetDir,
+	"cs_parquet_flush_interval":    &parquetFlushInterval,
+	"cs_progress_interval":         &progressInterval,
+	"cs_resume_file":               &resumeFile,
+	"cs_retention_age":             &retentionAge,
+	"cs_retention_blocks":          &retentionBlocks,
+	"cs_retention_interval":        &retentionInterval,
+	"cs_s3_access_key":             &s3AccessKey,
+	"cs_s3_batch":                  &s3BatchSize,
+	"cs_s3_bucket":                 &s3Bucket,
+	"cs_s3_endpoint":               &s3Endpoint,
+	"cs_s3_flush_interval":         &s3FlushInterval,
+	"cs_s3_prefix":                 &s3Prefix,
+	"cs_s3_region":                 &s3Region,
+	"cs_s3_secret_key":             &s3SecretKey,
+	"cs_scrape_state":              &scrapeStateEnabled,
+	"cs_scrape_state_interval":     &scrapeStateInterval,
+	"cs_sentry_dsn":                &sentryDSN,
+	"cs_signing_info_interval":     &signingInfoInterval,
+	"cs_sink_queue":                &sinkQueue,
+	"cs_staking_blocks":            &stakingBlocks,
+	"cs_staking_interval":          &stakingInterval,
+	"cs_stall_timeout":             &stallTimeout,
+	"cs_stall_watchdog":            &stallWatchdog,
+	"cs_start_height":              &startHeight,
+	"cs_stop_height":               &stopHeight,
+	"cs_supply_interval":           &supplyInterval,
+	"cs_trace_sample":              &traceSample,
+	"cs_track_uptime":              &trackUptime,
+	"cs_tx_index_grace":            &txIndexGrace,
+	"cs_verify_blocks":             &verifyBlocks,
+	"cs_vault_addr":                &vaultAddr,
+	"cs_vault_token":               &vaultToken,
+	"cs_vault_namespace":           &vaultNamespace,
+	"cs_db_collection_type":        &dbCollectionType,
+	"cs_db_compression":            &dbCompression,
+	"cs_db_journal":                &dbJournal,
+	"cs_db_read_preference":        &dbReadPreference,
+	"cs_db_type":                   &dbType,
+	"cs_db_uri":                    &dbURI,
+	"cs_kafka_brokers":             &kafkaBrokers,
+	"cs_abci_heights":              &abciHeights,
+	"cs_s3_compression":            &s3Compression,
+	"cs_bc_retry_min":              &bcRetry.min,
+	"cs_bc_retry_max":              &bcRetry.max,
+	"cs_bc_retry_factor":           &bcRetry.factor,
+	"cs_bc_retry_jitter":           &bcRetry.jitter,
+	"cs_bc_retry_attempts":         &bcRetry.attempts,
+	"cs_db_retry_min":              &dbRetry.min,
+	"cs_db_retry_max":              &dbRetry.max,
+	"cs_db_retry_factor":           &dbRetry.factor,
+	"cs_db_retry_jitter":           &dbRetry.jitter,
+	"cs_db_retry_attempts":         &dbRetry.attempts,
+	"cs_sink_retry_min":            &sinkRetry.min,
+	"cs_sink_retry_max":            &sinkRetry.max,
+	"cs_sink_retry_factor":         &sinkRetry.factor,
+	"cs_sink_retry_jitter":         &sinkRetry.jitter,
+	"cs_sink_retry_attempts":       &sinkRetry.attempts,
+}
+
+// configDatatypeVars maps per-datatype config keys to maps holding their effective values
+var configDatatypeVars = map[string]struct {
+	m        map[string]string
+	datatype string
+}{
+	"cs_db_collection_blocks":        {dbCollections, "block"},
+	"cs_db_collection_txs":           {dbCollections, "transactions"},
+	"cs_db_collection_block_results": {dbCollections, "block_results"},
+	"cs_kafka_topic_blocks":          {kafkaTopics, "block"},
+	"cs_kafka_topic_txs":             {kafkaTopics, "transactions"},
+	"cs_kafka_topic_block_results":   {kafkaTopics, "block_results"},
+	"cs_nats_subject_blocks":         {natsSubjects, "block"},
+	"cs_nats_subject_txs":            {natsSubjects, "transactions"},
+	"cs_nats_subject_block_results":  {natsSubjects, "block_results"},
+}
+
+// configSources are sources of config values set by command-line flags, config file or secret files (others are looked up when shown)
+var configSources = map[string]string{}
+
+// showConfig writes effective value and source of every known config key to w, with secrets redacted
+func showConfig(w io.Writer) error {
+	keys := make([]string, 0, len(configKeys))
+	for k := range configKeys {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KEY\tVALUE\tSOURCE")
+	for _, k := range keys {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", k, redactConfig(k, configValue(k)), configSource(k))
+	}
+	return tw.Flush()
+}
+
+// configValue returns effective value of config key, falling back to its raw value for keys parsed into composite values (eg, cs_event_queries)
+func configValue(key string) string {
+	if d, ok := configDatatypeVars[key]; ok {
+		return d.m[d.datatype]
+	}
+	p, ok := configVars[key]
+	if !ok {
+		return viper.GetString(key)
+	}
+	v := reflect.ValueOf(p).Elem()
+	switch v.Kind() {
+	case reflect.Slice:
+		items := make([]string, v.Len())
+		for i := range items {
+			items[i] = fmt.Sprint(v.Index(i).Interface())
+		}
+		return strings.Join(items, ",")
+	case reflect.Ptr:
+		if v.IsNil() {
+			return ""
+		}
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+// configSource returns where config key's value comes from: flag, env, env file, config file or default
+func configSource(key string) string {
+	if s, ok := configSources[key]; ok && s == "flag" {
+		return s
+	}
+	if _, ok := os.LookupEnv(strings.ToUpper(key)); ok {
+		return "env"
+	}
+	if viper.InConfig(key) {
+		return "env file"
+	}
+	if s, ok := configSources[key]; ok {
+		return s
+	}
+	return "default"
+}
+
+// redactConfig returns value of config key with secrets (ie, passwords, keys, tokens, headers and credentials in urls) redacted, keeping secret files' paths
+func redactConfig(key, value string) string {
+	if value == "" || strings.HasSuffix(key, "_file") {
+		return value
+	}
+	for _, s := range []string{"pass", "secret", "token", "dsn", "webhook", "headers"} {
+		if strings.Contains(key, s) {
+			return "xxxxx"
+		}
+	}
+	if strings.HasSuffix(key, "_key") {
+		return "xxxxx"
+	}
+	if strings.Contains(value, "://") {
+		return redactURI(value)
+	}
+	return value
+}
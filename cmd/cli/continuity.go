@@ -0,0 +1,129 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// continuity checks that each scraped block's last block id hash matches the hash of the block at previous height
+// as blocks are scraped concurrently, each block is checked against both of its neighbours, whichever is scraped later
+// mismatches are logged and recorded in col, keyed by height of the block referencing (wrong) previous block
+type continuity struct {
+	col *mongo.Collection
+
+	mu    sync.Mutex
+	links map[int]link // recently scraped blocks by height
+}
+
+// link is block's own hash and its previous block's hash
+type link struct {
+	hash, last []byte
+}
+
+// newContinuity returns continuity seeded with the last stored block before height tail, if any, from bxs collection
+func newContinuity(ctx context.Context, bxs, col *mongo.Collection, tail int) (*continuity, error) {
+	c := &continuity{col: col, links: map[int]link{}}
+	if tail <= 1 {
+		return c, nil
+	}
+	var b blockLink
+	err := findStored(ctx, bxs, tail-1, &b)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading block at height %d: %v", tail-1, err)
+	}
+	c.links[tail-1] = b.link()
+	return c, nil
+}
+
+// blockLink is block's own and its previous block's id, as stored and as returned by bcSource
+type blockLink struct {
+	BlockID struct {
+		Hash string `json:"hash" bson:"hash"`
+	} `json:"block_id" bson:"block_id"`
+	Block struct {
+		Header struct {
+			LastBlockID struct {
+				Hash string `json:"hash" bson:"hash"`
+			} `json:"last_block_id" bson:"last_block_id"`
+		} `json:"header" bson:"header"`
+	} `json:"block" bson:"block"`
+}
+
+// link returns decoded hashes of block link
+func (b blockLink) link() link {
+	return link{hash: decodeHash(b.BlockID.Hash), last: decodeHash(b.Block.Header.LastBlockID.Hash)}
+}
+
+// check checks block at height h, given as raw json, against its neighbours, returning only errors recording mismatches
+func (c *continuity) check(ctx context.Context, h int, raw []byte) error {
+	var b blockLink
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return fmt.Errorf("error unmarshalling block at height %d: %v", h, err)
+	}
+	l := b.link()
+
+	c.mu.Lock()
+	c.links[h] = l
+	prev, hasPrev := c.links[h-1]
+	next, hasNext := c.links[h+1]
+	// only keep recent heights, as workers process heights roughly in order
+	delete(c.links, h-2*(maxReqWorkers+maxPerWorkers))
+	c.mu.Unlock()
+
+	if hasPrev && !bytes.Equal(prev.hash, l.last) {
+		if err := c.mismatch(ctx, h, l.last, prev.hash); err != nil {
+			return err
+		}
+	}
+	if hasNext && !bytes.Equal(l.hash, next.last) {
+		if err := c.mismatch(ctx, h+1, next.last, l.hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mismatch logs and records that block at height h references last block hash that doesn't match actual hash of previous block
+func (c *continuity) mismatch(ctx context.Context, h int, last, actual []byte) error {
+	stdLogger.Printf("warn: block hash continuity broken at height %d: last block id hash %X does not match hash %X of block at height %d", h, last, actual, h-1)
+	alert(ctx, "continuity", fmt.Sprintf("block hash continuity broken at height %d", h), map[string]string{"last_block_id_hash": fmt.Sprintf("%X", last), "previous_block_hash": fmt.Sprintf("%X", actual)})
+	doc, err := json.Marshal(map[string]interface{}{
+		"height":          h,
+		"last_block_hash": fmt.Sprintf("%X", last),
+		"prev_block_hash": fmt.Sprintf("%X", actual),
+	})
+	if err != nil {
+		return err
+	}
+	if err := upsert(ctx, c.col, h, doc, bson.M{"detected_at": time.Now().UTC()}); err != nil {
+		return fmt.Errorf("error recording block hash continuity mismatch at height %d: %v", h, err)
+	}
+	return nil
+}
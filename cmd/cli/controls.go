@@ -0,0 +1,100 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+// pauser pauses and resumes queuing of new heights
+type pauser struct {
+	mu      sync.Mutex
+	resumed chan struct{} // closed on resume; nil if not paused
+}
+
+// toggle pauses queuing if not paused, or resumes it otherwise, and returns true if paused
+func (p *pauser) toggle() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.resumed != nil {
+		close(p.resumed)
+		p.resumed = nil
+		return false
+	}
+	p.resumed = make(chan struct{})
+	return true
+}
+
+// paused returns true if queuing is paused
+func (p *pauser) paused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.resumed != nil
+}
+
+// wait blocks while queuing is paused, unless ctx cancelled
+func (p *pauser) wait(ctx context.Context) {
+	p.mu.Lock()
+	resumed := p.resumed
+	p.mu.Unlock()
+	if resumed == nil {
+		return
+	}
+	select {
+	case <-ctx.Done():
+	case <-resumed:
+	}
+}
+
+// runtimeControls handles runtime control signals, until ctx cancelled:
+// SIGUSR1 logs current stats (progress, queue depths, in-flight heights and errors), and SIGUSR2 pauses or resumes queuing of new heights (eg, for node maintenance)
+func runtimeControls(ctx context.Context, pz *pauser, pg *progress, ss *scrapeState, queues func() (int, int)) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR1, syscall.SIGUSR2)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-c:
+			if sig == syscall.SIGUSR2 {
+				if pz.toggle() {
+					stdLogger.Println("received SIGUSR2: queuing of new heights paused (in-flight heights will still be processed; signal again to resume)")
+				} else {
+					stdLogger.Println("received SIGUSR2: queuing of new heights resumed")
+				}
+				continue
+			}
+			s := pg.sample()
+			req, per := queues()
+			rp := ss.resume()
+			remaining := s.head - s.watermark
+			if remaining < 0 {
+				remaining = 0
+			}
+			stdLogger.Printf("received SIGUSR1: stats: height %d of %d (%d remaining), highest processed height %d, %d blocks and %d txs stored since start, paused: %t, stalled: %t",
+				s.watermark, s.head, remaining, rp.highest, s.blocks, s.txs, pz.paused(), atomic.LoadInt32(&stalled) == 1)
+			stdLogger.Printf("stats: requesters queue: %d, persisters queue: %d, in-flight (partially processed) heights: %v", req, per, rp.pending)
+			stdLogger.Printf("stats: errors since start, by class: %v", errStats.counts())
+		}
+	}
+}
@@ -18,74 +18,209 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
-	"time"
+	"net/url"
+	"strconv"
+	"strings"
 
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
 )
 
-// initDB connects to mongo database returning client and respective collections for blocks and transactions
-func initDB(ctx context.Context, dbHost, dbPort, dbUser, dbPass string, napTime time.Duration) (dbc *mongo.Client, bxs, txs *mongo.Collection) {
-	stdLogger.Printf("connecting to database at %s:%s as %s...", dbHost, dbPort, dbUser)
+// initDB connects to mongo database returning client and respective collections for blocks, transactions and block results
+func initDB(ctx context.Context, dbHost, dbPort, dbUser, dbPass string, rp retryPolicy) (dbc *mongo.Client, bxs, txs, brs *mongo.Collection) {
+	if dbURI != "" {
+		stdLogger.Printf("connecting to database at %s...", redactURI(dbURI))
+	} else {
+		stdLogger.Printf("connecting to database at %s:%s as %s...", dbHost, dbPort, dbUser)
+	}
 
-	dbc, err := dbClient(ctx, dbHost, dbPort, dbUser, dbPass, napTime)
+	dbc, err := dbClient(ctx, dbHost, dbPort, dbUser, dbPass, rp)
 	if err != nil {
 		stdLogger.Fatalf("failed connecting to database: %v", err)
 	}
 
-	bxs = dbc.Database(dbName).Collection("blocks")
-	txs = dbc.Database(dbName).Collection("transactions")
+	bxs = collection(dbc.Database(dbName), dbCollections["block"])
+	txs = collection(dbc.Database(dbName), dbCollections["transactions"])
+	brs = collection(dbc.Database(dbName), dbCollections["block_results"])
+
+	return dbc, bxs, txs, brs
+}
 
-	return dbc, bxs, txs
+// checkReplicaSet returns error if connected mongo database does not support multi-document transactions (ie, is not replica set or sharded cluster)
+func checkReplicaSet(ctx context.Context, dbc *mongo.Client) error {
+	var res struct {
+		SetName string `bson:"setName"`
+		Msg     string `bson:"msg"`
+	}
+	if err := dbc.Database("admin").RunCommand(ctx, bson.D{{Key: "isMaster", Value: 1}}).Decode(&res); err != nil {
+		return fmt.Errorf("error checking database deployment: %v", err)
+	}
+	if res.SetName == "" && res.Msg != "isdbgrid" {
+		return fmt.Errorf("database transactions require replica set or sharded cluster")
+	}
+	return nil
+}
+
+// collection returns collection name in db, prefixed with configured collection prefix
+func collection(db *mongo.Database, name string) *mongo.Collection {
+	return db.Collection(dbPrefix + name)
 }
 
 // dbClient returns mongo database client after successfully connecting to it
-// it will retry indefinitely on connection error, pausing for napTime between retries, unless ctx cancelled
-func dbClient(ctx context.Context, dbHost, dbPort, dbUser, dbPass string, napTime time.Duration) (mc *mongo.Client, err error) {
+// it will retry on connection error as per retry policy, unless ctx cancelled
+func dbClient(ctx context.Context, dbHost, dbPort, dbUser, dbPass string, rp retryPolicy) (mc *mongo.Client, err error) {
 	uri := fmt.Sprintf("mongodb://%s:%s@%s:%s", dbUser, dbPass, dbHost, dbPort)
-	for {
-		if mc, err = mongo.Connect(ctx, options.Client().ApplyURI(uri)); err != nil {
-			stdLogger.Printf("error connecting to database (will retry in %s): %v", napTime, err)
-		} else if err = mc.Ping(ctx, readpref.Primary()); err != nil {
-			stdLogger.Printf("error pinging database (will retry in %s): %v", napTime, err)
-		} else {
-			break
+	if strings.HasPrefix(dbHost, "/") {
+		// unix domain socket path, percent-encoded, without port
+		uri = fmt.Sprintf("mongodb://%s:%s@%s", dbUser, dbPass, url.QueryEscape(dbHost))
+	}
+	if dbURI != "" {
+		// complete connection string (eg, srv, replica set, tls and auth options) takes precedence
+		uri = dbURI
+	}
+	for n := 1; ; n++ {
+		if mc, err = mongo.Connect(ctx, dbClientOptions(uri)); err == nil {
+			if err = mc.Ping(ctx, readpref.Primary()); err == nil {
+				break
+			}
+			err = fmt.Errorf("error pinging database: %v", err)
 		}
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-time.After(napTime):
-			continue
+		dbOutage.failed(err)
+		d, rerr := rp.retry(n)
+		if rerr != nil {
+			return nil, fmt.Errorf("%v: %v", rerr, err)
+		}
+		stdLogger.Printf("error connecting to database (will retry in %s): %v", d, err)
+		if err := wait(ctx, d); err != nil {
+			return nil, err
 		}
 	}
+	dbOutage.recovered()
 	return mc, nil
 }
 
-// store stores raw bytes as a single generalised mongo db doc returning InsertedID or any error occurred
-// it will retry indefinitely on database insert error, pausing for napTime between retries, unless ctx cancelled or due to unmarshalling errors
-func store(ctx context.Context, raw []byte, db *mongo.Collection) (interface{}, error) {
-	var doc interface{}
-	if err := json.Unmarshal(raw, &doc); err != nil {
-		return nil, fmt.Errorf("error unmarshalling %v: %v", raw, err)
+// dbClientOptions returns mongo client options for connection string uri, overridden with any configured client options
+func dbClientOptions(uri string) *options.ClientOptions {
+	opts := options.Client().ApplyURI(uri)
+	if dbWriteConcern != "" || dbJournal != "" {
+		var wco []writeconcern.Option
+		if dbWriteConcern == "majority" {
+			wco = append(wco, writeconcern.WMajority())
+		} else if w, err := strconv.Atoi(dbWriteConcern); err == nil {
+			wco = append(wco, writeconcern.W(w))
+		} else if dbWriteConcern != "" {
+			wco = append(wco, writeconcern.WTagSet(dbWriteConcern))
+		}
+		if j, err := strconv.ParseBool(dbJournal); err == nil {
+			wco = append(wco, writeconcern.J(j))
+		}
+		if opts.WriteConcern != nil {
+			opts.SetWriteConcern(opts.WriteConcern.WithOptions(wco...))
+		} else {
+			opts.SetWriteConcern(writeconcern.New(wco...))
+		}
+	}
+	if dbReadPreference != "" {
+		// note: mode is validated in config
+		mode, _ := readpref.ModeFromString(dbReadPreference)
+		rp, _ := readpref.New(mode)
+		opts.SetReadPreference(rp)
+	}
+	if dbMaxPoolSize > 0 {
+		opts.SetMaxPoolSize(uint64(dbMaxPoolSize))
+	}
+	if dbConnectTimeout > 0 {
+		opts.SetConnectTimeout(dbConnectTimeout)
+	}
+	if dbSocketTimeout > 0 {
+		opts.SetSocketTimeout(dbSocketTimeout)
 	}
+	return opts
+}
+
+// redactURI returns connection string uri with password removed, for logging
+func redactURI(uri string) string {
+	i := strings.Index(uri, "://")
+	if i < 0 {
+		return uri
+	}
+	rest := uri[i+3:]
+	at := strings.LastIndex(rest[:strings.IndexAny(rest+"/", "/?")], "@")
+	if at < 0 {
+		return uri
+	}
+	if c := strings.Index(rest[:at], ":"); c >= 0 {
+		return uri[:i+3] + rest[:c] + ":xxxxx" + rest[at:]
+	}
+	return uri
+}
 
-	var res *mongo.InsertOneResult
-	var err error
-	for {
-		if res, err = db.InsertOne(context.Background(), doc); err == nil {
-			break
+// updateWithRetry applies update to doc with _id in collection col, inserting it if not existing
+// it will retry on database error as per db retry policy, unless ctx cancelled
+func updateWithRetry(ctx context.Context, col *mongo.Collection, id interface{}, update bson.M) error {
+	for n := 1; ; n++ {
+		_, err := col.UpdateOne(context.Background(), bson.M{"_id": id}, update, options.Update().SetUpsert(true))
+		if err == nil {
+			dbOutage.recovered()
+			return nil
 		}
-		stdLogger.Printf("error inserting into database (will retry in %s): %v", napTime, err)
-		select {
-		case <-ctx.Done():
-			return nil, ctx.Err()
-		case <-time.After(napTime):
-			continue
+		dbOutage.failed(err)
+		d, rerr := dbRetry.retry(n)
+		if rerr != nil {
+			return fmt.Errorf("error updating database: %v: %v", rerr, err)
 		}
+		stdLogger.Printf("error updating database (will retry in %s): %v", d, err)
+		if err := wait(ctx, d); err != nil {
+			return err
+		}
+	}
+}
 
+// touch updates (or inserts, if not existing) doc with _id in collection col, setting fields in once only when inserting and fields in always every time
+// it will retry on database error as per db retry policy, unless ctx cancelled
+func touch(ctx context.Context, col *mongo.Collection, id interface{}, once, always bson.M) error {
+	update := bson.M{"$setOnInsert": once}
+	if len(always) > 0 {
+		update["$set"] = always
+	}
+	return updateWithRetry(ctx, col, id, update)
+}
+
+// upsert replaces (or inserts, if not existing) doc with _id in collection col with raw json, extended with any extra fields
+// it will retry on database error as per db retry policy, unless ctx cancelled or due to unmarshalling errors
+func upsert(ctx context.Context, col *mongo.Collection, id interface{}, raw []byte, extra bson.M) error {
+	var doc interface{}
+	jdoc, err := jsonDoc(id, raw, extra)
+	if err != nil {
+		return err
+	}
+	doc = jdoc
+	if oversized(doc, raw) {
+		stub, err := storeLarge(col, id, raw)
+		if err != nil {
+			return err
+		}
+		doc = stub
+	}
+
+	for n := 1; ; n++ {
+		_, err := col.ReplaceOne(context.Background(), bson.M{"_id": id}, doc, options.Replace().SetUpsert(true))
+		if err == nil {
+			dbOutage.recovered()
+			return nil
+		}
+		dbOutage.failed(err)
+		d, rerr := dbRetry.retry(n)
+		if rerr != nil {
+			return fmt.Errorf("error upserting into database: %v: %v", rerr, err)
+		}
+		stdLogger.Printf("error upserting into database (will retry in %s): %v", d, err)
+		if err := wait(ctx, d); err != nil {
+			return err
+		}
 	}
-	return res.InsertedID, nil
 }
@@ -0,0 +1,299 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// deadLetter is raw data that failed to be stored, with error context
+type deadLetter struct {
+	ID       string    `json:"id" bson:"_id"` // "<datatype>/<height>"
+	Datatype string    `json:"datatype" bson:"datatype"`
+	Height   int       `json:"height" bson:"height"`
+	Raw      []byte    `json:"raw" bson:"raw,omitempty"`
+	Error    string    `json:"error" bson:"error"`
+	FailedAt time.Time `json:"failed_at" bson:"failed_at"`
+}
+
+// deadLetters keeps data that failed to be stored (eg, malformed payloads), so scraping could continue and failed data could be reprocessed later
+// dead letters are kept either in json lines file at path, if set, or in dead_letters collection (with oversized raw data in gridfs, see storeLarge)
+type deadLetters struct {
+	col  *mongo.Collection
+	path string
+	mu   sync.Mutex // serialises file access
+}
+
+// newDeadLetters returns dead letters kept in file at path, if set, or in db
+func newDeadLetters(db *mongo.Database, path string) *deadLetters {
+	if path != "" {
+		return &deadLetters{path: path}
+	}
+	return &deadLetters{col: collection(db, "dead_letters")}
+}
+
+// openDeadLetters returns dead letters kept in json lines file, if set, or in dbc's database (nil if dead letters are disabled or not using mongo database)
+func openDeadLetters(dbc *mongo.Client) *deadLetters {
+	if deadLetterFile != "" {
+		return newDeadLetters(nil, deadLetterFile)
+	}
+	if deadLetterQueue && dbc != nil {
+		return newDeadLetters(dbc.Database(dbName), "")
+	}
+	return nil
+}
+
+// put keeps raw datatype at height that failed to be stored with err, replacing any existing dead letter for the same datatype and height
+func (d *deadLetters) put(ctx context.Context, p persist, err error) error {
+	dl := deadLetter{
+		ID:       fmt.Sprintf("%s/%d", p.datatype, p.height),
+		Datatype: p.datatype,
+		Height:   p.height,
+		Raw:      p.raw,
+		Error:    err.Error(),
+		FailedAt: time.Now().UTC(),
+	}
+	if d.path != "" {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return appendDeadLetters(d.path, dl)
+	}
+
+	gridfsName := ""
+	if len(dl.Raw) > maxDocSize/2 {
+		stub, err := storeLarge(d.col, dl.ID, dl.Raw)
+		if err != nil {
+			return err
+		}
+		dl.Raw, gridfsName = nil, stub["cs_gridfs"].(string)
+	}
+	doc, err := bson.Marshal(dl)
+	if err != nil {
+		return fmt.Errorf("error marshalling dead letter %s: %v", dl.ID, err)
+	}
+	var m bson.M
+	if err := bson.Unmarshal(doc, &m); err != nil {
+		return fmt.Errorf("error unmarshalling dead letter %s: %v", dl.ID, err)
+	}
+	if gridfsName != "" {
+		m["cs_gridfs"] = gridfsName
+	}
+	if _, err := d.col.ReplaceOne(ctx, bson.M{"_id": dl.ID}, m, options.Replace().SetUpsert(true)); err != nil {
+		return fmt.Errorf("error storing dead letter %s: %v", dl.ID, err)
+	}
+	return nil
+}
+
+// all returns all dead letters, with their raw data
+func (d *deadLetters) all(ctx context.Context) ([]deadLetter, error) {
+	if d.path != "" {
+		return readDeadLetters(d.path)
+	}
+	cur, err := d.col.Find(ctx, bson.M{}, options.Find().SetSort(bson.M{"height": 1}))
+	if err != nil {
+		return nil, fmt.Errorf("error finding dead letters: %v", err)
+	}
+	defer cur.Close(ctx)
+	var dls []deadLetter
+	for cur.Next(ctx) {
+		var dl deadLetter
+		if err := cur.Decode(&dl); err != nil {
+			return nil, fmt.Errorf("error decoding dead letter: %v", err)
+		}
+		if name, ok := cur.Current.Lookup("cs_gridfs").StringValueOK(); ok {
+			if dl.Raw, err = loadLarge(d.col, name); err != nil {
+				return nil, err
+			}
+		}
+		dls = append(dls, dl)
+	}
+	return dls, cur.Err()
+}
+
+// remove removes dead letters with ids
+func (d *deadLetters) remove(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	if d.path != "" {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		dls, err := readDeadLetters(d.path)
+		if err != nil {
+			return err
+		}
+		drop := map[string]bool{}
+		for _, id := range ids {
+			drop[id] = true
+		}
+		var keep []deadLetter
+		for _, dl := range dls {
+			if !drop[dl.ID] {
+				keep = append(keep, dl)
+			}
+		}
+		// rewrite file with remaining dead letters only
+		tmp := d.path + ".tmp"
+		if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := appendDeadLetters(tmp, keep...); err != nil {
+			return err
+		}
+		return os.Rename(tmp, d.path)
+	}
+	if _, err := d.col.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}}); err != nil {
+		return fmt.Errorf("error removing dead letters: %v", err)
+	}
+	return nil
+}
+
+// appendDeadLetters appends dead letters to json lines file at path, creating it if not existing
+func appendDeadLetters(path string, dls ...deadLetter) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening dead letters file %s: %v", path, err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for _, dl := range dls {
+		line, err := json.Marshal(dl)
+		if err != nil {
+			return fmt.Errorf("error marshalling dead letter %s: %v", dl.ID, err)
+		}
+		w.Write(line)
+		w.WriteByte('\n')
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("error writing dead letters file %s: %v", path, err)
+	}
+	return f.Sync()
+}
+
+// readDeadLetters returns dead letters from json lines file at path (none if not existing)
+// later dead letters for the same datatype and height replace earlier ones
+func readDeadLetters(path string) ([]deadLetter, error) {
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading dead letters file %s: %v", path, err)
+	}
+	var dls []deadLetter
+	index := map[string]int{}
+	for n, line := range bytes.Split(content, []byte{'\n'}) {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var dl deadLetter
+		if err := json.Unmarshal(line, &dl); err != nil {
+			return nil, fmt.Errorf("error parsing dead letters file %s at line %d: %v", path, n+1, err)
+		}
+		if i, ok := index[dl.ID]; ok {
+			dls[i] = dl
+			continue
+		}
+		index[dl.ID] = len(dls)
+		dls = append(dls, dl)
+	}
+	return dls, nil
+}
+
+// manageDeadLetters lists dead letters or retries storing them (removing those stored successfully), as per action
+func manageDeadLetters(ctx context.Context, action string) error {
+	var db *mongo.Database
+	var st storage = nopStorage{}
+	switch {
+	case dbType == "mongo":
+		dbc, bxs, txs, brs := initDB(ctx, dbHost, dbPort, dbUser, dbPass, dbRetry)
+		db = dbc.Database(dbName)
+		st = newMongoStorage(ctx, dbc, bxs, txs, brs, dbBatchSize, dbBatchWait)
+	case deadLetterFile == "":
+		return fmt.Errorf("dead letters require mongo database or cs_dead_letter_file")
+	case action == "retry" && dbType == "bolt":
+		bs, err := openBolt(dbPath)
+		if err != nil {
+			return err
+		}
+		st = bs
+	}
+	if action == "retry" {
+		// note: sink failures stop retrying (without dlq), so dead letters are kept
+		sinks, err := initSinks(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("error initialising sinks: %v", err)
+		}
+		if len(sinks) > 0 {
+			st = &sinkStorage{storage: st, sinks: sinks}
+		}
+	}
+	defer st.close(context.Background())
+	dlq := newDeadLetters(db, deadLetterFile)
+
+	dls, err := dlq.all(ctx)
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "list":
+		for _, dl := range dls {
+			fmt.Printf("%s\t%s\t%d bytes\t%s\n", dl.ID, dl.FailedAt.Format(time.RFC3339), len(dl.Raw), dl.Error)
+		}
+		return nil
+	case "retry":
+		var stored []string
+	retry:
+		for _, dl := range dls {
+			var err error
+			switch dl.Datatype {
+			case "block":
+				_, err = st.storeBlock(ctx, dl.Height, dl.Raw)
+			case "transactions":
+				_, err = st.storeTxs(ctx, dl.Height, dl.Raw)
+			case "block_results":
+				_, err = st.storeBlockResults(ctx, dl.Height, dl.Raw)
+			default:
+				err = fmt.Errorf("unknown datatype %q", dl.Datatype)
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					break retry
+				}
+				stdLogger.Printf("error storing dead letter %s (keeping it): %v", dl.ID, err)
+				continue
+			}
+			stdLogger.Printf("stored dead letter %s", dl.ID)
+			stored = append(stored, dl.ID)
+		}
+		stdLogger.Printf("stored %d of %d dead letters", len(stored), len(dls))
+		return dlq.remove(ctx, stored)
+	default:
+		return fmt.Errorf("unknown action %q: expected 'list' or 'retry'", action)
+	}
+}
@@ -0,0 +1,213 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// doctorScan is max number of recent blocks to scan for one with transactions, to check node's tx indexer
+const doctorScan = 50
+
+// doctor checks blockchain node and database connectivity and compatibility with current config, and writes findings, with hints for the failed ones, to w
+// it's a pre-flight check before starting (large) scrape, so each check is tried once, and error is returned if any failed
+func doctor(ctx context.Context, w io.Writer) error {
+	failed := 0
+	report := func(level, check, msg, hint string) {
+		fmt.Fprintf(w, "%-5s %s: %s\n", level, check, msg)
+		if hint != "" {
+			fmt.Fprintf(w, "      -> %s\n", hint)
+		}
+		if level == "fail" {
+			failed++
+		}
+	}
+	once := retryPolicy{min: time.Second, max: time.Second, factor: 1, attempts: 1}
+
+	doctorNode(ctx, report, once)
+	if dbType == "mongo" {
+		doctorDB(ctx, report, once)
+	} else {
+		report("ok", "database", fmt.Sprintf("%s (not checked)", dbType), "")
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+	return nil
+}
+
+// doctorNode checks blockchain node reachability, sync status, api compatibility, available history, tx indexer and block results
+func doctorNode(ctx context.Context, report func(level, check, msg, hint string), rp retryPolicy) {
+	node := fmt.Sprintf("%s:%s using %s", bcNode, bcPort, bcProtocol)
+	bcc, err := newBCSource(ctx, bcProtocol, bcNode, bcPort)
+	if err != nil {
+		report("fail", "node", err.Error(), "check cs_bc_protocol (rest, grpc or rpc), cs_bc_node and cs_bc_port")
+		return
+	}
+	start := time.Now()
+	head, err := bcHeight(ctx, bcc, rp)
+	if err != nil {
+		report("fail", "node", fmt.Sprintf("%s is not reachable: %v", node, err), "check node address and port, and that its api is enabled (eg, 'enable = true' in [api] or [grpc] section of app.toml), or cs_bc_block_path for non-standard api")
+		return
+	}
+	report("ok", "node", fmt.Sprintf("%s is reachable: latest height is %d (in %s)", node, head, time.Since(start).Round(time.Millisecond)), "")
+
+	if s, err := syncing(bcc, bcProtocol); err != nil {
+		report("warn", "sync", fmt.Sprintf("cannot determine node sync status: %v", err), "set cs_bc_sync_check=off to skip the check")
+	} else if s {
+		report("warn", "sync", "node is still catching up with the network", "its latest height and responses might be stale or incomplete: wait for it to catch up (cs_bc_sync_check=pause does that)")
+	} else {
+		report("ok", "sync", "node is synced", "")
+	}
+
+	if bcProtocol != "rpc" {
+		param, version, err := detectTxsParam(ctx, bcc, rp)
+		switch {
+		case err != nil:
+			report("warn", "api", fmt.Sprintf("cannot detect cosmos sdk version: %v", err), "set cs_bc_txs_param ('query' for sdk v0.50+, 'events' otherwise)")
+		case bcTxsParam != "" && bcTxsParam != param:
+			report("warn", "api", fmt.Sprintf("cosmos sdk version %q expects %q txs query parameter, but cs_bc_txs_param is %q", version, param, bcTxsParam), "unset cs_bc_txs_param to detect it automatically")
+		default:
+			report("ok", "api", fmt.Sprintf("cosmos sdk version %q: using %q txs query parameter", version, param), "")
+			bcTxsParam = param
+		}
+	}
+
+	from := logCheckpoint + 1
+	if startHeight > 0 {
+		from = startHeight
+	}
+	if from <= head {
+		if _, err := bcc.block(fmt.Sprint(from)); err != nil {
+			if m := lowestRe.FindStringSubmatch(err.Error()); m != nil {
+				report("warn", "history", fmt.Sprintf("node is pruned: lowest available height is %s, while scraping would start from %d", m[1], from), "heights below it would be skipped: use archive node, or set cs_log_checkpoint to scrape only available history")
+			} else {
+				report("warn", "history", fmt.Sprintf("cannot get block at starting height %d: %v", from, err), "")
+			}
+		} else {
+			report("ok", "history", fmt.Sprintf("block at starting height %d is available", from), "")
+		}
+	}
+
+	// latest blocks might not be indexed yet, so start below head
+	found := false
+	for h := head - 5; h > 0 && h > head-5-doctorScan; h-- {
+		blk, err := bcc.block(fmt.Sprint(h))
+		if err != nil {
+			break
+		}
+		n := numTxs(blk)
+		if n == 0 {
+			continue
+		}
+		found = true
+		t, err := transactionsAt(ctx, bcc, fmt.Sprint(h), rp)
+		switch {
+		case err != nil:
+			report("fail", "tx indexer", fmt.Sprintf("cannot get transactions at height %d: %v", h, err), "check cs_bc_txs_path and cs_bc_txs_param")
+		case t == nil:
+			report("fail", "tx indexer", fmt.Sprintf("no transactions found at height %d, although block has %d", h, n), "enable node's tx indexer ('indexer = \"kv\"' in [tx_index] section of config.toml)")
+		default:
+			report("ok", "tx indexer", fmt.Sprintf("found transactions at height %d", h), "")
+		}
+		break
+	}
+	if !found {
+		report("warn", "tx indexer", fmt.Sprintf("no transactions in last %d blocks to check it", doctorScan), "")
+	}
+
+	if blockResults {
+		rsc, err := rpcSource(ctx, bcc, bcProtocol, bcNode, "block results")
+		if err == nil {
+			_, err = rsc.blockResults(fmt.Sprint(head - 1))
+		}
+		if err != nil {
+			report("fail", "block results", fmt.Sprintf("cannot get block results at height %d: %v", head-1, err), "check that node's tendermint rpc is reachable on cs_bc_rpc_port")
+		} else {
+			report("ok", "block results", "tendermint rpc is reachable", "")
+		}
+	}
+}
+
+// doctorDB checks mongo database connectivity, authentication, write permissions, deployment and recommended indexes
+func doctorDB(ctx context.Context, report func(level, check, msg, hint string), rp retryPolicy) {
+	dbc, err := dbClient(ctx, dbHost, dbPort, dbUser, dbPass, rp)
+	if err != nil {
+		report("fail", "database", fmt.Sprintf("cannot connect: %v", err), "check cs_db_host, cs_db_port, cs_db_user and cs_db_pass, or cs_db_uri (including authSource), and that database is reachable")
+		return
+	}
+	defer dbc.Disconnect(context.Background())
+	report("ok", "database", "connected and authenticated", "")
+
+	db := dbc.Database(dbName)
+	col := collection(db, "status")
+	id := "doctor:" + instanceID()
+	if _, err := col.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"updated_at": time.Now().UTC()}}, options.Update().SetUpsert(true)); err != nil {
+		report("fail", "database", fmt.Sprintf("cannot write to %s database: %v", dbName, err), fmt.Sprintf("grant user %q readWrite role on %s database", dbUser, dbName))
+		return
+	}
+	if _, err := col.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+		report("warn", "database", fmt.Sprintf("cannot remove test doc %q from %s collection: %v", id, col.Name(), err), "")
+	}
+	report("ok", "database", fmt.Sprintf("can write to %s database", dbName), "")
+
+	if dbAtomic || leaderElection {
+		if err := checkReplicaSet(ctx, dbc); err != nil {
+			report("fail", "database", err.Error(), "use replica set (even single-node one), or disable cs_db_atomic and cs_leader_election")
+		} else {
+			report("ok", "database", "replica set or sharded cluster", "")
+		}
+	}
+
+	missing := 0
+	for name, models := range recommendedIndexes() {
+		cur, err := collection(db, name).Indexes().List(ctx)
+		if err != nil {
+			report("warn", "indexes", fmt.Sprintf("cannot list indexes on %s collection: %v", name, err), "")
+			return
+		}
+		var specs []bson.M
+		if err := cur.All(ctx, &specs); err != nil {
+			report("warn", "indexes", fmt.Sprintf("cannot read indexes on %s collection: %v", name, err), "")
+			return
+		}
+		existing := map[interface{}]bool{}
+		for _, s := range specs {
+			existing[s["name"]] = true
+		}
+		for _, m := range models {
+			if !existing[*m.Options.Name] {
+				missing++
+			}
+		}
+	}
+	switch {
+	case missing == 0:
+		report("ok", "indexes", "recommended indexes exist", "")
+	case dbIndexes:
+		report("ok", "indexes", fmt.Sprintf("%d recommended indexes are missing: they will be created on start", missing), "")
+	default:
+		report("warn", "indexes", fmt.Sprintf("%d recommended indexes are missing", missing), "create them with 'cli indexes create', or set cs_db_indexes=true")
+	}
+}
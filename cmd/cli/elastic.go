@@ -0,0 +1,226 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// elasticTemplate is index template for transactions, with messages and event attributes indexed as full text
+// note: messages are indexed as json text, rather than objects, to avoid mapping explosion from arbitrary message types
+var elasticTemplate = `{
+	"index_patterns": [%q],
+	"template": {
+		"mappings": {
+			"dynamic": false,
+			"properties": {
+				"height": {"type": "long"},
+				"timestamp": {"type": "date"},
+				"txhash": {"type": "keyword"},
+				"code": {"type": "integer"},
+				"signer": {"type": "keyword"},
+				"msg_types": {"type": "keyword"},
+				"memo": {"type": "text"},
+				"messages": {"type": "text"},
+				"events": {"type": "text", "fields": {"keyword": {"type": "keyword", "ignore_above": 512}}}
+			}
+		}
+	}
+}`
+
+// elasticSink indexes transactions into elasticsearch (or opensearch) index for full-text search, in bulk batches (see rangeBatcher)
+// transactions are indexed by their hash, so re-scraped heights don't create duplicates
+type elasticSink struct {
+	*rangeBatcher
+	url      string
+	index    string
+	user     string
+	password string
+	client   *http.Client
+}
+
+// newElasticSink returns elasticsearch sink for url (eg, "http://localhost:9200") and index, creating (or updating) its index template
+func newElasticSink(ctx context.Context, url, index, user, password string, size int, flush time.Duration) (*elasticSink, error) {
+	stdLogger.Printf("connecting to elasticsearch at %s...", url)
+	s := &elasticSink{
+		url:      strings.TrimSuffix(url, "/"),
+		index:    index,
+		user:     user,
+		password: password,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+	}
+	// ref: https://www.elastic.co/guide/en/elasticsearch/reference/current/index-templates.html
+	if _, err := s.request(ctx, http.MethodPut, "/_index_template/"+index, "application/json", strings.NewReader(fmt.Sprintf(elasticTemplate, index+"*"))); err != nil {
+		return nil, fmt.Errorf("error creating index template %s: %v", index, err)
+	}
+	s.rangeBatcher = newRangeBatcher("elasticsearch", size, flush, s.bulk)
+	return s, nil
+}
+
+// publish adds raw transactions at height to their batch, indexing the batch if complete
+func (s *elasticSink) publish(ctx context.Context, datatype string, height int, raw []byte) error {
+	if datatype != "transactions" {
+		return nil
+	}
+	return s.add(ctx, datatype, height, raw)
+}
+
+// bulk indexes transactions in batch b using bulk api
+// ref: https://www.elastic.co/guide/en/elasticsearch/reference/current/docs-bulk.html
+func (s *elasticSink) bulk(ctx context.Context, b *heightBatch) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	n := 0
+	for _, h := range b.heights() {
+		txs, err := txRows(h, b.items[h])
+		if err != nil {
+			return err
+		}
+		for _, row := range txs {
+			r := row.(parquetTx)
+			doc, err := elasticDoc(r)
+			if err != nil {
+				return err
+			}
+			if err := enc.Encode(map[string]interface{}{"index": map[string]string{"_index": s.index, "_id": r.TxHash}}); err != nil {
+				return err
+			}
+			if err := enc.Encode(doc); err != nil {
+				return err
+			}
+			n++
+		}
+	}
+	if n == 0 {
+		return nil
+	}
+
+	res, err := s.request(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", &body)
+	if err != nil {
+		return fmt.Errorf("error indexing transactions [%d..%d]: %v", b.from, b.to, err)
+	}
+	var r struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			ID    string          `json:"_id"`
+			Error json.RawMessage `json:"error"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(res, &r); err != nil {
+		return fmt.Errorf("error unmarshalling bulk response: %v", err)
+	}
+	if r.Errors {
+		for _, item := range r.Items {
+			for _, i := range item {
+				if len(i.Error) > 0 && string(i.Error) != "null" {
+					return fmt.Errorf("error indexing transaction %s: %s", i.ID, string(i.Error))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// elasticDoc returns index document of transaction r
+func elasticDoc(r parquetTx) (map[string]interface{}, error) {
+	var tx struct {
+		Tx struct {
+			Body struct {
+				Messages json.RawMessage `json:"messages"`
+			} `json:"body"`
+		} `json:"tx"`
+		Events   []abciEvent `json:"events"`
+		TxResult struct {
+			Events []abciEvent `json:"events"`
+		} `json:"tx_result"` // rpc
+	}
+	// note: rpc tx is base64-encoded string, so messages are not available
+	if err := json.Unmarshal([]byte(r.Raw), &tx); err != nil {
+		tx.Tx.Body.Messages = nil
+		var rpcTx struct {
+			TxResult struct {
+				Events []abciEvent `json:"events"`
+			} `json:"tx_result"`
+		}
+		if err := json.Unmarshal([]byte(r.Raw), &rpcTx); err != nil {
+			return nil, fmt.Errorf("error unmarshalling transaction %s: %v", r.TxHash, err)
+		}
+		tx.Events = rpcTx.TxResult.Events
+	}
+	if len(tx.Events) == 0 {
+		tx.Events = tx.TxResult.Events
+	}
+	var events []string
+	for _, e := range tx.Events {
+		for k, v := range e.attributes() {
+			events = append(events, e.Type+"."+k+"="+v)
+		}
+	}
+	var types []string
+	if r.MsgTypes != "" {
+		types = strings.Split(r.MsgTypes, ",")
+	}
+	doc := map[string]interface{}{
+		"height":    r.Height,
+		"txhash":    r.TxHash,
+		"code":      r.Code,
+		"signer":    r.Signer,
+		"msg_types": types,
+		"memo":      r.Memo,
+		"messages":  string(tx.Tx.Body.Messages),
+		"events":    events,
+	}
+	if r.Timestamp != "" {
+		doc["timestamp"] = r.Timestamp
+	}
+	return doc, nil
+}
+
+// request makes http request to path with body and returns response body
+func (s *elasticSink) request(ctx context.Context, method, path, contentType string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, s.url+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if s.user != "" {
+		req.SetBasicAuth(s.user, s.password)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	res, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(res) > 1024 {
+			res = res[:1024]
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, string(res))
+	}
+	return res, nil
+}
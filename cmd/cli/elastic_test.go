@@ -0,0 +1,183 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// elasticServer starts elasticsearch mock, returning created index templates, bulk requests (as action and document pairs), and function to set transaction hash failing to index
+func elasticServer(t *testing.T) (url string, state func() (templates map[string]json.RawMessage, bulks [][][2]map[string]interface{}), reject func(txhash string)) {
+	var mu sync.Mutex
+	templates := map[string]json.RawMessage{}
+	var bulks [][][2]map[string]interface{}
+	rejected := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "elastic" || pass != "changeme" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": {"type": "security_exception", "reason": "missing authentication credentials"}, "status": 401}`))
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/_index_template/"):
+			var tmpl json.RawMessage
+			if err := json.NewDecoder(r.Body).Decode(&tmpl); err != nil || r.Header.Get("Content-Type") != "application/json" {
+				http.Error(w, `{"error": {"type": "parse_exception"}, "status": 400}`, http.StatusBadRequest)
+				return
+			}
+			templates[strings.TrimPrefix(r.URL.Path, "/_index_template/")] = tmpl
+			w.Write([]byte(`{"acknowledged": true}`))
+		case r.Method == http.MethodPost && r.URL.Path == "/_bulk" && r.Header.Get("Content-Type") == "application/x-ndjson":
+			var bulk [][2]map[string]interface{}
+			var items []string
+			failed := false
+			sc := bufio.NewScanner(r.Body)
+			for sc.Scan() {
+				var pair [2]map[string]interface{}
+				if err := json.Unmarshal(sc.Bytes(), &pair[0]); err != nil || !sc.Scan() || json.Unmarshal(sc.Bytes(), &pair[1]) != nil {
+					http.Error(w, `{"error": {"type": "illegal_argument_exception"}, "status": 400}`, http.StatusBadRequest)
+					return
+				}
+				bulk = append(bulk, pair)
+				id := pair[0]["index"].(map[string]interface{})["_id"].(string)
+				if id == rejected {
+					failed = true
+					items = append(items, fmt.Sprintf(`{"index": {"_id": %q, "status": 400, "error": {"type": "mapper_parsing_exception"}}}`, id))
+					continue
+				}
+				items = append(items, fmt.Sprintf(`{"index": {"_id": %q, "status": 201, "result": "created"}}`, id))
+			}
+			bulks = append(bulks, bulk)
+			fmt.Fprintf(w, `{"took": 1, "errors": %v, "items": [%s]}`, failed, strings.Join(items, ","))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func() (map[string]json.RawMessage, [][][2]map[string]interface{}) {
+			mu.Lock()
+			defer mu.Unlock()
+			return templates, append([][][2]map[string]interface{}(nil), bulks...)
+		}, func(txhash string) {
+			mu.Lock()
+			defer mu.Unlock()
+			rejected = txhash
+		}
+}
+
+func TestElasticSink(t *testing.T) {
+	url, state, reject := elasticServer(t)
+	ctx := context.Background()
+
+	if _, err := newElasticSink(ctx, url, "cosmos-txs", "", "", 2, time.Hour); err == nil {
+		t.Fatal("expected error for missing credentials")
+	}
+	s, err := newElasticSink(ctx, url+"/", "cosmos-txs", "elastic", "changeme", 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	templates, _ := state()
+	var tmpl struct {
+		IndexPatterns []string `json:"index_patterns"`
+	}
+	if err := json.Unmarshal(templates["cosmos-txs"], &tmpl); err != nil || !reflect.DeepEqual(tmpl.IndexPatterns, []string{"cosmos-txs*"}) {
+		t.Errorf("got index template %s (%v), want one for cosmos-txs* indices", templates["cosmos-txs"], err)
+	}
+
+	// only transactions are indexed, once their height range [4..5] batch is complete
+	if err := s.publish(ctx, "block", 4, testBlock(4)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.publish(ctx, "transactions", 4, []byte(testTxs)); err != nil {
+		t.Fatal(err)
+	}
+	if _, bulks := state(); len(bulks) != 0 {
+		t.Fatalf("got bulk requests %v before batch was complete", bulks)
+	}
+	if err := s.publish(ctx, "transactions", 5, []byte(`{"tx_responses": []}`)); err != nil {
+		t.Fatal(err)
+	}
+	_, bulks := state()
+	if len(bulks) != 1 || len(bulks[0]) != 2 {
+		t.Fatalf("got bulk requests %v, want single request indexing 2 transactions", bulks)
+	}
+	for i, id := range []string{"AB12", "CD34"} {
+		want := map[string]interface{}{"index": map[string]interface{}{"_index": "cosmos-txs", "_id": id}}
+		if action := bulks[0][i][0]; !reflect.DeepEqual(action, want) {
+			t.Errorf("got action %v, want %v", action, want)
+		}
+	}
+
+	doc := bulks[0][0][1]
+	var messages []map[string]string
+	if err := json.Unmarshal([]byte(doc["messages"].(string)), &messages); err != nil || len(messages) != 2 || messages[1]["@type"] != "/cosmos.gov.v1beta1.MsgVote" {
+		t.Errorf("got messages %v (%v), want messages json text", doc["messages"], err)
+	}
+	delete(doc, "messages")
+	sortEvents := func(doc map[string]interface{}) {
+		if events, ok := doc["events"].([]interface{}); ok {
+			sort.Slice(events, func(i, j int) bool { return events[i].(string) < events[j].(string) })
+		}
+	}
+	sortEvents(doc)
+	want := map[string]interface{}{"height": 4.0, "txhash": "AB12", "code": 0.0, "signer": "cosmos1x", "msg_types": []interface{}{"/cosmos.bank.v1beta1.MsgSend", "/cosmos.gov.v1beta1.MsgVote"}, "memo": "hi", "events": []interface{}{"message.action=send", "message.sender=cosmos1x"}, "timestamp": "2022-01-01T00:00:04Z"}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("got document %v, want %v", doc, want)
+	}
+	// rpc transaction has base64-encoded event attributes, and neither messages nor timestamp
+	doc = bulks[0][1][1]
+	want = map[string]interface{}{"height": 4.0, "txhash": "CD34", "code": 5.0, "signer": "", "msg_types": nil, "memo": "", "messages": "", "events": []interface{}{"transfer.recipient=cosmos1y"}}
+	if !reflect.DeepEqual(doc, want) {
+		t.Errorf("got document %v, want %v", doc, want)
+	}
+
+	// documents rejected in bulk fail the batch, so it's retried
+	reject("CD34")
+	if err := s.publish(ctx, "transactions", 7, []byte(testTxs)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.close(); err == nil || !strings.Contains(err.Error(), "CD34") {
+		t.Errorf("got error %v, want error indexing CD34", err)
+	}
+	reject("")
+	if err := s.flush(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	ids := func(bulk [][2]map[string]interface{}) []interface{} {
+		var ids []interface{}
+		for _, pair := range bulk {
+			ids = append(ids, pair[0]["index"].(map[string]interface{})["_id"])
+		}
+		return ids
+	}
+	if _, bulks := state(); len(bulks) != 3 || !reflect.DeepEqual(ids(bulks[1]), ids(bulks[2])) {
+		t.Errorf("got bulk requests %v, want failed batch retried as is", bulks[1:])
+	}
+}
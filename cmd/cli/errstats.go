@@ -0,0 +1,129 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// errorStats counts errors by class, both since start and since last summary
+type errorStats struct {
+	mu     sync.Mutex
+	total  map[string]int64
+	recent map[string]int64
+}
+
+// errStats counts errors of node requests and database operations, and heights skipped due to errors
+var errStats = &errorStats{total: map[string]int64{}, recent: map[string]int64{}}
+
+// count counts err of dependency (ie, node or database) by its class
+func (s *errorStats) count(dependency string, err error) {
+	class := dependency + " " + errorClass(err)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total[class]++
+	s.recent[class]++
+}
+
+// errorClass returns class of err: status code class (eg, 5xx), unavailable height, rate limited, timeout, connection, unmarshal, oversized, write or other
+func errorClass(err error) string {
+	var se *statusError
+	var ne net.Error
+	var je *json.SyntaxError
+	var jte *json.UnmarshalTypeError
+	var we mongo.WriteException
+	var bwe mongo.BulkWriteException
+	switch {
+	case errors.Is(err, errTooLarge):
+		return "oversized"
+	case errors.As(err, &se):
+		switch {
+		case se.code == http.StatusTooManyRequests:
+			return "rate limited"
+		case strings.Contains(se.body, "is not available"):
+			return "unavailable height"
+		default:
+			return fmt.Sprintf("%dxx", se.code/100)
+		}
+	case errors.Is(err, context.DeadlineExceeded) || mongo.IsTimeout(err) || (errors.As(err, &ne) && ne.Timeout()):
+		return "timeout"
+	case mongo.IsNetworkError(err) || errors.As(err, &ne):
+		return "connection"
+	case errors.As(err, &je) || errors.As(err, &jte) || strings.Contains(err.Error(), "unmarshal"):
+		return "unmarshal"
+	case errors.As(err, &we) || errors.As(err, &bwe):
+		return "write"
+	default:
+		return "other"
+	}
+}
+
+// counts returns copy of error counts since start
+func (s *errorStats) counts() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := make(map[string]int64, len(s.total))
+	for k, v := range s.total {
+		c[k] = v
+	}
+	return c
+}
+
+// summary returns summary of error counts since last summary, and resets them
+func (s *errorStats) summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.recent) == 0 {
+		return "no errors"
+	}
+	classes := make([]string, 0, len(s.recent))
+	for k := range s.recent {
+		classes = append(classes, k)
+	}
+	sort.Strings(classes)
+	parts := make([]string, len(classes))
+	for i, k := range classes {
+		parts[i] = fmt.Sprintf("%s: %d (%d since start)", k, s.recent[k], s.total[k])
+	}
+	s.recent = map[string]int64{}
+	return strings.Join(parts, ", ")
+}
+
+// run logs summary of errors every interval, until ctx cancelled
+func (s *errorStats) run(ctx context.Context, interval time.Duration) {
+	first := true
+	periodically(ctx, "errors summary", interval, func(ctx context.Context) error {
+		if first {
+			// nothing to report right after start
+			first = false
+			return nil
+		}
+		stdLogger.Printf("errors summary (last %s): %s", interval, s.summary())
+		return nil
+	})
+}
@@ -0,0 +1,167 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// eventQuery is named tx event query (eg, "message.action='/cosmos.bank.v1beta1.MsgSend'")
+type eventQuery struct {
+	name  string
+	query string
+}
+
+// eventsScraper runs tx event queries over consecutive height ranges of up to span heights, every interval, until ctx cancelled
+// matching transactions are stored in events_<name> collection, keyed by tx hash, and progress (ie, last height queried) is kept in event_queries collection, keyed by name
+// queries without progress start from height from, or from the current height if from is 0
+func eventsScraper(ctx context.Context, bcc bcSource, db *mongo.Database, protocol string, queries []eventQuery, interval time.Duration, span, from int) {
+	periodically(ctx, "event queries", interval, func(ctx context.Context) error {
+		h, err := bcHeight(ctx, bcc, bcRetry)
+		if err != nil {
+			return err
+		}
+		for _, q := range queries {
+			if err := runEventQuery(ctx, bcc, db, protocol, q, h, span, from); err != nil {
+				return fmt.Errorf("error running event query %s: %v", q.name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// runEventQuery runs event query q over heights from its last progress up to height h
+func runEventQuery(ctx context.Context, bcc bcSource, db *mongo.Database, protocol string, q eventQuery, h, span, from int) error {
+	progress := collection(db, "event_queries")
+	var p struct {
+		Height int `bson:"height"`
+	}
+	err := progress.FindOne(ctx, bson.M{"_id": q.name}).Decode(&p)
+	if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+		return fmt.Errorf("error reading progress: %v", err)
+	}
+	last := p.Height
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		last = h - 1
+		if from > 0 {
+			last = from - 1
+		}
+	}
+
+	col := collection(db, "events_"+q.name)
+	for last < h {
+		to := last + span
+		if to > h {
+			to = h
+		}
+		txs, err := searchTxs(ctx, bcc, protocol, fmt.Sprintf("%s AND tx.height>=%d AND tx.height<=%d", q.query, last+1, to))
+		if err != nil {
+			return err
+		}
+		for _, raw := range txs {
+			id, err := jsonID("txhash")(raw)
+			if err == nil && id == "" {
+				id, err = jsonID("hash")(raw) // tendermint rpc
+			}
+			if err != nil || id == "" {
+				return fmt.Errorf("error getting hash of transaction %s: %v", string(raw), err)
+			}
+			if err := upsert(ctx, col, id, raw, bson.M{"query": q.query}); err != nil {
+				return fmt.Errorf("error storing transaction %s: %v", id, err)
+			}
+		}
+		if err := upsert(ctx, progress, q.name, []byte(fmt.Sprintf(`{"query": %q, "height": %d}`, q.query, to)), bson.M{"updated_at": time.Now().UTC()}); err != nil {
+			return fmt.Errorf("error storing progress: %v", err)
+		}
+		if len(txs) > 0 {
+			stdLogger.Printf("event query %s found %d transactions in [%d..%d]", q.name, len(txs), last+1, to)
+		}
+		last = to
+	}
+	return nil
+}
+
+// searchTxs returns all transactions matching tendermint query (ie, conditions joined with " AND ")
+// for rest and grpc protocols, transactions are returned as tx_responses, and for rpc as tx_search results
+func searchTxs(ctx context.Context, bcc bcSource, protocol, query string) ([]json.RawMessage, error) {
+	var all []json.RawMessage
+	for page := 1; ; page++ {
+		var path string
+		params := url.Values{}
+		if protocol == "rpc" {
+			// ref: https://docs.tendermint.com/v0.34/rpc/#/Info/tx_search
+			path = "/tx_search"
+			params.Set("query", `"`+query+`"`)
+			params.Set("page", strconv.Itoa(page))
+			params.Set("per_page", strconv.Itoa(rpcPerPage))
+			params.Set("order_by", `"asc"`)
+		} else {
+			path = bcTxsPath
+			if bcTxsParam == "query" {
+				params.Set("query", query)
+				params.Set("page", strconv.Itoa(page))
+				params.Set("limit", strconv.Itoa(rpcPerPage))
+			} else {
+				// conditions are passed as separate events, that are joined with " AND "
+				for _, e := range strings.Split(query, " AND ") {
+					params.Add("events", strings.TrimSpace(e))
+				}
+				params.Set("pagination.offset", strconv.Itoa(len(all)))
+				params.Set("pagination.limit", strconv.Itoa(rpcPerPage))
+			}
+		}
+		res, err := queryAt(ctx, bcc, path, params, 0, bcRetry)
+		if err != nil {
+			return nil, err
+		}
+
+		var r struct {
+			Txs         []json.RawMessage `json:"txs"`
+			TxResponses []json.RawMessage `json:"tx_responses"`
+			TotalCount  string            `json:"total_count"` // rpc
+			Total       string            `json:"total"`       // sdk v0.46+
+			Pagination  struct {
+				Total string `json:"total"`
+			} `json:"pagination"`
+		}
+		if err := json.Unmarshal(res, &r); err != nil {
+			return nil, fmt.Errorf("error unmarshalling transactions - got response:\n%s: %v", string(res), err)
+		}
+		items, total := r.TxResponses, r.Pagination.Total
+		if protocol == "rpc" {
+			items, total = r.Txs, r.TotalCount
+		}
+		if total == "" {
+			total = r.Total
+		}
+		all = append(all, items...)
+		n, err := strconv.Atoi(total)
+		if err != nil || len(all) >= n || len(items) == 0 {
+			return all, nil
+		}
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// evmClient scrapes eth-style blocks, transactions and receipts via ethereum json-rpc api of evm-compatible cosmos chains (eg, evmos, kava or injective)
+// data is stored in evm_blocks collection, keyed by height (with transactions replaced by their hashes), and evm_txs collection, keyed by tx hash (with receipt, including logs, attached)
+// ref: https://ethereum.org/en/developers/docs/apis/json-rpc/
+type evmClient struct {
+	url        string
+	httpClient *http.Client
+	blocks     *mongo.Collection
+	txs        *mongo.Collection
+
+	blockReceipts int32 // eth_getBlockReceipts support: 0 unknown, 1 supported, -1 unsupported
+}
+
+// evmError is ethereum json-rpc error
+type evmError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *evmError) Error() string {
+	return fmt.Sprintf("json-rpc error %d: %s", e.Code, e.Message)
+}
+
+// newEVMClient returns evmClient for ethereum json-rpc endpoint at rawurl, storing data into db
+func newEVMClient(rawurl string, db *mongo.Database) (*evmClient, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing evm json-rpc url %s: %v", rawurl, err)
+	}
+	var tlsConfig *tls.Config
+	if u.Scheme == "https" {
+		if tlsConfig, err = bcTLSConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return &evmClient{
+		url:        rawurl,
+		httpClient: &http.Client{Timeout: bcTimeout, Transport: newTransport(tlsConfig)},
+		blocks:     collection(db, "evm_blocks"),
+		txs:        collection(db, "evm_txs"),
+	}, nil
+}
+
+// call calls json-rpc method with params and returns its result
+func (c *evmClient) call(method string, params ...interface{}) (json.RawMessage, error) {
+	body, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request %s: %v", method, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range bcHeaders {
+		req.Header[k] = v
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request %s: %v", method, err)
+	}
+	defer resp.Body.Close()
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if err := readBody(resp, buf); err != nil {
+		return nil, fmt.Errorf("error reading response %s: %w", method, err)
+	}
+	res := buf.Bytes() // result is copied when unmarshalled, so buffer can be reused
+	if resp.StatusCode != http.StatusOK {
+		return nil, &statusError{url: c.url + " " + method, code: resp.StatusCode, status: resp.Status, body: string(res), retryAfter: retryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	var r struct {
+		Result json.RawMessage `json:"result"`
+		Error  *evmError       `json:"error"`
+	}
+	if err := json.Unmarshal(res, &r); err != nil {
+		return nil, fmt.Errorf("error unmarshalling response %s - got response:\n%s: %v", method, string(res), err)
+	}
+	if r.Error != nil {
+		return nil, r.Error
+	}
+	return r.Result, nil
+}
+
+// scrape stores evm block at height h with its transactions and their receipts
+// it will retry on request error as per retry policy, unless ctx cancelled
+func (c *evmClient) scrape(ctx context.Context, h int, rp retryPolicy) error {
+	height := fmt.Sprintf("0x%x", h)
+	raw, err := fetch(ctx, fmt.Sprintf("evm block at height %d", h), rp, func() ([]byte, error) { return c.call("eth_getBlockByNumber", height, true) })
+	if err != nil {
+		return err
+	}
+	if string(raw) == "null" {
+		return nil // eg, before evm was enabled
+	}
+	var block map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &block); err != nil {
+		return fmt.Errorf("error unmarshalling evm block at height %d: %v", h, err)
+	}
+	var txs []map[string]json.RawMessage
+	if err := json.Unmarshal(block["transactions"], &txs); err != nil {
+		return fmt.Errorf("error unmarshalling evm transactions at height %d: %v", h, err)
+	}
+
+	receipts, err := c.receipts(ctx, height, txs, rp)
+	if err != nil {
+		return err
+	}
+
+	hashes := make([]json.RawMessage, len(txs))
+	for i, tx := range txs {
+		hashes[i] = tx["hash"]
+		var hash string
+		if err := json.Unmarshal(tx["hash"], &hash); err != nil {
+			return fmt.Errorf("error unmarshalling evm transaction hash at height %d: %v", h, err)
+		}
+		tx["receipt"] = receipts[hash]
+		doc, err := json.Marshal(tx)
+		if err != nil {
+			return err
+		}
+		if err := upsert(ctx, c.txs, hash, doc, bson.M{"height": h}); err != nil {
+			return fmt.Errorf("error storing evm transaction %s: %v", hash, err)
+		}
+	}
+	if block["transactions"], err = json.Marshal(hashes); err != nil {
+		return err
+	}
+	doc, err := json.Marshal(block)
+	if err != nil {
+		return err
+	}
+	if err := upsert(ctx, c.blocks, h, doc, nil); err != nil {
+		return fmt.Errorf("error storing evm block at height %d: %v", h, err)
+	}
+	return nil
+}
+
+// receipts returns receipts of txs in block at height (hex-encoded), by tx hash
+// it uses eth_getBlockReceipts, if supported by node, or eth_getTransactionReceipt for each tx otherwise
+func (c *evmClient) receipts(ctx context.Context, height string, txs []map[string]json.RawMessage, rp retryPolicy) (map[string]json.RawMessage, error) {
+	receipts := map[string]json.RawMessage{}
+	if len(txs) == 0 {
+		return receipts, nil
+	}
+
+	if atomic.LoadInt32(&c.blockReceipts) >= 0 {
+		raw, err := fetch(ctx, "evm block receipts at height "+height, rp, func() ([]byte, error) {
+			res, err := c.call("eth_getBlockReceipts", height)
+			var ee *evmError
+			if errors.As(err, &ee) && ee.Code == -32601 { // method not found
+				return nil, errUnsupported
+			}
+			return res, err
+		})
+		if err == nil {
+			atomic.StoreInt32(&c.blockReceipts, 1)
+			var rs []map[string]json.RawMessage
+			if err := json.Unmarshal(raw, &rs); err != nil {
+				return nil, fmt.Errorf("error unmarshalling evm block receipts at height %s: %v", height, err)
+			}
+			for _, r := range rs {
+				var hash string
+				json.Unmarshal(r["transactionHash"], &hash)
+				receipts[hash], _ = json.Marshal(r)
+			}
+			return receipts, nil
+		}
+		if !errors.Is(err, errUnsupported) {
+			return nil, err
+		}
+		atomic.StoreInt32(&c.blockReceipts, -1)
+	}
+
+	for _, tx := range txs {
+		var hash string
+		if err := json.Unmarshal(tx["hash"], &hash); err != nil {
+			return nil, fmt.Errorf("error unmarshalling evm transaction hash at height %s: %v", height, err)
+		}
+		raw, err := fetch(ctx, "evm receipt of transaction "+hash, rp, func() ([]byte, error) { return c.call("eth_getTransactionReceipt", hash) })
+		if err != nil {
+			return nil, err
+		}
+		receipts[hash] = raw
+	}
+	return receipts, nil
+}
@@ -0,0 +1,110 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// configFlags are command-line flags overriding most commonly used config values, with config keys they set and description
+// note: any other config value can be overridden with --set
+var configFlags = []struct {
+	name string
+	keys []string
+	desc string
+}{
+	{"env-file", nil, "config file to read instead of .env"},
+	{"config", []string{"cs_config_file"}, "structured (yaml, toml or json) config file"},
+	{"chain", []string{"cs_chain"}, "chain to use from config file's chains section"},
+	{"log-file", []string{"cs_log_file"}, "log file"},
+	{"checkpoint", []string{"cs_log_checkpoint"}, "log checkpoint (ie, minimal height to resume from)"},
+	{"bc-protocol", []string{"cs_bc_protocol"}, "blockchain node protocol (rest, grpc or rpc)"},
+	{"bc-node", []string{"cs_bc_node"}, "blockchain node(s) address"},
+	{"bc-port", []string{"cs_bc_port"}, "blockchain node port"},
+	{"db-type", []string{"cs_db_type"}, "database type (mongo, bolt or none)"},
+	{"db-uri", []string{"cs_db_uri"}, "mongo connection string"},
+	{"db-host", []string{"cs_db_host"}, "mongo host"},
+	{"db-port", []string{"cs_db_port"}, "mongo port"},
+	{"db-name", []string{"cs_db_name"}, "mongo database name"},
+	{"workers", []string{"cs_max_req_workers", "cs_max_per_workers"}, "number of both requests and persists workers"},
+	{"req-workers", []string{"cs_max_req_workers"}, "number of requests workers"},
+	{"per-workers", []string{"cs_max_per_workers"}, "number of persists workers"},
+	{"naptime", []string{"cs_naptime"}, "sleep time between action retries (eg, 1m)"},
+	{"http-addr", []string{"cs_http_addr"}, "address to serve http endpoints on"},
+}
+
+// configOverrides is flag value collecting repeated 'key=value' config overrides
+type configOverrides map[string]string
+
+func (o configOverrides) String() string {
+	return fmt.Sprint(map[string]string(o))
+}
+
+func (o configOverrides) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("expected key=value, got %q", s)
+	}
+	key := strings.ToLower(strings.TrimSpace(kv[0]))
+	if !strings.HasPrefix(key, "cs_") {
+		return fmt.Errorf("unknown config key %q: expected cs_ prefix", kv[0])
+	}
+	o[key] = kv[1]
+	return nil
+}
+
+// parseConfigFlags parses config flags preceding command in args, overriding respective config values (ie, taking precedence over environment variables and .env file), and returns remaining args and config file to read
+func parseConfigFlags(args []string) (rest []string, envFile string, err error) {
+	fs := flag.NewFlagSet("cli", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	values := make([]*string, len(configFlags))
+	for i, f := range configFlags {
+		values[i] = fs.String(f.name, "", f.desc)
+	}
+	overrides := configOverrides{}
+	fs.Var(overrides, "set", "override any config value, as key=value (eg, cs_gap_scan=true); can be repeated")
+	if err := fs.Parse(args); err != nil {
+		return nil, "", err
+	}
+
+	envFile = ".env"
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for i, f := range configFlags {
+		if !set[f.name] {
+			continue
+		}
+		if f.name == "env-file" {
+			envFile = *values[i]
+			continue
+		}
+		for _, k := range f.keys {
+			viper.Set(k, *values[i])
+			configSources[k] = "flag"
+		}
+	}
+	for k, v := range overrides {
+		viper.Set(k, v)
+		configSources[k] = "flag"
+	}
+	return fs.Args(), envFile, nil
+}
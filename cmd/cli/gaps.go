@@ -0,0 +1,201 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// findGaps returns ranges of heights missing in col between the lowest stored height, but not below from, and to (inclusive)
+// heights are taken from docs' _id, so legacy docs (ie, not keyed by height) are ignored
+func findGaps(ctx context.Context, col *mongo.Collection, from, to int) ([]stateRange, error) {
+	cur, err := col.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"_id": bson.M{"$type": "number", "$gte": from, "$lte": to}}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		{{Key: "$project", Value: bson.M{"_id": 1}}},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error scanning %s: %v", col.Name(), err)
+	}
+	defer cur.Close(ctx)
+	var gaps []stateRange
+	prev := 0 // previous stored height, or 0 before the lowest one
+	for cur.Next(ctx) {
+		var d struct {
+			ID int `bson:"_id"`
+		}
+		if err := cur.Decode(&d); err != nil {
+			return nil, fmt.Errorf("error decoding %s height: %v", col.Name(), err)
+		}
+		if prev > 0 && d.ID > prev+1 {
+			gaps = append(gaps, stateRange{From: prev + 1, To: d.ID - 1})
+		}
+		prev = d.ID
+	}
+	if err := cur.Err(); err != nil {
+		return nil, fmt.Errorf("error scanning %s: %v", col.Name(), err)
+	}
+	if prev > 0 && prev < to {
+		gaps = append(gaps, stateRange{From: prev + 1, To: to})
+	}
+	return gaps, nil
+}
+
+// gapsArgs parses gaps command args (ie, [--from H1] [--to H2] [--output <path>]), where 0 heights default to the stored range
+func gapsArgs(args []string) (from, to int, output string, err error) {
+	fs := flag.NewFlagSet("gaps", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.IntVar(&from, "from", 0, "lowest height to check (default: lowest stored)")
+	fs.IntVar(&to, "to", 0, "highest height to check (default: highest stored)")
+	fs.StringVar(&output, "output", "", "file to also write missing ranges to, for rescrape --file")
+	if err := fs.Parse(args); err != nil {
+		return 0, 0, "", err
+	}
+	if fs.NArg() > 0 {
+		return 0, 0, "", fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if from < 0 || to < 0 || (to > 0 && to < from) {
+		return 0, 0, "", fmt.Errorf("invalid range [%d..%d]", from, to)
+	}
+	return from, to, output, nil
+}
+
+// listGaps writes ranges of heights missing in database between from and to (inclusive) to w, and to output file, if set, one range per line (as 'from-to', or just height for single one), so they can be re-scraped with rescrape --file
+// blocks are checked, and block results too, if enabled
+func listGaps(ctx context.Context, w io.Writer, from, to int, output string) error {
+	if dbType != "mongo" {
+		return fmt.Errorf("gaps requires mongo database")
+	}
+	dbc, bxs, _, brs := initDB(ctx, dbHost, dbPort, dbUser, dbPass, dbRetry)
+	defer dbc.Disconnect(context.Background())
+
+	if to == 0 {
+		_, hi, err := storedRange(ctx, bxs)
+		if err != nil {
+			return err
+		}
+		to = hi
+	}
+	if to == 0 {
+		return fmt.Errorf("no stored blocks")
+	}
+	cols := []*mongo.Collection{bxs}
+	if blockResults {
+		cols = append(cols, brs)
+	}
+	var gaps []stateRange
+	for _, col := range cols {
+		stdLogger.Printf("scanning %s for missing heights up to %d...", col.Name(), to)
+		g, err := findGaps(ctx, col, from, to)
+		if err != nil {
+			return err
+		}
+		gaps = append(gaps, g...)
+	}
+	gaps = mergeRanges(gaps)
+
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("error creating output file %s: %v", output, err)
+		}
+		defer f.Close()
+		w = io.MultiWriter(w, f)
+	}
+	bw := bufio.NewWriter(w)
+	missing := 0
+	for _, g := range gaps {
+		if g.From == g.To {
+			fmt.Fprintf(bw, "%d\n", g.From)
+		} else {
+			fmt.Fprintf(bw, "%d-%d\n", g.From, g.To)
+		}
+		missing += g.To - g.From + 1
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("error writing missing ranges: %v", err)
+	}
+	stdLogger.Printf("found %d missing heights in %d ranges up to %d", missing, len(gaps), to)
+	return nil
+}
+
+// mergeRanges returns ranges sorted, with overlapping and adjacent ones merged
+func mergeRanges(ranges []stateRange) []stateRange {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].From < ranges[j].From })
+	var merged []stateRange
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r.From <= merged[n-1].To+1 {
+			if r.To > merged[n-1].To {
+				merged[n-1].To = r.To
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// gapScanner scans cols for heights missing from height from up to height returned by upper, and queues them to reqChan for re-scraping
+// it scans once, or every interval if set, until ctx cancelled
+// note: heights that are not stored by design (eg, invalid or dead-lettered ones) would be re-scraped each time
+func gapScanner(ctx context.Context, cols []*mongo.Collection, from int, upper func() int, interval time.Duration, reqChan chan<- request) {
+	scan := func(ctx context.Context) error {
+		to := upper()
+		missing := map[int]bool{}
+		for _, col := range cols {
+			gaps, err := findGaps(ctx, col, from, to)
+			if err != nil {
+				return err
+			}
+			for _, g := range gaps {
+				for h := g.From; h <= g.To; h++ {
+					missing[h] = true
+				}
+			}
+		}
+		if len(missing) == 0 {
+			stdLogger.Printf("no missing heights found up to %d", to)
+			return nil
+		}
+		stdLogger.Printf("found %d missing heights up to %d: re-scraping them", len(missing), to)
+		for h := range missing {
+			select {
+			case reqChan <- request{height: h, force: true}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	}
+	if interval <= 0 {
+		if err := scan(ctx); err != nil && ctx.Err() == nil {
+			stdLogger.Printf("error scanning for missing heights: %v", err)
+		}
+		return
+	}
+	periodically(ctx, "missing heights", interval, scan)
+}
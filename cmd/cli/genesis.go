@@ -0,0 +1,178 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// genesisDoc is genesis file, with only app state modules of interest decoded
+// ref: https://docs.tendermint.com/v0.34/tendermint-core/using-tendermint.html#genesis
+type genesisDoc struct {
+	ChainID  string `json:"chain_id"`
+	AppState struct {
+		Auth struct {
+			Accounts []json.RawMessage `json:"accounts"`
+		} `json:"auth"`
+		Bank struct {
+			Balances []json.RawMessage `json:"balances"`
+		} `json:"bank"`
+		Staking struct {
+			Validators []json.RawMessage `json:"validators"`
+		} `json:"staking"`
+		Genutil struct {
+			GenTxs []struct {
+				Body struct {
+					Messages []json.RawMessage `json:"messages"`
+				} `json:"body"`
+			} `json:"gen_txs"`
+		} `json:"genutil"`
+	} `json:"app_state"`
+}
+
+// importGenesis reads genesis file from source (file path or http(s) url) and stores it into database:
+// genesis doc itself (without app state) into genesis collection, keyed by chain id, and accounts, balances and initial validators (from staking state and genesis txs) into
+// genesis_accounts, genesis_balances and genesis_validators collections, keyed by (operator) address
+// all docs are extended with chain_id, and re-importing the same genesis is safe
+func importGenesis(ctx context.Context, source string) error {
+	stdLogger.Printf("reading genesis from %s...", source)
+	raw, err := readGenesis(source)
+	if err != nil {
+		return err
+	}
+	var g genesisDoc
+	if err := json.Unmarshal(raw, &g); err != nil {
+		return fmt.Errorf("error unmarshalling genesis: %v", err)
+	}
+	if g.ChainID == "" {
+		return fmt.Errorf("error reading genesis from %s: chain_id not found", source)
+	}
+
+	if dbType != "mongo" {
+		return fmt.Errorf("genesis import requires mongo database")
+	}
+	dbc, _, _, _ := initDB(ctx, dbHost, dbPort, dbUser, dbPass, dbRetry)
+	defer dbc.Disconnect(context.Background())
+	db := dbc.Database(dbName)
+	extra := bson.M{"chain_id": g.ChainID}
+
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return fmt.Errorf("error unmarshalling genesis: %v", err)
+	}
+	delete(doc, "app_state")
+	gd, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := upsert(ctx, collection(db, "genesis"), g.ChainID, gd, nil); err != nil {
+		return fmt.Errorf("error storing genesis: %v", err)
+	}
+
+	n, err := storeGenesis(ctx, collection(db, "genesis_accounts"), g.AppState.Auth.Accounts, extra)
+	if err != nil {
+		return err
+	}
+	stdLogger.Printf("imported %d genesis accounts", n)
+
+	if n, err = storeGenesis(ctx, collection(db, "genesis_balances"), g.AppState.Bank.Balances, extra); err != nil {
+		return err
+	}
+	stdLogger.Printf("imported %d genesis balances", n)
+
+	// initial validators are either in staking state (eg, for chains restarted from exported state) or created by genesis txs
+	validators := g.AppState.Staking.Validators
+	for _, tx := range g.AppState.Genutil.GenTxs {
+		for _, msg := range tx.Body.Messages {
+			var m struct {
+				Type string `json:"@type"`
+			}
+			if err := json.Unmarshal(msg, &m); err == nil && strings.HasSuffix(m.Type, "MsgCreateValidator") {
+				validators = append(validators, msg)
+			}
+		}
+	}
+	if n, err = storeGenesis(ctx, collection(db, "genesis_validators"), validators, extra); err != nil {
+		return err
+	}
+	stdLogger.Printf("imported %d genesis validators", n)
+
+	stdLogger.Printf("genesis for chain %s imported", g.ChainID)
+	return nil
+}
+
+// readGenesis returns genesis file content from source (file path or http(s) url)
+func readGenesis(source string) ([]byte, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(source)
+	}
+	resp, err := http.Get(source)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading genesis from %s: %v", source, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error downloading genesis from %s: %s", source, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// storeGenesis stores items into col, keyed by their (operator) address, and returns number of items stored
+func storeGenesis(ctx context.Context, col *mongo.Collection, items []json.RawMessage, extra bson.M) (int, error) {
+	for i, raw := range items {
+		id := genesisID(raw)
+		if id == "" {
+			return i, fmt.Errorf("error storing %s: address not found in %s", col.Name(), string(raw))
+		}
+		if err := upsert(ctx, col, id, raw, extra); err != nil {
+			return i, fmt.Errorf("error storing %s %s: %v", col.Name(), id, err)
+		}
+	}
+	return len(items), nil
+}
+
+// genesisID returns address of account, balance or validator in raw json
+// vesting and module accounts nest their address in base (vesting) account
+func genesisID(raw []byte) string {
+	var m map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return ""
+	}
+	for _, f := range []string{"address", "operator_address", "validator_address"} {
+		var id string
+		if json.Unmarshal(m[f], &id) == nil && id != "" {
+			return id
+		}
+	}
+	for _, f := range []string{"base_account", "base_vesting_account"} {
+		if b, ok := m[f]; ok {
+			if id := genesisID(b); id != "" {
+				return id
+			}
+		}
+	}
+	return ""
+}
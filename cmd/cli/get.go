@@ -0,0 +1,106 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// getStored writes stored json of datatype ("block", "transactions" or "block_results") at height to w, reading original data if compressed or too large
+// transactions stored one doc per transaction are written one per line
+func getStored(ctx context.Context, w io.Writer, datatype, height string) error {
+	if dbType != "mongo" {
+		return fmt.Errorf("get requires mongo database")
+	}
+	h, err := strconv.Atoi(height)
+	if err != nil {
+		return fmt.Errorf("invalid height %q: %v", height, err)
+	}
+	dbc, bxs, txs, brs := initDB(ctx, dbHost, dbPort, dbUser, dbPass, dbRetry)
+	defer dbc.Disconnect(context.Background())
+	col := map[string]*mongo.Collection{"block": bxs, "transactions": txs, "block_results": brs}[datatype]
+	if col == nil {
+		return fmt.Errorf("unknown datatype %q: expected 'block', 'transactions' or 'block_results'", datatype)
+	}
+
+	var docs []bson.Raw
+	if datatype == "transactions" && dbTxDocs {
+		cur, err := col.Find(ctx, bson.M{"height": height}, options.Find().SetSort(bson.M{"index": 1}))
+		if err != nil {
+			return fmt.Errorf("error finding transactions at height %d: %v", h, err)
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			docs = append(docs, cur.Current)
+		}
+		if err := cur.Err(); err != nil {
+			return fmt.Errorf("error reading transactions at height %d: %v", h, err)
+		}
+	} else {
+		doc, err := col.FindOne(ctx, bson.M{"_id": h}).DecodeBytes()
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("error reading %s at height %d: %v", datatype, h, err)
+		}
+		if doc != nil {
+			docs = append(docs, doc)
+		}
+	}
+	if len(docs) == 0 {
+		return fmt.Errorf("%s at height %d not found", datatype, h)
+	}
+
+	for _, doc := range docs {
+		raw, err := docJSON(col, doc)
+		if err != nil {
+			return fmt.Errorf("error reading %s at height %d: %v", datatype, h, err)
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", raw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// docJSON returns json of stored doc in col, reading original data if compressed or too large, or converting plain doc (without _id) otherwise
+func docJSON(col *mongo.Collection, doc bson.Raw) ([]byte, error) {
+	raw, ok, err := storedJSON(col, doc)
+	if err != nil || ok {
+		return raw, err
+	}
+	var d bson.D
+	if err := bson.Unmarshal(doc, &d); err != nil {
+		return nil, fmt.Errorf("error unmarshalling doc: %v", err)
+	}
+	for i := 0; i < len(d); i++ {
+		if d[i].Key == "_id" {
+			d = append(d[:i], d[i+1:]...)
+			break
+		}
+	}
+	if raw, err = bson.MarshalExtJSON(d, false, false); err != nil {
+		return nil, fmt.Errorf("error marshalling doc: %v", err)
+	}
+	return raw, nil
+}
@@ -0,0 +1,139 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// govScraper scrapes governance proposals, along with their deposits, votes and tally, every interval, until ctx cancelled
+// data is stored in gov_proposals, gov_deposits, gov_votes and gov_tallies collections, keyed by proposal id (and depositor or voter), and updated as proposals progress
+func govScraper(ctx context.Context, bcc bcSource, db *mongo.Database, interval time.Duration) {
+	periodically(ctx, "governance data", interval, func(ctx context.Context) error {
+		stdLogger.Println("scraping governance data...")
+		if err := scrapeGov(ctx, bcc, db); err != nil {
+			return err
+		}
+		stdLogger.Printf("scraping governance data done (next in %s)", interval)
+		return nil
+	})
+}
+
+// scrapeGov scrapes all proposals and, for those not already stored in their final status, their deposits, votes and tally
+func scrapeGov(ctx context.Context, bcc bcSource, db *mongo.Database) error {
+	h, err := bcHeight(ctx, bcc, bcRetry)
+	if err != nil {
+		return err
+	}
+	extra := bson.M{"scraped_height": h, "scraped_at": time.Now().UTC()}
+
+	path := "/cosmos/gov/" + govAPIVersion + "/proposals"
+	proposals, err := queryAll(ctx, bcc, path, nil, "proposals", 0, bcRetry)
+	if err != nil {
+		return err
+	}
+
+	col := collection(db, "gov_proposals")
+	for _, raw := range proposals {
+		var p struct {
+			ProposalID string `json:"proposal_id"` // v1beta1
+			ID         string `json:"id"`          // v1
+			Status     string `json:"status"`
+		}
+		if err := json.Unmarshal(raw, &p); err != nil {
+			return fmt.Errorf("error unmarshalling proposal %s: %v", string(raw), err)
+		}
+		id := p.ProposalID
+		if id == "" {
+			id = p.ID
+		}
+
+		// skip proposals already stored in their final status
+		var stored struct {
+			Status string `bson:"status"`
+		}
+		if err := col.FindOne(ctx, bson.M{"_id": id}, options.FindOne().SetProjection(bson.M{"status": 1})).Decode(&stored); err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("error reading proposal %s: %v", id, err)
+		}
+		if stored.Status == p.Status && finalStatus(p.Status) {
+			continue
+		}
+
+		if err := upsert(ctx, col, id, raw, extra); err != nil {
+			return fmt.Errorf("error storing proposal %s: %v", id, err)
+		}
+
+		deposits, err := queryAll(ctx, bcc, path+"/"+id+"/deposits", nil, "deposits", 0, bcRetry)
+		if err != nil {
+			return err
+		}
+		for _, raw := range deposits {
+			var d struct {
+				Depositor string `json:"depositor"`
+			}
+			if err := json.Unmarshal(raw, &d); err != nil {
+				return fmt.Errorf("error unmarshalling deposit %s: %v", string(raw), err)
+			}
+			if err := upsert(ctx, collection(db, "gov_deposits"), id+"/"+d.Depositor, raw, extra); err != nil {
+				return fmt.Errorf("error storing deposit for proposal %s by %s: %v", id, d.Depositor, err)
+			}
+		}
+
+		votes, err := queryAll(ctx, bcc, path+"/"+id+"/votes", nil, "votes", 0, bcRetry)
+		if err != nil {
+			return err
+		}
+		for _, raw := range votes {
+			var v struct {
+				Voter string `json:"voter"`
+			}
+			if err := json.Unmarshal(raw, &v); err != nil {
+				return fmt.Errorf("error unmarshalling vote %s: %v", string(raw), err)
+			}
+			if err := upsert(ctx, collection(db, "gov_votes"), id+"/"+v.Voter, raw, extra); err != nil {
+				return fmt.Errorf("error storing vote for proposal %s by %s: %v", id, v.Voter, err)
+			}
+		}
+
+		tally, err := queryAt(ctx, bcc, path+"/"+id+"/tally", nil, 0, bcRetry)
+		if err != nil {
+			return err
+		}
+		if err := upsert(ctx, collection(db, "gov_tallies"), id, tally, extra); err != nil {
+			return fmt.Errorf("error storing tally for proposal %s: %v", id, err)
+		}
+	}
+
+	return nil
+}
+
+// finalStatus returns true if proposal status would not change anymore
+func finalStatus(status string) bool {
+	switch status {
+	case "PROPOSAL_STATUS_PASSED", "PROPOSAL_STATUS_REJECTED", "PROPOSAL_STATUS_FAILED":
+		return true
+	}
+	return false
+}
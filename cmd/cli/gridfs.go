@@ -0,0 +1,97 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// maxDocSize is max size of bson doc stored as is, leaving some headroom below mongo's 16MB limit for command overhead
+const maxDocSize = 16*1024*1024 - 16*1024
+
+// gridfsBucket is name of gridfs bucket for oversized docs (prefixed with configured collection prefix)
+const gridfsBucket = "oversized"
+
+// oversized returns true if doc converted from raw json exceeds maxDocSize when marshalled to bson
+func oversized(doc interface{}, raw []byte) bool {
+	if b, ok := doc.(bson.Raw); ok {
+		return len(b) > maxDocSize
+	}
+	// bson is rarely less than half of json size, so only large docs are marshalled to check
+	if len(raw) < maxDocSize/2 {
+		return false
+	}
+	b, err := bson.Marshal(doc)
+	return err != nil || len(b) > maxDocSize
+}
+
+// storeLarge stores raw json, too large to be stored as doc with id in col, into gridfs file named and keyed as "<collection>/<id>", replacing existing one, if any
+// it returns stub doc to be stored in col instead, referencing that file (as "cs_gridfs" field), so data could be read back with findStored
+func storeLarge(col *mongo.Collection, id interface{}, raw []byte) (bson.M, error) {
+	bucket, err := gridfs.NewBucket(col.Database(), options.GridFSBucket().SetName(dbPrefix+gridfsBucket))
+	if err != nil {
+		return nil, fmt.Errorf("error opening gridfs bucket: %v", err)
+	}
+	name := fmt.Sprintf("%s/%v", col.Name(), id)
+	if err := bucket.Delete(name); err != nil && !errors.Is(err, gridfs.ErrFileNotFound) {
+		return nil, fmt.Errorf("error deleting gridfs file %s: %v", name, err)
+	}
+	if err := bucket.UploadFromStreamWithID(name, name, bytes.NewReader(raw)); err != nil {
+		return nil, fmt.Errorf("error uploading gridfs file %s: %v", name, err)
+	}
+	stdLogger.Printf("warn: stored oversized doc %s (%d bytes) in gridfs", name, len(raw))
+	return bson.M{"_id": id, "cs_gridfs": name, "cs_size": len(raw)}, nil
+}
+
+// loadLarge returns raw json stored into gridfs file name by storeLarge
+func loadLarge(col *mongo.Collection, name string) ([]byte, error) {
+	bucket, err := gridfs.NewBucket(col.Database(), options.GridFSBucket().SetName(dbPrefix+gridfsBucket))
+	if err != nil {
+		return nil, fmt.Errorf("error opening gridfs bucket: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := bucket.DownloadToStream(name, &buf); err != nil {
+		return nil, fmt.Errorf("error downloading gridfs file %s: %v", name, err)
+	}
+	return buf.Bytes(), nil
+}
+
+// findStored decodes doc with id in col into v, reading original data if doc is compressed or too large (see storedJSON)
+// note: v is unmarshalled from bson doc or json, so it should have both tags
+func findStored(ctx context.Context, col *mongo.Collection, id interface{}, v interface{}) error {
+	doc, err := col.FindOne(ctx, bson.M{"_id": id}).DecodeBytes()
+	if err != nil {
+		return err
+	}
+	raw, ok, err := storedJSON(col, doc)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return bson.Unmarshal(doc, v)
+	}
+	return json.Unmarshal(raw, v)
+}
@@ -0,0 +1,576 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	rpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// grpcClient is bcSource using cosmos grpc services
+// message types are resolved at runtime via grpc server reflection (enabled by default on cosmos nodes), so no chain-specific protobuf definitions are needed
+// responses are json-encoded the same way grpc-gateway (ie, rest api) does, so they can be handled and stored interchangeably
+type grpcClient struct {
+	target string
+	conn   *grpc.ClientConn
+
+	mu    sync.Mutex                                   // guards fdps and files
+	fdps  map[string]*descriptorpb.FileDescriptorProto // file descriptors fetched so far, by file name
+	files *protoregistry.Files                         // registry built from fdps
+
+	routesMu sync.Mutex // guards routes
+	routes   []route    // rest api routes, resolved on first query
+}
+
+// protoCodec is grpc codec for (dynamic) protobuf api v2 messages
+type protoCodec struct{}
+
+func (protoCodec) Marshal(v interface{}) ([]byte, error) { return proto.Marshal(v.(proto.Message)) }
+func (protoCodec) Unmarshal(data []byte, v interface{}) error {
+	return proto.Unmarshal(data, v.(proto.Message))
+}
+func (protoCodec) Name() string { return "proto" }
+
+// newGRPCClient returns grpcClient referencing host and port, or unix domain socket path if socket is not empty, using tls if tlsConfig is not nil
+func newGRPCClient(host, port, socket string, tlsConfig *tls.Config) (*grpcClient, error) {
+	c := grpcClient{
+		target: net.JoinHostPort(host, port),
+		fdps:   map[string]*descriptorpb.FileDescriptorProto{},
+		files:  &protoregistry.Files{},
+	}
+	creds, scheme := grpc.WithInsecure(), "http"
+	if tlsConfig != nil {
+		creds, scheme = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)), "https"
+	}
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		return bcDial(ctx, scheme, addr)
+	}
+	// note: default max response size of 4MB is too small for large blocks
+	maxSize := math.MaxInt32
+	if bcMaxResponseSize > 0 && bcMaxResponseSize < math.MaxInt32 {
+		maxSize = int(bcMaxResponseSize)
+	}
+	opts := []grpc.DialOption{creds, grpc.WithDefaultCallOptions(grpc.ForceCodec(protoCodec{}), grpc.MaxCallRecvMsgSize(maxSize))}
+	if socket != "" {
+		c.target = socket
+		dialer = func(ctx context.Context, addr string) (net.Conn, error) {
+			return (&net.Dialer{Timeout: bcDialTimeout}).DialContext(ctx, "unix", addr)
+		}
+		opts = append(opts, grpc.WithAuthority("localhost"))
+	}
+	conn, err := grpc.Dial(c.target, append(opts, grpc.WithContextDialer(dialer))...)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %v", c.target, err)
+	}
+	c.conn = conn
+	return &c, nil
+}
+
+// block returns block at height
+func (c *grpcClient) block(height string) ([]byte, error) {
+	if height == "latest" {
+		return c.invoke("cosmos.base.tendermint.v1beta1.Service.GetLatestBlock", nil)
+	}
+	h, err := strconv.ParseInt(height, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing height %s: %v", height, err)
+	}
+	return c.invoke("cosmos.base.tendermint.v1beta1.Service.GetBlockByHeight", func(req *dynamicpb.Message) error {
+		return setField(req, "height", protoreflect.ValueOfInt64(h))
+	})
+}
+
+// txs returns single page of transactions at height
+func (c *grpcClient) txs(height, key string, offset int) ([]byte, error) {
+	return c.invoke("cosmos.tx.v1beta1.Service.GetTxsEvent", func(req *dynamicpb.Message) error {
+		// sdk v0.47+ uses query, older versions use events
+		if req.Descriptor().Fields().ByName("query") != nil {
+			if err := setField(req, "query", protoreflect.ValueOfString("tx.height="+height)); err != nil {
+				return err
+			}
+		} else {
+			fd := req.Descriptor().Fields().ByName("events")
+			if fd == nil {
+				return fmt.Errorf("unsupported request %s: no query or events field", req.Descriptor().FullName())
+			}
+			req.Mutable(fd).List().Append(protoreflect.ValueOfString("tx.height=" + height))
+		}
+		pfd := req.Descriptor().Fields().ByName("pagination")
+		if pfd == nil {
+			return nil
+		}
+		pagination := req.Mutable(pfd).Message()
+		if key != "" {
+			k, err := base64.StdEncoding.DecodeString(key)
+			if err != nil {
+				return fmt.Errorf("error decoding pagination key %s: %v", key, err)
+			}
+			return setField(pagination, "key", protoreflect.ValueOfBytes(k))
+		}
+		if offset > 0 {
+			return setField(pagination, "offset", protoreflect.ValueOfUint64(uint64(offset)))
+		}
+		return nil
+	})
+}
+
+// blockResults is not supported by grpc
+func (c *grpcClient) blockResults(height string) ([]byte, error) {
+	return nil, errUnsupported
+}
+
+// query returns response for rest api path with params at height, using grpc method mapped to it (as per google.api.http annotations)
+func (c *grpcClient) query(path string, params url.Values, height int) ([]byte, error) {
+	routes, err := c.rest()
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range routes {
+		vars, ok := r.match(path)
+		if !ok {
+			continue
+		}
+		return c.call(r.method, height, func(req *dynamicpb.Message) error {
+			for k, v := range vars {
+				if err := setFieldString(req, k, []string{v}); err != nil {
+					return err
+				}
+			}
+			for k, v := range params {
+				if err := setFieldString(req, k, v); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return nil, &statusError{url: c.target + path, code: http.StatusNotImplemented, status: "501 Not Implemented", body: "no grpc method found for path"}
+}
+
+// route maps rest api path template (eg, "/cosmos/gov/v1beta1/proposals/{proposal_id}/votes") to grpc method
+type route struct {
+	segments []string
+	method   protoreflect.MethodDescriptor
+}
+
+// match returns path variables' values if path matches route template
+func (r route) match(path string) (map[string]string, bool) {
+	segs := strings.Split(strings.Trim(path, "/"), "/")
+	vars := map[string]string{}
+	for i, t := range r.segments {
+		if strings.HasPrefix(t, "{") && strings.HasSuffix(t, "}") {
+			name := strings.TrimSuffix(strings.TrimPrefix(t, "{"), "}")
+			// {name=**} matches the rest of the path
+			if strings.HasSuffix(name, "=**") {
+				if i >= len(segs) {
+					return nil, false
+				}
+				vars[strings.TrimSuffix(name, "=**")] = strings.Join(segs[i:], "/")
+				return vars, true
+			}
+			if i >= len(segs) || segs[i] == "" {
+				return nil, false
+			}
+			vars[strings.TrimSuffix(name, "=*")], _ = url.PathUnescape(segs[i])
+			continue
+		}
+		if i >= len(segs) || segs[i] != t {
+			return nil, false
+		}
+	}
+	return vars, len(segs) == len(r.segments)
+}
+
+// rest returns rest api routes for all grpc services provided by the node, resolved via server reflection on first use
+func (c *grpcClient) rest() ([]route, error) {
+	c.routesMu.Lock()
+	defer c.routesMu.Unlock()
+
+	if c.routes != nil {
+		return c.routes, nil
+	}
+
+	services, err := c.services()
+	if err != nil {
+		return nil, err
+	}
+	var routes []route
+	for _, name := range services {
+		d, err := c.descriptor(protoreflect.FullName(name))
+		if err != nil {
+			return nil, err
+		}
+		sd, ok := d.(protoreflect.ServiceDescriptor)
+		if !ok {
+			continue
+		}
+		for i := 0; i < sd.Methods().Len(); i++ {
+			md := sd.Methods().Get(i)
+			rule, ok := proto.GetExtension(md.Options(), annotations.E_Http).(*annotations.HttpRule)
+			if !ok || rule == nil {
+				continue
+			}
+			for _, r := range append([]*annotations.HttpRule{rule}, rule.GetAdditionalBindings()...) {
+				if r.GetGet() != "" {
+					routes = append(routes, route{segments: strings.Split(strings.Trim(r.GetGet(), "/"), "/"), method: md})
+				}
+			}
+		}
+	}
+	c.routes = routes
+	return c.routes, nil
+}
+
+// services returns names of all grpc services provided by the node, via server reflection
+func (c *grpcClient) services() ([]string, error) {
+	stream, err := rpb.NewServerReflectionClient(c.conn).ServerReflectionInfo(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("error calling server reflection: %v", err)
+	}
+	defer stream.CloseSend()
+
+	if err := stream.Send(&rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_ListServices{ListServices: "*"}}); err != nil {
+		return nil, fmt.Errorf("error requesting services via server reflection: %v", err)
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return nil, fmt.Errorf("error receiving services via server reflection: %v", err)
+	}
+	if e := resp.GetErrorResponse(); e != nil {
+		return nil, fmt.Errorf("error listing services via server reflection: %s", e.ErrorMessage)
+	}
+	var services []string
+	for _, s := range resp.GetListServicesResponse().GetService() {
+		services = append(services, s.GetName())
+	}
+	return services, nil
+}
+
+// invoke calls grpc method (eg, "cosmos.tx.v1beta1.Service.GetTxsEvent") with request populated using optional fill func and returns json-encoded response
+func (c *grpcClient) invoke(method string, fill func(*dynamicpb.Message) error) ([]byte, error) {
+	md, err := c.method(method)
+	if err != nil {
+		return nil, err
+	}
+	return c.call(md, 0, fill)
+}
+
+// call calls grpc method at height (0 means latest) with request populated using optional fill func and returns json-encoded response
+// grpc errors are reported using respective http status codes (as grpc-gateway does), so callers can handle them the same way regardless of the protocol used
+func (c *grpcClient) call(md protoreflect.MethodDescriptor, height int, fill func(*dynamicpb.Message) error) ([]byte, error) {
+	method := string(md.FullName())
+	req := dynamicpb.NewMessage(md.Input())
+	if fill != nil {
+		if err := fill(req); err != nil {
+			return nil, fmt.Errorf("error creating request %s: %v", method, err)
+		}
+	}
+	resp := dynamicpb.NewMessage(md.Output())
+
+	path := fmt.Sprintf("/%s/%s", md.Parent().FullName(), md.Name())
+	ctx := context.Background()
+	for k, v := range bcHeaders {
+		ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(k), strings.Join(v, ","))
+	}
+	if height > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, "x-cosmos-block-height", strconv.Itoa(height))
+	}
+	if bcTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, bcTimeout)
+		defer cancel()
+	}
+	var trailer metadata.MD
+	if err := c.conn.Invoke(ctx, path, req, resp, grpc.Trailer(&trailer)); err != nil {
+		s := status.Convert(err)
+		if s.Code() == codes.ResourceExhausted && strings.Contains(s.Message(), "larger than max") {
+			return nil, fmt.Errorf("error making request %s: %w: %s", c.target+path, errTooLarge, s.Message())
+		}
+		code := httpStatus(s.Code())
+		se := &statusError{url: c.target + path, code: code, status: fmt.Sprintf("%d %s", code, http.StatusText(code)), body: s.Message()}
+		if v := trailer.Get("retry-after"); len(v) > 0 {
+			se.retryAfter = retryAfter(v[0])
+		}
+		return nil, se
+	}
+
+	return protojson.MarshalOptions{UseProtoNames: true, EmitUnpopulated: true, Resolver: c}.Marshal(resp)
+}
+
+// method returns descriptor of fully-qualified grpc method, resolving it via server reflection if needed
+func (c *grpcClient) method(method string) (protoreflect.MethodDescriptor, error) {
+	i := strings.LastIndex(method, ".")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid method name %s", method)
+	}
+	d, err := c.descriptor(protoreflect.FullName(method[:i]))
+	if err != nil {
+		return nil, err
+	}
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", method[:i])
+	}
+	md := sd.Methods().ByName(protoreflect.Name(method[i+1:]))
+	if md == nil {
+		return nil, fmt.Errorf("method %s not found", method)
+	}
+	return md, nil
+}
+
+// descriptor returns descriptor for fully-qualified name, fetching its file (and any missing dependencies) via server reflection if not already known
+func (c *grpcClient) descriptor(name protoreflect.FullName) (protoreflect.Descriptor, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if d, err := c.files.FindDescriptorByName(name); err == nil {
+		return d, nil
+	}
+
+	stream, err := rpb.NewServerReflectionClient(c.conn).ServerReflectionInfo(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("error calling server reflection: %v", err)
+	}
+	defer stream.CloseSend()
+
+	// fetch requested symbol's file and then any missing dependencies
+	reqs := []*rpb.ServerReflectionRequest{{MessageRequest: &rpb.ServerReflectionRequest_FileContainingSymbol{FileContainingSymbol: string(name)}}}
+	for len(reqs) > 0 {
+		req := reqs[0]
+		reqs = reqs[1:]
+		if err := stream.Send(req); err != nil {
+			return nil, fmt.Errorf("error requesting %v via server reflection: %v", req.MessageRequest, err)
+		}
+		resp, err := stream.Recv()
+		if err != nil {
+			return nil, fmt.Errorf("error receiving %v via server reflection: %v", req.MessageRequest, err)
+		}
+		if e := resp.GetErrorResponse(); e != nil {
+			return nil, fmt.Errorf("error resolving %v via server reflection: %s", req.MessageRequest, e.ErrorMessage)
+		}
+		for _, b := range resp.GetFileDescriptorResponse().GetFileDescriptorProto() {
+			var fdp descriptorpb.FileDescriptorProto
+			if err := proto.Unmarshal(b, &fdp); err != nil {
+				return nil, fmt.Errorf("error unmarshalling file descriptor: %v", err)
+			}
+			c.fdps[fdp.GetName()] = &fdp
+		}
+		for _, fdp := range c.fdps {
+			for _, dep := range fdp.GetDependency() {
+				if _, ok := c.fdps[dep]; !ok && !pending(reqs, dep) {
+					reqs = append(reqs, &rpb.ServerReflectionRequest{MessageRequest: &rpb.ServerReflectionRequest_FileByFilename{FileByFilename: dep}})
+				}
+			}
+		}
+	}
+
+	fds := descriptorpb.FileDescriptorSet{}
+	for _, fdp := range c.fdps {
+		fds.File = append(fds.File, fdp)
+	}
+	files, err := protodesc.NewFiles(&fds)
+	if err != nil {
+		return nil, fmt.Errorf("error building file descriptors: %v", err)
+	}
+	c.files = files
+
+	return c.files.FindDescriptorByName(name)
+}
+
+// FindMessageByName implements protoregistry.MessageTypeResolver (used to resolve Any types when marshalling responses)
+func (c *grpcClient) FindMessageByName(name protoreflect.FullName) (protoreflect.MessageType, error) {
+	d, err := c.descriptor(name)
+	if err != nil {
+		return nil, err
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message", name)
+	}
+	return dynamicpb.NewMessageType(md), nil
+}
+
+// FindMessageByURL implements protoregistry.MessageTypeResolver
+func (c *grpcClient) FindMessageByURL(url string) (protoreflect.MessageType, error) {
+	if i := strings.LastIndex(url, "/"); i >= 0 {
+		url = url[i+1:]
+	}
+	return c.FindMessageByName(protoreflect.FullName(url))
+}
+
+// FindExtensionByName implements protoregistry.ExtensionTypeResolver (extensions are not used in responses)
+func (c *grpcClient) FindExtensionByName(field protoreflect.FullName) (protoreflect.ExtensionType, error) {
+	return nil, protoregistry.NotFound
+}
+
+// FindExtensionByNumber implements protoregistry.ExtensionTypeResolver (extensions are not used in responses)
+func (c *grpcClient) FindExtensionByNumber(message protoreflect.FullName, field protoreflect.FieldNumber) (protoreflect.ExtensionType, error) {
+	return nil, protoregistry.NotFound
+}
+
+// pending returns true if reflection request for file is already queued
+func pending(reqs []*rpb.ServerReflectionRequest, file string) bool {
+	for _, r := range reqs {
+		if r.GetFileByFilename() == file {
+			return true
+		}
+	}
+	return false
+}
+
+// setFieldString sets message's field (referenced by path of field names, eg "pagination.key") to values parsed as per field's type
+func setFieldString(m protoreflect.Message, path string, values []string) error {
+	names := strings.Split(path, ".")
+	for i, name := range names {
+		fd := m.Descriptor().Fields().ByName(protoreflect.Name(name))
+		if fd == nil {
+			fd = m.Descriptor().Fields().ByJSONName(name)
+		}
+		if fd == nil {
+			return fmt.Errorf("field %s not found in %s", name, m.Descriptor().FullName())
+		}
+		if i < len(names)-1 {
+			if fd.Kind() != protoreflect.MessageKind || fd.IsList() || fd.IsMap() {
+				return fmt.Errorf("field %s in %s is not a message", name, m.Descriptor().FullName())
+			}
+			m = m.Mutable(fd).Message()
+			continue
+		}
+		for _, s := range values {
+			v, err := parseValue(fd, s)
+			if err != nil {
+				return fmt.Errorf("error parsing value %q for field %s: %v", s, path, err)
+			}
+			if fd.IsList() {
+				m.Mutable(fd).List().Append(v)
+			} else {
+				m.Set(fd, v)
+			}
+		}
+	}
+	return nil
+}
+
+// parseValue returns value parsed from s as per field's (scalar) type
+func parseValue(fd protoreflect.FieldDescriptor, s string) (protoreflect.Value, error) {
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return protoreflect.ValueOfString(s), nil
+	case protoreflect.BoolKind:
+		v, err := strconv.ParseBool(s)
+		return protoreflect.ValueOfBool(v), err
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfInt32(int32(v)), err
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		v, err := strconv.ParseInt(s, 10, 64)
+		return protoreflect.ValueOfInt64(v), err
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+		v, err := strconv.ParseUint(s, 10, 32)
+		return protoreflect.ValueOfUint32(uint32(v)), err
+	case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		v, err := strconv.ParseUint(s, 10, 64)
+		return protoreflect.ValueOfUint64(v), err
+	case protoreflect.FloatKind:
+		v, err := strconv.ParseFloat(s, 32)
+		return protoreflect.ValueOfFloat32(float32(v)), err
+	case protoreflect.DoubleKind:
+		v, err := strconv.ParseFloat(s, 64)
+		return protoreflect.ValueOfFloat64(v), err
+	case protoreflect.BytesKind:
+		v, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			v, err = base64.URLEncoding.DecodeString(s)
+		}
+		return protoreflect.ValueOfBytes(v), err
+	case protoreflect.EnumKind:
+		if ev := fd.Enum().Values().ByName(protoreflect.Name(s)); ev != nil {
+			return protoreflect.ValueOfEnum(ev.Number()), nil
+		}
+		v, err := strconv.ParseInt(s, 10, 32)
+		return protoreflect.ValueOfEnum(protoreflect.EnumNumber(v)), err
+	default:
+		return protoreflect.Value{}, fmt.Errorf("unsupported field type %s", fd.Kind())
+	}
+}
+
+// setField sets message's field name to value
+func setField(m protoreflect.Message, name string, value protoreflect.Value) error {
+	fd := m.Descriptor().Fields().ByName(protoreflect.Name(name))
+	if fd == nil {
+		return fmt.Errorf("field %s not found in %s", name, m.Descriptor().FullName())
+	}
+	m.Set(fd, value)
+	return nil
+}
+
+// httpStatus maps grpc code to http status code
+// ref: https://github.com/grpc-ecosystem/grpc-gateway/blob/master/runtime/errors.go
+func httpStatus(code codes.Code) int {
+	switch code {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return http.StatusRequestTimeout
+	case codes.InvalidArgument, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.FailedPrecondition:
+		return http.StatusBadRequest
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
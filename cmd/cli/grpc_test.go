@@ -0,0 +1,343 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"google.golang.org/genproto/googleapis/api/annotations"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// testProto returns descriptor of test query service file, with rest api routes as per google.api.http annotations, like cosmos modules' query services have
+func testProto() *descriptorpb.FileDescriptorProto {
+	rule := func(path string, more ...string) *descriptorpb.MethodOptions {
+		r := &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: path}}
+		for _, p := range more {
+			r.AdditionalBindings = append(r.AdditionalBindings, &annotations.HttpRule{Pattern: &annotations.HttpRule_Get{Get: p}})
+		}
+		opts := &descriptorpb.MethodOptions{}
+		proto.SetExtension(opts, annotations.E_Http, r)
+		return opts
+	}
+	field := func(name string, n int32, typ descriptorpb.FieldDescriptorProto_Type, typeName string) *descriptorpb.FieldDescriptorProto {
+		f := &descriptorpb.FieldDescriptorProto{Name: proto.String(name), Number: proto.Int32(n), Type: typ.Enum(), Label: descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum()}
+		if typeName != "" {
+			f.TypeName = proto.String(typeName)
+		}
+		return f
+	}
+	message := func(name string, fields ...*descriptorpb.FieldDescriptorProto) *descriptorpb.DescriptorProto {
+		return &descriptorpb.DescriptorProto{Name: proto.String(name), Field: fields}
+	}
+	method := func(name, in, out string, opts *descriptorpb.MethodOptions) *descriptorpb.MethodDescriptorProto {
+		return &descriptorpb.MethodDescriptorProto{Name: proto.String(name), InputType: proto.String(".scraper.test.v1." + in), OutputType: proto.String(".scraper.test.v1." + out), Options: opts}
+	}
+	const (
+		u64   = descriptorpb.FieldDescriptorProto_TYPE_UINT64
+		i64   = descriptorpb.FieldDescriptorProto_TYPE_INT64
+		str   = descriptorpb.FieldDescriptorProto_TYPE_STRING
+		byt   = descriptorpb.FieldDescriptorProto_TYPE_BYTES
+		msg   = descriptorpb.FieldDescriptorProto_TYPE_MESSAGE
+		enum  = descriptorpb.FieldDescriptorProto_TYPE_ENUM
+		boole = descriptorpb.FieldDescriptorProto_TYPE_BOOL
+	)
+	tags := field("tags", 6, str, "")
+	tags.Label = descriptorpb.FieldDescriptorProto_LABEL_REPEATED.Enum()
+	post := &descriptorpb.MethodOptions{}
+	proto.SetExtension(post, annotations.E_Http, &annotations.HttpRule{Pattern: &annotations.HttpRule_Post{Post: "/scraper/test/v1/proposals"}})
+
+	return &descriptorpb.FileDescriptorProto{
+		Name:       proto.String("scraper/test/v1/query.proto"),
+		Package:    proto.String("scraper.test.v1"),
+		Dependency: []string{"google/api/annotations.proto", "google/protobuf/any.proto"},
+		Syntax:     proto.String("proto3"),
+		EnumType: []*descriptorpb.EnumDescriptorProto{{
+			Name: proto.String("Status"),
+			Value: []*descriptorpb.EnumValueDescriptorProto{
+				{Name: proto.String("STATUS_UNSPECIFIED"), Number: proto.Int32(0)},
+				{Name: proto.String("STATUS_PASSED"), Number: proto.Int32(1)},
+			},
+		}},
+		MessageType: []*descriptorpb.DescriptorProto{
+			message("Proposal", field("proposal_id", 1, u64, ""), field("title", 2, str, ""), field("content", 3, msg, ".google.protobuf.Any"), field("data", 4, byt, ""), field("status", 5, enum, ".scraper.test.v1.Status"), tags),
+			message("TextProposal", field("description", 1, str, "")),
+			message("PageRequest", field("key", 1, byt, ""), field("limit", 2, u64, ""), field("reverse", 3, boole, "")),
+			message("QueryProposalRequest", field("proposal_id", 1, u64, "")),
+			message("QueryProposalResponse", field("proposal", 1, msg, ".scraper.test.v1.Proposal"), field("height", 2, i64, "")),
+			message("QueryVotesRequest", field("proposal_id", 1, u64, ""), field("voter", 2, str, ""), field("status", 3, enum, ".scraper.test.v1.Status"), field("pagination", 4, msg, ".scraper.test.v1.PageRequest")),
+			message("QueryVotesResponse", field("request", 1, msg, ".scraper.test.v1.QueryVotesRequest")),
+			message("QueryDenomRequest", field("denom", 1, str, "")),
+			message("QueryDenomResponse", field("denom", 1, str, "")),
+		},
+		Service: []*descriptorpb.ServiceDescriptorProto{{
+			Name: proto.String("Query"),
+			Method: []*descriptorpb.MethodDescriptorProto{
+				method("Proposal", "QueryProposalRequest", "QueryProposalResponse", rule("/scraper/test/v1/proposals/{proposal_id}")),
+				method("Votes", "QueryVotesRequest", "QueryVotesResponse", rule("/scraper/test/v1/proposals/{proposal_id}/votes", "/scraper/test/v1/voters/{voter}/votes")),
+				method("Denom", "QueryDenomRequest", "QueryDenomResponse", rule("/scraper/test/v1/denoms/{denom=**}")),
+				method("Submit", "QueryProposalRequest", "QueryProposalResponse", post),
+			},
+		}},
+	}
+}
+
+// serverCodec is protoCodec usable as (deprecated) server codec
+type serverCodec struct{ protoCodec }
+
+func (serverCodec) String() string { return "proto" }
+
+// grpcServer starts grpc server with server reflection, serving test query service (see testProto), and returns its host and port
+// Proposal method only knows proposal 5, and reports height requested via x-cosmos-block-height header, while other methods echo their requests
+func grpcServer(t *testing.T) (host, port string) {
+	fdp := testProto()
+	fd, err := protodesc.NewFile(fdp, protoregistry.GlobalFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd := fd.Services().ByName("Query")
+	byName := func(name protoreflect.Name) protoreflect.MessageDescriptor { return fd.Messages().ByName(name) }
+	set := func(m protoreflect.Message, name string, v protoreflect.Value) {
+		m.Set(m.Descriptor().Fields().ByName(protoreflect.Name(name)), v)
+	}
+	get := func(m protoreflect.Message, name string) protoreflect.Value {
+		return m.Get(m.Descriptor().Fields().ByName(protoreflect.Name(name)))
+	}
+
+	handler := func(md protoreflect.MethodDescriptor, serve func(ctx context.Context, req, resp protoreflect.Message) error) grpc.MethodDesc {
+		return grpc.MethodDesc{
+			MethodName: string(md.Name()),
+			Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error, _ grpc.UnaryServerInterceptor) (interface{}, error) {
+				req, resp := dynamicpb.NewMessage(md.Input()), dynamicpb.NewMessage(md.Output())
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return resp, serve(ctx, req, resp)
+			},
+		}
+	}
+	proposal := func(ctx context.Context, req, resp protoreflect.Message) error {
+		id := get(req, "proposal_id").Uint()
+		if id == 0 {
+			return status.Error(codes.InvalidArgument, "proposal id can not be 0")
+		}
+		if id != 5 {
+			return status.Errorf(codes.NotFound, "proposal %d doesn't exist", id)
+		}
+		p := resp.Mutable(resp.Descriptor().Fields().ByName("proposal")).Message()
+		set(p, "proposal_id", protoreflect.ValueOfUint64(id))
+		set(p, "title", protoreflect.ValueOfString("text"))
+		set(p, "data", protoreflect.ValueOfBytes([]byte{1, 2}))
+		set(p, "status", protoreflect.ValueOfEnum(1))
+		tags := p.Mutable(p.Descriptor().Fields().ByName("tags")).List()
+		tags.Append(protoreflect.ValueOfString("a"))
+		tags.Append(protoreflect.ValueOfString("b"))
+		text := dynamicpb.NewMessage(byName("TextProposal"))
+		set(text, "description", protoreflect.ValueOfString("d"))
+		value, err := proto.Marshal(text)
+		if err != nil {
+			return err
+		}
+		content := p.Mutable(p.Descriptor().Fields().ByName("content")).Message()
+		set(content, "type_url", protoreflect.ValueOfString("/scraper.test.v1.TextProposal"))
+		set(content, "value", protoreflect.ValueOfBytes(value))
+		if md, ok := metadata.FromIncomingContext(ctx); ok && len(md.Get("x-cosmos-block-height")) > 0 {
+			h, err := strconv.ParseInt(md.Get("x-cosmos-block-height")[0], 10, 64)
+			if err != nil {
+				return status.Error(codes.InvalidArgument, err.Error())
+			}
+			set(resp, "height", protoreflect.ValueOfInt64(h))
+		}
+		return nil
+	}
+	echo := func(ctx context.Context, req, resp protoreflect.Message) error {
+		fd := resp.Descriptor().Fields().Get(0)
+		if fd.Kind() == protoreflect.MessageKind {
+			resp.Set(fd, protoreflect.ValueOfMessage(req))
+			return nil
+		}
+		resp.Set(fd, get(req, string(fd.Name())))
+		return nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	b, err := proto.Marshal(fdp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw.Write(b)
+	zw.Close()
+
+	srv := grpc.NewServer(grpc.CustomCodec(serverCodec{}))
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: string(sd.FullName()),
+		HandlerType: (*interface{})(nil),
+		Methods: []grpc.MethodDesc{
+			handler(sd.Methods().ByName("Proposal"), proposal),
+			handler(sd.Methods().ByName("Votes"), echo),
+			handler(sd.Methods().ByName("Denom"), echo),
+			handler(sd.Methods().ByName("Submit"), proposal),
+		},
+		Metadata: buf.Bytes(), // gzipped file descriptor, used by server reflection
+	}, struct{}{})
+	reflection.Register(srv)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(srv.Stop)
+	host, port, err = net.SplitHostPort(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port
+}
+
+func TestRouteMatch(t *testing.T) {
+	tests := []struct {
+		template string
+		path     string
+		vars     map[string]string // nil if not matching
+	}{
+		{template: "/cosmos/gov/v1beta1/proposals", path: "/cosmos/gov/v1beta1/proposals", vars: map[string]string{}},
+		{template: "/cosmos/gov/v1beta1/proposals/{proposal_id}/votes", path: "/cosmos/gov/v1beta1/proposals/5/votes", vars: map[string]string{"proposal_id": "5"}},
+		{template: "/cosmos/gov/v1beta1/proposals/{proposal_id}/votes/{voter}", path: "cosmos/gov/v1beta1/proposals/5/votes/cosmos1x/", vars: map[string]string{"proposal_id": "5", "voter": "cosmos1x"}},
+		{template: "/cosmos/bank/v1beta1/denoms_metadata/{denom=*}", path: "/cosmos/bank/v1beta1/denoms_metadata/ibc%2FABC", vars: map[string]string{"denom": "ibc/ABC"}},
+		{template: "/ibc/apps/transfer/v1/denom_traces/{hash=**}", path: "/ibc/apps/transfer/v1/denom_traces/ibc/ABC", vars: map[string]string{"hash": "ibc/ABC"}},
+		{template: "/cosmos/gov/v1beta1/proposals/{proposal_id}", path: "/cosmos/gov/v1beta1/proposals/5/votes"},
+		{template: "/cosmos/gov/v1beta1/proposals/{proposal_id}/votes", path: "/cosmos/gov/v1beta1/proposals/5"},
+		{template: "/cosmos/gov/v1beta1/proposals/{proposal_id}/votes", path: "/cosmos/gov/v1beta1/proposals//votes"},
+		{template: "/cosmos/gov/v1beta1/proposals/{proposal_id}", path: "/cosmos/gov/v1/proposals/5"},
+		{template: "/ibc/apps/transfer/v1/denom_traces/{hash=**}", path: "/ibc/apps/transfer/v1/denom_traces"},
+	}
+	for _, tc := range tests {
+		r := route{segments: strings.Split(strings.Trim(tc.template, "/"), "/")}
+		vars, ok := r.match(tc.path)
+		if ok != (tc.vars != nil) || (ok && !reflect.DeepEqual(vars, tc.vars)) {
+			t.Errorf("%s matching %s: got %v (%v), want %v", tc.template, tc.path, vars, ok, tc.vars)
+		}
+	}
+}
+
+func TestGRPCQuery(t *testing.T) {
+	host, port := grpcServer(t)
+	c, err := newGRPCClient(host, port, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		params url.Values
+		height int
+		want   string // json response
+		code   int    // http status code of expected error, if any
+	}{
+		{
+			name:   "any resolved via reflection",
+			path:   "/scraper/test/v1/proposals/5",
+			height: 100,
+			want:   `{"proposal":{"proposal_id":"5","title":"text","content":{"@type":"/scraper.test.v1.TextProposal","description":"d"},"data":"AQI=","status":"STATUS_PASSED","tags":["a","b"]},"height":"100"}`,
+		},
+		{
+			name:   "params",
+			path:   "/scraper/test/v1/proposals/7/votes",
+			params: url.Values{"pagination.key": {"AQI="}, "pagination.limit": {"10"}, "status": {"STATUS_PASSED"}},
+			want:   `{"request":{"proposal_id":"7","voter":"","status":"STATUS_PASSED","pagination":{"key":"AQI=","limit":"10","reverse":false}}}`,
+		},
+		{
+			name:   "json param names and enum numbers",
+			path:   "/scraper/test/v1/proposals/7/votes",
+			params: url.Values{"proposalId": {"8"}, "status": {"1"}, "pagination.reverse": {"true"}},
+			want:   `{"request":{"proposal_id":"8","voter":"","status":"STATUS_PASSED","pagination":{"key":"","limit":"0","reverse":true}}}`,
+		},
+		{
+			name: "additional binding",
+			path: "/scraper/test/v1/voters/cosmos%2F1/votes",
+			want: `{"request":{"proposal_id":"0","voter":"cosmos/1","status":"STATUS_UNSPECIFIED","pagination":null}}`,
+		},
+		{
+			name: "rest of path",
+			path: "/scraper/test/v1/denoms/ibc/ABC",
+			want: `{"denom":"ibc/ABC"}`,
+		},
+		{name: "not found", path: "/scraper/test/v1/proposals/9", code: http.StatusNotFound},
+		{name: "invalid argument", path: "/scraper/test/v1/proposals/0", code: http.StatusBadRequest},
+		{name: "post only", path: "/scraper/test/v1/proposals", code: http.StatusNotImplemented},
+		{name: "unknown path", path: "/scraper/test/v2/proposals/5", code: http.StatusNotImplemented},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := c.query(tc.path, tc.params, tc.height)
+			if tc.code != 0 {
+				var se *statusError
+				if !errors.As(err, &se) || se.code != tc.code {
+					t.Fatalf("got error %v, want status %d", err, tc.code)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got, want interface{}
+			if err := json.Unmarshal(res, &got); err != nil {
+				t.Fatalf("invalid json response %s: %v", res, err)
+			}
+			if err := json.Unmarshal([]byte(tc.want), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %s, want %s", res, tc.want)
+			}
+		})
+	}
+
+	if _, err := c.query("/scraper/test/v1/proposals/5/votes", url.Values{"pagination.limit": {"x"}}, 0); err == nil {
+		t.Error("expected error for invalid param value")
+	}
+	if _, err := c.query("/scraper/test/v1/proposals/5/votes", url.Values{"unknown": {"x"}}, 0); err == nil {
+		t.Error("expected error for unknown param")
+	}
+	if _, err := c.invoke("scraper.test.v1.Query.Missing", nil); err == nil {
+		t.Error("expected error for unknown method")
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// serveHTTP serves mux on addr, until ctx cancelled
+func serveHTTP(ctx context.Context, addr string, mux *http.ServeMux) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(sctx)
+	}()
+	stdLogger.Printf("serving http endpoints on %s", ln.Addr())
+	go func() {
+		if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			stdLogger.Printf("error serving http endpoints: %v", err)
+		}
+	}()
+	return nil
+}
+
+// health reports scraper's liveness and readiness, based on node and database connectivity, lag behind chain head and progress
+// scraper is considered stalled if watermark (ie, last height with all lower heights processed) hasn't advanced for stallTimeout while lagging behind head
+type health struct {
+	bcc       bcSource
+	dbc       *mongo.Client // nil if not using mongo database
+	watermark func() int
+	timeout   time.Duration
+
+	mu       sync.Mutex
+	head     int
+	last     int       // last seen watermark
+	progress time.Time // when watermark last advanced
+}
+
+// healthStatus is health endpoints' response
+type healthStatus struct {
+	Status    string        `json:"status"`
+	Node      string        `json:"node,omitempty"`
+	Database  string        `json:"database,omitempty"`
+	Head      int           `json:"head"`
+	Watermark int           `json:"watermark"`
+	Lag       int           `json:"lag"`
+	Stalled   bool          `json:"stalled"`
+	Build     buildMetadata `json:"build"`
+}
+
+// newHealth returns health of scraper using bcc and dbc, with progress tracked by watermark
+func newHealth(bcc bcSource, dbc *mongo.Client, watermark func() int, stallTimeout time.Duration) *health {
+	return &health{bcc: bcc, dbc: dbc, watermark: watermark, timeout: stallTimeout, last: watermark(), progress: time.Now()}
+}
+
+// setHead records current chain head
+func (h *health) setHead(head int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.head = head
+}
+
+// status returns current head, watermark and lag, and if scraper is stalled
+func (h *health) status() healthStatus {
+	w := h.watermark()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if w != h.last {
+		h.last, h.progress = w, time.Now()
+	}
+	s := healthStatus{Status: "ok", Head: h.head, Watermark: w, Build: build()}
+	if h.head > w {
+		s.Lag = h.head - w
+	}
+	s.Stalled = s.Lag > 0 && time.Since(h.progress) > h.timeout
+	return s
+}
+
+// register registers /healthz (liveness: not stalled) and /readyz (readiness: also node and database reachable) endpoints in mux
+func (h *health) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		s := h.status()
+		if s.Stalled {
+			s.Status = "stalled"
+		}
+		h.reply(w, s)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		s := h.status()
+		ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+		defer cancel()
+		s.Node = "ok"
+		if err := h.pingNode(ctx); err != nil {
+			s.Node, s.Status = err.Error(), "unavailable"
+		}
+		if h.dbc != nil {
+			s.Database = "ok"
+			if err := h.dbc.Ping(ctx, nil); err != nil {
+				s.Database, s.Status = err.Error(), "unavailable"
+			}
+		}
+		if s.Stalled {
+			s.Status = "stalled"
+		}
+		h.reply(w, s)
+	})
+}
+
+// pingNode returns error if latest block can't be got from node before ctx expires
+func (h *health) pingNode(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := h.bcc.block("latest")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// reply writes status s as json, with 503 status code if not ok
+func (h *health) reply(w http.ResponseWriter, s healthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	if s.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,49 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// heartbeat updates heartbeat doc of this instance in col every interval, until ctx cancelled
+// doc, keyed by instance id, has instance name (if set), last completed height (ie, watermark), chain head, version (and commit) and update time, so external monitoring can detect dead scraper using database query only (eg, by stale updated_at)
+func heartbeat(ctx context.Context, col *mongo.Collection, pg *progress, interval time.Duration) {
+	id := instanceID()
+	started := time.Now().UTC()
+	periodically(ctx, "heartbeat", interval, func(ctx context.Context) error {
+		s := pg.sample()
+		return updateWithRetry(ctx, col, id, bson.M{"$set": bson.M{
+			"instance":      id,
+			"name":          instanceName,
+			"version":       version,
+			"commit":        commit,
+			"started_at":    started,
+			"height":        s.watermark,
+			"head":          s.head,
+			"stored_blocks": s.blocks,
+			"stored_txs":    s.txs,
+			"stalled":       atomic.LoadInt32(&stalled) == 1,
+			"updated_at":    s.at.UTC(),
+		}})
+	})
+}
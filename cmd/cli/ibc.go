@@ -0,0 +1,191 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ibcScraper scrapes ibc clients, connections and channels state every interval, until ctx cancelled
+// data is stored in ibc_clients, ibc_connections and ibc_channels collections, keyed by respective ids, and updated as state changes
+func ibcScraper(ctx context.Context, bcc bcSource, db *mongo.Database, interval time.Duration) {
+	periodically(ctx, "ibc state", interval, func(ctx context.Context) error {
+		stdLogger.Println("scraping ibc state...")
+		if err := scrapeIBC(ctx, bcc, db); err != nil {
+			return err
+		}
+		stdLogger.Printf("scraping ibc state done (next in %s)", interval)
+		return nil
+	})
+}
+
+// scrapeIBC scrapes all ibc clients, connections and channels at the current height
+func scrapeIBC(ctx context.Context, bcc bcSource, db *mongo.Database) error {
+	h, err := bcHeight(ctx, bcc, bcRetry)
+	if err != nil {
+		return err
+	}
+	extra := bson.M{"scraped_height": h, "scraped_at": time.Now().UTC()}
+
+	// ref: https://github.com/cosmos/ibc-go/tree/main/proto/ibc/core
+	for _, q := range []struct {
+		path, field, col string
+		id               func([]byte) (string, error)
+	}{
+		{"/ibc/core/client/v1/client_states", "client_states", "ibc_clients", jsonID("client_id")},
+		{"/ibc/core/connection/v1/connections", "connections", "ibc_connections", jsonID("id")},
+		{"/ibc/core/channel/v1/channels", "channels", "ibc_channels", func(raw []byte) (string, error) {
+			var c struct {
+				PortID    string `json:"port_id"`
+				ChannelID string `json:"channel_id"`
+			}
+			err := json.Unmarshal(raw, &c)
+			return c.PortID + "/" + c.ChannelID, err
+		}},
+	} {
+		items, err := queryAll(ctx, bcc, q.path, nil, q.field, h, bcRetry)
+		if err != nil {
+			return err
+		}
+		for _, raw := range items {
+			id, err := q.id(raw)
+			if err != nil {
+				return fmt.Errorf("error unmarshalling %s %s: %v", q.field, string(raw), err)
+			}
+			if err := upsert(ctx, collection(db, q.col), id, raw, extra); err != nil {
+				return fmt.Errorf("error storing %s %s: %v", q.field, id, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// jsonID returns func that extracts string field from raw json object
+func jsonID(field string) func([]byte) (string, error) {
+	return func(raw []byte) (string, error) {
+		var m map[string]interface{}
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return "", err
+		}
+		id, _ := m[field].(string)
+		return id, nil
+	}
+}
+
+// ibcPacketEvents are ibc packet lifecycle event types tracked
+var ibcPacketEvents = map[string]bool{
+	"send_packet":           true,
+	"recv_packet":           true,
+	"write_acknowledgement": true,
+	"acknowledge_packet":    true,
+	"timeout_packet":        true,
+	"timeout_on_close":      true,
+}
+
+// storeIBCPackets extracts ibc packet events from raw transactions at height and stores them into ibc collection
+// each event is stored as a separate doc, keyed by event type, source port and channel and packet sequence, so re-processing the same height is safe
+func storeIBCPackets(ctx context.Context, raw []byte, height int, ibc *mongo.Collection) error {
+	var t struct {
+		TxResponses []struct {
+			TxHash string `json:"txhash"`
+			Logs   []struct {
+				Events []abciEvent `json:"events"`
+			} `json:"logs"`
+			Events []abciEvent `json:"events"`
+		} `json:"tx_responses"`
+	}
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return fmt.Errorf("error unmarshalling transactions: %v", err)
+	}
+
+	for _, tx := range t.TxResponses {
+		// prefer (plain) events from logs, as tx events might be base64-encoded (ie, tendermint v0.34)
+		events := tx.Events
+		if len(tx.Logs) > 0 {
+			events = nil
+			for _, l := range tx.Logs {
+				events = append(events, l.Events...)
+			}
+		}
+		for _, e := range events {
+			if !ibcPacketEvents[e.Type] {
+				continue
+			}
+			attrs := e.attributes()
+			id := fmt.Sprintf("%s/%s/%s/%s", e.Type, attrs["packet_src_port"], attrs["packet_src_channel"], attrs["packet_sequence"])
+			doc, err := json.Marshal(map[string]interface{}{
+				"type":       e.Type,
+				"height":     height,
+				"txhash":     tx.TxHash,
+				"attributes": attrs,
+			})
+			if err != nil {
+				return err
+			}
+			if err := upsert(ctx, ibc, id, doc, nil); err != nil {
+				return fmt.Errorf("error storing ibc packet event %s: %v", id, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// abciEvent is abci event as returned in transactions
+type abciEvent struct {
+	Type       string `json:"type"`
+	Attributes []struct {
+		Key   string `json:"key"`
+		Value string `json:"value"`
+	} `json:"attributes"`
+}
+
+// identifier matches plain event attribute keys
+var identifier = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// attributes returns event attributes as map, decoding them if base64-encoded
+// note: plain ibc attribute keys (eg, 'packet_sequence') contain underscores that are invalid in (std) base64 encoding, so they are told apart reliably
+func (e abciEvent) attributes() map[string]string {
+	encoded := len(e.Attributes) > 0
+	for _, a := range e.Attributes {
+		k, err := base64.StdEncoding.DecodeString(a.Key)
+		if err != nil || !identifier.Match(k) {
+			encoded = false
+			break
+		}
+	}
+	attrs := map[string]string{}
+	for _, a := range e.Attributes {
+		k, v := a.Key, a.Value
+		if encoded {
+			kb, _ := base64.StdEncoding.DecodeString(k)
+			vb, _ := base64.StdEncoding.DecodeString(v)
+			k, v = string(kb), string(vb)
+		}
+		attrs[k] = v
+	}
+	return attrs
+}
@@ -0,0 +1,116 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// recommendedIndexes returns indexes recommended for querying blocks, transactions and block results (and heights ledger, if enabled), by collection
+// note: docs are also keyed by height (ie, _id), but raw heights are (api) strings, so they are indexed to be queried as such
+// unique indexes are partial, as compressed and oversized docs don't have raw fields
+func recommendedIndexes() map[string][]mongo.IndexModel {
+	txs := []mongo.IndexModel{
+		{Keys: bson.D{{Key: "tx_responses.height", Value: 1}}, Options: options.Index().SetName("cs_height")},
+		{Keys: bson.D{{Key: "tx_responses.txhash", Value: 1}}, Options: options.Index().SetName("cs_txhash")},
+	}
+	if dbTxDocs {
+		// one doc per transaction, keyed by tx hash
+		txs = []mongo.IndexModel{
+			{Keys: bson.D{{Key: "height", Value: 1}, {Key: "index", Value: 1}}, Options: options.Index().SetName("cs_height")},
+			{Keys: bson.D{{Key: "txhash", Value: 1}}, Options: options.Index().SetName("cs_txhash")},
+		}
+	}
+	indexes := map[string][]mongo.IndexModel{
+		dbCollections["block"]: {
+			{Keys: bson.D{{Key: "block.header.height", Value: 1}}, Options: options.Index().SetName("cs_height").SetUnique(true).SetPartialFilterExpression(bson.M{"block.header.height": bson.M{"$exists": true}})},
+			{Keys: bson.D{{Key: "block.header.time", Value: 1}}, Options: options.Index().SetName("cs_time")},
+		},
+		dbCollections["transactions"]: txs,
+		dbCollections["block_results"]: {
+			{Keys: bson.D{{Key: "height", Value: 1}}, Options: options.Index().SetName("cs_height").SetUnique(true).SetPartialFilterExpression(bson.M{"height": bson.M{"$exists": true}})},
+		},
+	}
+	if heightLedger {
+		indexes["heights"] = []mongo.IndexModel{
+			{Keys: bson.D{{Key: "state", Value: 1}}, Options: options.Index().SetName("cs_state")},
+		}
+	}
+	return indexes
+}
+
+// ensureIndexes creates any missing recommended indexes in db
+// failures (eg, unique index on collection with duplicates from previous versions) are only logged, as indexes are not required for scraping
+func ensureIndexes(ctx context.Context, db *mongo.Database) {
+	for col, models := range recommendedIndexes() {
+		for _, m := range models {
+			name, err := collection(db, col).Indexes().CreateOne(ctx, m)
+			if err != nil {
+				stdLogger.Printf("warn: error creating index %s on %s collection: %v", *m.Options.Name, col, err)
+				continue
+			}
+			stdLogger.Printf("verified index %s on %s collection", name, col)
+		}
+	}
+}
+
+// manageIndexes lists, creates or drops recommended indexes, as per action
+func manageIndexes(ctx context.Context, action string) error {
+	if dbType != "mongo" {
+		return fmt.Errorf("indexes require mongo database")
+	}
+	dbc, _, _, _ := initDB(ctx, dbHost, dbPort, dbUser, dbPass, dbRetry)
+	defer dbc.Disconnect(context.Background())
+	db := dbc.Database(dbName)
+
+	switch action {
+	case "list":
+		for col := range recommendedIndexes() {
+			cur, err := collection(db, col).Indexes().List(ctx)
+			if err != nil {
+				return fmt.Errorf("error listing indexes on %s collection: %v", col, err)
+			}
+			var specs []bson.M
+			if err := cur.All(ctx, &specs); err != nil {
+				return fmt.Errorf("error reading indexes on %s collection: %v", col, err)
+			}
+			for _, s := range specs {
+				fmt.Printf("%s\t%v\t%v\n", col, s["name"], s["key"])
+			}
+		}
+	case "create":
+		ensureIndexes(ctx, db)
+	case "drop":
+		for col, models := range recommendedIndexes() {
+			for _, m := range models {
+				if _, err := collection(db, col).Indexes().DropOne(ctx, *m.Options.Name); err != nil && !strings.Contains(err.Error(), "not found") {
+					return fmt.Errorf("error dropping index %s on %s collection: %v", *m.Options.Name, col, err)
+				}
+				stdLogger.Printf("dropped index %s on %s collection", *m.Options.Name, col)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown indexes action %q: expected 'list', 'create' or 'drop'", action)
+	}
+	return nil
+}
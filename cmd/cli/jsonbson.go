@@ -0,0 +1,334 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// jsonDoc returns bson doc with _id and any extra fields, followed by fields of raw json object (except for those overridden by the former)
+// it's equivalent to unmarshalling raw json into bson.M, setting the fields and marshalling it (eg, json numbers are stored as doubles), but converts json directly, without intermediate values, and keeps fields order
+func jsonDoc(id interface{}, raw []byte, extra bson.M) (bson.Raw, error) {
+	if !json.Valid(raw) {
+		return nil, fmt.Errorf("error unmarshalling %s: invalid json", string(raw))
+	}
+	c := &jsonConverter{in: raw, out: make([]byte, 0, len(raw))}
+	c.space()
+	if c.i >= len(c.in) || c.in[c.i] != '{' {
+		return nil, fmt.Errorf("error unmarshalling %s: not an object", string(raw))
+	}
+	fields := []string{"_id"}
+	for k := range extra {
+		fields = append(fields, k)
+	}
+	c.skip = func(key []byte) bool {
+		for _, f := range fields {
+			if string(key) == f {
+				return true
+			}
+		}
+		return false
+	}
+
+	start := len(c.out)
+	c.out = append(c.out, 0, 0, 0, 0)
+	if err := c.field("_id", id); err != nil {
+		return nil, err
+	}
+	for k, v := range extra {
+		if err := c.field(k, v); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.members('}', false); err != nil {
+		return nil, fmt.Errorf("error unmarshalling %s: %v", string(raw), err)
+	}
+	c.end(start)
+	return c.out, nil
+}
+
+// jsonConverter converts valid json (as per json.Valid) to bson
+type jsonConverter struct {
+	in    []byte
+	i     int // position in input
+	out   []byte
+	skip  func(key []byte) bool // top-level keys to skip
+	elems []int                 // start positions of elements of objects being converted (stacked for nested objects), to find duplicate keys
+}
+
+// field appends element key with value v (marshalled)
+func (c *jsonConverter) field(key string, v interface{}) error {
+	t, data, err := bson.MarshalValue(v)
+	if err != nil {
+		return fmt.Errorf("error marshalling %s: %v", key, err)
+	}
+	c.out = append(c.out, byte(t))
+	c.out = append(append(c.out, key...), 0)
+	c.out = append(c.out, data...)
+	return nil
+}
+
+// end completes document or array started at start (ie, its length placeholder), with terminating null byte
+func (c *jsonConverter) end(start int) {
+	c.out = append(c.out, 0)
+	binary.LittleEndian.PutUint32(c.out[start:], uint32(len(c.out)-start))
+}
+
+// space skips whitespace
+func (c *jsonConverter) space() {
+	for c.i < len(c.in) {
+		switch c.in[c.i] {
+		case ' ', '\t', '\n', '\r':
+			c.i++
+		default:
+			return
+		}
+	}
+}
+
+// members appends elements of object or array (as per array), whose opening bracket is at current position, up to closing one
+// top-level object's keys are skipped as per skip
+// for duplicate object keys, only the last value is kept (as with json.Unmarshal into map)
+func (c *jsonConverter) members(closing byte, array bool) error {
+	top := c.skip != nil && !array
+	skip := c.skip
+	c.skip = nil
+	base := len(c.elems)
+	c.i++
+	for n := 0; ; n++ {
+		c.space()
+		if c.in[c.i] == closing {
+			c.i++
+			c.elems = c.elems[:base]
+			return nil
+		}
+		if c.in[c.i] == ',' {
+			c.i++
+			c.space()
+		}
+		// element type is only known once value is read, so its placeholder is set after
+		typ := len(c.out)
+		c.out = append(c.out, 0)
+		key := len(c.out)
+		if array {
+			c.out = strconv.AppendInt(c.out, int64(n), 10)
+		} else {
+			c.str()
+			for _, b := range c.out[key:] {
+				if b == 0 {
+					return errors.New("key cannot contain null bytes")
+				}
+			}
+			c.space()
+			c.i++ // colon
+			c.space()
+		}
+		drop := top && skip(c.out[key:])
+		c.out = append(c.out, 0)
+		t, err := c.value()
+		if err != nil {
+			return err
+		}
+		c.out[typ] = byte(t)
+		if drop {
+			c.out = c.out[:typ]
+			continue
+		}
+		if !array {
+			typ = c.dedup(base, typ, key)
+			c.elems = append(c.elems, typ)
+		}
+	}
+}
+
+// dedup removes previous element of object (ie, starting at elems from base) with the same key as element at typ, with key at key
+// it returns new position of element at typ
+func (c *jsonConverter) dedup(base, typ, key int) int {
+	k := c.out[key : key+bytes.IndexByte(c.out[key:], 0)+1] // including terminating null byte
+	for i := base; i < len(c.elems); i++ {
+		start := c.elems[i]
+		if !bytes.HasPrefix(c.out[start+1:], k) {
+			continue
+		}
+		next := typ
+		if i+1 < len(c.elems) {
+			next = c.elems[i+1]
+		}
+		size := next - start
+		c.out = append(c.out[:start], c.out[next:]...)
+		for j := i + 1; j < len(c.elems); j++ {
+			c.elems[j-1] = c.elems[j] - size
+		}
+		c.elems = c.elems[:len(c.elems)-1]
+		return typ - size // there's at most one previous duplicate
+	}
+	return typ
+}
+
+// value appends value at current position, returning its type
+func (c *jsonConverter) value() (bsontype.Type, error) {
+	switch c.in[c.i] {
+	case '{':
+		start := len(c.out)
+		c.out = append(c.out, 0, 0, 0, 0)
+		if err := c.members('}', false); err != nil {
+			return 0, err
+		}
+		c.end(start)
+		return bsontype.EmbeddedDocument, nil
+	case '[':
+		start := len(c.out)
+		c.out = append(c.out, 0, 0, 0, 0)
+		if err := c.members(']', true); err != nil {
+			return 0, err
+		}
+		c.end(start)
+		return bsontype.Array, nil
+	case '"':
+		start := len(c.out)
+		c.out = append(c.out, 0, 0, 0, 0)
+		c.str()
+		c.out = append(c.out, 0)
+		binary.LittleEndian.PutUint32(c.out[start:], uint32(len(c.out)-start-4))
+		return bsontype.String, nil
+	case 't':
+		c.i += 4
+		c.out = append(c.out, 1)
+		return bsontype.Boolean, nil
+	case 'f':
+		c.i += 5
+		c.out = append(c.out, 0)
+		return bsontype.Boolean, nil
+	case 'n':
+		c.i += 4
+		return bsontype.Null, nil
+	default:
+		j := c.i
+		for j < len(c.in) && (c.in[j] >= '0' && c.in[j] <= '9' || c.in[j] == '-' || c.in[j] == '+' || c.in[j] == '.' || c.in[j] == 'e' || c.in[j] == 'E') {
+			j++
+		}
+		f, err := strconv.ParseFloat(string(c.in[c.i:j]), 64)
+		if err != nil {
+			return 0, fmt.Errorf("error parsing number %s: %v", c.in[c.i:j], err)
+		}
+		c.i = j
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+		c.out = append(c.out, b[:]...)
+		return bsontype.Double, nil
+	}
+}
+
+// str appends unquoted string at current position, replacing invalid utf-8 and utf-16 (ie, unpaired surrogates) with replacement character, as json.Unmarshal does
+func (c *jsonConverter) str() {
+	c.i++ // opening quote
+	for {
+		// copy plain ascii runs at once
+		j := c.i
+		for j < len(c.in) && c.in[j] != '"' && c.in[j] != '\\' && c.in[j] < utf8.RuneSelf {
+			j++
+		}
+		c.out = append(c.out, c.in[c.i:j]...)
+		c.i = j
+		switch b := c.in[c.i]; {
+		case b == '"':
+			c.i++
+			return
+		case b == '\\':
+			c.escape()
+		default:
+			r, size := utf8.DecodeRune(c.in[c.i:])
+			if r == utf8.RuneError && size == 1 {
+				c.rune(utf8.RuneError)
+			} else {
+				c.out = append(c.out, c.in[c.i:c.i+size]...)
+			}
+			c.i += size
+		}
+	}
+}
+
+// escape appends escape sequence at current position
+func (c *jsonConverter) escape() {
+	b := c.in[c.i+1]
+	c.i += 2
+	switch b {
+	case 'b':
+		c.out = append(c.out, '\b')
+	case 'f':
+		c.out = append(c.out, '\f')
+	case 'n':
+		c.out = append(c.out, '\n')
+	case 'r':
+		c.out = append(c.out, '\r')
+	case 't':
+		c.out = append(c.out, '\t')
+	case 'u':
+		r := c.hex4()
+		if utf16.IsSurrogate(r) {
+			// only valid as high surrogate followed by low one, escaped as well
+			dec := utf8.RuneError
+			if c.i+6 <= len(c.in) && c.in[c.i] == '\\' && c.in[c.i+1] == 'u' {
+				i := c.i
+				c.i += 2
+				if dec = utf16.DecodeRune(r, c.hex4()); dec == utf8.RuneError {
+					c.i = i
+				}
+			}
+			r = dec
+		}
+		c.rune(r)
+	default: // quote, backslash or slash
+		c.out = append(c.out, b)
+	}
+}
+
+// hex4 returns rune of 4 hex digits at current position
+func (c *jsonConverter) hex4() rune {
+	var r rune
+	for _, b := range c.in[c.i : c.i+4] {
+		switch {
+		case b >= '0' && b <= '9':
+			b -= '0'
+		case b >= 'a' && b <= 'f':
+			b -= 'a' - 10
+		default:
+			b -= 'A' - 10
+		}
+		r = r<<4 | rune(b)
+	}
+	c.i += 4
+	return r
+}
+
+// rune appends utf-8 encoding of r
+func (c *jsonConverter) rune(r rune) {
+	var b [utf8.UTFMax]byte
+	n := utf8.EncodeRune(b[:], r)
+	c.out = append(c.out, b[:n]...)
+}
@@ -0,0 +1,213 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// mapDoc returns bson doc the way it was built before jsonDoc: by unmarshalling raw json into bson.M, setting extra fields and _id, and marshalling it
+func mapDoc(id interface{}, raw []byte, extra bson.M) (bson.Raw, error) {
+	var doc bson.M
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("not an object")
+	}
+	for k, v := range extra {
+		doc[k] = v
+	}
+	doc["_id"] = id
+	return bson.Marshal(doc)
+}
+
+// sameDoc checks that jsonDoc returns doc equivalent to mapDoc (ie, with the same fields, regardless of order), or fails as well
+func sameDoc(t *testing.T, id interface{}, raw string, extra bson.M) {
+	t.Helper()
+	want, werr := mapDoc(id, []byte(raw), extra)
+	got, gerr := jsonDoc(id, []byte(raw), extra)
+	if werr != nil || gerr != nil {
+		if werr == nil || gerr == nil {
+			t.Fatalf("%s: got error %v, want %v", raw, gerr, werr)
+		}
+		return
+	}
+	if err := got.Validate(); err != nil {
+		t.Fatalf("%s: invalid bson: %v", raw, err)
+	}
+	var w, g bson.M
+	if err := bson.Unmarshal(want, &w); err != nil {
+		t.Fatal(err)
+	}
+	if err := bson.Unmarshal(got, &g); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Fatalf("%s:\ngot  %v\nwant %v", raw, g, w)
+	}
+}
+
+func TestJSONDoc(t *testing.T) {
+	now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name  string
+		raw   string
+		id    interface{}
+		extra bson.M
+	}{
+		{name: "empty object", raw: `{}`},
+		{name: "empty members", raw: `{"a":{},"b":[],"c":""}`},
+		{name: "whitespace", raw: " \n{ \"a\" :\t1 ,\r\n \"b\" : [ 1 , 2 ] }\n"},
+		{name: "literals", raw: `{"t":true,"f":false,"n":null}`},
+		{name: "escapes", raw: `{"s":"\"\\\/\b\f\n\r\t","k\n\"":"\u00e9\u4e2d"}`},
+		{name: "surrogate pair", raw: `{"s":"\ud83d\ude00 \uD83D\uDE00"}`},
+		{name: "unpaired surrogates", raw: `{"a":"\ud83d","b":"\ud83dx","c":"\ude00\ud83d\ude00","d":"\ud83d\u0041"}`},
+		{name: "invalid utf-8", raw: "{\"s\":\"\xff\xfea\xc3\"}"},
+		{name: "utf-8", raw: `{"é":"中文😀"}`},
+		{name: "numbers", raw: `{"a":0,"b":-0,"c":1.5e3,"d":-12.25E-2,"e":1e308,"f":-1e-308,"g":3}`},
+		{name: "big numbers", raw: `{"a":123456789012345678901,"b":-9223372036854775809,"c":18446744073709551616}`},
+		{name: "nested arrays", raw: `{"a":[[1,[2,[3,[]]]],[{"b":[{"c":[null]}]}]]}`},
+		{name: "duplicate keys", raw: `{"a":1,"b":2,"a":3}`},
+		{name: "duplicate keys nested", raw: `{"o":{"x":{"y":1},"z":2,"x":[3],"z":4,"x":5},"a":[{"k":1,"k":2}]}`},
+		{name: "duplicate keys with different values", raw: `{"a":"long string value","b":{"c":1},"a":{"d":[1,2,3]},"b":0}`},
+		{name: "id override", raw: `{"_id":"json","a":1,"_id":2}`, id: 5},
+		{name: "height override", raw: `{"height":"1","a":1}`, id: 7, extra: bson.M{"height": 7, "chain_id": "test"}},
+		{name: "time extra", raw: `{"cs_time":"then"}`, id: "x", extra: bson.M{"cs_time": now}},
+		{name: "not an object", raw: `[1]`},
+		{name: "null", raw: `null`},
+		{name: "invalid", raw: `{"a":`},
+		{name: "number out of range", raw: `{"a":1e400}`},
+		{name: "null byte in key", raw: `{"a\u0000":1}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			id := tc.id
+			if id == nil {
+				id = 1
+			}
+			sameDoc(t, id, tc.raw, tc.extra)
+		})
+	}
+}
+
+func TestJSONDocKeepsOrder(t *testing.T) {
+	doc, err := jsonDoc(1, []byte(`{"c":1,"a":2,"c":3,"b":{"z":1,"y":2,"z":3}}`), bson.M{"x": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	elems, _ := doc.Elements()
+	for _, e := range elems {
+		keys = append(keys, e.Key())
+	}
+	if want := []string{"_id", "x", "a", "c", "b"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got keys %v, want %v", keys, want)
+	}
+	keys = nil
+	elems, _ = doc.Lookup("b").Document().Elements()
+	for _, e := range elems {
+		keys = append(keys, e.Key())
+	}
+	if want := []string{"y", "z"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("got nested keys %v, want %v", keys, want)
+	}
+}
+
+// randomJSON returns random json value, nested up to depth
+func randomJSON(r *rand.Rand, depth int) string {
+	switch k := r.Intn(9); {
+	case depth == 0 || k < 2:
+		strs := []string{`"a"`, `"\u00e9\ud83d\ude00"`, `"\ud83d"`, `"\ude00\ud83d"`, "\"\xff\"", `"\"\\\/\b\f\n\r\t"`, `""`, `"é😀"`}
+		return strs[r.Intn(len(strs))]
+	case k == 2:
+		nums := []string{"0", "-0", "1.5e3", "-12.25E-2", "123456789012345678901", "7"}
+		return nums[r.Intn(len(nums))]
+	case k == 3:
+		return []string{"true", "false", "null"}[r.Intn(3)]
+	case k < 6:
+		var items []string
+		for i := r.Intn(4); i > 0; i-- {
+			items = append(items, randomJSON(r, depth-1))
+		}
+		return "[" + strings.Join(items, ",") + "]"
+	default:
+		keys := []string{`"a"`, `"b"`, `"_id"`, `"cs_time"`, `"\u00e9"`}
+		var members []string
+		for i := r.Intn(5); i > 0; i-- {
+			members = append(members, keys[r.Intn(len(keys))]+":"+randomJSON(r, depth-1))
+		}
+		return "{" + strings.Join(members, ",") + "}"
+	}
+}
+
+func TestJSONDocRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	extra := bson.M{"cs_time": time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)}
+	for i := 0; i < 5000; i++ {
+		raw := randomJSON(r, 5)
+		if !strings.HasPrefix(raw, "{") {
+			raw = `{"v":` + raw + `}`
+		}
+		sameDoc(t, i, raw, extra)
+	}
+}
+
+// blockJSON returns raw json of block with n transactions
+func blockJSON(n int) []byte {
+	var b strings.Builder
+	b.WriteString(`{"block_id":{"hash":"ABC"},"block":{"header":{"height":"123","time":"2021-01-01T00:00:00Z"},"data":{"txs":[`)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, `{"tx":"%s","code":%d,"gas":12345.5,"log":"[{\"events\":[]}]","ok":true,"n":null}`, strings.Repeat("a", 200), i)
+	}
+	b.WriteString(`]}}}`)
+	return []byte(b.String())
+}
+
+func BenchmarkJSONDoc(b *testing.B) {
+	raw := blockJSON(5000)
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := jsonDoc(1, raw, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkMapDoc is baseline for BenchmarkJSONDoc
+func BenchmarkMapDoc(b *testing.B) {
+	raw := blockJSON(5000)
+	b.SetBytes(int64(len(raw)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := mapDoc(1, raw, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// jsonlSink writes scraped data as json lines (ie, newline-delimited json) into local files in dir, one file per datatype at a time
+// files are named '<datatype>-<creation time>.jsonl' and rotated once they reach maxSize bytes, so they can be bulk-loaded (and removed) independently
+type jsonlSink struct {
+	dir     string
+	maxSize int64
+
+	mu    sync.Mutex
+	files map[string]*jsonlFile // current file, by datatype
+}
+
+// jsonlFile is current output file with its size
+type jsonlFile struct {
+	f    *os.File
+	size int64
+}
+
+// newJSONLSink returns json lines sink writing into dir, creating it if not existing
+func newJSONLSink(dir string, maxSize int64) (*jsonlSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("error creating output directory %s: %v", dir, err)
+	}
+	return &jsonlSink{dir: dir, maxSize: maxSize, files: map[string]*jsonlFile{}}, nil
+}
+
+// publish appends raw datatype as single line to its current file, rotating the file if needed
+func (s *jsonlSink) publish(ctx context.Context, datatype string, height int, raw []byte) error {
+	var line bytes.Buffer
+	if err := json.Compact(&line, raw); err != nil {
+		return fmt.Errorf("error compacting %s at height %d: %v", datatype, height, err)
+	}
+	line.WriteByte('\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jf, ok := s.files[datatype]
+	if ok && s.maxSize > 0 && jf.size+int64(line.Len()) > s.maxSize && jf.size > 0 {
+		if err := jf.f.Close(); err != nil {
+			return fmt.Errorf("error closing %s: %v", jf.f.Name(), err)
+		}
+		delete(s.files, datatype)
+		ok = false
+	}
+	if !ok {
+		name := filepath.Join(s.dir, fmt.Sprintf("%s-%s.jsonl", datatype, time.Now().UTC().Format("20060102T150405.000000000")))
+		f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("error creating output file: %v", err)
+		}
+		jf = &jsonlFile{f: f}
+		s.files[datatype] = jf
+	}
+	n, err := jf.f.Write(line.Bytes())
+	jf.size += int64(n)
+	return err
+}
+
+// close closes all current files
+func (s *jsonlSink) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var last error
+	for datatype, jf := range s.files {
+		if err := jf.f.Close(); err != nil {
+			last = err
+		}
+		delete(s.files, datatype)
+	}
+	return last
+}
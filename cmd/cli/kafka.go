@@ -0,0 +1,123 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaSink publishes scraped data to kafka topics, by datatype, with height as message key
+// if schema registry url is set, messages are framed in confluent wire format (ie, magic byte and schema id prefix) using json schema registered for each topic
+type kafkaSink struct {
+	w         kafkaWriter
+	topics    map[string]string // by datatype
+	schemaIDs map[string]uint32 // by topic
+}
+
+// kafkaWriter writes messages to kafka (ie, kafka.Writer)
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// newKafkaSink returns kafka sink for brokers and topics, by datatype, registering json schema for topics in schema registry, if set
+func newKafkaSink(ctx context.Context, brokers []string, topics map[string]string, registry string) (*kafkaSink, error) {
+	stdLogger.Printf("connecting to kafka brokers at %s...", strings.Join(brokers, ","))
+	s := &kafkaSink{
+		w: &kafka.Writer{
+			Addr:         kafka.TCP(brokers...),
+			Balancer:     &kafka.Hash{}, // same height always goes to the same partition
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 50 * time.Millisecond, // concurrent persist workers fill batches, so don't wait long for more
+		},
+		topics:    topics,
+		schemaIDs: map[string]uint32{},
+	}
+	if registry != "" {
+		for _, topic := range topics {
+			if topic == "" {
+				continue // datatype not published
+			}
+			id, err := registerSchema(ctx, registry, topic+"-value")
+			if err != nil {
+				return nil, fmt.Errorf("error registering schema for topic %s: %v", topic, err)
+			}
+			s.schemaIDs[topic] = id
+		}
+	}
+	return s, nil
+}
+
+// publish writes raw datatype at height to its topic
+func (s *kafkaSink) publish(ctx context.Context, datatype string, height int, raw []byte) error {
+	topic, ok := s.topics[datatype]
+	if !ok || topic == "" {
+		return nil // datatype not published
+	}
+	value := raw
+	if id, ok := s.schemaIDs[topic]; ok {
+		value = make([]byte, 5, 5+len(raw))
+		binary.BigEndian.PutUint32(value[1:], id)
+		value = append(value, raw...)
+	}
+	return s.w.WriteMessages(ctx, kafka.Message{Topic: topic, Key: []byte(strconv.Itoa(height)), Value: value})
+}
+
+// close flushes pending messages and closes kafka writer
+func (s *kafkaSink) close() error {
+	return s.w.Close()
+}
+
+// registerSchema registers generic json object schema for subject in schema registry, returning its id
+// ref: https://docs.confluent.io/platform/current/schema-registry/develop/api.html#post--subjects-(string-%20subject)-versions
+func registerSchema(ctx context.Context, registry, subject string) (uint32, error) {
+	body, err := json.Marshal(map[string]string{"schemaType": "JSON", "schema": `{"type":"object"}`})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(registry, "/")+"/subjects/"+subject+"/versions", bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.schemaregistry.v1+json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	var r struct {
+		ID      uint32 `json:"id"`
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return 0, fmt.Errorf("error decoding response (%s): %v", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s: %s", resp.Status, r.Message)
+	}
+	return r.ID, nil
+}
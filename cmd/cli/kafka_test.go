@@ -0,0 +1,135 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafkaWriter records written messages, failing with err, if set
+type fakeKafkaWriter struct {
+	mu   sync.Mutex
+	err  error
+	msgs []kafka.Message
+}
+
+func (w *fakeKafkaWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	w.msgs = append(w.msgs, msgs...)
+	return nil
+}
+
+func (w *fakeKafkaWriter) Close() error { return nil }
+
+func TestKafkaPublish(t *testing.T) {
+	// schema registry assigns ids to subjects in order of registration
+	var mu sync.Mutex
+	subjects := map[string]uint32{}
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/subjects/"), "/versions")
+		if !strings.HasPrefix(r.URL.Path, "/subjects/") || strings.Contains(subject, "/") {
+			http.Error(w, `{"error_code": 404, "message": "HTTP 404 Not Found"}`, http.StatusNotFound)
+			return
+		}
+		var req struct {
+			SchemaType string `json:"schemaType"`
+			Schema     string `json:"schema"`
+		}
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil || req.SchemaType != "JSON" {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"error_code": 42201, "message": "Invalid schema"}`))
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if _, ok := subjects[subject]; !ok {
+			subjects[subject] = uint32(len(subjects) + 100)
+		}
+		json.NewEncoder(w).Encode(map[string]uint32{"id": subjects[subject]})
+	}))
+	t.Cleanup(registry.Close)
+	ctx := context.Background()
+
+	topics := map[string]string{"block": "cosmos.blocks", "transactions": "cosmos.txs", "block_results": ""}
+	for _, reg := range []string{"", registry.URL} {
+		// brokers aren't contacted until messages are written
+		s, err := newKafkaSink(ctx, []string{"127.0.0.1:1"}, topics, reg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := &fakeKafkaWriter{}
+		s.w = w
+		for _, m := range []sinkMsg{{"block", 10, []byte(`{"a":1}`)}, {"transactions", 10, []byte(`{"b":2}`)}, {"block_results", 10, []byte(`{}`)}, {"block", 11, []byte(`{"a":2}`)}} {
+			if err := s.publish(ctx, m.datatype, m.height, m.raw); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if len(w.msgs) != 3 {
+			t.Fatalf("got %d messages, want 3 (datatype without topic not published)", len(w.msgs))
+		}
+		for i, want := range []struct {
+			topic, key, value string
+		}{{"cosmos.blocks", "10", `{"a":1}`}, {"cosmos.txs", "10", `{"b":2}`}, {"cosmos.blocks", "11", `{"a":2}`}} {
+			m := w.msgs[i]
+			value := m.Value
+			if reg != "" {
+				// confluent wire format: magic byte 0 and big-endian schema id
+				if len(value) < 5 || value[0] != 0 || binary.BigEndian.Uint32(value[1:5]) != subjects[want.topic+"-value"] {
+					t.Errorf("message %d: got value %v, want framed with schema id %d", i, value, subjects[want.topic+"-value"])
+					continue
+				}
+				value = value[5:]
+			}
+			if m.Topic != want.topic || string(m.Key) != want.key || string(value) != want.value {
+				t.Errorf("message %d: got (%s, %s, %s), want (%s, %s, %s)", i, m.Topic, m.Key, value, want.topic, want.key, want.value)
+			}
+		}
+
+		w.err = errors.New("leader not available")
+		if err := s.publish(ctx, "block", 12, []byte(`{}`)); !errors.Is(err, w.err) {
+			t.Errorf("got error %v, want writer error", err)
+		}
+	}
+	var registered []string
+	for subject := range subjects {
+		registered = append(registered, subject)
+	}
+	sort.Strings(registered)
+	if want := []string{"cosmos.blocks-value", "cosmos.txs-value"}; !reflect.DeepEqual(registered, want) {
+		t.Errorf("got registered subjects %v, want %v", registered, want)
+	}
+
+	if _, err := registerSchema(ctx, registry.URL+"/invalid", "x"); err == nil {
+		t.Error("expected error for rejected schema")
+	}
+}
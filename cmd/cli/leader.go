@@ -0,0 +1,117 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// instanceID returns identifier of this scraper instance
+func instanceID() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// leader elects single leader among scraper instances sharing the same database, using lock doc with id in col that expires after ttl without heartbeat
+// standby instances wait for lock to expire (eg, if leader died) and take over
+type leader struct {
+	col     leaseCollection
+	id      string
+	owner   string // this instance
+	ttl     time.Duration
+	expires time.Time // of lock as last acquired (or renewed) by this instance
+}
+
+// newLeader returns leader election using lock doc with id in col, expiring after ttl
+func newLeader(col *mongo.Collection, id string, ttl time.Duration) *leader {
+	return &leader{col: mongoCollection{col}, id: id, owner: instanceID(), ttl: ttl}
+}
+
+// acquire acquires or renews lock, returning false if it's held by another instance
+func (l *leader) acquire(ctx context.Context) (bool, error) {
+	now := time.Now().UTC()
+	_, err := l.col.UpdateOne(ctx,
+		bson.M{"_id": l.id, "$or": bson.A{bson.M{"owner": l.owner}, bson.M{"expires_at": bson.M{"$lt": now}}}},
+		bson.M{"$set": bson.M{"owner": l.owner, "expires_at": now.Add(l.ttl), "renewed_at": now}},
+		options.Update().SetUpsert(true),
+	)
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil // lock doc exists, but held by another instance
+	}
+	if err != nil {
+		return false, fmt.Errorf("error acquiring leader lock: %v", err)
+	}
+	l.expires = now.Add(l.ttl)
+	return true, nil
+}
+
+// wait blocks until lock is acquired, retrying every third of ttl, unless ctx cancelled
+func (l *leader) wait(ctx context.Context) error {
+	stdLogger.Printf("waiting to become leader as %s...", l.owner)
+	for {
+		ok, err := l.acquire(ctx)
+		if err != nil && ctx.Err() == nil {
+			stdLogger.Printf("warn: %v", err)
+		}
+		if ok {
+			stdLogger.Printf("became leader as %s", l.owner)
+			return nil
+		}
+		if err := wait(ctx, l.ttl/3); err != nil {
+			return err
+		}
+	}
+}
+
+// keep renews lock every third of ttl, until ctx cancelled, calling lost if it's lost (ie, held by another instance or not renewed in time)
+// if renewals fail (eg, database unreachable), lock is given up while still valid, when next renewal would be too late, so standby instance can't take over while this one still acts as leader
+func (l *leader) keep(ctx context.Context, lost func()) {
+	for wait(ctx, l.ttl/3) == nil {
+		// renewal taking too long (eg, hanging on unreachable database) must not delay giving lock up
+		rctx, cancel := context.WithDeadline(ctx, l.expires.Add(-l.ttl/3))
+		ok, err := l.acquire(rctx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			stdLogger.Printf("warn: %v", err)
+			if time.Until(l.expires) > l.ttl/3 {
+				continue
+			}
+		} else if ok {
+			continue
+		}
+		lost()
+		return
+	}
+}
+
+// release releases lock, if held, so standby instance could take over immediately
+func (l *leader) release(ctx context.Context) error {
+	if _, err := l.col.UpdateOne(ctx, bson.M{"_id": l.id, "owner": l.owner}, bson.M{"$set": bson.M{"expires_at": time.Time{}}}); err != nil {
+		return fmt.Errorf("error releasing leader lock: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLeader(t *testing.T) {
+	ctx := context.Background()
+	col := newFakeCollection()
+	const ttl = 300 * time.Millisecond
+	connA, connB := col.conn(), col.conn()
+	a := &leader{col: connA, id: "scrape", owner: "a", ttl: ttl}
+	b := &leader{col: connB, id: "scrape", owner: "b", ttl: ttl}
+	acquire := func(l *leader, want bool) {
+		t.Helper()
+		if ok, err := l.acquire(ctx); err != nil || ok != want {
+			t.Fatalf("%s acquired lock: %v (%v), want %v", l.owner, ok, err, want)
+		}
+	}
+	// became returns channel closed once l becomes leader
+	became := func(l *leader) <-chan struct{} {
+		c := make(chan struct{})
+		go func() {
+			if err := l.wait(ctx); err != nil {
+				t.Error(err)
+			}
+			close(c)
+		}()
+		return c
+	}
+
+	acquire(a, true)
+	acquire(b, false)
+	acquire(a, true) // renewal
+
+	// standby takes over once lock expires
+	start := time.Now()
+	select {
+	case <-became(b):
+		if time.Since(start) < ttl-50*time.Millisecond {
+			t.Errorf("b became leader after %s, before lock expired", time.Since(start))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("b didn't take over expired lock")
+	}
+	acquire(a, false)
+
+	// released lock is taken over without waiting for it to expire
+	leaderA := became(a)
+	if err := b.release(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-leaderA:
+	case <-time.After(ttl):
+		t.Fatal("a didn't take over released lock before it would expire")
+	}
+
+	// leader keeps lock while renewing it, and gives it up once it can't be renewed before standby could take over
+	kctx, stop := context.WithCancel(ctx)
+	defer stop()
+	lostA := make(chan time.Time, 1)
+	go a.keep(kctx, func() { lostA <- time.Now() })
+	leaderB := became(b)
+	select {
+	case <-leaderB:
+		t.Fatal("b became leader while a kept renewing lock")
+	case <-lostA:
+		t.Fatal("a lost lock while renewing it")
+	case <-time.After(2 * ttl):
+	}
+	connA.setDown(true)
+	var lost time.Time
+	select {
+	case lost = <-lostA:
+	case <-leaderB:
+		t.Fatal("b became leader before a gave up lock (split brain)")
+	case <-time.After(5 * time.Second):
+		t.Fatal("a didn't give up lock it couldn't renew")
+	}
+	select {
+	case <-leaderB:
+		if !time.Now().After(lost) {
+			t.Error("b became leader before a gave up lock")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("b didn't take over lock that a couldn't renew")
+	}
+	connA.setDown(false)
+
+	// leader gives up lock as soon as it finds it held by another instance
+	lostA = make(chan time.Time, 1)
+	a.expires = time.Now().Add(ttl)
+	go a.keep(kctx, func() { lostA <- time.Now() })
+	select {
+	case <-lostA:
+	case <-time.After(ttl):
+		t.Fatal("a didn't give up lock held by b")
+	}
+}
@@ -0,0 +1,224 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// leases coordinates job (eg, backfill of heights range) across multiple scraper instances, by leasing its disjoint chunks (ie, height ranges) via col
+// leases are kept alive by heartbeats and reclaimed by other instances once expired (eg, if instance holding it died)
+type leases struct {
+	col   leaseCollection
+	job   string
+	owner string // this instance
+	ttl   time.Duration
+}
+
+// leaseCollection is subset of mongo collection api used by leases and leader (see mongoCollection), so they could be tested without mongo
+type leaseCollection interface {
+	InsertMany(ctx context.Context, docs []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error)
+	UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error)
+	CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error)
+	findOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts *options.FindOneAndUpdateOptions, v interface{}) error
+}
+
+// mongoCollection is leaseCollection of mongo collection
+type mongoCollection struct {
+	*mongo.Collection
+}
+
+// findOneAndUpdate updates single doc matching filter and decodes it into v, returning mongo.ErrNoDocuments if there is none
+func (c mongoCollection) findOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts *options.FindOneAndUpdateOptions, v interface{}) error {
+	return c.FindOneAndUpdate(ctx, filter, update, opts).Decode(v)
+}
+
+// lease is leased chunk of job, as stored
+type lease struct {
+	ID          string     `bson:"_id"`
+	Job         string     `bson:"job"`
+	From        int        `bson:"from"`
+	To          int        `bson:"to"`
+	Owner       string     `bson:"owner"`
+	ExpiresAt   time.Time  `bson:"expires_at"`
+	Done        bool       `bson:"done"`
+	CompletedAt *time.Time `bson:"completed_at,omitempty"`
+}
+
+// newLeases returns leases for job in col, expiring after ttl without heartbeat
+func newLeases(col *mongo.Collection, job string, ttl time.Duration) *leases {
+	return &leases{col: mongoCollection{col}, job: job, owner: instanceID(), ttl: ttl}
+}
+
+// prepare creates chunks of size heights for [from..to] range, unless already created by other instance
+func (l *leases) prepare(ctx context.Context, from, to, size int) error {
+	var docs []interface{}
+	for h := from; h <= to; h += size {
+		c := lease{ID: fmt.Sprintf("%s/%d", l.job, h), Job: l.job, From: h, To: h + size - 1}
+		if c.To > to {
+			c.To = to
+		}
+		docs = append(docs, c)
+	}
+	if _, err := l.col.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false)); err != nil && !onlyDuplicates(err) {
+		return fmt.Errorf("error creating %s leases: %v", l.job, err)
+	}
+	return nil
+}
+
+// onlyDuplicates returns true if err is bulk write error caused by duplicate keys only
+func onlyDuplicates(err error) bool {
+	var bwe mongo.BulkWriteException
+	if !errors.As(err, &bwe) || bwe.WriteConcernError != nil {
+		return false
+	}
+	for _, we := range bwe.WriteErrors {
+		if we.Code != 11000 {
+			return false
+		}
+	}
+	return true
+}
+
+// acquire leases the lowest chunk not done and not leased (or with expired lease), or returns nil if there is none
+func (l *leases) acquire(ctx context.Context) (*lease, error) {
+	now := time.Now().UTC()
+	var c lease
+	err := l.col.findOneAndUpdate(ctx,
+		bson.M{"job": l.job, "done": false, "expires_at": bson.M{"$lt": now}},
+		bson.M{"$set": bson.M{"owner": l.owner, "expires_at": now.Add(l.ttl)}},
+		options.FindOneAndUpdate().SetSort(bson.M{"from": 1}).SetReturnDocument(options.After),
+		&c,
+	)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error acquiring %s lease: %v", l.job, err)
+	}
+	return &c, nil
+}
+
+// heartbeat extends lease c every third of ttl, until ctx cancelled
+func (l *leases) heartbeat(ctx context.Context, c *lease) {
+	for wait(ctx, l.ttl/3) == nil {
+		res, err := l.col.UpdateOne(ctx, bson.M{"_id": c.ID, "owner": l.owner}, bson.M{"$set": bson.M{"expires_at": time.Now().UTC().Add(l.ttl)}})
+		if err != nil {
+			if ctx.Err() == nil {
+				stdLogger.Printf("warn: error extending lease %s: %v", c.ID, err)
+			}
+			continue
+		}
+		if res.MatchedCount == 0 {
+			stdLogger.Printf("warn: lease %s was taken over by another instance (its heights might be scraped twice)", c.ID)
+			return
+		}
+	}
+}
+
+// complete marks chunk of lease c as done
+func (l *leases) complete(ctx context.Context, c *lease) error {
+	if _, err := l.col.UpdateOne(ctx, bson.M{"_id": c.ID, "owner": l.owner}, bson.M{"$set": bson.M{"done": true, "completed_at": time.Now().UTC()}}); err != nil {
+		return fmt.Errorf("error completing lease %s: %v", c.ID, err)
+	}
+	return nil
+}
+
+// release gives up lease c, so its chunk could be leased again immediately
+func (l *leases) release(ctx context.Context, c *lease) error {
+	if _, err := l.col.UpdateOne(ctx, bson.M{"_id": c.ID, "owner": l.owner, "done": false}, bson.M{"$set": bson.M{"expires_at": time.Time{}}}); err != nil {
+		return fmt.Errorf("error releasing lease %s: %v", c.ID, err)
+	}
+	return nil
+}
+
+// remaining returns number of job's chunks not done yet
+func (l *leases) remaining(ctx context.Context) (int64, error) {
+	n, err := l.col.CountDocuments(ctx, bson.M{"job": l.job, "done": false})
+	if err != nil {
+		return 0, fmt.Errorf("error counting remaining %s leases: %v", l.job, err)
+	}
+	return n, nil
+}
+
+// distributedBackfill scrapes blocks and transactions in [from..to] heights range, like backfill, but cooperating with other instances running the same command, by leasing chunks of the range
+// it returns once all chunks are done, by any instance
+func distributedBackfill(ctx context.Context, from, to int) error {
+	if dbType != "mongo" {
+		return fmt.Errorf("distributed backfill requires mongo database")
+	}
+	s, err := newHeightsScraper(ctx)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+	h, err := bcHeight(ctx, s.bcc, bcRetry)
+	if err != nil {
+		return fmt.Errorf("error getting current blockchain height: %v", err)
+	}
+	if to > h {
+		return fmt.Errorf("last height %d is greater than current blockchain height %d", to, h)
+	}
+
+	l := newLeases(collection(s.dbc.Database(dbName), "leases"), fmt.Sprintf("backfill:%d-%d", from, to), leaseTTL)
+	if err := l.prepare(ctx, from, to, leaseSize); err != nil {
+		return err
+	}
+	stdLogger.Printf("backfilling blocks [%d..%d] in chunks of %d heights as %s", from, to, leaseSize, l.owner)
+	for ctx.Err() == nil {
+		c, err := l.acquire(ctx)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			n, err := l.remaining(ctx)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				stdLogger.Printf("backfilled blocks [%d..%d]", from, to)
+				return nil
+			}
+			// wait for other instances to complete their chunks, or for their leases to expire
+			stdLogger.Printf("%d chunks leased by other instances - napping for %s", n, l.ttl)
+			wait(ctx, l.ttl)
+			continue
+		}
+
+		hctx, stop := context.WithCancel(ctx)
+		go l.heartbeat(hctx, c)
+		err = s.scrape(ctx, fmt.Sprintf("[%d..%d]", c.From, c.To), heightsRange(c.From, c.To))
+		stop()
+		if err != nil {
+			if rerr := l.release(context.Background(), c); rerr != nil {
+				stdLogger.Printf("warn: %v", rerr)
+			}
+			return err
+		}
+		if err := l.complete(ctx, c); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
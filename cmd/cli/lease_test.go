@@ -0,0 +1,370 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// fakeCollection is in-memory leaseCollection, evaluating (subset of) mongo query operators used by leases and leader
+type fakeCollection struct {
+	mu   sync.Mutex
+	docs map[string]bson.M // by id
+}
+
+func newFakeCollection() *fakeCollection {
+	return &fakeCollection{docs: map[string]bson.M{}}
+}
+
+// conn returns connection of single instance to collection, that could be cut off
+func (c *fakeCollection) conn() *fakeConn {
+	return &fakeConn{c: c}
+}
+
+// fakeConn is instance's connection to fakeCollection, failing all operations while down
+type fakeConn struct {
+	c    *fakeCollection
+	mu   sync.Mutex
+	down bool
+}
+
+var errUnreachable = errors.New("server selection error: server selection timeout")
+
+func (fc *fakeConn) setDown(down bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.down = down
+}
+
+// lock locks collection, unless connection is down
+func (fc *fakeConn) lock(ctx context.Context) (*fakeCollection, error) {
+	fc.mu.Lock()
+	down := fc.down
+	fc.mu.Unlock()
+	if down {
+		<-ctx.Done() // like operation timing out
+		return nil, errUnreachable
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	fc.c.mu.Lock()
+	return fc.c, nil
+}
+
+func (fc *fakeConn) InsertMany(ctx context.Context, docs []interface{}, opts ...*options.InsertManyOptions) (*mongo.InsertManyResult, error) {
+	c, err := fc.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+	res := &mongo.InsertManyResult{}
+	var bwe mongo.BulkWriteException
+	for i, d := range docs {
+		doc := toM(d)
+		id := doc["_id"].(string)
+		if _, ok := c.docs[id]; ok {
+			bwe.WriteErrors = append(bwe.WriteErrors, mongo.BulkWriteError{WriteError: mongo.WriteError{Index: i, Code: 11000, Message: "E11000 duplicate key error"}})
+			continue
+		}
+		c.docs[id] = doc
+		res.InsertedIDs = append(res.InsertedIDs, id)
+	}
+	if len(bwe.WriteErrors) > 0 {
+		return res, bwe
+	}
+	return res, nil
+}
+
+func (fc *fakeConn) UpdateOne(ctx context.Context, filter interface{}, update interface{}, opts ...*options.UpdateOptions) (*mongo.UpdateResult, error) {
+	c, err := fc.lock(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.mu.Unlock()
+	for _, doc := range c.sorted(nil) {
+		if match(doc, filter.(bson.M)) {
+			set(doc, update.(bson.M))
+			return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+		}
+	}
+	upsert := false
+	for _, o := range opts {
+		if o.Upsert != nil {
+			upsert = *o.Upsert
+		}
+	}
+	if !upsert {
+		return &mongo.UpdateResult{}, nil
+	}
+	id := filter.(bson.M)["_id"].(string)
+	if _, ok := c.docs[id]; ok {
+		return nil, mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: "E11000 duplicate key error"}}}
+	}
+	doc := bson.M{"_id": id}
+	set(doc, update.(bson.M))
+	c.docs[id] = doc
+	return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: id}, nil
+}
+
+func (fc *fakeConn) CountDocuments(ctx context.Context, filter interface{}, opts ...*options.CountOptions) (int64, error) {
+	c, err := fc.lock(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer c.mu.Unlock()
+	var n int64
+	for _, doc := range c.docs {
+		if match(doc, filter.(bson.M)) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (fc *fakeConn) findOneAndUpdate(ctx context.Context, filter interface{}, update interface{}, opts *options.FindOneAndUpdateOptions, v interface{}) error {
+	c, err := fc.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.mu.Unlock()
+	if opts.ReturnDocument == nil || *opts.ReturnDocument != options.After {
+		return fmt.Errorf("unsupported options %+v", opts)
+	}
+	for _, doc := range c.sorted(opts.Sort.(bson.M)) {
+		if match(doc, filter.(bson.M)) {
+			set(doc, update.(bson.M))
+			b, err := bson.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			return bson.Unmarshal(b, v)
+		}
+	}
+	return mongo.ErrNoDocuments
+}
+
+// sorted returns docs sorted by (single, ascending) sort field, or by id
+func (c *fakeCollection) sorted(sortBy bson.M) []bson.M {
+	field := "_id"
+	for k := range sortBy {
+		field = k
+	}
+	docs := make([]bson.M, 0, len(c.docs))
+	for _, doc := range c.docs {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool { return compare(docs[i][field], docs[j][field]) < 0 })
+	return docs
+}
+
+// doc returns copy of doc with id
+func (c *fakeCollection) doc(id string) bson.M {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	doc := bson.M{}
+	for k, v := range c.docs[id] {
+		doc[k] = v
+	}
+	return doc
+}
+
+// toM returns v as stored (ie, with times and numbers as decoded by mongo driver)
+func toM(v interface{}) bson.M {
+	b, err := bson.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	var m bson.M
+	if err := bson.Unmarshal(b, &m); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// set applies $set update to doc
+func set(doc bson.M, update bson.M) {
+	for k, v := range toM(update["$set"]) {
+		doc[k] = v
+	}
+}
+
+// match returns true if doc matches filter with equality, $lt and $or conditions
+func match(doc bson.M, filter bson.M) bool {
+	for k, cond := range toM(filter) {
+		switch {
+		case k == "$or":
+			ok := false
+			for _, f := range cond.(bson.A) {
+				ok = ok || match(doc, f.(bson.M))
+			}
+			if !ok {
+				return false
+			}
+		case reflect.TypeOf(cond) == reflect.TypeOf(bson.M{}):
+			for op, arg := range cond.(bson.M) {
+				if op != "$lt" {
+					panic("unsupported operator " + op)
+				}
+				if v, ok := doc[k]; !ok || compare(v, arg) >= 0 {
+					return false
+				}
+			}
+		default:
+			if v, ok := doc[k]; !ok || compare(v, cond) != 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compare compares values of the same type (or numbers)
+func compare(a, b interface{}) int {
+	switch a := a.(type) {
+	case string:
+		if a < b.(string) {
+			return -1
+		}
+		if a > b.(string) {
+			return 1
+		}
+		return 0
+	case primitive.DateTime:
+		return compare(int64(a), int64(b.(primitive.DateTime)))
+	case bool:
+		if a == b.(bool) {
+			return 0
+		}
+		return 1
+	}
+	x, y := reflect.ValueOf(a).Convert(reflect.TypeOf(int64(0))).Int(), reflect.ValueOf(b).Convert(reflect.TypeOf(int64(0))).Int()
+	if x < y {
+		return -1
+	}
+	if x > y {
+		return 1
+	}
+	return 0
+}
+
+func TestLeases(t *testing.T) {
+	ctx := context.Background()
+	col := newFakeCollection()
+	a := &leases{col: col.conn(), job: "backfill:1-25", owner: "a", ttl: 300 * time.Millisecond}
+	b := &leases{col: col.conn(), job: "backfill:1-25", owner: "b", ttl: 300 * time.Millisecond}
+
+	// chunks are created once, by whichever instance is first
+	if err := a.prepare(ctx, 1, 25, 10); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.prepare(ctx, 1, 25, 10); err != nil {
+		t.Fatal(err)
+	}
+	acquire := func(l *leases) string {
+		t.Helper()
+		c, err := l.acquire(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c == nil {
+			return ""
+		}
+		if c.Owner != l.owner {
+			t.Errorf("got lease %s owned by %s, want %s", c.ID, c.Owner, l.owner)
+		}
+		return fmt.Sprintf("[%d..%d]", c.From, c.To)
+	}
+	for _, want := range []struct {
+		l     *leases
+		chunk string
+	}{{a, "[1..10]"}, {b, "[11..20]"}, {a, "[21..25]"}, {b, ""}} {
+		if got := acquire(want.l); got != want.chunk {
+			t.Fatalf("%s acquired %q, want %q", want.l.owner, got, want.chunk)
+		}
+	}
+	if err := a.complete(ctx, &lease{ID: "backfill:1-25/1"}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := a.remaining(ctx); err != nil || n != 2 {
+		t.Fatalf("got %d remaining chunks (%v), want 2", n, err)
+	}
+
+	// chunk of instance that stopped heartbeating is taken over once its lease expires, while heartbeating one is kept
+	hctx, stop := context.WithCancel(ctx)
+	defer stop()
+	go b.heartbeat(hctx, &lease{ID: "backfill:1-25/11"})
+	if got := acquire(b); got != "" {
+		t.Fatalf("b acquired %s before lease expired", got)
+	}
+	time.Sleep(a.ttl + 10*time.Millisecond) // expiry is stored with millisecond precision
+	if got := acquire(b); got != "[21..25]" {
+		t.Fatalf("b acquired %q, want expired [21..25] chunk", got)
+	}
+	if got := acquire(a); got != "" {
+		t.Fatalf("a acquired %q, want none (chunk [11..20] heartbeated)", got)
+	}
+
+	// previous owner stops heartbeating taken over lease, and can't complete it
+	done := make(chan struct{})
+	go func() {
+		a.heartbeat(ctx, &lease{ID: "backfill:1-25/21"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("heartbeat didn't stop for taken over lease")
+	}
+	if err := a.complete(ctx, &lease{ID: "backfill:1-25/21"}); err != nil {
+		t.Fatal(err)
+	}
+	if doc := col.doc("backfill:1-25/21"); doc["done"] != false || doc["owner"] != "b" {
+		t.Errorf("got chunk %v, want it not done and owned by b", doc)
+	}
+
+	// released chunk can be acquired by other instance immediately
+	if err := b.release(ctx, &lease{ID: "backfill:1-25/21"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := acquire(a); got != "[21..25]" {
+		t.Fatalf("a acquired %q, want released [21..25] chunk", got)
+	}
+	for _, c := range []struct {
+		l  *leases
+		id string
+	}{{a, "backfill:1-25/21"}, {b, "backfill:1-25/11"}} {
+		if err := c.l.complete(ctx, &lease{ID: c.id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := b.remaining(ctx); err != nil || n != 0 {
+		t.Errorf("got %d remaining chunks (%v), want 0", n, err)
+	}
+}
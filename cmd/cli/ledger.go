@@ -0,0 +1,221 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ledger records state of each height in col, as it transitions from pending (ie, picked up by worker) to fetched (ie, block got from node) to stored (ie, all its datatypes processed)
+// heights not stored are recorded as skipped (eg, unavailable or invalid blocks) or failed (ie, dead-lettered), with reason
+// each state is timestamped, and number of attempts is counted, so progress, retries and failures are queryable
+// processed datatypes are recorded from log lines, so ledger always agrees with log, and updates are written asynchronously, in order, in bulks
+type ledger struct {
+	col  *mongo.Collection
+	full int // flags of datatypes required for height to be processed
+
+	mu     sync.Mutex
+	seen   map[int]int    // processed datatypes of heights in progress
+	bad    map[int]string // outcome of datatype not stored at height in progress, if any
+	closed bool
+
+	updates chan mongo.WriteModel
+	done    chan struct{}
+}
+
+// newLedger returns running ledger in col, also tracking block results if withResults is true
+// it's fed by processed heights logged by bxs, txs, brs and std loggers
+func newLedger(col *mongo.Collection, withResults bool) *ledger {
+	l := &ledger{col: col, full: stateBlock | stateTxs, seen: map[int]int{}, bad: map[int]string{}, updates: make(chan mongo.WriteModel, dbBatchSize), done: make(chan struct{})}
+	if withResults {
+		l.full |= stateBrs
+	}
+	bxsLogger.SetOutput(io.MultiWriter(bxsLogger.Writer(), ledgerWriter{l, "bxs:"}))
+	txsLogger.SetOutput(io.MultiWriter(txsLogger.Writer(), ledgerWriter{l, "txs:"}))
+	brsLogger.SetOutput(io.MultiWriter(brsLogger.Writer(), ledgerWriter{l, "brs:"}))
+	stdLogger.SetOutput(io.MultiWriter(stdLogger.Writer(), ledgerWriter{l, "std:"}))
+	go l.run()
+	return l
+}
+
+// update queues update of height h's doc, unless ledger is closed
+func (l *ledger) update(h int, update bson.M) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.updates <- mongo.NewUpdateOneModel().SetFilter(bson.M{"_id": h}).SetUpdate(update).SetUpsert(true)
+}
+
+// pending records height h as picked up for processing
+func (l *ledger) pending(h int) {
+	now := time.Now().UTC()
+	l.update(h, bson.M{
+		"$set":   bson.M{"state": "pending", "pending_at": now, "updated_at": now},
+		"$unset": bson.M{"parts": "", "reason": ""},
+		"$inc":   bson.M{"attempts": 1},
+	})
+}
+
+// fetched records block at height h as got from node
+func (l *ledger) fetched(h int) {
+	now := time.Now().UTC()
+	l.update(h, bson.M{"$set": bson.M{"state": "fetched", "fetched_at": now, "updated_at": now}})
+}
+
+// stored returns true if height h is already recorded as stored
+func (l *ledger) stored(ctx context.Context, h int) (bool, error) {
+	var d struct {
+		State string `bson:"state"`
+	}
+	err := l.col.FindOne(ctx, bson.M{"_id": h}, options.FindOne().SetProjection(bson.M{"state": 1})).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("error reading height %d state: %v", h, err)
+	}
+	return d.State == "stored", nil
+}
+
+// ledgerWriter feeds ledger with log lines written by logger with prefix
+type ledgerWriter struct {
+	l      *ledger
+	prefix string
+}
+
+// Write records datatype processed at height in log line p, if any, as per parseLogLine
+func (w ledgerWriter) Write(p []byte) (int, error) {
+	line := trimInstanceName(string(p))
+	if !strings.HasPrefix(line, w.prefix) {
+		return len(p), nil
+	}
+	h, flags, pruned, ok, err := parseLogLine(line)
+	if !ok || err != nil || pruned {
+		return len(p), nil
+	}
+	// note: line is "<prefix> <date> <time> <height> <outcome>", where outcome is "-> <id>" if stored
+	outcome := ""
+	if l := strings.SplitN(strings.TrimSpace(line), " ", 5); len(l) == 5 {
+		outcome = l[4]
+	}
+	w.l.processed(h, flags, outcome)
+	return len(p), nil
+}
+
+// processed records datatypes flags as processed at height h with outcome, recording height's final state once all required datatypes are processed
+// note: heights skipped as already stored are left as they are
+func (l *ledger) processed(h, flags int, outcome string) {
+	if strings.HasPrefix(outcome, "already stored") {
+		return
+	}
+	now := time.Now().UTC()
+	set := bson.M{"updated_at": now}
+	// note: empty transactions are processed, but not stored
+	ok := strings.HasPrefix(outcome, "->") || strings.HasPrefix(outcome, "empty")
+	for f, name := range map[int]string{stateBlock: "block", stateTxs: "transactions", stateBrs: "block_results"} {
+		if flags&f != 0 {
+			set["parts."+name] = outcome
+		}
+	}
+
+	l.mu.Lock()
+	l.seen[h] |= flags
+	if !ok {
+		l.bad[h] = outcome
+	}
+	done := l.seen[h]&l.full == l.full
+	reason, bad := l.bad[h]
+	if done {
+		delete(l.seen, h)
+		delete(l.bad, h)
+	}
+	l.mu.Unlock()
+
+	if done {
+		state := "stored"
+		if bad {
+			state = "skipped"
+			if strings.HasPrefix(reason, "dead-lettered") {
+				state = "failed"
+			}
+			set["reason"] = reason
+		}
+		set["state"] = state
+		set[state+"_at"] = now
+	}
+	l.update(h, bson.M{"$set": set})
+}
+
+// run writes queued updates in order, in bulks of up to dbBatchSize, waiting up to dbBatchWait for more updates to arrive, until closed
+func (l *ledger) run() {
+	defer close(l.done)
+	for {
+		m, ok := <-l.updates
+		if !ok {
+			return
+		}
+		batch := []mongo.WriteModel{m}
+		timer := time.NewTimer(dbBatchWait)
+	collect:
+		for len(batch) < dbBatchSize {
+			select {
+			case m, ok := <-l.updates:
+				if !ok {
+					break collect
+				}
+				batch = append(batch, m)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+		for n := 1; ; n++ {
+			_, err := l.col.BulkWrite(context.Background(), batch, options.BulkWrite().SetOrdered(true))
+			if err == nil {
+				break
+			}
+			d, rerr := dbRetry.retry(n)
+			if rerr != nil {
+				stdLogger.Printf("warn: error recording %d heights ledger updates (dropping them): %v", len(batch), err)
+				break
+			}
+			stdLogger.Printf("error recording heights ledger updates (will retry in %s): %v", d, err)
+			time.Sleep(d)
+		}
+	}
+}
+
+// close writes remaining updates and stops ledger
+func (l *ledger) close() {
+	l.mu.Lock()
+	l.closed = true
+	close(l.updates)
+	l.mu.Unlock()
+	<-l.done
+}
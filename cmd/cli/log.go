@@ -21,15 +21,15 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
-	"sort"
-	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/rogpeppe/go-internal/lockedfile"
 )
 
-// logSetup initialises loggers for processes blocks and transactions and all other (standard) records using UTC timestamps
+// logSetup initialises loggers for processes blocks, transactions and block results and all other (standard) records using UTC timestamps
 // it's also used to prevent multiple concurrently running app instances, corrupting the data (duplicate+ records)
 // logs written to std logger would also be echoed to stdout
 func logSetup(file string) error {
@@ -40,137 +40,78 @@ func logSetup(file string) error {
 	}
 	//log.SetOutput(f)
 
-	bxsLogger = log.New(f, "bxs: ", log.LstdFlags|log.LUTC)                            // logger for processed blocks only!       -> log file
-	txsLogger = log.New(f, "txs: ", log.LstdFlags|log.LUTC)                            // logger for processed transactions only! -> log file
-	stdLogger = log.New(io.MultiWriter(f, os.Stdout), "std: ", log.LstdFlags|log.LUTC) // logger for everything else              -> log file & stdout
+	bxsLogger = log.New(f, logPrefix("bxs"), log.LstdFlags|log.LUTC)                                       // logger for processed blocks only!       -> log file
+	txsLogger = log.New(f, logPrefix("txs"), log.LstdFlags|log.LUTC)                                       // logger for processed transactions only! -> log file
+	brsLogger = log.New(f, logPrefix("brs"), log.LstdFlags|log.LUTC)                                       // logger for processed block results only! -> log file
+	stdLogger = log.New(io.MultiWriter(f, levelWriter{console}), logPrefix("std"), log.LstdFlags|log.LUTC) // logger for everything else              -> log file & stdout (as per log level)
+	atomic.StoreInt32(&consoleLevel, logLevels[logLevel])
 
 	return nil
 }
 
-// logHeight checks log consistency from checkpoint and returns last processed block
-// log entries (and blockchain blocks) below checkpoint will be ignored (ie, checkpoint is a minimal logHeight value to return)
-func logHeight(file string, checkpoint int) (int, error) {
-	content, err := os.ReadFile(file)
-	if err != nil {
-		return -1, fmt.Errorf("error reading log file %s: %v", err, file)
-	}
-
-	var b, t sort.IntSlice
-	lines := bytes.Split(content, []byte{'\n'})
-	for n, line := range lines {
-		l := strings.Split(string(line), " ")
-		switch l[0] {
-		case "bxs:":
-			if i, err := strconv.Atoi(l[3]); err != nil {
-				return -1, fmt.Errorf("error parsing log at line %d for block height: %v", n+1, err)
-			} else {
-				b = append(b, i)
-			}
-		case "txs:":
-			if i, err := strconv.Atoi(l[3]); err != nil {
-				return -1, fmt.Errorf("error parsing log at line %d for block height: %v", n+1, err)
-			} else {
-				t = append(t, i)
-			}
-		case "std:":
-			// check for invalid blocks that are skipped
-			if len(l) > 4 && l[4] == "invalid" {
-				if i, err := strconv.Atoi(l[3]); err != nil {
-					return -1, fmt.Errorf("error parsing log at line %d for block height: %v", n+1, err)
-				} else {
-					b = append(b, i)
-					t = append(t, i)
-				}
-			}
-		}
-	}
-
-	lastBxs := 0
-	if len(b) > 0 {
-		b.Sort()
-		lastBxs = b[len(b)-1]
-		// skip check if checkpoint value is: negative, lastBxs or greater
-		if 0 <= checkpoint && checkpoint < lastBxs {
-			c := -1 // checkpoint index
-			for i, v := range b {
-				// skip any blocks before checkpoint
-				if v < checkpoint {
-					continue
-				}
-				// note index of checkpoint value
-				if v == checkpoint {
-					c = i
-					continue
-				}
-				// check if blocks are in-order after checkpoint or dump reversed values to file to aid manual recovery
-				if v != checkpoint+(i-c) {
-					sort.Sort(sort.Reverse(b))
-					dumpIntSliceToFile(b, logFile+".bxs-dump")
-					return -1, fmt.Errorf("error detected while parsing log against checkpoint %d: blocks out-of-order (got: %d, want: %d); manual recovery needed (check '%s.bxs-dump' file)", checkpoint, v, checkpoint+(i-c), logFile)
-				}
-			}
-		}
+// logPrefix returns prefix of log records of kind (ie, bxs, txs, brs or std), preceded by instance name in brackets, if set
+func logPrefix(kind string) string {
+	if instanceName == "" {
+		return kind + ": "
 	}
+	return "[" + instanceName + "] " + kind + ": "
+}
 
-	lastTxs := 0
-	if len(t) > 0 {
-		t.Sort()
-		lastTxs = t[len(t)-1]
-		// skip check if checkpoint value is: negative, lastTxs or greater
-		if 0 <= checkpoint && checkpoint < lastTxs {
-			c := -1 // checkpoint index
-			for i, v := range t {
-				// skip any blocks before checkpoint
-				if v < checkpoint {
-					continue
-				}
-				// note index of checkpoint value
-				if v == checkpoint {
-					c = i
-					continue
-				}
-				// check if transactions are in-order after checkpoint or dump reversed values to file to aid manual recovery
-				if v != checkpoint+(i-c) {
-					sort.Sort(sort.Reverse(t))
-					dumpIntSliceToFile(t, logFile+".txs-dump")
-					return -1, fmt.Errorf("error detected while parsing log against checkpoint %d: transactions out-of-order (got: %d, want: %d); manual recovery needed (check '%s.txs-dump' file)", checkpoint, v, checkpoint+(i-c), logFile)
-				}
-			}
+// trimInstanceName returns log line without instance name preceding it, if any
+func trimInstanceName(line string) string {
+	if strings.HasPrefix(line, "[") {
+		if i := strings.Index(line, "] "); i > 0 {
+			return line[i+2:]
 		}
 	}
+	return line
+}
 
-	// if lastBxs != lastTxs but checkpoint >= max(lastBxs, lastTxs), then return -1 and no error, so checkpoint will be used
-	if (lastBxs > lastTxs && checkpoint >= lastBxs) ||
-		(lastTxs > lastBxs && checkpoint >= lastTxs) {
-		return -1, nil
+// logHeight returns resume point from processed heights recorded in log from checkpoint
+// as heights are processed concurrently, they are tracked out of order, so heights processed only partially or not at all before stop (eg, crash) are returned as pending, and the rest are not scraped again
+// log entries (and blockchain blocks) below checkpoint will be ignored (ie, checkpoint is a minimal watermark value to return)
+// heights recorded as pruned or skipped (ie, fast-forwarded past) are considered processed
+// if withResults is true, block results are also required, but only from the first height they were recorded at (ie, since they were enabled)
+func logHeight(file string, checkpoint int, withResults bool) (resumePoint, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return resumePoint{}, fmt.Errorf("error reading log file %s: %v", file, err)
 	}
 
-	if lastBxs != lastTxs {
-		sort.Sort(sort.Reverse(b))
-		dumpIntSliceToFile(b, logFile+".bxs-dump")
-		sort.Sort(sort.Reverse(t))
-		dumpIntSliceToFile(t, logFile+".txs-dump")
-		return -1, fmt.Errorf("error: crash detected while parsing log: last processed block height %d != %d last processed transaction height; manual recovery needed (check '%s.?xs-dump' files)", lastBxs, lastTxs, logFile)
+	type entry struct {
+		h, flags int
+		pruned   bool
 	}
-
-	return lastBxs, nil
-}
-
-// dumpIntSliceToFile stores int slice to file having single value per line
-func dumpIntSliceToFile(slice []int, file string) error {
-	if len(slice) == 0 {
-		return nil
+	var entries []entry
+	c := newCompletion(checkpoint, withResults)
+	c.results = -1 // block results are not required until first recorded
+	for n, line := range bytes.Split(content, []byte{'\n'}) {
+		h, flags, pruned, ok, err := parseLogLine(string(line))
+		if err != nil {
+			return resumePoint{}, fmt.Errorf("error parsing log at line %d: %v", n+1, err)
+		}
+		if !ok {
+			continue
+		}
+		if flags&stateBrs != 0 && (c.results < 0 || h < c.results) {
+			c.results = h
+		}
+		entries = append(entries, entry{h, flags, pruned})
 	}
-
-	f, err := os.OpenFile(file, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0644)
-	if err != nil {
-		return err
+	if c.results < 0 {
+		c.results = math.MaxInt64
 	}
-	for _, v := range slice {
-		if _, err := f.WriteString(fmt.Sprintf("%d\n", v)); err != nil {
-			return err
+	for _, e := range entries {
+		if e.pruned {
+			c.skip(e.h)
+		} else {
+			c.mark(e.h, e.flags)
 		}
 	}
 
-	return nil
+	r := c.resume()
+	if len(r.pending) > 0 {
+		stdLogger.Printf("found %d partially processed heights between %d and %d in log: re-scraping them", len(r.pending), r.watermark, r.highest)
+	}
+	return r, nil
 }
@@ -18,19 +18,277 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
 )
 
-var version = "v0.3.0-beta"
+// usage describes available commands
+const usage = `usage: cli [flags] [command [args]]
+
+flags (override respective config values, set in environment or .env file):
+  --env-file <path>           config file to read instead of .env
+  --config <path>             structured (yaml, toml or json) config file, providing values not set otherwise
+  --chain <name>              chain to use from config file's chains section
+  --log-file <path>           log file
+  --checkpoint <height>       log checkpoint (ie, minimal height to resume from)
+  --bc-protocol <protocol>    blockchain node protocol (rest, grpc or rpc)
+  --bc-node <address>         blockchain node(s) address
+  --bc-port <port>            blockchain node port
+  --db-type <type>            database type (mongo, bolt or none)
+  --db-uri <uri>              mongo connection string
+  --db-host <host>            mongo host
+  --db-port <port>            mongo port
+  --db-name <name>            mongo database name
+  --workers <n>               number of both requests and persists workers
+  --req-workers <n>           number of requests workers
+  --per-workers <n>           number of persists workers
+  --naptime <duration>        sleep time between action retries (eg, 1m)
+  --http-addr <address>       address to serve http endpoints on
+  --set <key>=<value>         override any config value (eg, cs_gap_scan=true); can be repeated
+
+commands:
+  scrape [--start-height <height>] [--stop-height <height>] [--follow] [--tui]
+                   scrape blocks and transactions (default), optionally from start height (instead of the last processed one) and until stop height,
+                   or from current chain head (skipping historical blocks), optionally showing live progress in interactive terminal ui
+  backfill --from <height> --to <height> [--distributed]
+                   scrape blocks and transactions in height range, independently of the scrape command,
+                   optionally cooperating with other instances backfilling the same range (by leasing its chunks)
+  rescrape [--heights <height>,...] [--file <path>]
+                   scrape blocks and transactions at given heights or height ranges (eg, 100-200; file having single one per line), independently of the scrape command
+  verify [--from <height>] [--to <height>] [--repair]
+                   audit stored blocks and transactions against the chain and print issues found as json lines (optionally fixing them)
+  genesis <source> import genesis accounts, balances and validators from genesis file path or http(s) url
+  indexes <action> list, create or drop recommended database indexes
+  deadletters <action>
+                   list dead letters or retry storing them
+  get <datatype> <height>
+                   print stored block, transactions or block_results json at height (decompressed, if needed)
+  gaps [--from <height>] [--to <height>] [--output <path>]
+                   print ranges of heights missing in database (in stored range, by default), optionally also writing them to file for rescrape --file
+  tail [--from <height>] [--raw] [--interval <duration>]
+                   print line (height, time, number of transactions and hash) or, with --raw, complete json of each newly stored block, as it's stored
+  doctor           check blockchain node and database connectivity and compatibility (ie, api, available history, tx indexer, authentication and write permissions), before starting (large) scrape
+  status           print chain head, last processed height and lag, and stored data stats (ie, heights range, gaps, documents counts and database size)
+  config show      print effective configuration (merged defaults, config file, .env file, environment and flags), with secrets redacted
+  version          print version, commit, build date and go version of this build
+`
 
 func main() {
-	stdLogger.Printf("cosmos-scraper %s started", version)
+	args, envFile, err := parseConfigFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Print(usage)
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n%s", err, usage)
+		os.Exit(2)
+	}
+	// version doesn't need (valid) config
+	if len(args) > 0 && args[0] == "version" {
+		if len(args) != 1 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		fmt.Println(build())
+		return
+	}
+	loadConfig(envFile)
+
+	if sentryDSN != "" {
+		if sentry, err = newSentry(sentryDSN); err != nil {
+			log.Fatalf("failed setting up sentry reporting: %v", err)
+		}
+	}
+
+	cmd := "scrape"
+	if len(args) > 0 {
+		cmd, args = args[0], args[1:]
+	}
+
+	switch cmd {
+	case "scrape":
+		if err := scrapeArgs(args); err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n%s", err, usage)
+			os.Exit(2)
+		}
+		// init log
+		if err := logSetup(logFile); err != nil {
+			log.Fatalf("failed to set up logging: %v", err)
+		}
+		scrape()
+	case "backfill":
+		from, to, distributed, err := backfillArgs(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n%s", err, usage)
+			os.Exit(2)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		run := backfill
+		if distributed {
+			run = distributedBackfill
+		}
+		if err := run(ctx, from, to); err != nil {
+			stdLogger.Fatalf("error backfilling: %v", err)
+		}
+	case "rescrape":
+		heights, err := rescrapeArgs(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n%s", err, usage)
+			os.Exit(2)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := rescrape(ctx, heights); err != nil {
+			stdLogger.Fatalf("error re-scraping: %v", err)
+		}
+	case "verify":
+		from, to, repair, err := auditArgs(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n%s", err, usage)
+			os.Exit(2)
+		}
+		// keep stdout for report only
+		stdLogger.SetOutput(os.Stderr)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := audit(ctx, os.Stdout, from, to, repair); err != nil {
+			stdLogger.Fatalf("error verifying: %v", err)
+		}
+	case "genesis":
+		if len(args) != 1 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := importGenesis(ctx, args[0]); err != nil {
+			stdLogger.Fatalf("error importing genesis: %v", err)
+		}
+	case "indexes":
+		if len(args) != 1 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := manageIndexes(ctx, args[0]); err != nil {
+			stdLogger.Fatalf("error managing indexes: %v", err)
+		}
+	case "deadletters":
+		if len(args) != 1 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := manageDeadLetters(ctx, args[0]); err != nil {
+			stdLogger.Fatalf("error managing dead letters: %v", err)
+		}
+	case "get":
+		if len(args) != 2 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		// keep stdout for output only
+		stdLogger.SetOutput(os.Stderr)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := getStored(ctx, os.Stdout, args[0], args[1]); err != nil {
+			stdLogger.Fatalf("error getting stored data: %v", err)
+		}
+	case "gaps":
+		from, to, output, err := gapsArgs(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n%s", err, usage)
+			os.Exit(2)
+		}
+		// keep stdout for output only
+		stdLogger.SetOutput(os.Stderr)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := listGaps(ctx, os.Stdout, from, to, output); err != nil {
+			stdLogger.Fatalf("error listing gaps: %v", err)
+		}
+	case "tail":
+		from, raw, interval, err := tailArgs(args)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n%s", err, usage)
+			os.Exit(2)
+		}
+		// keep stdout for blocks only
+		stdLogger.SetOutput(os.Stderr)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := tailBlocks(ctx, os.Stdout, from, raw, interval); err != nil {
+			stdLogger.Fatalf("error tailing blocks: %v", err)
+		}
+	case "doctor":
+		if len(args) != 0 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		// keep stdout for findings only
+		stdLogger.SetOutput(os.Stderr)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := doctor(ctx, os.Stdout); err != nil {
+			stdLogger.Fatalf("error: %v", err)
+		}
+	case "status":
+		if len(args) != 0 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		// keep stdout for output only
+		stdLogger.SetOutput(os.Stderr)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		if err := showStatus(ctx, os.Stdout); err != nil {
+			stdLogger.Fatalf("error getting status: %v", err)
+		}
+	case "config":
+		if len(args) != 1 || args[0] != "show" {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		if err := showConfig(os.Stdout); err != nil {
+			stdLogger.Fatalf("error showing config: %v", err)
+		}
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n%s", cmd, usage)
+		os.Exit(2)
+	}
+}
 
+// scrape scrapes blocks and transactions, catching up and then keeping up with current blockchain height, until stopped
+func scrape() {
+	stdLogger.Printf("%s started", build())
+	if pidFile != "" {
+		if err := writePIDFile(pidFile); err != nil {
+			stdLogger.Fatalf("failed writing pid file: %v", err)
+		}
+		defer os.Remove(pidFile)
+	}
+
+	// ctx stops queuing new heights and subsystems, while wctx, used by workers and storage, is only cancelled if in-flight heights are not drained within drainTimeout
 	ctx, cancel := context.WithCancel(context.Background())
+	wctx, abort := context.WithCancel(context.Background())
+	defer abort()
 
 	// gracefully stop if <Ctrl>-<C> or SIGTERM signal received
 	c := make(chan os.Signal, 1)
@@ -40,71 +298,521 @@ func main() {
 		for sig := range c {
 			// quit immediately if already requested (more than once)
 			if stopping {
-				stdLogger.Println("ok, cosmos-scraper stopped forcibly (there might be some inconsistencies requiring manual recovery).")
+				stdLogger.Println("ok, cosmos-scraper stopped forcibly (unfinished heights will be re-scraped on restart).")
 				os.Exit(0)
 			}
 			stdLogger.Printf("received %v signal, trying to stop 'gracefully' (signal again to quit immediately)...", sig)
 			stopping = true
 			cancel()
+			if drainTimeout > 0 {
+				time.AfterFunc(drainTimeout, func() {
+					stdLogger.Printf("in-flight heights not drained within %s: aborting them (they will be re-scraped on restart)", drainTimeout)
+					abort()
+				})
+			}
 		}
 	}()
 
-	dbc, bxs, txs := initDB(ctx, dbHost, dbPort, dbUser, dbPass, napTime)
+	st, dbc, bxs, txs, brs, dlq := openStorage(wctx)
+	var err error
 	defer func() {
-		recover() // silence any panics
-		if err := dbc.Disconnect(ctx); err != nil {
-			stdLogger.Fatalf("failed disconnecting from database: %v", err)
+		alertPanic(recover()) // silence any panics, but alert on them
+		if err := st.close(wctx); err != nil {
+			stdLogger.Fatalf("failed closing database: %v", err)
 		}
 	}()
 
-	bcc, tail, head := initBC(ctx, bcNode, bcPort)
+	// wait to become leader, if leader election is enabled, and keep leadership until stopped
+	var ld *leader     // nil if leader election is disabled
+	var lostLead int32 // set to 1 if leadership was lost
+	var wgl sync.WaitGroup
+	lctx, stopLead := context.WithCancel(wctx)
+	defer stopLead()
+	if leaderElection {
+		ld = newLeader(collection(dbc.Database(dbName), "leader"), "scrape", leaderTTL)
+		if err := ld.wait(ctx); err != nil {
+			stdLogger.Println("cosmos-scraper stopped while waiting to become leader.")
+			return
+		}
+		wgl.Add(1)
+		go func() {
+			defer wgl.Done()
+			ld.keep(lctx, func() {
+				stdLogger.Println("error: leadership lost (another instance might have taken over): stopping immediately...")
+				atomic.StoreInt32(&lostLead, 1)
+				cancel()
+				abort()
+			})
+		}()
+	}
+
+	var stateCol *mongo.Collection // nil disables scrape state
+	var saved *resumePoint         // nil if no scrape state saved
+	// scrape state and resume manifest are neither used nor updated when scraping arbitrary slice of history
+	slice := startHeight > 0 || stopHeight > 0
+	if scrapeStateEnabled && dbc != nil && !slice {
+		stateCol = collection(dbc.Database(dbName), "scrape_state")
+		if saved, err = loadState(ctx, stateCol, "scrape"); err != nil {
+			stdLogger.Fatalf("failed loading scrape state: %v", err)
+		}
+	}
+	// note: manifest is read (and removed) even if scrape state is used, so it never outlives the run it was written for
+	if slice {
+		stdLogger.Printf("scraping slice of history from height %d to %d (0 means not set): scrape state and resume manifest are not used", startHeight, stopHeight)
+	} else if m, err := readResume(resumeFile); err != nil {
+		stdLogger.Fatalf("failed loading resume manifest: %v", err)
+	} else if m != nil && saved == nil {
+		stdLogger.Printf("resuming from manifest %s", resumeFile)
+		saved = m
+	}
+
+	if startHeight > 0 {
+		saved = &resumePoint{watermark: startHeight - 1, highest: startHeight - 1}
+	}
+	bcc, rsc, rp, tail, head := initBC(ctx, bcProtocol, bcNode, bcPort, saved)
+	checkStorage(ctx, st, tail-1)
+
+	// track processed heights for resume manifest, and scrape state, if enabled
+	ss := newScrapeState(stateCol, "scrape", rp, blockResults)
+	if stateCol != nil {
+		go ss.run(ctx, scrapeStateInterval)
+	}
+	head -= headLag
+
+	// optional subsystems running alongside blocks scraping
+	var wgs sync.WaitGroup
+	if govInterval > 0 {
+		if bcProtocol == "rpc" {
+			stdLogger.Println("warn: governance scraping is not supported with rpc protocol (skipping)")
+		} else {
+			wgs.Add(1)
+			go func() {
+				defer wgs.Done()
+				govScraper(ctx, bcc, dbc.Database(dbName), govInterval)
+			}()
+		}
+	}
+	if stakingInterval > 0 || stakingBlocks > 0 {
+		if bcProtocol == "rpc" {
+			stdLogger.Println("warn: staking snapshots are not supported with rpc protocol (skipping)")
+		} else {
+			interval := stakingInterval
+			if interval == 0 {
+				interval = napTime
+			}
+			wgs.Add(1)
+			go func() {
+				defer wgs.Done()
+				stakingScraper(ctx, bcc, dbc.Database(dbName), interval, stakingBlocks)
+			}()
+		}
+	}
+
+	if ibcInterval > 0 {
+		if bcProtocol == "rpc" {
+			stdLogger.Println("warn: ibc state scraping is not supported with rpc protocol (skipping)")
+		} else {
+			wgs.Add(1)
+			go func() {
+				defer wgs.Done()
+				ibcScraper(ctx, bcc, dbc.Database(dbName), ibcInterval)
+			}()
+		}
+	}
+	if paramsInterval > 0 {
+		wgs.Add(1)
+		go func() {
+			defer wgs.Done()
+			paramsScraper(ctx, bcc, collection(dbc.Database(dbName), "params"), paramsInterval, bcProtocol)
+		}()
+	}
+
+	if supplyInterval > 0 {
+		if bcProtocol == "rpc" {
+			stdLogger.Println("warn: supply scraping is not supported with rpc protocol (skipping)")
+		} else {
+			wgs.Add(1)
+			go func() {
+				defer wgs.Done()
+				supplyScraper(ctx, bcc, collection(dbc.Database(dbName), "supply"), supplyInterval)
+			}()
+		}
+	}
+
+	if len(eventQueries) > 0 {
+		wgs.Add(1)
+		go func() {
+			defer wgs.Done()
+			eventsScraper(ctx, bcc, dbc.Database(dbName), bcProtocol, eventQueries, eventInterval, eventSpan, eventFrom)
+		}()
+	}
+
+	if mempoolInterval > 0 {
+		msc, err := rpcSource(ctx, bcc, bcProtocol, bcNode, "mempool")
+		if err != nil {
+			stdLogger.Panicf("error creating blockchain client for mempool: %v", err)
+		}
+		wgs.Add(1)
+		go func() {
+			defer wgs.Done()
+			mempoolScraper(ctx, msc, collection(dbc.Database(dbName), "mempool"), mempoolInterval)
+		}()
+	}
+
+	if netInfoInterval > 0 {
+		nsc, err := rpcSource(ctx, bcc, bcProtocol, bcNode, "net info")
+		if err != nil {
+			stdLogger.Panicf("error creating blockchain client for net info: %v", err)
+		}
+		wgs.Add(1)
+		go func() {
+			defer wgs.Done()
+			netInfoScraper(ctx, nsc, dbc.Database(dbName), netInfoInterval)
+		}()
+	}
+
+	if len(abciQueries) > 0 {
+		asc, err := rpcSource(ctx, bcc, bcProtocol, bcNode, "abci queries")
+		if err != nil {
+			stdLogger.Panicf("error creating blockchain client for abci queries: %v", err)
+		}
+		wgs.Add(1)
+		go func() {
+			defer wgs.Done()
+			abciScraper(ctx, asc, collection(dbc.Database(dbName), "abci_queries"), abciQueries, abciHeights, abciInterval)
+		}()
+	}
+
+	var vrf *verifier // nil disables blocks verification
+	if verifyBlocks != "off" {
+		vsc, err := rpcSource(ctx, bcc, bcProtocol, bcNode, "block verification")
+		if err != nil {
+			stdLogger.Panicf("error creating blockchain client for block verification: %v", err)
+		}
+		vrf = newVerifier(vsc)
+	}
+
+	var cc *continuity // nil disables block hash continuity check
+	if checkContinuity {
+		var err error
+		if cc, err = newContinuity(ctx, bxs, collection(dbc.Database(dbName), "continuity_errors"), tail); err != nil {
+			stdLogger.Panicf("error initialising block hash continuity check: %v", err)
+		}
+	}
+
+	var evm *evmClient // nil disables evm data scraping
+	if evmRPCURL != "" {
+		var err error
+		if evm, err = newEVMClient(evmRPCURL, dbc.Database(dbName)); err != nil {
+			stdLogger.Panicf("error creating evm json-rpc client: %v", err)
+		}
+	}
+
+	var ut *uptime // nil disables validators uptime tracking
+	if trackUptime {
+		ut = newUptime(dbc.Database(dbName))
+	}
+	if signingInfoInterval > 0 {
+		if bcProtocol == "rpc" {
+			stdLogger.Println("warn: signing infos scraping is not supported with rpc protocol (skipping)")
+		} else {
+			wgs.Add(1)
+			go func() {
+				defer wgs.Done()
+				signingInfoScraper(ctx, bcc, collection(dbc.Database(dbName), "signing_infos"), signingInfoInterval)
+			}()
+		}
+	}
+	// note: capped and time series collections are pruned by database itself
+	if (retentionBlocks > 0 || retentionAge > 0) && dbCollectionType == "regular" {
+		wgs.Add(1)
+		go func() {
+			defer wgs.Done()
+			pruner(ctx, st, bxs, txs, brs, retentionBlocks, retentionAge, retentionInterval)
+		}()
+	}
+
+	var ibc *mongo.Collection // nil disables ibc packets extraction
+	if ibcPackets {
+		ibc = collection(dbc.Database(dbName), "ibc_packets")
+	}
+
+	var lg *ledger // nil disables heights ledger
+	if heightLedger {
+		lg = newLedger(collection(dbc.Database(dbName), "heights"), blockResults)
+		defer lg.close()
+	}
+
+	var tr *tracer // nil disables tracing
+	if otlpEndpoint != "" {
+		tr = newTracer(otlpEndpoint, traceSample)
+		defer tr.close()
+	}
+
+	pg := newProgress(ss.height)
+	if progressInterval > 0 {
+		wgs.Add(1)
+		go func() {
+			defer wgs.Done()
+			pg.run(ctx, progressInterval)
+		}()
+	}
+
+	if heartbeatInterval > 0 {
+		wgs.Add(1)
+		go func() {
+			defer wgs.Done()
+			heartbeat(ctx, collection(dbc.Database(dbName), "status"), pg, heartbeatInterval)
+		}()
+	}
+	if errorSummaryInterval > 0 {
+		wgs.Add(1)
+		go func() {
+			defer wgs.Done()
+			errStats.run(ctx, errorSummaryInterval)
+		}()
+	}
+
+	var hl *health // nil disables health endpoints
+	if httpAddr != "" {
+		hl = newHealth(bcc, dbc, ss.height, stallTimeout)
+		mux := http.NewServeMux()
+		hl.register(mux)
+		pg.register(mux)
+		if debugEndpoints {
+			registerDebug(mux)
+		}
+		if err := serveHTTP(ctx, httpAddr, mux); err != nil {
+			stdLogger.Fatalf("failed serving http endpoints: %v", err)
+		}
+	}
 
 	stdLogger.Printf("spawning workers...")
 	reqChan := make(chan request, maxReqWorkers)
 	perChan := make(chan persist, maxPerWorkers)
+
+	queues := func() (int, int) { return len(reqChan), len(perChan) }
+	pz := &pauser{}
+	wgs.Add(1)
+	go func() {
+		defer wgs.Done()
+		runtimeControls(ctx, pz, pg, ss, queues)
+	}()
+
+	if stallWatchdog {
+		wd := newWatchdog(pg, ss, pz, queues, stallTimeout)
+		wgs.Add(1)
+		go func() {
+			defer wgs.Done()
+			wd.run(ctx)
+		}()
+	}
+	// workers pools can be resized on config reload
 	var wgr, wgp sync.WaitGroup
-	for i := 0; i < maxReqWorkers; i++ {
-		wgr.Add(1)
+	reqPool := &workerPool{wg: &wgr, work: func() {
+		defer alertOnPanic()
+		reqWorker(wctx, bcc, rsc, vrf, cc, evm, ut, lg, tr, bxs, txs, brs, reqChan, perChan, bcRetry)
+	}, quit: func(ctx context.Context) error {
+		select {
+		case reqChan <- request{quit: true}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}}
+	perPool := &workerPool{wg: &wgp, work: func() {
+		defer alertOnPanic()
+		perWorker(wctx, perChan, st, ibc, dlq)
+	}, quit: func(ctx context.Context) error {
+		select {
+		case perChan <- persist{quit: true}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}}
+	if adaptiveWorkers {
+		reqPool.max, perPool.max = maxReqWorkers, maxPerWorkers
+		reqPool.resize(ctx, initialWorkers(maxReqWorkers))
+		perPool.resize(ctx, initialWorkers(maxPerWorkers))
+		stdLogger.Printf("scaling workers adaptively: starting with %d requests and %d persists workers (up to %d and %d)", reqPool.workers(), perPool.workers(), maxReqWorkers, maxPerWorkers)
+	} else {
+		reqPool.resize(ctx, maxReqWorkers)
+		perPool.resize(ctx, maxPerWorkers)
+	}
+
+	// note: reloader, adaptive scaling and gap scanner send to workers' channels, so they are stopped before closing them
+	var wgg sync.WaitGroup
+	if adaptiveWorkers {
+		wgg.Add(1)
+		go func() {
+			defer wgg.Done()
+			adaptiveScaling(ctx, reqPool, perPool, reqChan, perChan, adaptiveInterval)
+		}()
+	}
+	if l, ok := bcc.(*limitedSource); ok {
+		wgg.Add(1)
 		go func() {
-			defer wgr.Done()
-			reqWorker(ctx, bcc, bxs, txs, reqChan, perChan, napTime)
+			defer wgg.Done()
+			reloader(ctx, reqPool, perPool, l.limiter)
 		}()
 	}
-	for i := 0; i < maxPerWorkers; i++ {
-		wgp.Add(1)
+
+	// re-scrape heights missing in database
+	if gapScan && dbc != nil && !slice {
+		gapFrom := 0
+		if follow {
+			// historical blocks are not scraped in follow mode
+			gapFrom = tail
+		}
+		cols := []*mongo.Collection{bxs}
+		if rsc != nil {
+			cols = append(cols, brs)
+		}
+		wgg.Add(1)
 		go func() {
-			defer wgp.Done()
-			perWorker(ctx, perChan)
+			defer wgg.Done()
+			gapScanner(ctx, cols, gapFrom, ss.height, gapScanInterval, reqChan)
 		}()
 	}
 
+	// get new blocks as soon as they are produced, falling back to polling every napTime
+	var heads <-chan int // nil channel (ie, polling only) if subscription is not configured
+	if bcWSURL != "" {
+		heads = subscribeHeads(ctx, bcWSURL, napTime, bcWSTimeout)
+	}
+
+	// re-scrape heights not fully processed before last stop
+	if len(rp.pending) > 0 {
+		stdLogger.Printf("queuing %d pending blocks [%d..%d]", len(rp.pending), rp.pending[0], rp.pending[len(rp.pending)-1])
+		for _, h := range rp.pending {
+			if ctx.Err() != nil {
+				break
+			}
+			reqChan <- request{height: h}
+		}
+	}
+
 	stdLogger.Printf("starting scraping from block %d to %d", tail, head)
+	if ok, err := sdNotify("READY=1"); err != nil {
+		stdLogger.Printf("warn: %v", err)
+	} else if ok {
+		// note: watchdog keeps being pinged while draining, until workers are aborted
+		go sdWatchdog(wctx, pg)
+	}
+	if tui {
+		wgs.Add(1)
+		go func() {
+			defer wgs.Done()
+			runTUI(ctx, pg, pz, queues)
+		}()
+	}
+	// tip pipeline workers share everything with the other requests workers, except for their channel
+	tipWork := func(ch <-chan request) {
+		defer alertOnPanic()
+		reqWorker(wctx, bcc, rsc, vrf, cc, evm, ut, lg, tr, bxs, txs, brs, ch, perChan, bcRetry)
+	}
+	setHead := func(h int) {
+		pg.setHead(h)
+		if hl != nil {
+			hl.setHead(h)
+		}
+	}
+	var tip *tipPipeline // non-nil while tip pipeline is running
+
 	// catch up and keep up with current blockchain height
-	var err error
+	recheck := 0 // lowest provisional height (ie, queued within confirmations of head) not yet re-validated, or 0 if none
 	for ctx.Err() == nil {
-		stdLogger.Printf("queuing new blocks [%d..%d]", tail, head)
+		if stopHeight > 0 && head > stopHeight {
+			head = stopHeight
+		}
+		setHead(head)
+		// re-validate provisional blocks that got confirmed in the meantime
+		for ctx.Err() == nil && recheck > 0 && recheck <= head-confirmations && recheck < tail {
+			reqChan <- request{height: recheck, recheck: true}
+			recheck++
+		}
+		if recheck >= tail {
+			recheck = 0
+		}
+		if confirmations > 0 && recheck == 0 && tail <= head {
+			recheck = tail
+			if p := head - confirmations + 1; p > recheck {
+				recheck = p
+			}
+		}
+
+		// scrape near-head heights in tip pipeline, while far behind chain head
+		if tip == nil && tipWorkers > 0 && stopHeight == 0 && head-tail >= tipWindow {
+			tip = startTip(ctx, pz, bcc, head-tipWindow+1, head, tipWorkers, tipWork, heads, setHead)
+			stdLogger.Printf("lagging behind chain head by %d heights: scraping heights from %d in tip pipeline, concurrently with backfill", head-tail+1, tip.from)
+		}
+		end := head
+		if tip != nil {
+			end = tip.from - 1
+		}
+
+		stdLogger.Printf("queuing new blocks [%d..%d]", tail, end)
 		// fill-in buffered reqChan channel in bulks of maxReqWorkers new requests
-		for ctx.Err() == nil && tail <= head {
+		for ctx.Err() == nil && tail <= end {
+			pz.wait(ctx)
+			if ctx.Err() != nil {
+				break
+			}
+			// skip heights pruned by node
+			if p := int(atomic.LoadInt64(&pruned)); tail <= p {
+				tail = p + 1
+				continue
+			}
 			reqChan <- request{height: tail}
 			tail++ // next unprocessed block
 		}
+		// continue from where tip pipeline got to, once backfill reaches it
+		if tip != nil && tail > end {
+			tail = tip.stop()
+			tip = nil
+			if tail-1 > head {
+				head = tail - 1
+			}
+			stdLogger.Printf("backfill reached tip pipeline: pipelines merged at height %d", tail)
+		}
 		// wait for new blocks
 		for ctx.Err() == nil && tail > head {
-			stdLogger.Printf("no new blocks after %d - napping for %s", head, napTime)
+			if stopHeight > 0 && tail > stopHeight {
+				stdLogger.Printf("stop height %d reached: stopping...", stopHeight)
+				cancel()
+				break
+			}
+			stdLogger.Printf("no new blocks after %d - napping for %s", head, nap())
 			select {
 			case <-ctx.Done():
 				continue // will break from this and also outer loop because of ctx.Err()
-			case <-time.After(napTime):
+			case h := <-heads:
+				if h -= headLag; h > head {
+					head = h
+				}
+			case <-time.After(nap()):
 				stdLogger.Println("awakening...")
-				if head, err = bcHeight(ctx, bcc, napTime); err != nil {
+				if err = checkSync(ctx, bcc, bcProtocol); err != nil {
+					continue // ctx cancelled
+				}
+				if head, err = bcHeight(ctx, bcc, bcRetry); err != nil {
 					stdLogger.Panicf("error getting current blockchain height: %v", err)
 				}
+				head -= headLag
 			}
 		}
 	}
 
-	// gracefully exit
+	// gracefully exit, draining in-flight heights
+	if _, err := sdNotify("STOPPING=1"); err != nil {
+		stdLogger.Printf("warn: %v", err)
+	}
 	stdLogger.Println("stopping requesters...")
+	if tip != nil {
+		tip.stop()
+	}
+	wgg.Wait()
 	close(reqChan)
 	wgr.Wait()
 	stdLogger.Println("requesters stopped")
@@ -114,5 +822,95 @@ func main() {
 	wgp.Wait()
 	stdLogger.Println("persisters stopped")
 
+	// record precise resume point, unless scraping arbitrary slice of history or another instance took over
+	if !slice && atomic.LoadInt32(&lostLead) == 0 {
+		if err := ss.save(context.Background()); err != nil {
+			stdLogger.Printf("error saving final scrape state: %v", err)
+		}
+		r := ss.resume()
+		if err := writeResume(resumeFile, r); err != nil {
+			stdLogger.Printf("error writing resume manifest: %v", err)
+		} else {
+			stdLogger.Printf("resume point recorded in %s: after height %d (with %d pending heights)", resumeFile, r.highest, len(r.pending))
+		}
+	}
+
+	stdLogger.Println("stopping subsystems...")
+	wgs.Wait()
+	stdLogger.Println("subsystems stopped")
+
+	if ld != nil {
+		stopLead()
+		wgl.Wait()
+		if atomic.LoadInt32(&lostLead) == 0 {
+			if err := ld.release(context.Background()); err != nil {
+				stdLogger.Printf("warn: %v", err)
+			}
+		}
+	}
+
 	stdLogger.Println("cosmos-scraper stopped 'gracefully'.")
 }
+
+// scrapeArgs parses scrape command args (ie, [--start-height H1] [--stop-height H2]), overriding respective config values
+func scrapeArgs(args []string) error {
+	fs := flag.NewFlagSet("scrape", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.IntVar(&startHeight, "start-height", startHeight, "first height to scrape, instead of the one after last processed")
+	fs.IntVar(&stopHeight, "stop-height", stopHeight, "last height to scrape, before stopping")
+	fs.BoolVar(&follow, "follow", follow, "start from current chain head, skipping historical blocks")
+	fs.BoolVar(&tui, "tui", tui, "show interactive terminal ui instead of stdout logging")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if startHeight < 0 || stopHeight < 0 || (stopHeight > 0 && startHeight > stopHeight) {
+		return fmt.Errorf("invalid start height %d and stop height %d", startHeight, stopHeight)
+	}
+	if follow && startHeight > 0 {
+		return fmt.Errorf("start height cannot be used in follow mode")
+	}
+	return nil
+}
+
+// openStorage returns storage as per dbType, wrapped with configured sinks, and, if using mongo database, its client and blocks, transactions and block results collections (nil otherwise)
+// it also returns configured dead letters, used by storage and sinks (nil if disabled)
+func openStorage(ctx context.Context) (st storage, dbc *mongo.Client, bxs, txs, brs *mongo.Collection, dlq *deadLetters) {
+	var err error
+	switch dbType {
+	case "bolt":
+		if st, err = openBolt(dbPath); err != nil {
+			stdLogger.Fatalf("failed opening embedded database: %v", err)
+		}
+	case "none":
+		st = nopStorage{}
+	default:
+		dbc, bxs, txs, brs = initDB(ctx, dbHost, dbPort, dbUser, dbPass, dbRetry)
+		if err := checkLegacyDocs(ctx, bxs, txs, brs); err != nil {
+			stdLogger.Fatalf("failed opening database: %v", err)
+		}
+		st = newMongoStorage(ctx, dbc, bxs, txs, brs, dbBatchSize, dbBatchWait)
+		if err := createCollections(ctx, dbc.Database(dbName)); err != nil {
+			stdLogger.Fatalf("failed creating collections: %v", err)
+		}
+		if dbIndexes {
+			ensureIndexes(ctx, dbc.Database(dbName))
+		}
+		if dbAtomic {
+			if err := checkReplicaSet(ctx, dbc); err != nil {
+				stdLogger.Fatalf("failed enabling atomic persistence: %v", err)
+			}
+		}
+	}
+	dlq = openDeadLetters(dbc)
+	sinks, err := initSinks(ctx, dlq)
+	if err != nil {
+		stdLogger.Fatalf("failed initialising sinks: %v", err)
+	}
+	if len(sinks) > 0 {
+		st = &sinkStorage{storage: st, sinks: sinks}
+	}
+	return st, dbc, bxs, txs, brs, dlq
+}
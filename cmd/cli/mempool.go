@@ -0,0 +1,69 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// mempoolScraper polls node's mempool every interval, until ctx cancelled, storing pending transactions into col
+// transactions are keyed by their hash (matching txhash of confirmed transactions), with seen_at set when first seen and last_seen_at updated on every poll, so inclusion latency can be derived
+// note: tendermint returns up to 100 pending transactions per request, so transactions beyond that in busy mempools might be missed
+func mempoolScraper(ctx context.Context, rsc bcSource, col *mongo.Collection, interval time.Duration) {
+	periodically(ctx, "mempool", interval, func(ctx context.Context) error {
+		return scrapeMempool(ctx, rsc, col)
+	})
+}
+
+// scrapeMempool stores currently pending transactions into col
+func scrapeMempool(ctx context.Context, rsc bcSource, col *mongo.Collection) error {
+	// ref: https://docs.tendermint.com/v0.34/rpc/#/Info/unconfirmed_txs
+	res, err := queryAt(ctx, rsc, "/unconfirmed_txs", url.Values{"limit": {"100"}}, 0, bcRetry)
+	if err != nil {
+		return err
+	}
+	var m struct {
+		Txs []string `json:"txs"`
+	}
+	if err := json.Unmarshal(res, &m); err != nil {
+		return fmt.Errorf("error unmarshalling unconfirmed txs - got response:\n%s: %v", string(res), err)
+	}
+
+	now := time.Now().UTC()
+	for _, tx := range m.Txs {
+		b, err := base64.StdEncoding.DecodeString(tx)
+		if err != nil {
+			return fmt.Errorf("error decoding unconfirmed tx %s: %v", tx, err)
+		}
+		hash := strings.ToUpper(fmt.Sprintf("%x", sha256.Sum256(b)))
+		if err := touch(ctx, col, hash, bson.M{"tx": tx, "seen_at": now}, bson.M{"last_seen_at": now}); err != nil {
+			return fmt.Errorf("error storing unconfirmed tx %s: %v", hash, err)
+		}
+	}
+
+	return nil
+}
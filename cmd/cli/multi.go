@@ -0,0 +1,152 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// multiSource is bcSource that round-robins requests across multiple nodes, failing over to the next one if a node returns an error or times out
+// failed nodes are considered unhealthy and skipped for napTime, unless all nodes are unhealthy
+type multiSource struct {
+	nodes []*endpoint
+	next  uint32 // index of the next node to use
+}
+
+// endpoint is a single node of multiSource
+type endpoint struct {
+	name string
+	src  bcSource
+
+	mu        sync.Mutex
+	downUntil time.Time // node is unhealthy until then
+}
+
+// newMultiSource returns multiSource for protocol referencing comma-separated list of hosts (as [scheme://]host[:port][/prefix]), using port for those without one
+func newMultiSource(ctx context.Context, protocol, hosts, port string) (*multiSource, error) {
+	var m multiSource
+	for _, h := range strings.Split(hosts, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+		src, err := newBCSource(ctx, protocol, h, port)
+		if err != nil {
+			return nil, fmt.Errorf("error creating client for %s: %v", h, err)
+		}
+		name := h
+		if scheme, host, p, prefix := splitEndpoint(h, port); scheme != "unix" {
+			name = scheme + "://" + net.JoinHostPort(host, p) + prefix
+		}
+		m.nodes = append(m.nodes, &endpoint{name: name, src: src})
+	}
+	if len(m.nodes) == 0 {
+		return nil, fmt.Errorf("no endpoints found in %q", hosts)
+	}
+	return &m, nil
+}
+
+// block returns block at height from the next healthy node
+func (m *multiSource) block(height string) ([]byte, error) {
+	return m.do(func(src bcSource) ([]byte, error) { return src.block(height) })
+}
+
+// txs returns single page of transactions at height from the next healthy node
+func (m *multiSource) txs(height, key string, offset int) ([]byte, error) {
+	return m.do(func(src bcSource) ([]byte, error) { return src.txs(height, key, offset) })
+}
+
+// blockResults returns block results at height from the next healthy node
+func (m *multiSource) blockResults(height string) ([]byte, error) {
+	return m.do(func(src bcSource) ([]byte, error) { return src.blockResults(height) })
+}
+
+// query returns response for api path with params at height from the next healthy node
+func (m *multiSource) query(path string, params url.Values, height int) ([]byte, error) {
+	return m.do(func(src bcSource) ([]byte, error) { return src.query(path, params, height) })
+}
+
+// do makes request using next healthy node, failing over to other nodes on error, and returns the first successful response or the last error
+func (m *multiSource) do(req func(bcSource) ([]byte, error)) ([]byte, error) {
+	start := int(atomic.AddUint32(&m.next, 1))
+
+	// try healthy nodes first, then any unhealthy ones as a last resort, each node at most once
+	var err error
+	tried := make([]bool, len(m.nodes))
+	for _, healthy := range []bool{true, false} {
+		for i := 0; i < len(m.nodes); i++ {
+			j := (start + i) % len(m.nodes)
+			n := m.nodes[j]
+			if tried[j] || n.healthy() != healthy {
+				continue
+			}
+			tried[j] = true
+			var res []byte
+			if res, err = req(n.src); err == nil || !nodeFailure(err) {
+				if err == nil {
+					n.up()
+				}
+				return res, err
+			}
+			n.down()
+			stdLogger.Printf("node %s failed (skipping it for %s): %v", n.name, nap(), err)
+		}
+	}
+	return nil, err
+}
+
+// healthy returns true if node is not marked as unhealthy
+func (n *endpoint) healthy() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return time.Now().After(n.downUntil)
+}
+
+// down marks node as unhealthy for napTime
+func (n *endpoint) down() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.downUntil = time.Now().Add(nap())
+}
+
+// up marks node as healthy
+func (n *endpoint) up() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.downUntil = time.Time{}
+}
+
+// nodeFailure returns true if error is caused by node itself (eg, connection error, timeout or server error) rather than by the request (eg, unavailable height)
+func nodeFailure(err error) bool {
+	if errors.Is(err, errUnsupported) || errors.Is(err, errTooLarge) {
+		return false
+	}
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= http.StatusInternalServerError || se.code == http.StatusTooManyRequests || se.code == http.StatusRequestTimeout
+	}
+	return true
+}
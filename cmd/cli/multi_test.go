@@ -0,0 +1,95 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// fakeSource is bcSource returning err (or ok response if nil) for all requests, recording calls
+type fakeSource struct {
+	mu    sync.Mutex
+	err   error
+	calls int
+}
+
+func (s *fakeSource) do() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []byte("ok"), nil
+}
+
+func (s *fakeSource) block(string) ([]byte, error)                  { return s.do() }
+func (s *fakeSource) txs(string, string, int) ([]byte, error)       { return s.do() }
+func (s *fakeSource) blockResults(string) ([]byte, error)           { return s.do() }
+func (s *fakeSource) query(string, url.Values, int) ([]byte, error) { return s.do() }
+
+func TestMultiSource(t *testing.T) {
+	failure := &statusError{code: http.StatusServiceUnavailable, status: "503 Service Unavailable"}
+	badRequest := &statusError{code: http.StatusBadRequest, status: "400 Bad Request"}
+	tests := []struct {
+		name  string
+		errs  []error // per node
+		down  []bool  // nodes initially marked unhealthy
+		calls []int   // expected calls per node
+		err   bool
+	}{
+		{name: "first ok", errs: []error{nil, nil, nil}, calls: []int{1, 0, 0}},
+		{name: "failover", errs: []error{failure, nil, nil}, calls: []int{1, 1, 0}},
+		{name: "request error not failed over", errs: []error{badRequest, nil, nil}, calls: []int{1, 0, 0}, err: true},
+		{name: "all failing tried once", errs: []error{failure, failure, failure}, calls: []int{1, 1, 1}, err: true},
+		{name: "unhealthy skipped", errs: []error{nil, nil, nil}, down: []bool{true, false, false}, calls: []int{0, 1, 0}},
+		{name: "unhealthy as last resort", errs: []error{nil, failure, failure}, down: []bool{true, false, false}, calls: []int{1, 1, 1}},
+		{name: "all unhealthy", errs: []error{failure, nil}, down: []bool{true, true}, calls: []int{1, 1}},
+		{name: "single node", errs: []error{errors.New("connection refused")}, calls: []int{1}, err: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := &multiSource{next: ^uint32(0)} // so the first request starts with the first node
+			var srcs []*fakeSource
+			for i, err := range tc.errs {
+				src := &fakeSource{err: err}
+				srcs = append(srcs, src)
+				n := &endpoint{name: "node", src: src}
+				if tc.down != nil && tc.down[i] {
+					n.down()
+				}
+				m.nodes = append(m.nodes, n)
+			}
+			_, err := m.block("1")
+			if (err != nil) != tc.err {
+				t.Errorf("got error %v, want error: %v", err, tc.err)
+			}
+			var calls []int
+			for _, src := range srcs {
+				calls = append(calls, src.calls)
+			}
+			if !reflect.DeepEqual(calls, tc.calls) {
+				t.Errorf("got calls %v, want %v", calls, tc.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsSink publishes scraped data to nats jetstream subjects, by datatype
+// messages are published with 'subject/height' message id, so jetstream discards duplicates (eg, re-scraped heights) within stream's duplicates window
+type natsSink struct {
+	nc       *nats.Conn
+	js       nats.JetStreamContext
+	subjects map[string]string // by datatype
+}
+
+// newNATSSink returns nats jetstream sink for server url and subjects, by datatype
+// if stream is set, it's created (if not existing) to capture all subjects, with dedup duplicates window
+func newNATSSink(url string, subjects map[string]string, stream string, dedup time.Duration) (*natsSink, error) {
+	stdLogger.Printf("connecting to nats at %s...", url)
+	nc, err := nats.Connect(url, nats.Name("cosmos-scraper"), nats.MaxReconnects(-1))
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to nats: %v", err)
+	}
+	js, err := nc.JetStream()
+	if err != nil {
+		nc.Close()
+		return nil, fmt.Errorf("error creating jetstream context: %v", err)
+	}
+	if stream != "" {
+		if _, err := js.StreamInfo(stream); errors.Is(err, nats.ErrStreamNotFound) {
+			var subs []string
+			for _, s := range subjects {
+				if s != "" {
+					subs = append(subs, s)
+				}
+			}
+			if _, err := js.AddStream(&nats.StreamConfig{Name: stream, Subjects: subs, Duplicates: dedup}); err != nil {
+				nc.Close()
+				return nil, fmt.Errorf("error creating jetstream stream %s: %v", stream, err)
+			}
+			stdLogger.Printf("created jetstream stream %s for subjects %v", stream, subs)
+		} else if err != nil {
+			nc.Close()
+			return nil, fmt.Errorf("error getting jetstream stream %s info: %v", stream, err)
+		}
+	}
+	return &natsSink{nc: nc, js: js, subjects: subjects}, nil
+}
+
+// publish publishes raw datatype at height to its subject, waiting for jetstream acknowledgement
+func (s *natsSink) publish(ctx context.Context, datatype string, height int, raw []byte) error {
+	subject, ok := s.subjects[datatype]
+	if !ok || subject == "" {
+		return nil // datatype not published
+	}
+	msg := nats.NewMsg(subject)
+	msg.Data = raw
+	msg.Header.Set(nats.MsgIdHdr, fmt.Sprintf("%s/%d", subject, height)) // same as nats.MsgId option, but set on message itself
+	_, err := s.js.PublishMsg(msg, nats.Context(ctx))
+	return err
+}
+
+// close drains pending messages and closes nats connection
+func (s *natsSink) close() error {
+	return s.nc.Drain()
+}
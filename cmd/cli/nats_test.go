@@ -0,0 +1,74 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+// fakeJetStream records published messages, failing with err, if set
+type fakeJetStream struct {
+	nats.JetStreamContext
+	mu   sync.Mutex
+	err  error
+	msgs []*nats.Msg
+}
+
+func (js *fakeJetStream) PublishMsg(m *nats.Msg, opts ...nats.PubOpt) (*nats.PubAck, error) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if js.err != nil {
+		return nil, js.err
+	}
+	js.msgs = append(js.msgs, m)
+	return &nats.PubAck{Stream: "COSMOS", Sequence: uint64(len(js.msgs))}, nil
+}
+
+func TestNATSPublish(t *testing.T) {
+	js := &fakeJetStream{}
+	s := &natsSink{js: js, subjects: map[string]string{"block": "cosmos.blocks", "transactions": "cosmos.txs", "block_results": ""}}
+	ctx := context.Background()
+
+	// re-scraped height is published with the same message id, so jetstream discards it as duplicate
+	for _, m := range []sinkMsg{{"block", 10, []byte(`{"a":1}`)}, {"transactions", 10, []byte(`{"b":2}`)}, {"block_results", 10, []byte(`{}`)}, {"block", 10, []byte(`{"a":1}`)}} {
+		if err := s.publish(ctx, m.datatype, m.height, m.raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []struct {
+		subject, id, data string
+	}{{"cosmos.blocks", "cosmos.blocks/10", `{"a":1}`}, {"cosmos.txs", "cosmos.txs/10", `{"b":2}`}, {"cosmos.blocks", "cosmos.blocks/10", `{"a":1}`}}
+	if len(js.msgs) != len(want) {
+		t.Fatalf("got %d messages, want %d (datatype without subject not published)", len(js.msgs), len(want))
+	}
+	for i, w := range want {
+		m := js.msgs[i]
+		if m.Subject != w.subject || m.Header.Get(nats.MsgIdHdr) != w.id || string(m.Data) != w.data {
+			t.Errorf("message %d: got (%s, %s, %s), want (%s, %s, %s)", i, m.Subject, m.Header.Get(nats.MsgIdHdr), m.Data, w.subject, w.id, w.data)
+		}
+	}
+
+	js.err = nats.ErrNoStreamResponse
+	if err := s.publish(ctx, "block", 11, []byte(`{}`)); !errors.Is(err, nats.ErrNoStreamResponse) {
+		t.Errorf("got error %v, want jetstream error", err)
+	}
+}
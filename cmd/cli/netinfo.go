@@ -0,0 +1,84 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// netInfoScraper stores node's peers snapshot every interval, until ctx cancelled
+// snapshots (ie, whole net_info responses, including peers' connection status with send and receive rates) are stored in net_info collection, keyed by scraped_at timestamp
+// peers are also stored in peers collection, keyed by node id, with first_seen_at set when first seen and last_seen_at and node info updated on every snapshot, so topology changes can be followed over time
+func netInfoScraper(ctx context.Context, rsc bcSource, db *mongo.Database, interval time.Duration) {
+	periodically(ctx, "net info", interval, func(ctx context.Context) error {
+		return scrapeNetInfo(ctx, rsc, collection(db, "net_info"), collection(db, "peers"))
+	})
+}
+
+// scrapeNetInfo stores current node's net info snapshot into snapshots and its peers into peers collection
+func scrapeNetInfo(ctx context.Context, rsc bcSource, snapshots, peers *mongo.Collection) error {
+	// ref: https://docs.tendermint.com/v0.34/rpc/#/Info/net_info
+	res, err := queryAt(ctx, rsc, "/net_info", nil, 0, bcRetry)
+	if err != nil {
+		return err
+	}
+	var ni struct {
+		Peers []struct {
+			NodeInfo struct {
+				ID         string `json:"id"`
+				Moniker    string `json:"moniker"`
+				Network    string `json:"network"`
+				Version    string `json:"version"`
+				ListenAddr string `json:"listen_addr"`
+			} `json:"node_info"`
+			IsOutbound bool   `json:"is_outbound"`
+			RemoteIP   string `json:"remote_ip"`
+		} `json:"peers"`
+	}
+	if err := json.Unmarshal(res, &ni); err != nil {
+		return fmt.Errorf("error unmarshalling net info - got response:\n%s: %v", string(res), err)
+	}
+
+	now := time.Now().UTC()
+	if err := upsert(ctx, snapshots, now, res, bson.M{"scraped_at": now}); err != nil {
+		return fmt.Errorf("error storing net info: %v", err)
+	}
+	for _, p := range ni.Peers {
+		if p.NodeInfo.ID == "" {
+			continue
+		}
+		info := bson.M{
+			"moniker":      p.NodeInfo.Moniker,
+			"network":      p.NodeInfo.Network,
+			"version":      p.NodeInfo.Version,
+			"listen_addr":  p.NodeInfo.ListenAddr,
+			"remote_ip":    p.RemoteIP,
+			"is_outbound":  p.IsOutbound,
+			"last_seen_at": now,
+		}
+		if err := touch(ctx, peers, p.NodeInfo.ID, bson.M{"first_seen_at": now}, info); err != nil {
+			return fmt.Errorf("error storing peer %s: %v", p.NodeInfo.ID, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// paramsPaths are api paths of module params, by module
+// consensus params are only available via consensus module in sdk v0.47+, or via tendermint rpc
+var paramsPaths = map[string]string{
+	"consensus":    "/cosmos/consensus/v1/params",
+	"mint":         "/cosmos/mint/v1beta1/params",
+	"staking":      "/cosmos/staking/v1beta1/params",
+	"slashing":     "/cosmos/slashing/v1beta1/params",
+	"distribution": "/cosmos/distribution/v1beta1/params",
+}
+
+// paramsScraper scrapes consensus and module params every interval, until ctx cancelled
+// params are stored in params collection, keyed by module and height, only when they change, so each doc is a params version effective from its height
+func paramsScraper(ctx context.Context, bcc bcSource, col *mongo.Collection, interval time.Duration, protocol string) {
+	paths := paramsPaths
+	if protocol == "rpc" {
+		// ref: https://docs.tendermint.com/v0.34/rpc/#/Info/consensus_params
+		paths = map[string]string{"consensus": "/consensus_params"}
+	}
+	last := map[string]string{} // last stored params hash, by module
+	periodically(ctx, "params", interval, func(ctx context.Context) error {
+		h, err := bcHeight(ctx, bcc, bcRetry)
+		if err != nil {
+			return err
+		}
+		for module, path := range paths {
+			if err := scrapeParams(ctx, bcc, col, module, path, h, last); err != nil {
+				if errors.Is(err, context.Canceled) {
+					return err
+				}
+				// modules might be missing or not expose params on some chains, so don't let them block others
+				stdLogger.Printf("warn: error scraping %s params at height %d (will retry in %s): %v", module, h, interval, err)
+			}
+		}
+		return nil
+	})
+}
+
+// scrapeParams stores module params at height h if they differ from the last stored version
+func scrapeParams(ctx context.Context, bcc bcSource, col *mongo.Collection, module, path string, h int, last map[string]string) error {
+	// note: single attempt, as missing modules would otherwise be retried indefinitely
+	res, err := bcc.query(path, nil, h)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(res, &doc); err != nil {
+		return fmt.Errorf("error unmarshalling %s params - got response:\n%s: %v", module, string(res), err)
+	}
+	delete(doc, "block_height") // tendermint rpc response includes requested height
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	hash := fmt.Sprintf("%x", sha256.Sum256(raw))
+
+	if _, ok := last[module]; !ok {
+		var prev struct {
+			Hash string `bson:"hash"`
+		}
+		err := col.FindOne(ctx, bson.M{"module": module}, options.FindOne().SetSort(bson.M{"height": -1})).Decode(&prev)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return fmt.Errorf("error reading last %s params: %v", module, err)
+		}
+		last[module] = prev.Hash
+	}
+	if last[module] == hash {
+		return nil
+	}
+
+	id := fmt.Sprintf("%s/%d", module, h)
+	if err := upsert(ctx, col, id, raw, bson.M{"module": module, "height": h, "hash": hash, "scraped_at": time.Now().UTC()}); err != nil {
+		return fmt.Errorf("error storing %s params: %v", module, err)
+	}
+	last[module] = hash
+	stdLogger.Printf("stored new %s params version at height %d", module, h)
+	return nil
+}
@@ -0,0 +1,273 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// parquetBlock is blocks parquet file row
+type parquetBlock struct {
+	Height          int64  `parquet:"name=height, type=INT64"`
+	Time            string `parquet:"name=time, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ChainID         string `parquet:"name=chain_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Hash            string `parquet:"name=hash, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ProposerAddress string `parquet:"name=proposer_address, type=BYTE_ARRAY, convertedtype=UTF8"`
+	NumTxs          int32  `parquet:"name=num_txs, type=INT32"`
+}
+
+// parquetTx is transactions parquet file row (one per transaction)
+// note: memo, messages types and fee are not available with rpc protocol (as transactions are not decoded)
+type parquetTx struct {
+	Height    int64  `parquet:"name=height, type=INT64"`
+	TxHash    string `parquet:"name=txhash, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Code      int32  `parquet:"name=code, type=INT32"`
+	GasWanted int64  `parquet:"name=gas_wanted, type=INT64"`
+	GasUsed   int64  `parquet:"name=gas_used, type=INT64"`
+	Timestamp string `parquet:"name=timestamp, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Memo      string `parquet:"name=memo, type=BYTE_ARRAY, convertedtype=UTF8"`
+	MsgTypes  string `parquet:"name=msg_types, type=BYTE_ARRAY, convertedtype=UTF8"` // comma-separated
+	Signer    string `parquet:"name=signer, type=BYTE_ARRAY, convertedtype=UTF8"`    // first message sender
+	Fee       string `parquet:"name=fee, type=BYTE_ARRAY, convertedtype=UTF8"`       // comma-separated amounts with denoms
+	Raw       string `parquet:"name=raw, type=BYTE_ARRAY, convertedtype=UTF8"`       // json
+}
+
+// parquetRaw is parquet file row of other datatypes (ie, block results)
+type parquetRaw struct {
+	Height int64  `parquet:"name=height, type=INT64"`
+	Raw    string `parquet:"name=raw, type=BYTE_ARRAY, convertedtype=UTF8"` // json
+}
+
+// parquetSink exports scraped data as snappy-compressed parquet files in dir, for analytical workloads (eg, spark, duckdb or athena)
+// data is batched by height ranges (see rangeBatcher), and files are named '<dir>/<datatype>/<first height>-<last height>.parquet', partitioned by datatype and height range
+type parquetSink struct {
+	*rangeBatcher
+	dir string
+}
+
+// newParquetSink returns parquet sink writing into dir
+func newParquetSink(dir string, size int, flush time.Duration) (*parquetSink, error) {
+	for datatype := range boltBuckets {
+		if err := os.MkdirAll(filepath.Join(dir, datatype), 0755); err != nil {
+			return nil, fmt.Errorf("error creating output directory: %v", err)
+		}
+	}
+	s := &parquetSink{dir: dir}
+	s.rangeBatcher = newRangeBatcher("parquet", size, flush, s.export)
+	return s, nil
+}
+
+// publish adds raw datatype at height to its batch, exporting the batch if complete
+func (s *parquetSink) publish(ctx context.Context, datatype string, height int, raw []byte) error {
+	return s.add(ctx, datatype, height, raw)
+}
+
+// export writes batch b as parquet file, ordered by height
+// file is written under temporary name first, so only complete files are visible to readers
+func (s *parquetSink) export(ctx context.Context, b *heightBatch) error {
+	var schema interface{}
+	var rows []interface{}
+	for _, h := range b.heights() {
+		raw := b.items[h]
+		switch b.datatype {
+		case "block":
+			schema = new(parquetBlock)
+			row, err := blockRow(h, raw)
+			if err != nil {
+				return err
+			}
+			rows = append(rows, row)
+		case "transactions":
+			schema = new(parquetTx)
+			txs, err := txRows(h, raw)
+			if err != nil {
+				return err
+			}
+			rows = append(rows, txs...)
+		default:
+			schema = new(parquetRaw)
+			rows = append(rows, parquetRaw{Height: int64(h), Raw: string(raw)})
+		}
+	}
+
+	name := filepath.Join(s.dir, b.datatype, fmt.Sprintf("%d-%d.parquet", b.from, b.to))
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	pw, err := writer.NewParquetWriterFromWriter(f, schema, 4)
+	if err != nil {
+		return fmt.Errorf("error creating parquet writer: %v", err)
+	}
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	for _, row := range rows {
+		if err := pw.Write(row); err != nil {
+			return fmt.Errorf("error writing parquet row: %v", err)
+		}
+	}
+	if err := pw.WriteStop(); err != nil {
+		return fmt.Errorf("error finalising parquet file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), name); err != nil {
+		return err
+	}
+	stdLogger.Printf("exported %d %s heights [%d..%d] as %s", len(b.items), b.datatype, b.from, b.to, name)
+	return nil
+}
+
+// blockRow returns parquet row of raw block at height h
+func blockRow(h int, raw []byte) (parquetBlock, error) {
+	var b struct {
+		BlockID struct {
+			Hash string `json:"hash"`
+		} `json:"block_id"`
+		Block struct {
+			Header struct {
+				ChainID         string `json:"chain_id"`
+				Time            string `json:"time"`
+				ProposerAddress string `json:"proposer_address"`
+			} `json:"header"`
+			Data struct {
+				Txs []json.RawMessage `json:"txs"`
+			} `json:"data"`
+		} `json:"block"`
+	}
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return parquetBlock{}, fmt.Errorf("error unmarshalling block at height %d: %v", h, err)
+	}
+	return parquetBlock{
+		Height:          int64(h),
+		Time:            b.Block.Header.Time,
+		ChainID:         b.Block.Header.ChainID,
+		Hash:            fmt.Sprintf("%X", decodeHash(b.BlockID.Hash)),
+		ProposerAddress: fmt.Sprintf("%X", decodeHash(b.Block.Header.ProposerAddress)),
+		NumTxs:          int32(len(b.Block.Data.Txs)),
+	}, nil
+}
+
+// txRows returns parquet rows of raw transactions at height h, from either rest (or grpc) or rpc tx_responses
+func txRows(h int, raw []byte) ([]interface{}, error) {
+	var t struct {
+		TxResponses []json.RawMessage `json:"tx_responses"`
+	}
+	if err := json.Unmarshal(raw, &t); err != nil {
+		return nil, fmt.Errorf("error unmarshalling transactions at height %d: %v", h, err)
+	}
+	var rows []interface{}
+	for _, r := range t.TxResponses {
+		var tx struct {
+			TxHash    string      `json:"txhash"`
+			Hash      string      `json:"hash"` // rpc
+			Code      int32       `json:"code"`
+			GasWanted string      `json:"gas_wanted"`
+			GasUsed   string      `json:"gas_used"`
+			Timestamp string      `json:"timestamp"`
+			Events    []abciEvent `json:"events"`
+			TxResult  *struct {
+				Code      int32       `json:"code"`
+				GasWanted string      `json:"gas_wanted"`
+				GasUsed   string      `json:"gas_used"`
+				Events    []abciEvent `json:"events"`
+			} `json:"tx_result"` // rpc
+			Tx struct {
+				Body struct {
+					Memo     string `json:"memo"`
+					Messages []struct {
+						Type string `json:"@type"`
+					} `json:"messages"`
+				} `json:"body"`
+				AuthInfo struct {
+					Fee struct {
+						Amount []struct {
+							Denom  string `json:"denom"`
+							Amount string `json:"amount"`
+						} `json:"amount"`
+					} `json:"fee"`
+				} `json:"auth_info"`
+			} `json:"tx"`
+		}
+		// note: rpc tx is base64-encoded string, so it's decoded separately from the rest
+		if err := json.Unmarshal(r, &tx); err != nil {
+			var rpcTx struct {
+				Hash     string `json:"hash"`
+				TxResult struct {
+					Code      int32       `json:"code"`
+					GasWanted string      `json:"gas_wanted"`
+					GasUsed   string      `json:"gas_used"`
+					Events    []abciEvent `json:"events"`
+				} `json:"tx_result"`
+			}
+			if err := json.Unmarshal(r, &rpcTx); err != nil {
+				return nil, fmt.Errorf("error unmarshalling transaction at height %d: %v", h, err)
+			}
+			tx.Hash = rpcTx.Hash
+			tx.TxResult = &rpcTx.TxResult
+		}
+		if tx.TxHash == "" {
+			tx.TxHash = tx.Hash
+		}
+		if tx.TxResult != nil {
+			tx.Code, tx.GasWanted, tx.GasUsed, tx.Events = tx.TxResult.Code, tx.TxResult.GasWanted, tx.TxResult.GasUsed, tx.TxResult.Events
+		}
+		var signer string
+		for _, e := range tx.Events {
+			if e.Type == "message" {
+				if signer = e.attributes()["sender"]; signer != "" {
+					break
+				}
+			}
+		}
+		var types, fee []string
+		for _, m := range tx.Tx.Body.Messages {
+			types = append(types, m.Type)
+		}
+		for _, c := range tx.Tx.AuthInfo.Fee.Amount {
+			fee = append(fee, c.Amount+c.Denom)
+		}
+		gasWanted, _ := strconv.ParseInt(tx.GasWanted, 10, 64)
+		gasUsed, _ := strconv.ParseInt(tx.GasUsed, 10, 64)
+		rows = append(rows, parquetTx{
+			Height:    int64(h),
+			TxHash:    tx.TxHash,
+			Code:      tx.Code,
+			GasWanted: gasWanted,
+			GasUsed:   gasUsed,
+			Timestamp: tx.Timestamp,
+			Memo:      tx.Tx.Body.Memo,
+			MsgTypes:  strings.Join(types, ","),
+			Signer:    signer,
+			Fee:       strings.Join(fee, ","),
+			Raw:       string(r),
+		})
+	}
+	return rows, nil
+}
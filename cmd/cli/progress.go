@@ -0,0 +1,179 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// storedBlocks and storedTxs count blocks and transactions stored since start
+var storedBlocks, storedTxs int64
+
+// progress periodically reports scraping throughput (blocks and transactions stored per second), remaining heights to chain head and estimated time to catch up with it
+// eta is based on net catch-up rate (ie, blocks stored per second less blocks produced per second)
+type progress struct {
+	watermark func() int
+
+	mu   sync.Mutex
+	head int
+	last progressSample // previous sample
+	rate progressRate   // rates between the last two samples
+}
+
+// progressSample is point-in-time snapshot of progress counters
+type progressSample struct {
+	at        time.Time
+	blocks    int64
+	txs       int64
+	head      int
+	watermark int
+}
+
+// progressRate is progress between two samples
+type progressRate struct {
+	blocks    float64 // per second
+	txs       float64 // per second
+	remaining int
+	eta       time.Duration // -1 if not catching up
+}
+
+// newProgress returns progress of scraper tracked by watermark
+func newProgress(watermark func() int) *progress {
+	p := &progress{watermark: watermark}
+	p.last = p.sample()
+	p.rate.eta = -1
+	return p
+}
+
+// setHead records current chain head
+func (p *progress) setHead(head int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.head = head
+}
+
+// sample returns current progress counters
+func (p *progress) sample() progressSample {
+	p.mu.Lock()
+	head := p.head
+	p.mu.Unlock()
+	return progressSample{
+		at:        time.Now(),
+		blocks:    atomic.LoadInt64(&storedBlocks),
+		txs:       atomic.LoadInt64(&storedTxs),
+		head:      head,
+		watermark: p.watermark(),
+	}
+}
+
+// update takes new sample and returns it with rates since the previous one
+func (p *progress) update() (progressSample, progressRate) {
+	s := p.sample()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	r := progressRate{remaining: s.head - s.watermark, eta: -1}
+	if r.remaining < 0 {
+		r.remaining = 0
+	}
+	if secs := s.at.Sub(p.last.at).Seconds(); secs > 0 {
+		r.blocks = float64(s.blocks-p.last.blocks) / secs
+		r.txs = float64(s.txs-p.last.txs) / secs
+		produced := 0.0
+		if p.last.head > 0 {
+			produced = float64(s.head-p.last.head) / secs
+		}
+		if r.remaining == 0 {
+			r.eta = 0
+		} else if net := r.blocks - produced; net > 0 {
+			r.eta = time.Duration(float64(r.remaining) / net * float64(time.Second))
+		}
+	}
+	p.last, p.rate = s, r
+	return s, r
+}
+
+// run logs progress every interval, until ctx cancelled
+func (p *progress) run(ctx context.Context, interval time.Duration) {
+	first := true
+	periodically(ctx, "progress", interval, func(ctx context.Context) error {
+		s, r := p.update()
+		if first {
+			// nothing to report right after start
+			first = false
+			return nil
+		}
+		eta := "unknown (not catching up)"
+		if r.eta >= 0 {
+			eta = r.eta.Round(time.Second).String()
+		}
+		stdLogger.Printf("progress: height %d of %d (%d remaining), %.1f blocks/s, %.1f txs/s, eta %s", s.watermark, s.head, r.remaining, r.blocks, r.txs, eta)
+		return nil
+	})
+}
+
+// register registers /metrics endpoint with progress metrics, in prometheus text format, in mux
+// all metrics are labelled with instance name (empty if not set)
+// ref: https://prometheus.io/docs/instrumenting/exposition_formats/#text-based-format
+func (p *progress) register(mux *http.ServeMux) {
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		s := p.sample()
+		p.mu.Lock()
+		rate := p.rate
+		p.mu.Unlock()
+		eta := -1.0
+		if rate.eta >= 0 {
+			eta = rate.eta.Seconds()
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		name := fmt.Sprintf("instance_name=%q", instanceName)
+		for _, m := range []struct {
+			name, typ, help string
+			value           float64
+		}{
+			{"cosmos_scraper_blocks_stored_total", "counter", "Blocks stored since start.", float64(s.blocks)},
+			{"cosmos_scraper_txs_stored_total", "counter", "Transactions stored since start.", float64(s.txs)},
+			{"cosmos_scraper_watermark_height", "gauge", "Last height with all lower heights processed.", float64(s.watermark)},
+			{"cosmos_scraper_head_height", "gauge", "Current chain head height (less head lag).", float64(s.head)},
+			{"cosmos_scraper_remaining_heights", "gauge", "Heights remaining to catch up with chain head.", float64(rate.remaining)},
+			{"cosmos_scraper_blocks_per_second", "gauge", "Blocks stored per second (over the last progress interval).", rate.blocks},
+			{"cosmos_scraper_txs_per_second", "gauge", "Transactions stored per second (over the last progress interval).", rate.txs},
+			{"cosmos_scraper_eta_seconds", "gauge", "Estimated time to catch up with chain head (-1 if not catching up).", eta},
+			{"cosmos_scraper_stalled", "gauge", "Whether scraper is stalled, as detected by stall watchdog (1) or not (0).", float64(atomic.LoadInt32(&stalled))},
+			{"cosmos_scraper_stalls_total", "counter", "Stalls detected by stall watchdog since start.", float64(atomic.LoadInt64(&stalls))},
+		} {
+			fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s{%s} %g\n", m.name, m.help, m.name, m.typ, m.name, name, m.value)
+		}
+		b := build()
+		fmt.Fprintf(w, "# HELP cosmos_scraper_build_info Build metadata of running scraper.\n# TYPE cosmos_scraper_build_info gauge\ncosmos_scraper_build_info{%s,version=%q,commit=%q,build_date=%q,go_version=%q} 1\n", name, b.Version, b.Commit, b.BuildDate, b.GoVersion)
+		fmt.Fprint(w, "# HELP cosmos_scraper_errors_total Node and database errors since start, by class.\n# TYPE cosmos_scraper_errors_total counter\n")
+		counts := errStats.counts()
+		classes := make([]string, 0, len(counts))
+		for c := range counts {
+			classes = append(classes, c)
+		}
+		sort.Strings(classes)
+		for _, c := range classes {
+			fmt.Fprintf(w, "cosmos_scraper_errors_total{%s,class=%q} %d\n", name, c, counts[c])
+		}
+	})
+}
@@ -0,0 +1,109 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// bcProxy returns proxy url to use for request (nil for direct connection)
+// configured proxy is used for all requests, otherwise standard proxy environment variables (HTTP_PROXY, HTTPS_PROXY and NO_PROXY) are honoured
+func bcProxy(req *http.Request) (*url.URL, error) {
+	if bcProxyURL != "" {
+		return url.Parse(bcProxyURL)
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// bcDial connects to addr directly or via proxy (http, https or socks5) as per bcProxy, for non-http clients (ie, grpc and websocket)
+// scheme is target's scheme (ie, "http" or "https") used to select proxy from environment variables
+func bcDial(ctx context.Context, scheme, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: bcDialTimeout, KeepAlive: bcKeepAlive}
+
+	u, err := bcProxy(&http.Request{URL: &url.URL{Scheme: scheme, Host: addr}})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing proxy url: %v", err)
+	}
+	if u == nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			p, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: p}
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, dialer)
+		if err != nil {
+			return nil, fmt.Errorf("error creating socks5 proxy dialer for %s: %v", u.Host, err)
+		}
+		return d.Dial("tcp", addr)
+	case "http", "https":
+		conn, err := dialer.DialContext(ctx, "tcp", u.Host)
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to proxy %s: %v", u.Host, err)
+		}
+		if u.Scheme == "https" {
+			conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		}
+		if err := connect(conn, u, addr); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+}
+
+// connect establishes tunnel to addr via http proxy u using conn
+func connect(conn net.Conn, u *url.URL, addr string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if u.User != nil {
+		p, _ := u.User.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+p)))
+	}
+	if err := req.Write(conn); err != nil {
+		return fmt.Errorf("error sending connect request to proxy %s: %v", u.Host, err)
+	}
+	// note: target server would not send anything before the client does, so the reader would not buffer more than the response
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return fmt.Errorf("error reading connect response from proxy %s: %v", u.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("error connecting to %s via proxy %s: %s", addr, u.Host, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// limiter is a token bucket rate limiter, allowing rate events per second with bursts of up to burst events (0 rate means unlimited)
+type limiter struct {
+	mu     sync.Mutex
+	rate   float64   // tokens added per second
+	burst  float64   // bucket size
+	tokens float64   // available tokens (negative if reserved by waiting callers)
+	last   time.Time // last time tokens were updated
+}
+
+// newLimiter returns limiter with full bucket
+func newLimiter(rate float64, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &limiter{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// set changes limiter's rate and burst (eg, on config reload)
+func (l *limiter) set(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate, l.burst = rate, float64(burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// limits returns limiter's rate and burst
+func (l *limiter) limits() (float64, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate, int(l.burst)
+}
+
+// wait blocks until a token is available, or ctx is cancelled, in which case reserved token is returned
+func (l *limiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// reserve token, even if not yet available, so concurrent callers are served in order
+	l.tokens--
+	deficit, rate := -l.tokens, l.rate // rate might be changed concurrently by set once unlocked
+	l.mu.Unlock()
+
+	if deficit <= 0 {
+		return nil
+	}
+	if err := wait(ctx, time.Duration(deficit/rate*float64(time.Second))); err != nil {
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// limitedSource is bcSource that rate limits requests made using underlying bcSource
+type limitedSource struct {
+	bcSource
+	ctx     context.Context // used for limiter waits
+	limiter *limiter
+}
+
+// block returns block at height once allowed by limiter
+func (s *limitedSource) block(height string) ([]byte, error) {
+	if err := s.limiter.wait(s.ctx); err != nil {
+		return nil, err
+	}
+	return s.bcSource.block(height)
+}
+
+// txs returns single page of transactions at height once allowed by limiter
+func (s *limitedSource) txs(height, key string, offset int) ([]byte, error) {
+	if err := s.limiter.wait(s.ctx); err != nil {
+		return nil, err
+	}
+	return s.bcSource.txs(height, key, offset)
+}
+
+// blockResults returns block results at height once allowed by limiter
+func (s *limitedSource) blockResults(height string) ([]byte, error) {
+	if err := s.limiter.wait(s.ctx); err != nil {
+		return nil, err
+	}
+	return s.bcSource.blockResults(height)
+}
+
+// query returns response for api path with params at height once allowed by limiter
+func (s *limitedSource) query(path string, params url.Values, height int) ([]byte, error) {
+	if err := s.limiter.wait(s.ctx); err != nil {
+		return nil, err
+	}
+	return s.bcSource.query(path, params, height)
+}
+
+// maxThrottle caps pause requested by node's Retry-After response header
+const maxThrottle = 10 * time.Minute
+
+// throttledSource is bcSource that pauses all requests made using underlying bcSource when rate limited by the node (ie, on '429 Too Many Requests')
+// pause duration is taken from the Retry-After response header (capped at maxThrottle), if set, or napTime otherwise
+type throttledSource struct {
+	bcSource
+	ctx  context.Context // used for pause waits
+	name string          // node name for logging
+
+	mu    sync.Mutex
+	until time.Time // requests are paused until then
+}
+
+// block returns block at height once not paused
+func (s *throttledSource) block(height string) ([]byte, error) {
+	if err := s.wait(); err != nil {
+		return nil, err
+	}
+	res, err := s.bcSource.block(height)
+	s.check(err)
+	return res, err
+}
+
+// txs returns single page of transactions at height once not paused
+func (s *throttledSource) txs(height, key string, offset int) ([]byte, error) {
+	if err := s.wait(); err != nil {
+		return nil, err
+	}
+	res, err := s.bcSource.txs(height, key, offset)
+	s.check(err)
+	return res, err
+}
+
+// blockResults returns block results at height once not paused
+func (s *throttledSource) blockResults(height string) ([]byte, error) {
+	if err := s.wait(); err != nil {
+		return nil, err
+	}
+	res, err := s.bcSource.blockResults(height)
+	s.check(err)
+	return res, err
+}
+
+// query returns response for api path with params at height once not paused
+func (s *throttledSource) query(path string, params url.Values, height int) ([]byte, error) {
+	if err := s.wait(); err != nil {
+		return nil, err
+	}
+	res, err := s.bcSource.query(path, params, height)
+	s.check(err)
+	return res, err
+}
+
+// wait blocks while requests are paused, or until ctx is cancelled
+func (s *throttledSource) wait() error {
+	s.mu.Lock()
+	d := time.Until(s.until)
+	s.mu.Unlock()
+	if d <= 0 {
+		return nil
+	}
+	return wait(s.ctx, d)
+}
+
+// check pauses requests if err is '429 Too Many Requests'
+func (s *throttledSource) check(err error) {
+	var se *statusError
+	if !errors.As(err, &se) || se.code != http.StatusTooManyRequests {
+		return
+	}
+	d := se.retryAfter
+	if d <= 0 {
+		d = nap()
+	} else if d > maxThrottle {
+		d = maxThrottle
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if until := time.Now().Add(d); until.After(s.until) {
+		s.until = until
+		stdLogger.Printf("rate limited by %s: pausing all requests to it for %s", s.name, d)
+	}
+}
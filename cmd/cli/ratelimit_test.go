@@ -0,0 +1,211 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestLimiterSetWhileWaiting checks that changing limits (eg, on config reload) while callers wait doesn't race (run with -race) or break waits
+func TestLimiterSetWhileWaiting(t *testing.T) {
+	l := newLimiter(1000, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				l.wait(context.Background())
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	timeout := time.After(5 * time.Second)
+	for i := 0; ; i++ {
+		select {
+		case <-done:
+			return
+		case <-time.After(time.Millisecond):
+			l.set(float64(i%2)*1000, 1) // alternate between unlimited and limited
+		case <-timeout:
+			t.Fatal("waits not completed")
+		}
+	}
+}
+
+func TestLimiterBurst(t *testing.T) {
+	l := newLimiter(10, 3)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		l.wait(context.Background())
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("burst of 3 took %s, want no waiting", d)
+	}
+	start = time.Now()
+	l.wait(context.Background())
+	if d := time.Since(start); d < 50*time.Millisecond || d > time.Second {
+		t.Errorf("wait after burst took %s, want about 100ms", d)
+	}
+}
+
+func TestLimiterRefill(t *testing.T) {
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    float64 // tokens after refill, capped by burst
+	}{
+		{name: "partial", elapsed: 250 * time.Millisecond, want: 2.5},
+		{name: "capped", elapsed: time.Hour, want: 5},
+	}
+	for _, tc := range tests {
+		l := newLimiter(10, 5)
+		l.tokens = 0
+		l.last = time.Now().Add(-tc.elapsed)
+		l.wait(context.Background()) // takes one token
+		if got := l.tokens + 1; got < tc.want-0.1 || got > tc.want+0.1 {
+			t.Errorf("%s: got %.2f tokens after refill, want %.2f", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	l := newLimiter(0, 1)
+	start := time.Now()
+	for i := 0; i < 1000; i++ {
+		l.wait(context.Background())
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("unlimited waits took %s", d)
+	}
+}
+
+func TestLimiterWaitCancelled(t *testing.T) {
+	l := newLimiter(0.1, 1) // next token in 10s
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := l.wait(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	if err := l.wait(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("wait returned %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cancelled wait took %s", d)
+	}
+	// reserved token is returned, so cancelled waits don't delay subsequent callers
+	if l.tokens < -0.1 {
+		t.Errorf("got %.2f tokens after cancelled wait, want about 0", l.tokens)
+	}
+}
+
+func TestLimiterSet(t *testing.T) {
+	l := newLimiter(10, 5)
+	l.set(20, 2)
+	if rate, burst := l.limits(); rate != 20 || burst != 2 {
+		t.Errorf("got limits %v/%d, want 20/2", rate, burst)
+	}
+	if l.tokens != 2 {
+		t.Errorf("got %.2f tokens, want bucket capped to new burst of 2", l.tokens)
+	}
+	l.set(20, 0)
+	if _, burst := l.limits(); burst != 1 {
+		t.Errorf("got burst %d, want min of 1", burst)
+	}
+}
+
+// setNap sets napTime to d until test cleanup
+func setNap(t *testing.T, d time.Duration) {
+	prev := nap()
+	atomic.StoreInt64((*int64)(&napTime), int64(d))
+	t.Cleanup(func() { atomic.StoreInt64((*int64)(&napTime), int64(prev)) })
+}
+
+func TestThrottledSource(t *testing.T) {
+	setNap(t, 30*time.Millisecond)
+	tooMany := func(d time.Duration) error {
+		return &statusError{code: http.StatusTooManyRequests, status: "429 Too Many Requests", retryAfter: d}
+	}
+	tests := []struct {
+		name string
+		err  error
+		min  time.Duration // min pause of the next request
+		max  time.Duration
+	}{
+		{name: "retry after", err: tooMany(50 * time.Millisecond), min: 40 * time.Millisecond, max: time.Second},
+		{name: "naptime without retry after", err: tooMany(0), min: 20 * time.Millisecond, max: time.Second},
+		{name: "other status", err: &statusError{code: http.StatusServiceUnavailable, status: "503 Service Unavailable"}, max: 10 * time.Millisecond},
+		{name: "other error", err: errors.New("connection refused"), max: 10 * time.Millisecond},
+		{name: "ok", max: 10 * time.Millisecond},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			src := &fakeSource{err: tc.err}
+			s := &throttledSource{bcSource: src, ctx: context.Background(), name: "node"}
+			if _, err := s.block("1"); err != tc.err {
+				t.Fatalf("got error %v, want %v", err, tc.err)
+			}
+			src.mu.Lock()
+			src.err = nil
+			src.mu.Unlock()
+			start := time.Now()
+			if _, err := s.block("1"); err != nil {
+				t.Fatal(err)
+			}
+			if d := time.Since(start); d < tc.min || d > tc.max {
+				t.Errorf("next request paused for %s, want between %s and %s", d, tc.min, tc.max)
+			}
+		})
+	}
+
+	// shorter pause doesn't cut longer one short
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &throttledSource{bcSource: &fakeSource{}, ctx: ctx, name: "node"}
+	s.check(tooMany(time.Minute))
+	until := s.until
+	s.check(tooMany(time.Millisecond))
+	if !s.until.Equal(until) {
+		t.Errorf("pause shortened from %s to %s", until, s.until)
+	}
+
+	// long pause is capped
+	s.check(tooMany(24 * time.Hour))
+	if d := time.Until(s.until); d > maxThrottle {
+		t.Errorf("got pause of %s, want at most %s", d, maxThrottle)
+	}
+
+	// paused requests return once ctx is cancelled
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := s.block("1"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want %v", err, context.Canceled)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("cancelled request took %s", d)
+	}
+}
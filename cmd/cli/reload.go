@@ -0,0 +1,206 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// logLevels are stdout log levels, by name
+var logLevels = map[string]int32{"info": 0, "warn": 1, "error": 2}
+
+// consoleLevel is current stdout log level (as per logLevels)
+var consoleLevel int32
+
+// levelWriter writes log records to w, dropping those below current stdout log level, as per their 'warn' or 'error' wording
+type levelWriter struct {
+	w io.Writer
+}
+
+func (lw levelWriter) Write(p []byte) (int, error) {
+	if lvl := atomic.LoadInt32(&consoleLevel); lvl > 0 {
+		s := strings.ToLower(string(p))
+		if !strings.Contains(s, "error") && (lvl > 1 || !strings.Contains(s, "warn")) {
+			return len(p), nil
+		}
+	}
+	return lw.w.Write(p)
+}
+
+// nap returns current napTime, which can change on config reload
+func nap() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(&napTime)))
+}
+
+// workerPool runs resizable number of workers, stopping them with quit value sent to their (shared) channel
+type workerPool struct {
+	wg   *sync.WaitGroup
+	work func()                      // runs single worker until its channel is closed or quit value is received
+	quit func(context.Context) error // sends quit value to workers' channel, unless ctx cancelled
+
+	mu   sync.Mutex
+	size int
+	max  int // max workers, if scaled adaptively (0 means unlimited)
+}
+
+// resize starts or stops workers, so n of them (but not more than max, if set) are running, unless ctx cancelled
+// stopped workers finish their current work first, and quit values are queued behind already queued work
+func (p *workerPool) resize(ctx context.Context, n int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.max > 0 && n > p.max {
+		n = p.max
+	}
+	for ; p.size < n; p.size++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			p.work()
+		}()
+	}
+	for ; p.size > n; p.size-- {
+		if err := p.quit(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// workers returns number of running workers
+func (p *workerPool) workers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.size
+}
+
+// limit sets max workers to n, stopping those above it, unless ctx cancelled
+func (p *workerPool) limit(ctx context.Context, n int) error {
+	p.mu.Lock()
+	p.max = n
+	p.mu.Unlock()
+	if p.workers() > n {
+		return p.resize(ctx, n)
+	}
+	return nil
+}
+
+// maxWorkers returns max workers, if set, or number of running workers otherwise
+func (p *workerPool) maxWorkers() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.max > 0 {
+		return p.max
+	}
+	return p.size
+}
+
+// reloader reloads config on SIGHUP, until ctx cancelled, applying changed workers counts (max ones, if scaled adaptively), napTime, request rate limit and stdout log level
+// other config changes require restart
+func reloader(ctx context.Context, reqPool, perPool *workerPool, lim *limiter) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+			stdLogger.Println("received SIGHUP: reloading config...")
+			if err := reloadConfig(ctx, reqPool, perPool, lim); err != nil {
+				stdLogger.Printf("error reloading config (keeping current one): %v", err)
+			}
+		}
+	}
+}
+
+// reloadConfig re-reads .env and config files (environment variables and flags are only read on start, so they still take precedence) and applies reloadable values
+// unset values are kept as they are, and none is applied if any is invalid
+func reloadConfig(ctx context.Context, reqPool, perPool *workerPool, lim *limiter) error {
+	if err := viper.ReadInConfig(); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error reading %s: %v", viper.ConfigFileUsed(), err)
+	}
+	if file, chain := configString("cs_config_file"), configString("cs_chain"); file != "" {
+		if err := loadConfigFile(file, chain); err != nil {
+			return err
+		}
+	}
+
+	n := len(configErrors)
+	reqWorkers, perWorkers := reqPool.maxWorkers(), perPool.maxWorkers()
+	if v := configInt("cs_max_req_workers"); v > 0 {
+		reqWorkers = v
+	}
+	if v := configInt("cs_max_per_workers"); v > 0 {
+		perWorkers = v
+	}
+	naptime := nap()
+	if v := configDuration("cs_naptime"); v > 0 {
+		naptime = v
+	}
+	rate, burst := lim.limits()
+	if v := configString("cs_bc_rate_limit"); v != "" {
+		rate = configFloat64("cs_bc_rate_limit")
+	}
+	if v := configInt("cs_bc_rate_burst"); v > 0 {
+		burst = v
+	}
+	level := ""
+	for name, l := range logLevels {
+		if l == atomic.LoadInt32(&consoleLevel) {
+			level = name
+		}
+	}
+	if v := configString("cs_log_level"); v != "" {
+		if _, ok := logLevels[v]; !ok {
+			invalid("invalid cs_log_level %q: expected 'info', 'warn' or 'error'", v)
+		}
+		level = v
+	}
+	if len(configErrors) > n {
+		errs := configErrors[n:]
+		configErrors = configErrors[:n]
+		return fmt.Errorf("invalid configuration: %s", strings.Join(errs, "; "))
+	}
+
+	atomic.StoreInt64((*int64)(&napTime), int64(naptime))
+	lim.set(rate, burst)
+	atomic.StoreInt32(&consoleLevel, logLevels[level])
+	if adaptiveWorkers {
+		stdLogger.Printf("config reloaded: up to %d requests and %d persists workers (scaled adaptively), naptime %s, rate limit %v per second (burst %d; 0 means unlimited), log level %s", reqWorkers, perWorkers, naptime, rate, burst, level)
+		if err := reqPool.limit(ctx, reqWorkers); err != nil {
+			return err
+		}
+		return perPool.limit(ctx, perWorkers)
+	}
+	stdLogger.Printf("config reloaded: %d requests and %d persists workers, naptime %s, rate limit %v per second (burst %d; 0 means unlimited), log level %s", reqWorkers, perWorkers, naptime, rate, burst, level)
+	if err := reqPool.resize(ctx, reqWorkers); err != nil {
+		return err
+	}
+	return perPool.resize(ctx, perWorkers)
+}
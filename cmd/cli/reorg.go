@@ -0,0 +1,105 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// recheckAt re-validates provisionally stored block at height h (ie, scraped while within confirmations of head) once it's confirmed
+// if block hash changed since, stored block, block results (if rsc is not nil) and transactions at height h are replaced with current ones
+// note: no log entries are made for replaced data, as height was already processed
+func recheckAt(ctx context.Context, bcc, rsc bcSource, h int, bxs, txs, brs *mongo.Collection, rp retryPolicy) error {
+	height := strconv.Itoa(h)
+	b, err := blockAt(ctx, bcc, height, rp)
+	if err != nil {
+		return err
+	}
+	var current blockLink
+	if err := json.Unmarshal(b, &current); err != nil {
+		return fmt.Errorf("error unmarshalling block at height %d: %v", h, err)
+	}
+
+	var stored blockLink
+	err = findStored(ctx, bxs, h, &stored)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// might be still queued for persisting, or skipped
+		stdLogger.Printf("warn: cannot re-validate block at height %d: not stored (yet)", h)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading block at height %d: %v", h, err)
+	}
+	if bytes.Equal(stored.link().hash, current.link().hash) {
+		return nil
+	}
+
+	stdLogger.Printf("warn: block at height %d changed after being stored (hash %X -> %X): replacing stored data", h, stored.link().hash, current.link().hash)
+	if err := replace(ctx, bxs, h, b); err != nil {
+		return err
+	}
+	if rsc != nil {
+		res, err := blockResultsAt(ctx, rsc, height, rp)
+		if err != nil {
+			return err
+		}
+		if err := replace(ctx, brs, h, res); err != nil {
+			return err
+		}
+	}
+	t, err := transactionsAt(ctx, bcc, height, rp)
+	if err != nil {
+		return err
+	}
+	if dbTxDocs {
+		models, err := txDocModels(h, t)
+		if err != nil {
+			return err
+		}
+		if _, err := txs.BulkWrite(ctx, models); err != nil {
+			return fmt.Errorf("error replacing transactions at height %d: %v", h, err)
+		}
+		return nil
+	}
+	return replace(ctx, txs, h, t)
+}
+
+// replace replaces doc at height h in col with raw, or deletes it if raw is nil
+func replace(ctx context.Context, col *mongo.Collection, h int, raw []byte) error {
+	if raw == nil {
+		if _, err := col.DeleteOne(ctx, bson.M{"_id": h}); err != nil {
+			return fmt.Errorf("error deleting from %s: %v", col.Name(), err)
+		}
+		return nil
+	}
+	m, err := replaceModel(col, h, raw)
+	if err != nil {
+		return err
+	}
+	if _, err := col.BulkWrite(ctx, []mongo.WriteModel{m}); err != nil {
+		return fmt.Errorf("error replacing in %s: %v", col.Name(), err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// pruner deletes blocks, block results and transactions outside of retention window every interval, until ctx cancelled
+// window is either last keepBlocks heights (up to the highest stored block) or blocks within keepAge (by block time), whichever is shorter, if both are set
+func pruner(ctx context.Context, st storage, bxs, txs, brs *mongo.Collection, keepBlocks int, keepAge, interval time.Duration) {
+	periodically(ctx, "retention pruning", interval, func(ctx context.Context) error {
+		cutoff := 0 // lowest height to keep
+		if keepBlocks > 0 {
+			last, err := st.lastHeight(ctx)
+			if err != nil {
+				return err
+			}
+			cutoff = last - keepBlocks + 1
+		}
+		if keepAge > 0 {
+			h, err := heightBefore(ctx, bxs, time.Now().Add(-keepAge))
+			if err != nil {
+				return err
+			}
+			if h+1 > cutoff {
+				cutoff = h + 1
+			}
+		}
+		if cutoff <= 1 {
+			return nil
+		}
+
+		below := bson.M{"_id": bson.M{"$lt": cutoff}}
+		for _, col := range []*mongo.Collection{bxs, brs, txs} {
+			filter := below
+			if col == txs && dbTxDocs {
+				// note: transactions stored one doc per transaction are keyed by tx hash, with (api) string height
+				filter = bson.M{"$expr": bson.M{"$lt": bson.A{bson.M{"$toLong": "$height"}, cutoff}}}
+			}
+			res, err := col.DeleteMany(ctx, filter)
+			if err != nil {
+				return fmt.Errorf("error pruning %s: %v", col.Name(), err)
+			}
+			if res.DeletedCount > 0 {
+				stdLogger.Printf("pruned %d docs below height %d from %s", res.DeletedCount, cutoff, col.Name())
+			}
+		}
+		return nil
+	})
+}
+
+// heightBefore returns height of the highest block in bxs with block time before t (0 if none)
+// note: block times are stored as (rfc3339) strings, so they are compared as such
+func heightBefore(ctx context.Context, bxs *mongo.Collection, t time.Time) (int, error) {
+	var b struct {
+		ID int `bson:"_id"`
+	}
+	err := bxs.FindOne(ctx, bson.M{"block.header.time": bson.M{"$lt": t.UTC().Format(time.RFC3339Nano)}},
+		options.FindOne().SetSort(bson.M{"block.header.time": -1}).SetProjection(bson.M{"_id": 1})).Decode(&b)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error finding last block before %s: %v", t, err)
+	}
+	return b.ID, nil
+}
+
+// createCollections creates blocks, transactions and block results collections in db as capped or time series collections, as per dbCollectionType, if not existing
+// capped collections are limited to dbCappedSize bytes and dbCappedMax docs (if set) each, while time series docs expire after retentionAge (if set)
+// note: existing collections are not converted
+func createCollections(ctx context.Context, db *mongo.Database) error {
+	opts := options.CreateCollection()
+	switch dbCollectionType {
+	case "capped":
+		opts.SetCapped(true).SetSizeInBytes(int64(dbCappedSize))
+		if dbCappedMax > 0 {
+			opts.SetMaxDocuments(int64(dbCappedMax))
+		}
+	case "timeseries":
+		opts.SetTimeSeriesOptions(options.TimeSeries().SetTimeField("cs_time"))
+		if retentionAge > 0 {
+			opts.SetExpireAfterSeconds(int64(retentionAge.Seconds()))
+		}
+	default:
+		return nil
+	}
+	names, err := db.ListCollectionNames(ctx, bson.M{})
+	if err != nil {
+		return fmt.Errorf("error listing collections: %v", err)
+	}
+	existing := map[string]bool{}
+	for _, n := range names {
+		existing[n] = true
+	}
+	for _, datatype := range []string{"block", "transactions", "block_results"} {
+		name := dbPrefix + dbCollections[datatype]
+		if existing[name] {
+			stdLogger.Printf("warn: %s collection already exists (not converting it to %s collection)", name, dbCollectionType)
+			continue
+		}
+		if err := db.CreateCollection(ctx, name, opts); err != nil {
+			return fmt.Errorf("error creating %s collection %s: %v", dbCollectionType, name, err)
+		}
+		stdLogger.Printf("created %s collection %s", dbCollectionType, name)
+	}
+	return nil
+}
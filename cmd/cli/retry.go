@@ -0,0 +1,68 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// retryPolicy defines how failed actions are retried: with exponentially increasing pauses (with jitter) between retries, up to an optional max number of attempts
+type retryPolicy struct {
+	min      time.Duration // pause before first retry
+	max      time.Duration // max pause between retries
+	factor   float64       // pause multiplier for each subsequent retry
+	jitter   float64       // max fraction of pause randomly added or subtracted (0..1)
+	attempts int           // max number of attempts (0 means unlimited)
+}
+
+// backoff returns pause before retry n (starting from 1)
+func (p retryPolicy) backoff(n int) time.Duration {
+	d := float64(p.min) * math.Pow(p.factor, float64(n-1))
+	if d > float64(p.max) || math.IsInf(d, 0) || math.IsNaN(d) {
+		d = float64(p.max)
+	}
+	if p.jitter > 0 {
+		d += d * p.jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(d)
+}
+
+// retry returns pause before retry n (starting from 1) or error if max number of attempts is reached
+func (p retryPolicy) retry(n int) (time.Duration, error) {
+	if p.attempts > 0 && n >= p.attempts {
+		return 0, fmt.Errorf("giving up after %d attempts", n)
+	}
+	return p.backoff(n), nil
+}
+
+// wait pauses for d, unless ctx cancelled, in which case ctx error is returned
+func wait(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
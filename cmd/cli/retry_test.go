@@ -0,0 +1,85 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicy{min: time.Second, max: 10 * time.Second, factor: 2}
+	for n, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second} {
+		if got := p.backoff(n + 1); got != want {
+			t.Errorf("backoff(%d) = %s, want %s", n+1, got, want)
+		}
+	}
+	// huge retry numbers don't overflow
+	if got := p.backoff(10000); got != p.max {
+		t.Errorf("backoff(10000) = %s, want %s", got, p.max)
+	}
+
+	p.jitter = 0.2
+	for n := 1; n <= 6; n++ {
+		base := retryPolicy{min: p.min, max: p.max, factor: p.factor}.backoff(n)
+		lo, hi := time.Duration(float64(base)*0.8), time.Duration(float64(base)*1.2)
+		for i := 0; i < 100; i++ {
+			if got := p.backoff(n); got < lo || got > hi {
+				t.Fatalf("backoff(%d) with jitter = %s, want within [%s, %s]", n, got, lo, hi)
+			}
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	tests := []struct {
+		attempts int
+		n        int
+		giveUp   bool
+	}{
+		{attempts: 0, n: 1},
+		{attempts: 0, n: 1000},
+		{attempts: 1, n: 1, giveUp: true},
+		{attempts: 3, n: 1},
+		{attempts: 3, n: 2},
+		{attempts: 3, n: 3, giveUp: true},
+		{attempts: 3, n: 4, giveUp: true},
+	}
+	for _, tc := range tests {
+		p := retryPolicy{min: time.Second, max: time.Minute, factor: 2, attempts: tc.attempts}
+		d, err := p.retry(tc.n)
+		if (err != nil) != tc.giveUp {
+			t.Errorf("attempts %d: retry(%d) error %v, want giving up: %v", tc.attempts, tc.n, err, tc.giveUp)
+		}
+		if err == nil && d != p.backoff(tc.n) {
+			t.Errorf("attempts %d: retry(%d) = %s, want %s", tc.attempts, tc.n, d, p.backoff(tc.n))
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	if err := wait(context.Background(), time.Millisecond); err != nil {
+		t.Errorf("wait returned %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := wait(ctx, time.Hour); !errors.Is(err, context.Canceled) {
+		t.Errorf("wait returned %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const rpcPerPage = 100 // max number of transactions per tx_search page allowed by tendermint
+
+// rpcClient is bcSource using tendermint (cometbft) rpc
+// ref: https://docs.tendermint.com/v0.34/rpc/
+type rpcClient struct {
+	*bcClient
+}
+
+// newRPCClient returns rpcClient referencing host and port, with optional path prefix, using https if tlsConfig is not nil
+func newRPCClient(host, port, prefix string, tlsConfig *tls.Config) *rpcClient {
+	return &rpcClient{bcClient: newBCClient(host, port, prefix, tlsConfig)}
+}
+
+// block returns block at height, with the same structure as rest api response (ie, block_id and block)
+func (c *rpcClient) block(height string) ([]byte, error) {
+	query := ""
+	if height != "latest" {
+		query = "height=" + height
+	}
+	return c.call("/block", query)
+}
+
+// txs returns single page of transactions at height
+// tx_search results are returned as tx_responses (with raw base64-encoded txs as txs) and total_count as pagination.total, so they can be paginated and merged the same way as rest api responses
+func (c *rpcClient) txs(height, key string, offset int) ([]byte, error) {
+	query := fmt.Sprintf("query=%s&page=%d&per_page=%d&order_by=%s", url.QueryEscape(`"tx.height=`+height+`"`), offset/rpcPerPage+1, rpcPerPage, url.QueryEscape(`"asc"`))
+	res, err := c.call("/tx_search", query)
+	if err != nil {
+		return nil, err
+	}
+
+	var r struct {
+		Txs        []json.RawMessage `json:"txs"`
+		TotalCount string            `json:"total_count"`
+	}
+	if err := json.Unmarshal(res, &r); err != nil {
+		return nil, fmt.Errorf("error unmarshalling transactions at height %s - got response:\n%s: %v", height, string(res), err)
+	}
+	txs := make([]string, len(r.Txs))
+	for i, raw := range r.Txs {
+		var t struct {
+			Tx string `json:"tx"`
+		}
+		if err := json.Unmarshal(raw, &t); err != nil {
+			return nil, fmt.Errorf("error unmarshalling transaction at height %s - got response:\n%s: %v", height, string(raw), err)
+		}
+		txs[i] = t.Tx
+	}
+
+	page := map[string]interface{}{
+		"txs":          txs,
+		"tx_responses": r.Txs,
+		"pagination": map[string]interface{}{
+			"next_key": nil,
+			"total":    r.TotalCount,
+		},
+	}
+	return json.Marshal(page)
+}
+
+// blockResults returns block results at height
+func (c *rpcClient) blockResults(height string) ([]byte, error) {
+	return c.call("/block_results", "height="+height)
+}
+
+// query returns result for rpc path with params
+// height is ignored, as rpc endpoints supporting it take it as a param
+func (c *rpcClient) query(path string, params url.Values, height int) ([]byte, error) {
+	return c.call(path, params.Encode())
+}
+
+// call makes json-rpc request (via uri over http) and returns its result or error
+// errors for unavailable heights are reported as '400 Bad Request', matching rest api behaviour
+func (c *rpcClient) call(path, query string) ([]byte, error) {
+	var r struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Data    string `json:"data"`
+		} `json:"error"`
+	}
+	// result is copied when unmarshalled, so response is decoded in place, without copying it first
+	err := c.requestWith(path, query, 0, func(body []byte) error {
+		if err := json.Unmarshal(body, &r); err != nil {
+			return fmt.Errorf("error unmarshalling response %s?%s - got response:\n%s: %v", path, query, string(body), err)
+		}
+		return nil
+	})
+	if err != nil {
+		var se *statusError
+		if errors.As(err, &se) {
+			var e struct {
+				Error struct {
+					Data string `json:"data"`
+				} `json:"error"`
+			}
+			if json.Unmarshal([]byte(se.body), &e) == nil && unavailable(e.Error.Data) {
+				return nil, &statusError{url: se.url, code: http.StatusBadRequest, status: "400 Bad Request", body: e.Error.Data}
+			}
+		}
+		return nil, err
+	}
+	if r.Error != nil {
+		code := http.StatusInternalServerError
+		if unavailable(r.Error.Data) {
+			code = http.StatusBadRequest
+		}
+		return nil, &statusError{url: path + "?" + query, code: code, status: strconv.Itoa(code) + " " + http.StatusText(code), body: fmt.Sprintf("%d %s: %s", r.Error.Code, r.Error.Message, r.Error.Data)}
+	}
+	return r.Result, nil
+}
+
+// unavailable returns true if json-rpc error data references unavailable height
+// example data: 'height 1 is not available, lowest height is 1995900' or 'height 100000000 must be less than or equal to the current blockchain height 8542000'
+// note: api/response might change in the future
+func unavailable(data string) bool {
+	return strings.Contains(data, "is not available") || strings.Contains(data, "must be less than or equal to the current blockchain height")
+}
@@ -0,0 +1,181 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// rpcServer starts tendermint rpc server mock, with 3 transactions at height 10, recording tx_search query params
+// block errors mimic tendermint's: unavailable heights are reported in error data, either with '500 Internal Server Error' (as tendermint does over http) or '200 OK'
+func rpcServer(t *testing.T) (host, port string, searches func() []string) {
+	var mu sync.Mutex
+	var queries []string
+	rpcError := func(w http.ResponseWriter, code int, data string) {
+		w.WriteHeader(code)
+		w.Write([]byte(`{"jsonrpc": "2.0", "id": -1, "error": {"code": -32603, "message": "Internal error", "data": "` + data + `"}}`))
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		switch r.URL.Path {
+		case "/tx_search":
+			mu.Lock()
+			queries = append(queries, r.URL.RawQuery)
+			mu.Unlock()
+			if q.Get("page") != "1" {
+				rpcError(w, http.StatusInternalServerError, "page should be within [1, 1] range, given "+q.Get("page"))
+				return
+			}
+			w.Write([]byte(`{"jsonrpc": "2.0", "id": -1, "result": {"txs": [
+				{"hash": "A1", "height": "10", "index": 0, "tx_result": {"code": 0, "log": "[]"}, "tx": "dHgx"},
+				{"hash": "B2", "height": "10", "index": 1, "tx_result": {"code": 5, "log": "insufficient funds"}, "tx": "dHgy"},
+				{"hash": "C3", "height": "10", "index": 2, "tx_result": {"code": 0, "log": "[]"}, "tx": "dHgz"}
+			], "total_count": "3"}}`))
+		case "/block":
+			switch q.Get("height") {
+			case "1":
+				rpcError(w, http.StatusInternalServerError, "height 1 is not available, lowest height is 1995900")
+			case "100000000":
+				rpcError(w, http.StatusOK, "height 100000000 must be less than or equal to the current blockchain height 8542000")
+			case "13":
+				rpcError(w, http.StatusInternalServerError, "database is closed")
+			case "14":
+				rpcError(w, http.StatusOK, "database is closed")
+			default:
+				w.Write([]byte(`{"jsonrpc": "2.0", "id": -1, "result": {"block_id": {"hash": "ABC"}, "block": {"header": {"height": "` + q.Get("height") + `"}}}}`))
+			}
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, port, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), queries...)
+	}
+}
+
+func TestRPCTxs(t *testing.T) {
+	host, port, searches := rpcServer(t)
+	c := newRPCClient(host, port, "", nil)
+
+	res, err := c.txs("10", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var page struct {
+		Txs         []string `json:"txs"`
+		TxResponses []struct {
+			Hash     string `json:"hash"`
+			Height   string `json:"height"`
+			TxResult struct {
+				Code int `json:"code"`
+			} `json:"tx_result"`
+		} `json:"tx_responses"`
+		Pagination struct {
+			NextKey *string `json:"next_key"`
+			Total   string  `json:"total"`
+		} `json:"pagination"`
+	}
+	if err := json.Unmarshal(res, &page); err != nil {
+		t.Fatalf("invalid response %s: %v", res, err)
+	}
+	if want := []string{"dHgx", "dHgy", "dHgz"}; !reflect.DeepEqual(page.Txs, want) {
+		t.Errorf("got txs %v, want %v", page.Txs, want)
+	}
+	if len(page.TxResponses) != 3 || page.TxResponses[1].Hash != "B2" || page.TxResponses[1].Height != "10" || page.TxResponses[1].TxResult.Code != 5 {
+		t.Errorf("got tx_responses %+v, want tx_search results as is", page.TxResponses)
+	}
+	if page.Pagination.NextKey != nil || page.Pagination.Total != "3" {
+		t.Errorf("got pagination %+v, want no next key and total 3", page.Pagination)
+	}
+
+	// offsets are mapped to (1-based) tx_search pages of rpcPerPage txs
+	for _, offset := range []int{rpcPerPage - 1, rpcPerPage, 2*rpcPerPage + 1} {
+		if _, err := c.txs("10", "", offset); (err == nil) != (offset < rpcPerPage) {
+			t.Errorf("got error %v for offset %d, want error only beyond first page", err, offset)
+		}
+	}
+	var pages []string
+	for _, q := range searches() {
+		if !strings.Contains(q, "query=%22tx.height%3D10%22") || !strings.Contains(q, "per_page=100") || !strings.Contains(q, "order_by=%22asc%22") {
+			t.Errorf("unexpected tx_search query %s", q)
+		}
+		for _, p := range strings.Split(q, "&") {
+			if strings.HasPrefix(p, "page=") {
+				pages = append(pages, strings.TrimPrefix(p, "page="))
+			}
+		}
+	}
+	if want := []string{"1", "1", "2", "3"}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("got pages %v, want %v", pages, want)
+	}
+}
+
+func TestRPCCall(t *testing.T) {
+	host, port, _ := rpcServer(t)
+	c := newRPCClient(host, port, "", nil)
+
+	res, err := c.block("5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b struct {
+		BlockID struct {
+			Hash string `json:"hash"`
+		} `json:"block_id"`
+		Block struct {
+			Header struct {
+				Height string `json:"height"`
+			} `json:"header"`
+		} `json:"block"`
+	}
+	if err := json.Unmarshal(res, &b); err != nil || b.BlockID.Hash != "ABC" || b.Block.Header.Height != "5" {
+		t.Errorf("got block %s (%v), want json-rpc result", res, err)
+	}
+
+	tests := []struct {
+		height string
+		code   int
+		body   string
+	}{
+		{height: "1", code: http.StatusBadRequest, body: "is not available"},
+		{height: "100000000", code: http.StatusBadRequest, body: "must be less than or equal"},
+		{height: "13", code: http.StatusInternalServerError, body: "database is closed"},
+		{height: "14", code: http.StatusInternalServerError, body: "database is closed"},
+	}
+	for _, tc := range tests {
+		_, err := c.block(tc.height)
+		var se *statusError
+		if !errors.As(err, &se) || se.code != tc.code || !strings.Contains(se.body, tc.body) {
+			t.Errorf("block at height %s: got error %v, want status %d with %q", tc.height, err, tc.code, tc.body)
+		}
+	}
+}
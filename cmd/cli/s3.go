@@ -0,0 +1,194 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// s3Sink archives scraped data as json lines objects in s3-compatible (eg, aws s3 or minio) bucket
+// data is batched by height ranges (see rangeBatcher), and objects are named '<prefix><datatype>/<first height>-<last height>.jsonl[.gz|.zst]', so they are never overwritten by partial batches of the same range
+type s3Sink struct {
+	*rangeBatcher
+	endpoint    *url.URL
+	region      string
+	bucket      string
+	prefix      string
+	accessKey   string
+	secretKey   string
+	compression string // "gzip", "zstd" or "none"
+	client      *http.Client
+}
+
+// newS3Sink returns s3 sink for endpoint (eg, "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000") and bucket, using path-style requests signed with aws signature v4
+func newS3Sink(endpoint, region, bucket, prefix, accessKey, secretKey string, size int, compression string, flush time.Duration) (*s3Sink, error) {
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q: %v", endpoint, err)
+	}
+	s := &s3Sink{
+		endpoint:    u,
+		region:      region,
+		bucket:      bucket,
+		prefix:      prefix,
+		accessKey:   accessKey,
+		secretKey:   secretKey,
+		compression: compression,
+		client:      &http.Client{Timeout: 5 * time.Minute},
+	}
+	s.rangeBatcher = newRangeBatcher("s3", size, flush, s.upload)
+	return s, nil
+}
+
+// publish adds raw datatype at height to its batch, uploading the batch if complete
+func (s *s3Sink) publish(ctx context.Context, datatype string, height int, raw []byte) error {
+	return s.add(ctx, datatype, height, raw)
+}
+
+// upload puts batch b as (optionally compressed) json lines object, ordered by height, into bucket
+func (s *s3Sink) upload(ctx context.Context, b *heightBatch) error {
+	key := fmt.Sprintf("%s%s/%d-%d.jsonl", s.prefix, b.datatype, b.from, b.to)
+	var lines bytes.Buffer
+	for _, h := range b.heights() {
+		// json lines require each doc on single line
+		if err := json.Compact(&lines, b.items[h]); err != nil {
+			return fmt.Errorf("error compacting %s at height %d: %v", b.datatype, h, err)
+		}
+		lines.WriteByte('\n')
+	}
+	body := lines.Bytes()
+	var buf bytes.Buffer
+	switch s.compression {
+	case "gzip":
+		key += ".gz"
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	case "zstd":
+		key += ".zst"
+		zw, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return err
+		}
+		if _, err := zw.Write(body); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+
+	u := *s.endpoint
+	u.Path += "/" + s.bucket + "/" + key
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	s.sign(req, body, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("error uploading %s: %s: %s", key, resp.Status, string(msg))
+	}
+	stdLogger.Printf("archived %d %s heights [%d..%d] as %s", len(b.items), b.datatype, b.from, b.to, key)
+	return nil
+}
+
+// sign signs request with payload using aws signature version 4
+// ref: https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (s *s3Sink) sign(req *http.Request, payload []byte, t time.Time) {
+	date := t.Format("20060102")
+	amzDate := t.Format("20060102T150405Z")
+	hash := sha256.Sum256(payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(hash[:]))
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	toSign := stringToSign(amzDate, scope, canonicalRequest(req))
+	key := []byte("AWS4" + s.secretKey)
+	for _, v := range []string{date, s.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+// signedHeaders are (sorted, lowercase) names of headers included in request signature
+const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+
+// canonicalRequest returns aws signature v4 canonical form of request, that already has x-amz-date and x-amz-content-sha256 headers set
+func canonicalRequest(req *http.Request) string {
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	return strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + req.Header.Get("X-Amz-Date") + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+}
+
+// canonicalQuery returns query params sorted by name, with names and values uri-encoded as per aws rules (ie, spaces as '%20', not '+'), and with '=' also for params without value
+func canonicalQuery(q url.Values) string {
+	var params []string
+	for k, vs := range q {
+		for _, v := range vs {
+			params = append(params, strings.ReplaceAll(url.QueryEscape(k), "+", "%20")+"="+strings.ReplaceAll(url.QueryEscape(v), "+", "%20"))
+		}
+	}
+	sort.Strings(params)
+	return strings.Join(params, "&")
+}
+
+// stringToSign returns aws signature v4 string to sign for canonical request at amzDate and credential scope
+func stringToSign(amzDate, scope, canonical string) string {
+	hash := sha256.Sum256([]byte(canonical))
+	return "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+}
+
+// hmacSHA256 returns hmac-sha256 of data using key
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,37 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// periodically runs job every interval, until ctx cancelled
+// job errors are logged and job is retried on the next run
+func periodically(ctx context.Context, name string, interval time.Duration, job func(context.Context) error) {
+	for ctx.Err() == nil {
+		if err := job(ctx); err != nil {
+			if errors.Is(err, context.Canceled) {
+				return
+			}
+			stdLogger.Printf("error scraping %s (will retry in %s): %v", name, interval, err)
+		}
+		wait(ctx, interval)
+	}
+}
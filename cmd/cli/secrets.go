@@ -0,0 +1,132 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// vaultPrefix marks secret config value as reference to vault secret field, as 'vault:<path>#<field>' (eg, 'vault:secret/data/cosmos-scraper#db_pass')
+const vaultPrefix = "vault:"
+
+// vaultSecrets caches vault secrets' data by path, so that multiple fields of the same secret are read once
+var vaultSecrets = map[string]map[string]interface{}{}
+
+// configSecret returns secret config value of key, read from file set with key's '_file' variant (eg, docker or kubernetes secret mounted as cs_db_pass_file), or looked up in vault if value is vault reference
+// invalid or unresolvable values are recorded as config errors
+func configSecret(key string) string {
+	v := configString(key)
+	if file := configString(key + "_file"); file != "" {
+		if v != "" {
+			invalid("both %s and %s_file are set: use only one", key, key)
+			return ""
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			invalid("error reading %s_file: %v", key, err)
+			return ""
+		}
+		v = strings.TrimRight(string(b), "\r\n")
+		configSources[key] = "secret file"
+	}
+	if strings.HasPrefix(v, vaultPrefix) {
+		s, err := vaultSecret(strings.TrimPrefix(v, vaultPrefix))
+		if err != nil {
+			invalid("error looking up %s in vault: %v", key, err)
+			return ""
+		}
+		v = s
+	}
+	return v
+}
+
+// vaultSecret returns value of field in vault secret at path, given as reference '<path>#<field>'
+// both kv v2 (eg, 'secret/data/cosmos-scraper#db_pass') and kv v1 (eg, 'secret/cosmos-scraper#db_pass') secrets engines are supported
+// ref: https://developer.hashicorp.com/vault/api-docs/secret/kv/kv-v2#read-secret-version
+func vaultSecret(ref string) (string, error) {
+	i := strings.LastIndex(ref, "#")
+	if i <= 0 || i == len(ref)-1 {
+		return "", fmt.Errorf("invalid vault reference %q: expected '<path>#<field>'", ref)
+	}
+	path, field := strings.Trim(ref[:i], "/"), ref[i+1:]
+
+	data, ok := vaultSecrets[path]
+	if !ok {
+		var err error
+		if data, err = readVault(path); err != nil {
+			return "", err
+		}
+		vaultSecrets[path] = data
+	}
+	v, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("field %q not found in vault secret %s", field, path)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("field %q in vault secret %s is not a string", field, path)
+	}
+	return s, nil
+}
+
+// readVault returns data of vault secret at path
+func readVault(path string) (map[string]interface{}, error) {
+	if vaultAddr == "" || vaultToken == "" {
+		return nil, fmt.Errorf("vault address and token are required (cs_vault_addr and cs_vault_token or cs_vault_token_file, or VAULT_ADDR and VAULT_TOKEN)")
+	}
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(vaultAddr, "/")+"/v1/"+path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating vault request: %v", err)
+	}
+	req.Header.Set("X-Vault-Token", vaultToken)
+	if vaultNamespace != "" {
+		req.Header.Set("X-Vault-Namespace", vaultNamespace)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error reading vault secret %s: %v", path, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading vault secret %s: %v", path, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error reading vault secret %s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return nil, fmt.Errorf("error unmarshalling vault secret %s: %v", path, err)
+	}
+	// kv v2 nests secret's data (next to its metadata) in data
+	if d, ok := secret.Data["data"].(map[string]interface{}); ok {
+		if _, ok := secret.Data["metadata"]; ok {
+			return d, nil
+		}
+	}
+	return secret.Data, nil
+}
@@ -0,0 +1,201 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// sentry reports panics and unexpected errors to sentry (or compatible service), if configured (nil otherwise)
+var sentry *sentryClient
+
+// sentryClient sends events to sentry project identified by dsn, using envelope endpoint
+// ref: https://develop.sentry.dev/sdk/envelopes/
+type sentryClient struct {
+	dsn    string
+	url    string // envelope endpoint
+	auth   string // X-Sentry-Auth header
+	client *http.Client
+}
+
+// sentryEvent is sentry error event
+// ref: https://develop.sentry.dev/sdk/event-payloads/
+type sentryEvent struct {
+	EventID    string                 `json:"event_id"`
+	Timestamp  string                 `json:"timestamp"`
+	Platform   string                 `json:"platform"`
+	Level      string                 `json:"level"`
+	Logger     string                 `json:"logger"`
+	ServerName string                 `json:"server_name"`
+	Release    string                 `json:"release"`
+	Exception  sentryExceptions       `json:"exception"`
+	Tags       map[string]string      `json:"tags,omitempty"`
+	Extra      map[string]interface{} `json:"extra,omitempty"`
+}
+
+type sentryExceptions struct {
+	Values []sentryException `json:"values"`
+}
+
+type sentryException struct {
+	Type       string            `json:"type"`
+	Value      string            `json:"value"`
+	Stacktrace *sentryStacktrace `json:"stacktrace,omitempty"`
+}
+
+type sentryStacktrace struct {
+	Frames []sentryFrame `json:"frames"`
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Module   string `json:"module"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+// newSentry returns sentry client for dsn (ie, '<scheme>://<public key>@<host>[/<path>]/<project id>')
+func newSentry(dsn string) (*sentryClient, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing dsn: %v", err)
+	}
+	project := path.Base(u.Path)
+	if u.User == nil || u.User.Username() == "" || u.Host == "" || project == "" || project == "." || project == "/" {
+		return nil, fmt.Errorf("invalid dsn: expected '<scheme>://<public key>@<host>[/<path>]/<project id>'")
+	}
+	return &sentryClient{
+		dsn:    dsn,
+		url:    fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, strings.TrimSuffix(path.Dir(u.Path), "/"), project),
+		auth:   fmt.Sprintf("Sentry sentry_version=7, sentry_client=cosmos-scraper/%s, sentry_key=%s", version, u.User.Username()),
+		client: &http.Client{Timeout: 5 * time.Second},
+	}, nil
+}
+
+// report sends event of level (eg, fatal or error) with exception of kind (eg, panic) with message, stack frames (oldest first) and extra context (eg, height, endpoint and payload size)
+// errors are only logged, as reporting must not affect scraping
+func (s *sentryClient) report(level, kind, message string, frames []sentryFrame, extra map[string]interface{}) {
+	if s == nil {
+		return
+	}
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	ev := sentryEvent{
+		EventID:    hex.EncodeToString(id),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339Nano),
+		Platform:   "go",
+		Level:      level,
+		Logger:     "cosmos-scraper",
+		ServerName: instanceID(),
+		Release:    "cosmos-scraper@" + version,
+		Exception:  sentryExceptions{Values: []sentryException{{Type: kind, Value: message}}},
+		Tags:       map[string]string{"protocol": bcProtocol, "db_type": dbType},
+		Extra:      extra,
+	}
+	if len(frames) > 0 {
+		ev.Exception.Values[0].Stacktrace = &sentryStacktrace{Frames: frames}
+	}
+	if err := s.send(ev); err != nil {
+		stdLogger.Printf("warn: error reporting %s to sentry: %v", kind, err)
+	}
+}
+
+// send posts event in envelope
+func (s *sentryClient) send(ev sentryEvent) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body) // note: each item is followed by newline, as required
+	for _, item := range []interface{}{
+		map[string]string{"event_id": ev.EventID, "dsn": s.dsn},
+		map[string]string{"type": "event"},
+		ev,
+	} {
+		if err := enc.Encode(item); err != nil {
+			return fmt.Errorf("error encoding event: %v", err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, &body)
+	if err != nil {
+		return fmt.Errorf("error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", s.auth)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error posting event: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("error posting event: %s", resp.Status)
+	}
+	return nil
+}
+
+// panicFrames returns stack frames (oldest first) of panicking goroutine, up to panic call, if called from deferred function while panicking
+func panicFrames() []sentryFrame {
+	pcs := make([]uintptr, 64)
+	n := runtime.Callers(1, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+	var fs []sentryFrame
+	for {
+		f, more := frames.Next()
+		if f.Function == "runtime.gopanic" {
+			fs = nil // drop frames of recovery (ie, above panic)
+		} else {
+			module, function := splitFunction(f.Function)
+			fs = append(fs, sentryFrame{
+				Function: function,
+				Module:   module,
+				Filename: filepath.Base(f.File),
+				AbsPath:  f.File,
+				Lineno:   f.Line,
+				InApp:    module == "main",
+			})
+		}
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(fs)-1; i < j; i, j = i+1, j-1 {
+		fs[i], fs[j] = fs[j], fs[i]
+	}
+	return fs
+}
+
+// splitFunction splits fully qualified function name (eg, 'github.com/org/pkg.(*T).method') into package and function name
+func splitFunction(name string) (pkg, function string) {
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		return name[:slash+1+dot], name[slash+1+dot+1:]
+	}
+	return "", name
+}
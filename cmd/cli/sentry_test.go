@@ -0,0 +1,182 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sentryServer starts sentry envelope endpoint mock for project 42, returning received envelopes (as items' json lines)
+func sentryServer(t *testing.T) (host string, envelopes func() [][]string) {
+	var mu sync.Mutex
+	var envs [][]string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/sentry/api/42/envelope/" || r.Header.Get("Content-Type") != "application/x-sentry-envelope" {
+			http.Error(w, "unsupported request", http.StatusBadRequest)
+			return
+		}
+		if auth := r.Header.Get("X-Sentry-Auth"); !strings.HasPrefix(auth, "Sentry sentry_version=7,") || !strings.Contains(auth, "sentry_key=public") {
+			http.Error(w, `{"detail": "missing authorization information"}`, http.StatusUnauthorized)
+			return
+		}
+		var lines []string
+		sc := bufio.NewScanner(r.Body)
+		sc.Buffer(nil, 1<<20)
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+		mu.Lock()
+		envs = append(envs, lines)
+		mu.Unlock()
+		w.Write([]byte(`{"id": "ok"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://"), func() [][]string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]string(nil), envs...)
+	}
+}
+
+func TestNewSentry(t *testing.T) {
+	for _, dsn := range []string{"", "https://sentry.io/42", "https://public@/42", "https://public@sentry.io", "https://public@sentry.io/", "%"} {
+		if _, err := newSentry(dsn); err == nil {
+			t.Errorf("expected error for invalid dsn %q", dsn)
+		}
+	}
+	s, err := newSentry("https://public@o1.ingest.sentry.io/42")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.url != "https://o1.ingest.sentry.io/api/42/envelope/" {
+		t.Errorf("got envelope url %s", s.url)
+	}
+}
+
+func TestSentryReport(t *testing.T) {
+	host, envelopes := sentryServer(t)
+	dsn := "http://public@" + host + "/sentry/42"
+	s, err := newSentry(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var frames []sentryFrame
+	func() {
+		defer func() {
+			if recover() != nil {
+				frames = panicFrames()
+			}
+		}()
+		panic("unexpected height")
+	}()
+	s.report("fatal", "panic", "unexpected height", frames, map[string]interface{}{"height": 42, "endpoint": "rpc"})
+	var none *sentryClient
+	none.report("error", "dead letter", "not reported", nil, nil)
+
+	envs := envelopes()
+	if len(envs) != 1 {
+		t.Fatalf("got %d envelopes, want 1", len(envs))
+	}
+	// envelope is newline-separated envelope header, item header and item
+	if len(envs[0]) != 3 {
+		t.Fatalf("got envelope %v, want 3 lines", envs[0])
+	}
+	var header, item map[string]string
+	var ev struct {
+		EventID   string `json:"event_id"`
+		Timestamp string `json:"timestamp"`
+		Platform  string `json:"platform"`
+		Level     string `json:"level"`
+		Release   string `json:"release"`
+		Exception struct {
+			Values []struct {
+				Type       string `json:"type"`
+				Value      string `json:"value"`
+				Stacktrace struct {
+					Frames []struct {
+						Function string `json:"function"`
+						Module   string `json:"module"`
+						Filename string `json:"filename"`
+						Lineno   int    `json:"lineno"`
+						InApp    bool   `json:"in_app"`
+					} `json:"frames"`
+				} `json:"stacktrace"`
+			} `json:"values"`
+		} `json:"exception"`
+		Tags  map[string]string      `json:"tags"`
+		Extra map[string]interface{} `json:"extra"`
+	}
+	for i, v := range []interface{}{&header, &item, &ev} {
+		if err := json.Unmarshal([]byte(envs[0][i]), v); err != nil {
+			t.Fatalf("envelope line %d: %v", i, err)
+		}
+	}
+	if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(ev.EventID) || header["event_id"] != ev.EventID || header["dsn"] != dsn {
+		t.Errorf("got envelope header %v and event id %s, want event's 32 hex chars id and dsn", header, ev.EventID)
+	}
+	if item["type"] != "event" {
+		t.Errorf("got item header %v, want event", item)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, ev.Timestamp); err != nil {
+		t.Errorf("got invalid timestamp %s: %v", ev.Timestamp, err)
+	}
+	if ev.Platform != "go" || ev.Level != "fatal" || ev.Release != "cosmos-scraper@"+version || ev.Extra["height"] != 42.0 || ev.Extra["endpoint"] != "rpc" {
+		t.Errorf("got event %+v", ev)
+	}
+	if len(ev.Exception.Values) != 1 || ev.Exception.Values[0].Type != "panic" || ev.Exception.Values[0].Value != "unexpected height" {
+		t.Fatalf("got exceptions %+v, want panic", ev.Exception.Values)
+	}
+	// frames are oldest first, up to panicking function
+	fs := ev.Exception.Values[0].Stacktrace.Frames
+	if len(fs) < 2 {
+		t.Fatalf("got %d stack frames, want panicking function and its callers", len(fs))
+	}
+	last := fs[len(fs)-1]
+	// note: package main is named by its import path when tested
+	if last.Module != "github.com/prezha/cosmos-scraper/cmd/cli" || !strings.HasPrefix(last.Function, "TestSentryReport.") || last.Filename != "sentry_test.go" || last.Lineno == 0 {
+		t.Errorf("got last frame %+v, want panicking function", last)
+	}
+	for _, f := range fs {
+		if strings.HasPrefix(f.Module, "runtime") && f.Function == "gopanic" {
+			t.Errorf("got frame %+v of recovery", f)
+		}
+	}
+}
+
+func TestSplitFunction(t *testing.T) {
+	for name, want := range map[string][2]string{
+		"main.main":                         {"main", "main"},
+		"main.(*worker).persist.func1":      {"main", "(*worker).persist.func1"},
+		"github.com/org/pkg.(*T).method":    {"github.com/org/pkg", "(*T).method"},
+		"github.com/org/pkg/v2.Func":        {"github.com/org/pkg/v2", "Func"},
+		"gopkg.in/yaml%2ev2.(*parser).init": {"gopkg.in/yaml%2ev2", "(*parser).init"}, // dots in last path element are escaped in symbol names
+		"unknown":                           {"", "unknown"},
+	} {
+		if pkg, function := splitFunction(name); pkg != want[0] || function != want[1] {
+			t.Errorf("%s: got (%s, %s), want (%s, %s)", name, pkg, function, want[0], want[1])
+		}
+	}
+}
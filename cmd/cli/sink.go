@@ -0,0 +1,293 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// sink publishes copies of scraped blocks, transactions and block results (eg, to streaming pipelines), in addition to (or instead of) storing them into database
+type sink interface {
+	publish(ctx context.Context, datatype string, height int, raw []byte) error
+	close() error
+}
+
+// initSinks returns configured sinks, each with its own publishing queue, if configured (see queuedSink), keeping messages it fails to publish in dlq, if not nil
+func initSinks(ctx context.Context, dlq *deadLetters) ([]sink, error) {
+	var sinks []sink
+	add := func(name string, s sink) {
+		if sinkQueue > 0 {
+			s = newQueuedSink(ctx, name, s, sinkQueue, sinkRetry, dlq)
+		}
+		sinks = append(sinks, s)
+	}
+	if len(kafkaBrokers) > 0 {
+		s, err := newKafkaSink(ctx, kafkaBrokers, kafkaTopics, kafkaSchemaRegistry)
+		if err != nil {
+			return nil, fmt.Errorf("error creating kafka sink: %v", err)
+		}
+		add("kafka", s)
+	}
+	if natsURL != "" {
+		s, err := newNATSSink(natsURL, natsSubjects, natsStream, natsDedupWindow)
+		if err != nil {
+			return nil, fmt.Errorf("error creating nats sink: %v", err)
+		}
+		add("nats", s)
+	}
+	if s3Bucket != "" {
+		s, err := newS3Sink(s3Endpoint, s3Region, s3Bucket, s3Prefix, s3AccessKey, s3SecretKey, s3BatchSize, s3Compression, s3FlushInterval)
+		if err != nil {
+			return nil, fmt.Errorf("error creating s3 sink: %v", err)
+		}
+		add("s3", s)
+	}
+	if jsonlDir != "" {
+		s, err := newJSONLSink(jsonlDir, jsonlMaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("error creating json lines sink: %v", err)
+		}
+		add("jsonl", s)
+	}
+	if parquetDir != "" {
+		s, err := newParquetSink(parquetDir, parquetBatchSize, parquetFlushInterval)
+		if err != nil {
+			return nil, fmt.Errorf("error creating parquet sink: %v", err)
+		}
+		add("parquet", s)
+	}
+	if clickhouseURL != "" {
+		s, err := newClickhouseSink(ctx, clickhouseURL, clickhouseDatabase, clickhouseUser, clickhousePass, clickhouseBatchSize, clickhouseFlushInterval)
+		if err != nil {
+			return nil, fmt.Errorf("error creating clickhouse sink: %v", err)
+		}
+		add("clickhouse", s)
+	}
+	if elasticURL != "" {
+		s, err := newElasticSink(ctx, elasticURL, elasticIndex, elasticUser, elasticPass, elasticBatchSize, elasticFlushInterval)
+		if err != nil {
+			return nil, fmt.Errorf("error creating elasticsearch sink: %v", err)
+		}
+		add("elastic", s)
+	}
+	return sinks, nil
+}
+
+// sinkError is error publishing data to sinks after it was already stored
+// it's not a storage failure, so such data is not kept as dead letter, but rather not recorded as processed (see perWorker)
+type sinkError struct {
+	err error
+}
+
+func (e *sinkError) Error() string { return e.err.Error() }
+
+func (e *sinkError) Unwrap() error { return e.err }
+
+// sinkStorage is storage that also publishes stored data to sinks
+type sinkStorage struct {
+	storage
+	sinks []sink
+}
+
+// storeBlock stores block and publishes it to sinks
+func (s *sinkStorage) storeBlock(ctx context.Context, height int, raw []byte) (interface{}, error) {
+	id, err := s.storage.storeBlock(ctx, height, raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.publish(ctx, "block", height, raw); err != nil {
+		return nil, &sinkError{err}
+	}
+	return id, nil
+}
+
+// storeTxs stores transactions and publishes them to sinks
+func (s *sinkStorage) storeTxs(ctx context.Context, height int, raw []byte) (interface{}, error) {
+	id, err := s.storage.storeTxs(ctx, height, raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.publish(ctx, "transactions", height, raw); err != nil {
+		return nil, &sinkError{err}
+	}
+	return id, nil
+}
+
+// storeBlockResults stores block results and publishes them to sinks
+func (s *sinkStorage) storeBlockResults(ctx context.Context, height int, raw []byte) (interface{}, error) {
+	id, err := s.storage.storeBlockResults(ctx, height, raw)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.publish(ctx, "block_results", height, raw); err != nil {
+		return nil, &sinkError{err}
+	}
+	return id, nil
+}
+
+// storeHeight stores block, block results and transactions at height atomically and publishes them to sinks
+func (s *sinkStorage) storeHeight(ctx context.Context, height int, parts []persist) (interface{}, error) {
+	id, err := s.storage.storeHeight(ctx, height, parts)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range parts {
+		if err := s.publish(ctx, p.datatype, height, p.raw); err != nil {
+			return nil, &sinkError{err}
+		}
+	}
+	return id, nil
+}
+
+// publish publishes raw datatype at height to all sinks
+// it will retry on sink error as per sink retry policy, unless ctx cancelled
+func (s *sinkStorage) publish(ctx context.Context, datatype string, height int, raw []byte) error {
+	for _, sk := range s.sinks {
+		for n := 1; ; n++ {
+			err := sk.publish(ctx, datatype, height, raw)
+			if err == nil {
+				break
+			}
+			d, rerr := sinkRetry.retry(n)
+			if rerr != nil {
+				return fmt.Errorf("error publishing %s at height %d: %v: %v", datatype, height, rerr, err)
+			}
+			stdLogger.Printf("error publishing %s at height %d (will retry in %s): %v", datatype, height, d, err)
+			if err := wait(ctx, d); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// close closes all sinks and then storage
+func (s *sinkStorage) close(ctx context.Context) error {
+	for _, sk := range s.sinks {
+		if err := sk.close(); err != nil {
+			stdLogger.Printf("error closing sink: %v", err)
+		}
+	}
+	return s.storage.close(ctx)
+}
+
+// queuedSink is sink publishing asynchronously to underlying sink from its own bounded queue, retrying on error as per its own retry policy
+// so slow or failing sink would not hold back storage and other sinks, until its queue is full (ie, backpressure)
+// as queued messages are already recorded as processed, those that could not be published after all retries (or on ctx cancel) are kept in dlq,
+// so they could be published later (see deadletters command), or, without dlq, scraper is stopped
+// note: queued messages would still be lost on crash
+type queuedSink struct {
+	sink
+	ctx   context.Context // used for retry waits
+	name  string
+	rp    retryPolicy
+	dlq   *deadLetters // nil if dead letters are disabled
+	queue chan sinkMsg
+	done  chan struct{}
+}
+
+// sinkMsg is single queued message
+type sinkMsg struct {
+	datatype string
+	height   int
+	raw      []byte
+}
+
+// newQueuedSink returns running queued sink named name for sink s with queue of size, keeping messages it fails to publish in dlq, if not nil
+func newQueuedSink(ctx context.Context, name string, s sink, size int, rp retryPolicy, dlq *deadLetters) *queuedSink {
+	q := &queuedSink{sink: s, ctx: ctx, name: name, rp: rp, dlq: dlq, queue: make(chan sinkMsg, size), done: make(chan struct{})}
+	go q.run()
+	return q
+}
+
+// publish queues raw datatype at height for publishing, waiting while queue is full, unless ctx cancelled
+func (q *queuedSink) publish(ctx context.Context, datatype string, height int, raw []byte) error {
+	select {
+	case q.queue <- sinkMsg{datatype: datatype, height: height, raw: raw}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run publishes queued messages to underlying sink, until queue closed
+func (q *queuedSink) run() {
+	defer close(q.done)
+	for m := range q.queue {
+		for n := 1; ; n++ {
+			err := q.sink.publish(q.ctx, m.datatype, m.height, m.raw)
+			if err == nil {
+				break
+			}
+			d, rerr := q.rp.retry(n)
+			if rerr == nil {
+				stdLogger.Printf("error publishing %s at height %d to %s sink (will retry in %s, %d queued): %v", m.datatype, m.height, q.name, d, len(q.queue), err)
+				rerr = wait(q.ctx, d)
+			}
+			if rerr != nil {
+				q.drop(m, fmt.Errorf("error publishing %s at height %d to %s sink: %v: %v", m.datatype, m.height, q.name, rerr, err))
+				break
+			}
+		}
+	}
+}
+
+// drop keeps message that could not be published due to err as dead letter, or stops scraper if there's no dlq
+func (q *queuedSink) drop(m sinkMsg, err error) {
+	if q.dlq == nil {
+		stdLogger.Panicf("%v (enable dead letters to keep unpublished data instead of stopping)", err)
+	}
+	p := persist{datatype: m.datatype, height: m.height, raw: m.raw}
+	// note: ctx might be already cancelled
+	if derr := q.dlq.put(context.Background(), p, err); derr != nil {
+		stdLogger.Panicf("%v (and error keeping it as dead letter: %v)", err, derr)
+	}
+	errStats.count(q.name, err)
+	sentry.report("error", "dead letter", err.Error(), nil, map[string]interface{}{"height": m.height, "datatype": m.datatype, "sink": q.name, "payload_size": len(m.raw)})
+	stdLogger.Printf("warn: %v (keeping it as dead letter)", err)
+}
+
+// close publishes remaining queued messages and closes underlying sink
+func (q *queuedSink) close() error {
+	close(q.queue)
+	<-q.done
+	return q.sink.close()
+}
+
+// nopStorage is storage that doesn't store anything, used when scraped data is only published to sinks
+type nopStorage struct{}
+
+func (nopStorage) storeBlock(ctx context.Context, height int, raw []byte) (interface{}, error) {
+	return height, nil
+}
+
+func (nopStorage) storeTxs(ctx context.Context, height int, raw []byte) (interface{}, error) {
+	return height, nil
+}
+
+func (nopStorage) storeBlockResults(ctx context.Context, height int, raw []byte) (interface{}, error) {
+	return height, nil
+}
+
+func (nopStorage) storeHeight(ctx context.Context, height int, parts []persist) (interface{}, error) {
+	return height, nil
+}
+
+func (nopStorage) lastHeight(ctx context.Context) (int, error) { return 0, nil }
+
+func (nopStorage) close(ctx context.Context) error { return nil }
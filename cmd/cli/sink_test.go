@@ -0,0 +1,113 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink records published messages, failing with err, if set
+type fakeSink struct {
+	mu        sync.Mutex
+	err       error
+	published []sinkMsg
+}
+
+func (s *fakeSink) publish(ctx context.Context, datatype string, height int, raw []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.published = append(s.published, sinkMsg{datatype: datatype, height: height, raw: raw})
+	return nil
+}
+
+func (s *fakeSink) close() error { return nil }
+
+func TestSinkStorage(t *testing.T) {
+	prev := sinkRetry
+	sinkRetry = retryPolicy{min: time.Millisecond, max: time.Millisecond, factor: 1, attempts: 2}
+	t.Cleanup(func() { sinkRetry = prev })
+	ctx := context.Background()
+
+	ok := &fakeSink{}
+	st := &sinkStorage{storage: nopStorage{}, sinks: []sink{ok}}
+	if id, err := st.storeBlock(ctx, 5, []byte("{}")); err != nil || id != 5 {
+		t.Fatalf("got (%v, %v), want (5, nil)", id, err)
+	}
+	if len(ok.published) != 1 || ok.published[0].height != 5 || ok.published[0].datatype != "block" {
+		t.Errorf("got published %v, want block at height 5", ok.published)
+	}
+
+	// stored, but not published data is not reported as stored, and is distinguishable from storage failure
+	failed := &fakeSink{err: errors.New("broker down")}
+	st = &sinkStorage{storage: nopStorage{}, sinks: []sink{failed}}
+	id, err := st.storeTxs(ctx, 6, []byte("{}"))
+	var se *sinkError
+	if id != nil || !errors.As(err, &se) {
+		t.Fatalf("got (%v, %v), want sink error without id", id, err)
+	}
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := st.storeHeight(cctx, 7, []persist{{datatype: "block", height: 7}}); !errors.As(err, &se) || !errors.Is(err, context.Canceled) {
+		t.Errorf("got error %v, want cancelled sink error", err)
+	}
+}
+
+func TestQueuedSink(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "dead-letters")
+	dlq := newDeadLetters(nil, file)
+	s := &fakeSink{err: errors.New("broker down")}
+	q := newQueuedSink(context.Background(), "test", s, 10, retryPolicy{min: time.Millisecond, max: time.Millisecond, factor: 1, attempts: 2}, dlq)
+
+	for h := 1; h <= 3; h++ {
+		if err := q.publish(context.Background(), "block", h, []byte(`{"h":1}`)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.close(); err != nil {
+		t.Fatal(err)
+	}
+	// messages failing after all retries are kept as dead letters instead of being dropped
+	dls, err := dlq.all(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dls) != 3 {
+		t.Fatalf("got %d dead letters, want 3", len(dls))
+	}
+	for i, dl := range dls {
+		if dl.Height != i+1 || dl.Datatype != "block" || string(dl.Raw) != `{"h":1}` {
+			t.Errorf("got dead letter %+v, want block at height %d", dl, i+1)
+		}
+	}
+
+	// messages published after retries are not kept
+	s = &fakeSink{}
+	q = newQueuedSink(context.Background(), "test", s, 10, retryPolicy{attempts: 1}, newDeadLetters(nil, filepath.Join(t.TempDir(), "dead-letters")))
+	q.publish(context.Background(), "transactions", 4, nil)
+	q.close()
+	if dls, _ := q.dlq.all(context.Background()); len(dls) != 0 || len(s.published) != 1 {
+		t.Errorf("got %d dead letters and %d published messages, want 0 and 1", len(dls), len(s.published))
+	}
+}
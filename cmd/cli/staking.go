@@ -0,0 +1,111 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// stakingScraper snapshots validators, delegations and unbonding delegations every interval or every n blocks (if n > 0), until ctx cancelled
+// with n > 0, snapshots are taken at heights that are multiples of n (checked every interval), otherwise at the current height
+// data is stored in staking_validators, staking_delegations and staking_unbondings collections, keyed by snapshot height (and validator and delegator), with height attached
+func stakingScraper(ctx context.Context, bcc bcSource, db *mongo.Database, interval time.Duration, n int) {
+	last := 0 // last snapshot height
+	periodically(ctx, "staking snapshot", interval, func(ctx context.Context) error {
+		h, err := bcHeight(ctx, bcc, bcRetry)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			if h = h / n * n; h <= last {
+				return nil
+			}
+		}
+		stdLogger.Printf("taking staking snapshot at height %d...", h)
+		if err := snapshotStaking(ctx, bcc, db, h); err != nil {
+			return err
+		}
+		last = h
+		stdLogger.Printf("taking staking snapshot at height %d done", h)
+		return nil
+	})
+}
+
+// snapshotStaking stores validators with their delegations and unbonding delegations at height h
+func snapshotStaking(ctx context.Context, bcc bcSource, db *mongo.Database, h int) error {
+	extra := bson.M{"height": h, "snapshot_at": time.Now().UTC()}
+	path := "/cosmos/staking/v1beta1/validators"
+
+	validators, err := queryAll(ctx, bcc, path, nil, "validators", h, bcRetry)
+	if err != nil {
+		return err
+	}
+	for _, raw := range validators {
+		var v struct {
+			OperatorAddress string `json:"operator_address"`
+		}
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return fmt.Errorf("error unmarshalling validator %s: %v", string(raw), err)
+		}
+		id := fmt.Sprintf("%d/%s", h, v.OperatorAddress)
+		if err := upsert(ctx, collection(db, "staking_validators"), id, raw, extra); err != nil {
+			return fmt.Errorf("error storing validator %s: %v", v.OperatorAddress, err)
+		}
+
+		delegations, err := queryAll(ctx, bcc, path+"/"+v.OperatorAddress+"/delegations", nil, "delegation_responses", h, bcRetry)
+		if err != nil {
+			return err
+		}
+		for _, raw := range delegations {
+			var d struct {
+				Delegation struct {
+					DelegatorAddress string `json:"delegator_address"`
+				} `json:"delegation"`
+			}
+			if err := json.Unmarshal(raw, &d); err != nil {
+				return fmt.Errorf("error unmarshalling delegation %s: %v", string(raw), err)
+			}
+			if err := upsert(ctx, collection(db, "staking_delegations"), id+"/"+d.Delegation.DelegatorAddress, raw, extra); err != nil {
+				return fmt.Errorf("error storing delegation to %s by %s: %v", v.OperatorAddress, d.Delegation.DelegatorAddress, err)
+			}
+		}
+
+		unbondings, err := queryAll(ctx, bcc, path+"/"+v.OperatorAddress+"/unbonding_delegations", nil, "unbonding_responses", h, bcRetry)
+		if err != nil {
+			return err
+		}
+		for _, raw := range unbondings {
+			var u struct {
+				DelegatorAddress string `json:"delegator_address"`
+			}
+			if err := json.Unmarshal(raw, &u); err != nil {
+				return fmt.Errorf("error unmarshalling unbonding delegation %s: %v", string(raw), err)
+			}
+			if err := upsert(ctx, collection(db, "staking_unbondings"), id+"/"+u.DelegatorAddress, raw, extra); err != nil {
+				return fmt.Errorf("error storing unbonding delegation from %s by %s: %v", v.OperatorAddress, u.DelegatorAddress, err)
+			}
+		}
+	}
+
+	return nil
+}
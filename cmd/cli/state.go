@@ -0,0 +1,386 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// processed datatypes of a height, as bit flags
+const (
+	stateBlock = 1 << iota
+	stateTxs
+	stateBrs
+)
+
+// completion tracks processed heights, completing out of order, as contiguous high-water mark (ie, last height with all lower heights processed) and set of processed datatypes of heights above it
+// set only spans heights in flight (ie, roughly number of workers), as watermark advances over fully processed heights
+type completion struct {
+	full      int // flags of datatypes required for height to be processed
+	results   int // first height block results are required from (ie, since they were enabled)
+	watermark int
+	seen      map[int]int // processed datatypes of heights above watermark
+}
+
+// newCompletion returns completion starting from watermark, also requiring block results if withResults is true
+func newCompletion(watermark int, withResults bool) *completion {
+	c := &completion{full: stateBlock | stateTxs, watermark: watermark, seen: map[int]int{}}
+	if withResults {
+		c.full |= stateBrs
+	}
+	return c
+}
+
+// required returns flags of datatypes required for height h to be processed
+func (c *completion) required(h int) int {
+	if h < c.results {
+		return c.full &^ stateBrs
+	}
+	return c.full
+}
+
+// mark records datatypes flags as processed at height h, advancing watermark over fully processed heights
+func (c *completion) mark(h, flags int) {
+	if h <= c.watermark {
+		return
+	}
+	c.seen[h] |= flags
+	c.advance()
+}
+
+// skip records all heights up to h as processed (ie, pruned by node or skipped in follow mode)
+func (c *completion) skip(h int) {
+	if h <= c.watermark {
+		return
+	}
+	for k := range c.seen {
+		if k <= h {
+			delete(c.seen, k)
+		}
+	}
+	c.watermark = h
+	c.advance()
+}
+
+// advance advances watermark over fully processed heights
+func (c *completion) advance() {
+	for h := c.watermark + 1; c.seen[h]&c.required(h) == c.required(h); h++ {
+		delete(c.seen, h)
+		c.watermark = h
+	}
+}
+
+// resumeGap is max gap between processed heights above watermark for resume point to span them
+// so pending heights are bounded, even if heights far ahead were processed (ie, by tip pipeline), which are then scraped again on resume
+const resumeGap = 10000
+
+// resume returns resume point
+func (c *completion) resume() resumePoint {
+	r := resumePoint{watermark: c.watermark, highest: c.watermark}
+	var processed []int
+	for h, f := range c.seen {
+		if f&c.required(h) == c.required(h) {
+			processed = append(processed, h)
+		}
+	}
+	sort.Ints(processed)
+	for _, h := range processed {
+		if h-r.highest > resumeGap {
+			break
+		}
+		r.highest = h
+	}
+	for h := c.watermark + 1; h < r.highest; h++ {
+		if f := c.seen[h]; f&c.required(h) != c.required(h) {
+			r.pending = append(r.pending, h)
+		}
+	}
+	return r
+}
+
+// resumePoint is where to resume scraping from: after the highest fully processed height, once pending heights (ie, not fully processed ones between watermark and highest) are re-scraped
+type resumePoint struct {
+	watermark int
+	highest   int
+	pending   []int // sorted
+}
+
+// from returns resume point adjusted to start not below checkpoint
+func (r resumePoint) from(checkpoint int) resumePoint {
+	if r.highest <= checkpoint {
+		return resumePoint{watermark: checkpoint, highest: checkpoint}
+	}
+	if r.watermark < checkpoint {
+		r.watermark = checkpoint
+		i := sort.SearchInts(r.pending, checkpoint+1)
+		r.pending = r.pending[i:]
+	}
+	return r
+}
+
+// parseLogLine returns height processed in log line, if any, and flags of its processed datatypes, or if heights up to it were pruned (skipped), as per logHeight
+// note: invalid blocks are considered as processed (ie, skipped), and heights pruned by node or skipped in follow mode are fast-forwarded past
+func parseLogLine(line string) (h, flags int, pruned, ok bool, err error) {
+	l := strings.Split(trimInstanceName(strings.TrimSpace(line)), " ")
+	if len(l) < 4 {
+		return 0, 0, false, false, nil
+	}
+	switch l[0] {
+	case "bxs:":
+		flags = stateBlock
+	case "txs:":
+		flags = stateTxs
+	case "brs:":
+		flags = stateBrs
+	case "std:":
+		if len(l) < 5 {
+			return 0, 0, false, false, nil
+		}
+		switch l[4] {
+		case "invalid":
+			flags = stateBlock | stateTxs
+		case "pruned", "skipped":
+			pruned = true
+		default:
+			return 0, 0, false, false, nil
+		}
+	default:
+		return 0, 0, false, false, nil
+	}
+	if h, err = strconv.Atoi(l[3]); err != nil {
+		return 0, 0, false, false, fmt.Errorf("error parsing block height: %v", err)
+	}
+	return h, flags, pruned, true, nil
+}
+
+// scrapeState tracks processed heights, as recorded in log, and periodically saves contiguous high-water mark and any gaps above it to scrape_state collection, if not nil
+// it's used instead of parsing log on start, if available, so log could be rotated without losing resume state
+type scrapeState struct {
+	col *mongo.Collection
+	id  string
+
+	mu    sync.Mutex
+	c     *completion
+	dirty bool
+}
+
+// stateDoc is saved scrape state
+type stateDoc struct {
+	Watermark int          `bson:"watermark"`
+	Gaps      []stateRange `bson:"gaps"`
+	Highest   int          `bson:"highest"`
+	UpdatedAt time.Time    `bson:"updated_at"`
+}
+
+// stateRange is inclusive range of heights
+type stateRange struct {
+	From int `bson:"from"`
+	To   int `bson:"to"`
+}
+
+// loadState returns saved resume point with id in col, or nil if none saved
+func loadState(ctx context.Context, col *mongo.Collection, id string) (*resumePoint, error) {
+	var d stateDoc
+	err := col.FindOne(ctx, bson.M{"_id": id}).Decode(&d)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading scrape state: %v", err)
+	}
+	r := &resumePoint{watermark: d.Watermark, highest: d.Highest}
+	if r.highest < r.watermark {
+		r.highest = r.watermark
+	}
+	for _, g := range d.Gaps {
+		for h := g.From; h <= g.To; h++ {
+			r.pending = append(r.pending, h)
+		}
+	}
+	sort.Ints(r.pending)
+	return r, nil
+}
+
+// newScrapeState returns scrape state with id in col, resuming from r, also tracking block results if withResults is true
+// it's fed by processed heights logged by bxs, txs, brs and std loggers, so it always agrees with log
+func newScrapeState(col *mongo.Collection, id string, r resumePoint, withResults bool) *scrapeState {
+	c := newCompletion(r.watermark, withResults)
+	// heights between watermark and highest that are not pending are already processed
+	pending := map[int]bool{}
+	for _, h := range r.pending {
+		pending[h] = true
+	}
+	for h := r.watermark + 1; h <= r.highest; h++ {
+		if !pending[h] {
+			c.seen[h] = c.full
+		}
+	}
+	c.advance()
+	s := &scrapeState{col: col, id: id, c: c, dirty: true}
+	bxsLogger.SetOutput(io.MultiWriter(bxsLogger.Writer(), stateWriter{s, "bxs:"}))
+	txsLogger.SetOutput(io.MultiWriter(txsLogger.Writer(), stateWriter{s, "txs:"}))
+	brsLogger.SetOutput(io.MultiWriter(brsLogger.Writer(), stateWriter{s, "brs:"}))
+	stdLogger.SetOutput(io.MultiWriter(stdLogger.Writer(), stateWriter{s, "std:"}))
+	return s
+}
+
+// stateWriter feeds scrape state with log lines written by logger with prefix
+type stateWriter struct {
+	s      *scrapeState
+	prefix string
+}
+
+// Write records height processed in log line p, if any, as per parseLogLine
+func (w stateWriter) Write(p []byte) (int, error) {
+	line := trimInstanceName(string(p))
+	if !strings.HasPrefix(line, w.prefix) {
+		return len(p), nil
+	}
+	h, flags, pruned, ok, err := parseLogLine(line)
+	if !ok || err != nil {
+		return len(p), nil
+	}
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	if pruned {
+		w.s.c.skip(h)
+	} else {
+		w.s.c.mark(h, flags)
+	}
+	w.s.dirty = true
+	return len(p), nil
+}
+
+// resume returns current resume point
+func (s *scrapeState) resume() resumePoint {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.resume()
+}
+
+// height returns current watermark
+func (s *scrapeState) height() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.c.watermark
+}
+
+// snapshot returns current state doc
+func (s *scrapeState) snapshot() stateDoc {
+	s.mu.Lock()
+	r := s.c.resume()
+	s.mu.Unlock()
+	d := stateDoc{Watermark: r.watermark, Highest: r.highest, Gaps: []stateRange{}, UpdatedAt: time.Now().UTC()}
+	for _, h := range r.pending {
+		if n := len(d.Gaps); n > 0 && d.Gaps[n-1].To == h-1 {
+			d.Gaps[n-1].To = h
+			continue
+		}
+		d.Gaps = append(d.Gaps, stateRange{From: h, To: h})
+	}
+	return d
+}
+
+// save saves current state, if changed since last saved
+func (s *scrapeState) save(ctx context.Context) error {
+	if s.col == nil {
+		return nil
+	}
+	s.mu.Lock()
+	dirty := s.dirty
+	s.dirty = false
+	s.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	d := s.snapshot()
+	if err := updateWithRetry(ctx, s.col, s.id, bson.M{"$set": d}); err != nil {
+		s.mu.Lock()
+		s.dirty = true
+		s.mu.Unlock()
+		return fmt.Errorf("error saving scrape state: %v", err)
+	}
+	return nil
+}
+
+// run saves state every interval, until ctx cancelled
+func (s *scrapeState) run(ctx context.Context, interval time.Duration) {
+	periodically(ctx, "scrape state", interval, s.save)
+}
+
+// resumeManifest is resume point written on graceful stop
+type resumeManifest struct {
+	Watermark int       `json:"watermark"`
+	Highest   int       `json:"highest"`
+	Pending   []int     `json:"pending"`
+	StoppedAt time.Time `json:"stopped_at"`
+}
+
+// writeResume writes resume point r to manifest file
+func writeResume(file string, r resumePoint) error {
+	m := resumeManifest{Watermark: r.watermark, Highest: r.highest, Pending: r.pending, StoppedAt: time.Now().UTC()}
+	if m.Pending == nil {
+		m.Pending = []int{}
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write atomically, so partially written manifest is never read
+	tmp := file + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("error writing resume manifest %s: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		return fmt.Errorf("error writing resume manifest %s: %v", file, err)
+	}
+	return nil
+}
+
+// readResume returns resume point from manifest file, or nil if there is none
+// manifest is removed once read, as it's only valid until scraping resumes (ie, log is authoritative if scraper is not stopped gracefully again)
+func readResume(file string) (*resumePoint, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading resume manifest %s: %v", file, err)
+	}
+	var m resumeManifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("error parsing resume manifest %s: %v", file, err)
+	}
+	if err := os.Remove(file); err != nil {
+		return nil, fmt.Errorf("error removing resume manifest %s: %v", file, err)
+	}
+	sort.Ints(m.Pending)
+	return &resumePoint{watermark: m.Watermark, highest: m.Highest, pending: m.Pending}, nil
+}
@@ -0,0 +1,277 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// logLine returns log line of logger with prefix (eg, "bxs:") recording message
+func logLine(prefix, msg string) string {
+	return prefix + " 2022/01/02 03:04:05 " + msg
+}
+
+func TestParseLogLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		h      int
+		flags  int
+		pruned bool
+		ok     bool
+		err    bool
+	}{
+		{line: logLine("bxs:", "5 -> 5"), h: 5, flags: stateBlock, ok: true},
+		{line: logLine("txs:", "6 -> 6"), h: 6, flags: stateTxs, ok: true},
+		{line: logLine("brs:", "7 -> 7"), h: 7, flags: stateBrs, ok: true},
+		{line: logLine("txs:", "8 empty (skipping)"), h: 8, flags: stateTxs, ok: true},
+		{line: logLine("bxs:", "9 unavailable (skipping): error"), h: 9, flags: stateBlock, ok: true},
+		{line: logLine("std:", "10 invalid (skipping): bad commit"), h: 10, flags: stateBlock | stateTxs, ok: true},
+		{line: logLine("std:", "11 pruned (fast-forwarding to lowest available height 12)"), h: 11, pruned: true, ok: true},
+		{line: logLine("std:", "12 skipped (following chain head: historical blocks up to it are not scraped)"), h: 12, pruned: true, ok: true},
+		{line: logLine("std:", "3 chunks leased by other instances - napping for 1m0s"), ok: false},
+		{line: logLine("std:", "queuing new blocks [1..2]"), ok: false},
+		{line: logLine("std:", "13"), ok: false},
+		{line: "[node-1] " + logLine("bxs:", "14 -> 14"), h: 14, flags: stateBlock, ok: true},
+		{line: "[node-1] " + logLine("std:", "15 pruned (fast-forwarding to lowest available height 16)"), h: 15, pruned: true, ok: true},
+		{line: "  " + logLine("txs:", "16 -> 16") + "  ", h: 16, flags: stateTxs, ok: true},
+		{line: logLine("xyz:", "17 -> 17"), ok: false},
+		{line: "bxs: 17", ok: false},
+		{line: "", ok: false},
+		{line: logLine("bxs:", "x -> x"), err: true},
+	}
+	for _, tc := range tests {
+		h, flags, pruned, ok, err := parseLogLine(tc.line)
+		if (err != nil) != tc.err {
+			t.Errorf("%q: got error %v, want error: %v", tc.line, err, tc.err)
+			continue
+		}
+		if h != tc.h || flags != tc.flags || pruned != tc.pruned || ok != tc.ok {
+			t.Errorf("%q: got (%d, %b, %v, %v), want (%d, %b, %v, %v)", tc.line, h, flags, pruned, ok, tc.h, tc.flags, tc.pruned, tc.ok)
+		}
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	c := newCompletion(10, false)
+	c.mark(12, stateBlock|stateTxs)
+	c.mark(11, stateBlock)
+	if c.watermark != 10 {
+		t.Fatalf("watermark advanced to %d over partially processed height", c.watermark)
+	}
+	c.mark(11, stateTxs)
+	if c.watermark != 12 {
+		t.Fatalf("got watermark %d, want 12", c.watermark)
+	}
+	if len(c.seen) != 0 {
+		t.Errorf("heights below watermark still tracked: %v", c.seen)
+	}
+	c.mark(5, stateBlock) // below watermark
+	c.mark(14, stateBlock|stateTxs)
+	c.skip(13)
+	if c.watermark != 14 {
+		t.Fatalf("got watermark %d after skip, want 14", c.watermark)
+	}
+
+	// block results are only required from results height
+	c = newCompletion(0, true)
+	c.results = 3
+	for h := 1; h <= 4; h++ {
+		c.mark(h, stateBlock|stateTxs)
+	}
+	if c.watermark != 2 {
+		t.Fatalf("got watermark %d, want 2 (block results required from 3)", c.watermark)
+	}
+	c.mark(3, stateBrs)
+	if c.watermark != 3 {
+		t.Fatalf("got watermark %d, want 3", c.watermark)
+	}
+}
+
+func TestLogHeight(t *testing.T) {
+	// processed returns log lines recording heights as fully processed (with block results, if brs is set)
+	processed := func(brs bool, heights ...int) []string {
+		var lines []string
+		for _, h := range heights {
+			lines = append(lines, logLine("bxs:", fmt.Sprintf("%d -> %d", h, h)), logLine("txs:", fmt.Sprintf("%d -> %d", h, h)))
+			if brs {
+				lines = append(lines, logLine("brs:", fmt.Sprintf("%d -> %d", h, h)))
+			}
+		}
+		return lines
+	}
+	concat := func(parts ...[]string) []string {
+		var lines []string
+		for _, p := range parts {
+			lines = append(lines, p...)
+		}
+		return lines
+	}
+	tests := []struct {
+		name        string
+		lines       []string
+		checkpoint  int
+		withResults bool
+		want        resumePoint
+	}{
+		{
+			name: "empty log",
+			want: resumePoint{},
+		},
+		{
+			name:  "contiguous",
+			lines: processed(false, 1, 2, 3),
+			want:  resumePoint{watermark: 3, highest: 3},
+		},
+		{
+			name:  "out of order",
+			lines: processed(false, 3, 1, 2),
+			want:  resumePoint{watermark: 3, highest: 3},
+		},
+		{
+			name:  "gaps",
+			lines: processed(false, 1, 2, 4, 7),
+			want:  resumePoint{watermark: 2, highest: 7, pending: []int{3, 5, 6}},
+		},
+		{
+			name:  "partially processed",
+			lines: concat(processed(false, 1, 3), []string{logLine("bxs:", "2 -> 2"), logLine("txs:", "4 -> 4")}),
+			want:  resumePoint{watermark: 1, highest: 3, pending: []int{2}},
+		},
+		{
+			name:       "checkpoint",
+			lines:      processed(false, 1, 2, 3, 12),
+			checkpoint: 10,
+			want:       resumePoint{watermark: 10, highest: 12, pending: []int{11}},
+		},
+		{
+			name:        "block results required from first recorded",
+			lines:       concat(processed(false, 1, 2), processed(true, 3, 5), processed(false, 4)),
+			withResults: true,
+			want:        resumePoint{watermark: 3, highest: 5, pending: []int{4}},
+		},
+		{
+			name:        "block results never recorded",
+			lines:       processed(false, 1, 2),
+			withResults: true,
+			want:        resumePoint{watermark: 2, highest: 2},
+		},
+		{
+			name:        "block results not required",
+			lines:       concat(processed(false, 1), processed(true, 2)),
+			withResults: false,
+			want:        resumePoint{watermark: 2, highest: 2},
+		},
+		{
+			name:  "pruned",
+			lines: concat([]string{logLine("std:", "100 pruned (fast-forwarding to lowest available height 101)")}, processed(false, 101, 103)),
+			want:  resumePoint{watermark: 101, highest: 103, pending: []int{102}},
+		},
+		{
+			name:  "skipped in follow mode",
+			lines: concat(processed(false, 1, 3), []string{logLine("std:", "50 skipped (following chain head: historical blocks up to it are not scraped)")}, processed(false, 51)),
+			want:  resumePoint{watermark: 51, highest: 51},
+		},
+		{
+			name:  "invalid",
+			lines: concat(processed(false, 1), []string{logLine("std:", "2 invalid (skipping): bad commit")}, processed(false, 3)),
+			want:  resumePoint{watermark: 3, highest: 3},
+		},
+		{
+			name:        "invalid with block results",
+			lines:       concat(processed(true, 1), []string{logLine("std:", "2 invalid (skipping): bad commit"), logLine("brs:", "2 invalid (skipping): bad commit")}, processed(true, 3)),
+			withResults: true,
+			want:        resumePoint{watermark: 3, highest: 3},
+		},
+		{
+			name: "instance name",
+			lines: func() []string {
+				var lines []string
+				for _, l := range concat(processed(false, 1, 2, 4), []string{logLine("std:", "3 invalid (skipping): bad commit")}) {
+					lines = append(lines, "[node-1] "+l)
+				}
+				return lines
+			}(),
+			want: resumePoint{watermark: 4, highest: 4},
+		},
+		{
+			name:  "other lines ignored",
+			lines: concat([]string{logLine("std:", "cosmos-scraper started"), logLine("std:", "3 chunks leased by other instances - napping for 1m0s")}, processed(false, 1)),
+			want:  resumePoint{watermark: 1, highest: 1},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "log")
+			if err := os.WriteFile(file, []byte(strings.Join(tc.lines, "\n")+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := logHeight(file, tc.checkpoint, tc.withResults)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+
+	file := filepath.Join(t.TempDir(), "log")
+	if err := os.WriteFile(file, []byte(logLine("bxs:", "x -> x")), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := logHeight(file, 0, false); err == nil {
+		t.Error("expected error for invalid height")
+	}
+}
+
+func TestResumeGap(t *testing.T) {
+	tests := []struct {
+		name      string
+		processed []int
+		highest   int
+		pending   int // number of pending heights
+	}{
+		{name: "contiguous", processed: []int{1, 2, 3}, highest: 3},
+		{name: "within gap", processed: []int{1, 2, 5, resumeGap}, highest: resumeGap, pending: resumeGap - 4},
+		{name: "far ahead", processed: []int{1, 2, 5, 5 + resumeGap + 1, 5 + resumeGap + 2}, highest: 5, pending: 2},
+		{name: "far ahead only", processed: []int{resumeGap + 2, resumeGap + 3}, highest: 0},
+		{name: "chained within gap", processed: []int{1, resumeGap, 2 * resumeGap, 4 * resumeGap}, highest: 2 * resumeGap, pending: 2*resumeGap - 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newCompletion(0, false)
+			for _, h := range tc.processed {
+				c.mark(h, stateBlock|stateTxs)
+			}
+			c.mark(tc.highest+1, stateBlock) // partially processed height just above resume point is scraped again
+			r := c.resume()
+			if r.highest != tc.highest || len(r.pending) != tc.pending {
+				t.Fatalf("got highest %d with %d pending heights, want %d with %d", r.highest, len(r.pending), tc.highest, tc.pending)
+			}
+			for _, h := range r.pending {
+				if h <= r.watermark || h >= r.highest {
+					t.Fatalf("pending height %d outside of (%d, %d)", h, r.watermark, r.highest)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// showStatus writes operational summary of scraper deployment to w: chain head, last processed height (as per scrape state or log) and lag behind the head, and, for mongo database, stored heights range, gaps, documents counts, database size and instances' heartbeats
+// it only reads, so it can be used while scraper is running, and unavailable node or missing log are reported rather than failing
+func showStatus(ctx context.Context, w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	defer tw.Flush()
+	line := func(name, format string, args ...interface{}) {
+		fmt.Fprintf(tw, "%s:\t%s\n", name, fmt.Sprintf(format, args...))
+	}
+	// single attempt, so status is quick even if node or database are down
+	once := retryPolicy{min: time.Second, max: time.Second, factor: 1, attempts: 1}
+
+	head := -1
+	bcc, err := newBCSource(ctx, bcProtocol, bcNode, bcPort)
+	if err == nil {
+		head, err = bcHeight(ctx, bcc, once)
+	}
+	if err != nil {
+		line("chain head", "unavailable: %v", err)
+	} else {
+		line("chain head", "%d (%s:%s)", head, bcNode, bcPort)
+	}
+
+	var dbc *mongo.Client
+	var bxs, txs, brs *mongo.Collection
+	if dbType == "mongo" {
+		dbc, bxs, txs, brs = initDB(ctx, dbHost, dbPort, dbUser, dbPass, once)
+		defer dbc.Disconnect(context.Background())
+	}
+
+	var rp *resumePoint
+	source := "log " + logFile
+	if scrapeStateEnabled && dbc != nil {
+		if rp, err = loadState(ctx, collection(dbc.Database(dbName), "scrape_state"), "scrape"); err != nil {
+			return err
+		}
+		source = "scrape state"
+	}
+	if rp == nil {
+		r, err := logHeight(logFile, logCheckpoint, blockResults)
+		if err != nil {
+			line("processed height", "unavailable: %v", err)
+		} else {
+			rp = &r
+			source = "log " + logFile
+		}
+	}
+	if rp != nil {
+		line("processed height", "%d (%s; highest: %d, pending: %d)", rp.watermark, source, rp.highest, len(rp.pending))
+		if head >= 0 {
+			lag := head - rp.watermark
+			if lag < 0 {
+				lag = 0
+			}
+			line("lag", "%d heights", lag)
+		}
+	}
+
+	if dbc == nil {
+		line("database", "%s (stored data stats require mongo)", dbType)
+		return nil
+	}
+
+	lo, hi, err := storedRange(ctx, bxs)
+	if err != nil {
+		return err
+	}
+	if hi == 0 {
+		line("stored heights", "none")
+	} else {
+		line("stored heights", "%d..%d", lo, hi)
+		gaps, err := findGaps(ctx, bxs, lo, hi)
+		if err != nil {
+			return err
+		}
+		missing := 0
+		for _, g := range gaps {
+			missing += g.To - g.From + 1
+		}
+		line("gaps", "%d missing heights in %d ranges", missing, len(gaps))
+	}
+
+	for _, col := range []*mongo.Collection{bxs, txs, brs} {
+		n, err := col.EstimatedDocumentCount(ctx)
+		if err != nil {
+			return fmt.Errorf("error counting %s documents: %v", col.Name(), err)
+		}
+		line(col.Name(), "%d documents", n)
+	}
+
+	var stats struct {
+		DataSize    float64 `bson:"dataSize"`
+		StorageSize float64 `bson:"storageSize"`
+		IndexSize   float64 `bson:"indexSize"`
+	}
+	if err := dbc.Database(dbName).RunCommand(ctx, bson.D{{Key: "dbStats", Value: 1}}).Decode(&stats); err != nil {
+		return fmt.Errorf("error getting database stats: %v", err)
+	}
+	line("database size", "%s data, %s storage, %s indexes (%s)", byteSize(stats.DataSize), byteSize(stats.StorageSize), byteSize(stats.IndexSize), dbName)
+
+	cur, err := collection(dbc.Database(dbName), "status").Find(ctx, bson.M{})
+	if err != nil {
+		return fmt.Errorf("error reading heartbeats: %v", err)
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		var hb struct {
+			Instance  string    `bson:"instance"`
+			Version   string    `bson:"version"`
+			Height    int       `bson:"height"`
+			Head      int       `bson:"head"`
+			Stalled   bool      `bson:"stalled"`
+			UpdatedAt time.Time `bson:"updated_at"`
+		}
+		if err := cur.Decode(&hb); err != nil {
+			return fmt.Errorf("error decoding heartbeat: %v", err)
+		}
+		line("heartbeat "+hb.Instance, "height %d, head %d, stalled: %t, version %s, updated %s ago", hb.Height, hb.Head, hb.Stalled, hb.Version, time.Since(hb.UpdatedAt).Round(time.Second))
+	}
+	return cur.Err()
+}
+
+// byteSize returns n bytes in human-readable binary units (eg, "1.5 GiB")
+func byteSize(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0f B", n)
+	}
+	i := 0
+	for n >= unit && i < 5 {
+		n /= unit
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", n, "KMGTP"[i-1])
+}
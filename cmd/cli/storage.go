@@ -0,0 +1,250 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// storage is backend storing raw blocks, transactions and block results json at height, returning id of stored data
+type storage interface {
+	storeBlock(ctx context.Context, height int, raw []byte) (interface{}, error)
+	storeTxs(ctx context.Context, height int, raw []byte) (interface{}, error)
+	storeBlockResults(ctx context.Context, height int, raw []byte) (interface{}, error)
+	// storeHeight stores block, block results and transactions at height atomically: either all or none of them
+	storeHeight(ctx context.Context, height int, parts []persist) (interface{}, error)
+	// lastHeight returns height of the highest stored block (0 if none)
+	lastHeight(ctx context.Context) (int, error)
+	close(ctx context.Context) error
+}
+
+// mongoStorage is storage using mongo database collections
+// docs are keyed by height (ie, _id), so re-processing a height (eg, after crash recovery or checkpoint rewind) replaces existing docs instead of creating duplicates
+// concurrent writes are grouped into bulk writes (see bulkWriter)
+type mongoStorage struct {
+	client        *mongo.Client
+	bxs, txs, brs *mongo.Collection
+	bxw, txw, brw *bulkWriter
+}
+
+// newMongoStorage returns mongo storage using collections bxs, txs and brs, with bulk writes of up to batchSize docs, waiting up to batchWait for more
+func newMongoStorage(ctx context.Context, client *mongo.Client, bxs, txs, brs *mongo.Collection, batchSize int, batchWait time.Duration) *mongoStorage {
+	return &mongoStorage{
+		client: client,
+		bxs:    bxs,
+		txs:    txs,
+		brs:    brs,
+		bxw:    newBulkWriter(ctx, bxs, batchSize, batchWait),
+		txw:    newBulkWriter(ctx, txs, batchSize, batchWait),
+		brw:    newBulkWriter(ctx, brs, batchSize, batchWait),
+	}
+}
+
+// storeBlock stores block into blocks collection
+func (s *mongoStorage) storeBlock(ctx context.Context, height int, raw []byte) (interface{}, error) {
+	return height, s.bxw.upsert(height, raw)
+}
+
+// storeTxs stores transactions into transactions collection, either as single doc or one doc per transaction (see txDocModels)
+func (s *mongoStorage) storeTxs(ctx context.Context, height int, raw []byte) (interface{}, error) {
+	if !dbTxDocs {
+		return height, s.txw.upsert(height, raw)
+	}
+	models, err := txDocModels(height, raw)
+	if err != nil {
+		return nil, err
+	}
+	return height, s.txw.write(models...)
+}
+
+// storeHeight stores block, block results and transactions at height in a single multi-document transaction (requires replica set)
+// it will retry on database error as per db retry policy, unless ctx cancelled
+func (s *mongoStorage) storeHeight(ctx context.Context, height int, parts []persist) (interface{}, error) {
+	writes := map[*mongo.Collection][]mongo.WriteModel{}
+	for _, p := range parts {
+		switch p.datatype {
+		case "block", "block_results":
+			col := s.bxs
+			if p.datatype == "block_results" {
+				col = s.brs
+			}
+			m, err := replaceModel(col, height, p.raw)
+			if err != nil {
+				return nil, err
+			}
+			writes[col] = append(writes[col], m)
+		case "transactions":
+			if !dbTxDocs {
+				m, err := replaceModel(s.txs, height, p.raw)
+				if err != nil {
+					return nil, err
+				}
+				writes[s.txs] = append(writes[s.txs], m)
+				continue
+			}
+			models, err := txDocModels(height, p.raw)
+			if err != nil {
+				return nil, err
+			}
+			writes[s.txs] = append(writes[s.txs], models...)
+		default:
+			return nil, fmt.Errorf("unknown datatype %q", p.datatype)
+		}
+	}
+
+	for n := 1; ; n++ {
+		err := s.client.UseSession(context.Background(), func(sc mongo.SessionContext) error {
+			_, err := sc.WithTransaction(sc, func(sc mongo.SessionContext) (interface{}, error) {
+				for col, models := range writes {
+					if _, err := col.BulkWrite(sc, models); err != nil {
+						return nil, err
+					}
+				}
+				return nil, nil
+			})
+			return err
+		})
+		if err == nil {
+			dbOutage.recovered()
+			return height, nil
+		}
+		dbOutage.failed(err)
+		d, rerr := dbRetry.retry(n)
+		if rerr != nil {
+			return nil, fmt.Errorf("error storing height %d in database transaction: %v: %v", height, rerr, err)
+		}
+		stdLogger.Printf("error storing height %d in database transaction (will retry in %s): %v", height, d, err)
+		if err := wait(ctx, d); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// txDocModels returns write models replacing docs of transactions at height with one doc per transaction from raw transactions response (nil deletes them all)
+// each doc is tx_responses element (compressed, if configured) keyed by tx hash (ie, _id), with (api) string height, txhash (also set for rpc responses, that have hash only) and index within block fields
+// docs of transactions previously stored at height, but no longer included (eg, after reorg), are deleted
+func txDocModels(height int, raw []byte) ([]mongo.WriteModel, error) {
+	h := strconv.Itoa(height)
+	var t struct {
+		TxResponses []bson.M `json:"tx_responses"`
+	}
+	if raw != nil {
+		if err := json.Unmarshal(raw, &t); err != nil {
+			return nil, fmt.Errorf("error unmarshalling transactions at height %d: %v", height, err)
+		}
+	}
+	hashes := bson.A{}
+	var models []mongo.WriteModel
+	for i, doc := range t.TxResponses {
+		hash, _ := doc["txhash"].(string)
+		if hash == "" {
+			hash, _ = doc["hash"].(string) // rpc
+		}
+		if hash == "" {
+			return nil, fmt.Errorf("error getting hash of transaction %d at height %d", i, height)
+		}
+		if dbCompression != "" {
+			data, err := json.Marshal(doc)
+			if err != nil {
+				return nil, fmt.Errorf("error marshalling transaction %s at height %d: %v", hash, height, err)
+			}
+			if doc, err = compressedDoc(hash, dbCompression, data); err != nil {
+				return nil, err
+			}
+		}
+		doc["_id"] = hash
+		doc["txhash"] = hash
+		doc["height"] = h
+		doc["index"] = i
+		hashes = append(hashes, hash)
+		models = append(models, mongo.NewReplaceOneModel().SetFilter(bson.M{"_id": hash}).SetReplacement(doc).SetUpsert(true))
+	}
+	return append([]mongo.WriteModel{mongo.NewDeleteManyModel().SetFilter(bson.M{"height": h, "_id": bson.M{"$nin": hashes}})}, models...), nil
+}
+
+// storeBlockResults stores block results into block_results collection
+func (s *mongoStorage) storeBlockResults(ctx context.Context, height int, raw []byte) (interface{}, error) {
+	return height, s.brw.upsert(height, raw)
+}
+
+// lastHeight returns height of the highest block in blocks collection
+// note: heights are stored as strings, so they are converted to be compared numerically, while compressed and oversized blocks' heights are taken from their _id
+func (s *mongoStorage) lastHeight(ctx context.Context) (int, error) {
+	cur, err := s.bxs.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": nil, "height": bson.M{"$max": bson.M{"$toLong": bson.M{"$ifNull": bson.A{"$block.header.height", "$_id"}}}}}}},
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error aggregating blocks: %v", err)
+	}
+	defer cur.Close(ctx)
+	var r struct {
+		Height int64 `bson:"height"`
+	}
+	if !cur.Next(ctx) {
+		return 0, cur.Err()
+	}
+	if err := cur.Decode(&r); err != nil {
+		return 0, fmt.Errorf("error decoding last block height: %v", err)
+	}
+	return int(r.Height), nil
+}
+
+// checkLegacyDocs returns error if any of cols has docs keyed by ObjectId, as stored by versions before docs were keyed by height (or tx hash)
+// such docs would not be replaced when re-processing their heights, but duplicated, and would be mixed with new ones when getting last stored height
+func checkLegacyDocs(ctx context.Context, cols ...*mongo.Collection) error {
+	for _, col := range cols {
+		n, err := col.CountDocuments(ctx, bson.M{"_id": bson.M{"$type": "objectId"}}, options.Count().SetLimit(1))
+		if err != nil {
+			return fmt.Errorf("error checking %s collection for legacy docs: %v", col.Name(), err)
+		}
+		if n > 0 {
+			return fmt.Errorf("%s collection has docs keyed by ObjectId, stored by previous versions: re-scrape into new database (or with cs_db_prefix), or delete them (eg, db.%s.deleteMany({_id: {$type: \"objectId\"}})) and re-scrape their heights", col.Name(), col.Name())
+		}
+	}
+	return nil
+}
+
+// close writes pending docs and disconnects from mongo database
+func (s *mongoStorage) close(ctx context.Context) error {
+	for _, w := range []*bulkWriter{s.bxw, s.txw, s.brw} {
+		w.close()
+	}
+	return s.client.Disconnect(ctx)
+}
+
+// checkStorage warns if storage already has blocks beyond last processed one (eg, if log file was lost or rewound), as they would be stored again
+func checkStorage(ctx context.Context, st storage, last int) {
+	h, err := st.lastHeight(ctx)
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			stdLogger.Printf("warn: error getting last stored block height: %v", err)
+		}
+		return
+	}
+	if h > last {
+		stdLogger.Printf("warn: database already has blocks up to height %d, beyond last processed one %d (is log file missing?): those will be stored again", h, last)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// supplyMetrics are api paths and their response fields of tokenomics metrics, by metric name
+var supplyMetrics = []struct {
+	name, path, field string
+}{
+	{"supply", "/cosmos/bank/v1beta1/supply", "supply"},
+	{"pool", "/cosmos/staking/v1beta1/pool", "pool"},
+	{"inflation", "/cosmos/mint/v1beta1/inflation", "inflation"},
+	{"annual_provisions", "/cosmos/mint/v1beta1/annual_provisions", "annual_provisions"},
+	{"community_pool", "/cosmos/distribution/v1beta1/community_pool", "pool"},
+}
+
+// supplyScraper scrapes total supply, bonded and not bonded tokens, inflation, annual provisions and community pool every interval, until ctx cancelled
+// metrics are stored as time series in supply collection, keyed by height, with scraped_at timestamp
+func supplyScraper(ctx context.Context, bcc bcSource, col *mongo.Collection, interval time.Duration) {
+	periodically(ctx, "supply", interval, func(ctx context.Context) error {
+		h, err := bcHeight(ctx, bcc, bcRetry)
+		if err != nil {
+			return err
+		}
+		doc := map[string]json.RawMessage{}
+		for _, m := range supplyMetrics {
+			v, err := scrapeMetric(ctx, bcc, m.path, m.field, h)
+			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					return err
+				}
+				// modules might be missing on some chains (eg, mint), so don't let them block others
+				stdLogger.Printf("warn: error scraping %s at height %d (skipping): %v", m.name, h, err)
+				continue
+			}
+			doc[m.name] = v
+		}
+		if len(doc) == 0 {
+			return fmt.Errorf("no metrics available at height %d", h)
+		}
+		raw, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		return upsert(ctx, col, h, raw, bson.M{"height": h, "scraped_at": time.Now().UTC()})
+	})
+}
+
+// scrapeMetric returns field of api path response at height h
+// paginated responses (ie, total supply) are followed through all pages
+func scrapeMetric(ctx context.Context, bcc bcSource, path, field string, h int) (json.RawMessage, error) {
+	if path == "/cosmos/bank/v1beta1/supply" {
+		items, err := queryAll(ctx, bcc, path, nil, field, h, bcRetry)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(items)
+	}
+	// note: single attempt, as missing modules would otherwise be retried indefinitely
+	res, err := bcc.query(path, nil, h)
+	if err != nil {
+		return nil, err
+	}
+	var r map[string]json.RawMessage
+	if err := json.Unmarshal(res, &r); err != nil {
+		return nil, fmt.Errorf("error unmarshalling %s - got response:\n%s: %v", path, string(res), err)
+	}
+	v, ok := r[field]
+	if !ok {
+		return nil, fmt.Errorf("no %s in %s - got response:\n%s", field, path, string(res))
+	}
+	return v, nil
+}
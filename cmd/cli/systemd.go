@@ -0,0 +1,92 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// sdNotify sends state (eg, "READY=1") to systemd, if running as its notify service (ie, with NOTIFY_SOCKET set), and returns false if not
+// ref: https://www.freedesktop.org/software/systemd/man/sd_notify.html
+func sdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// abstract namespace socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("error connecting to systemd notify socket: %v", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("error notifying systemd: %v", err)
+	}
+	return true, nil
+}
+
+// sdWatchdogInterval returns interval to ping systemd watchdog at (ie, half of its timeout), or 0 if watchdog is not enabled for this process
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// sdWatchdog pings systemd watchdog, if enabled, and reports progress as service status, until ctx cancelled
+// pings are skipped while scraping is stalled (as per stall watchdog), so systemd restarts stuck scraper
+func sdWatchdog(ctx context.Context, pg *progress) {
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	stdLogger.Printf("pinging systemd watchdog every %s", interval)
+	for {
+		state := "WATCHDOG=1\n"
+		if atomic.LoadInt32(&stalled) == 1 {
+			state = ""
+		}
+		s := pg.sample()
+		if _, err := sdNotify(fmt.Sprintf("%sSTATUS=height %d of %d", state, s.watermark, s.head)); err != nil {
+			stdLogger.Printf("warn: %v", err)
+		}
+		if err := wait(ctx, interval); err != nil {
+			return
+		}
+	}
+}
+
+// writePIDFile writes process id to file
+func writePIDFile(file string) error {
+	if err := os.WriteFile(file, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644); err != nil {
+		return fmt.Errorf("error writing pid file %s: %v", file, err)
+	}
+	return nil
+}
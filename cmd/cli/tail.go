@@ -0,0 +1,145 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// tailArgs parses tail command args (ie, [--from H] [--raw] [--interval D]), where 0 height defaults to the one after the highest stored
+func tailArgs(args []string) (from int, raw bool, interval time.Duration, err error) {
+	fs := flag.NewFlagSet("tail", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.IntVar(&from, "from", 0, "first height to print (default: next to be stored)")
+	fs.BoolVar(&raw, "raw", false, "print complete block json")
+	fs.DurationVar(&interval, "interval", time.Second, "database polling interval")
+	if err := fs.Parse(args); err != nil {
+		return 0, false, 0, err
+	}
+	if fs.NArg() > 0 {
+		return 0, false, 0, fmt.Errorf("unexpected arguments: %v", fs.Args())
+	}
+	if from < 0 || interval <= 0 {
+		return 0, false, 0, fmt.Errorf("invalid height %d or interval %s", from, interval)
+	}
+	return from, raw, interval, nil
+}
+
+// tailBlocks writes line for each block newly stored in database, from height from, to w, polling database every interval, until ctx cancelled
+// line has block's height, time, number of transactions and hash, or is its complete json, if raw is set
+// as blocks are stored concurrently (ie, out of order), heights within window of workers below the highest printed one are checked again, so late ones are printed too
+func tailBlocks(ctx context.Context, w io.Writer, from int, raw bool, interval time.Duration) error {
+	if dbType != "mongo" {
+		return fmt.Errorf("tail requires mongo database")
+	}
+	dbc, bxs, _, _ := initDB(ctx, dbHost, dbPort, dbUser, dbPass, dbRetry)
+	defer dbc.Disconnect(context.Background())
+
+	if from == 0 {
+		_, hi, err := storedRange(ctx, bxs)
+		if err != nil {
+			return err
+		}
+		from = hi + 1
+	}
+	stdLogger.Printf("tailing blocks stored from height %d...", from)
+
+	window := 2 * (maxReqWorkers + maxPerWorkers)
+	highest := from - 1
+	printed := map[int]bool{}
+	poll := func(ctx context.Context) error {
+		low := highest - window
+		if low < from-1 {
+			low = from - 1
+		}
+		for h := range printed {
+			if h <= low {
+				delete(printed, h)
+			}
+		}
+		cur, err := bxs.Find(ctx, bson.M{"_id": bson.M{"$type": "number", "$gt": low}}, options.Find().SetSort(bson.M{"_id": 1}).SetLimit(int64(window+1000)))
+		if err != nil {
+			return fmt.Errorf("error finding blocks: %v", err)
+		}
+		defer cur.Close(ctx)
+		for cur.Next(ctx) {
+			var d struct {
+				ID int `bson:"_id"`
+			}
+			if err := cur.Decode(&d); err != nil {
+				return fmt.Errorf("error decoding block height: %v", err)
+			}
+			if printed[d.ID] {
+				continue
+			}
+			blk, err := docJSON(bxs, cur.Current)
+			if err != nil {
+				return fmt.Errorf("error reading block at height %d: %v", d.ID, err)
+			}
+			line := string(blk)
+			if !raw {
+				line = blockLine(d.ID, blk)
+			}
+			if _, err := fmt.Fprintln(w, line); err != nil {
+				return err
+			}
+			printed[d.ID] = true
+			if d.ID > highest {
+				highest = d.ID
+			}
+		}
+		return cur.Err()
+	}
+	for {
+		if err := poll(ctx); err != nil {
+			if errors.Is(err, context.Canceled) || ctx.Err() != nil {
+				return nil
+			}
+			stdLogger.Printf("error tailing blocks (will retry in %s): %v", interval, err)
+		}
+		if err := wait(ctx, interval); err != nil {
+			return nil
+		}
+	}
+}
+
+// blockLine returns concise line describing raw block at height: its time, number of transactions and hash
+func blockLine(height int, raw []byte) string {
+	var b struct {
+		BlockID struct {
+			Hash string `json:"hash"`
+		} `json:"block_id"`
+		Block struct {
+			Header struct {
+				Time string `json:"time"`
+			} `json:"header"`
+		} `json:"block"`
+	}
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return fmt.Sprintf("%d (error unmarshalling block: %v)", height, err)
+	}
+	return fmt.Sprintf("%d %s txs=%d hash=%s", height, b.Block.Header.Time, numTxs(raw), b.BlockID.Hash)
+}
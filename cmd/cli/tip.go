@@ -0,0 +1,92 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// tipPipeline scrapes heights from its first one up to chain head, and then newly produced ones, with its own requests workers, concurrently with historical backfill
+// scraped heights are sent to the same persisters as backfill's ones
+type tipPipeline struct {
+	from    int // first height scraped by tip pipeline
+	reqChan chan request
+	cancel  context.CancelFunc
+	next    chan int // next height to queue, sent once queuing stopped
+	wg      sync.WaitGroup
+}
+
+// startTip starts tip pipeline scraping heights from up to head, and newly produced ones, as per heads (if not nil) or polling bcc every napTime, until stopped or ctx cancelled
+// it runs n requests workers, each running work on pipeline's requests channel, and calls onHead with each new head (less head lag)
+func startTip(ctx context.Context, pz *pauser, bcc bcSource, from, head, n int, work func(<-chan request), heads <-chan int, onHead func(int)) *tipPipeline {
+	tctx, cancel := context.WithCancel(ctx)
+	t := &tipPipeline{from: from, reqChan: make(chan request, n), cancel: cancel, next: make(chan int, 1)}
+	for i := 0; i < n; i++ {
+		t.wg.Add(1)
+		go func() {
+			defer t.wg.Done()
+			work(t.reqChan)
+		}()
+	}
+	go func() {
+		next := from
+		defer func() { t.next <- next }()
+		for tctx.Err() == nil {
+			for tctx.Err() == nil && next <= head {
+				pz.wait(tctx)
+				select {
+				case <-tctx.Done():
+				case t.reqChan <- request{height: next}:
+					next++
+				}
+			}
+			select {
+			case <-tctx.Done():
+			case h := <-heads:
+				if h -= headLag; h > head {
+					head = h
+					onHead(head)
+				}
+			case <-time.After(nap()):
+				h, err := bcHeight(tctx, bcc, bcRetry)
+				if err != nil {
+					if !errors.Is(err, context.Canceled) {
+						stdLogger.Printf("error getting current blockchain height for tip pipeline (will retry in %s): %v", nap(), err)
+					}
+					continue
+				}
+				if h -= headLag; h > head {
+					head = h
+					onHead(head)
+				}
+			}
+		}
+	}()
+	return t
+}
+
+// stop stops queuing new heights and waits for workers to finish in-flight ones (ie, to send them to persisters), and returns the next height tip pipeline would have queued
+func (t *tipPipeline) stop() int {
+	t.cancel()
+	next := <-t.next
+	close(t.reqChan)
+	t.wg.Wait()
+	return next
+}
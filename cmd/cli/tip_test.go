@@ -0,0 +1,121 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tipRecorder records heights received by tip pipeline workers, which block until released
+type tipRecorder struct {
+	mu      sync.Mutex
+	heights []int
+	release chan struct{}
+}
+
+func (r *tipRecorder) work(ch <-chan request) {
+	for req := range ch {
+		r.mu.Lock()
+		r.heights = append(r.heights, req.height)
+		r.mu.Unlock()
+		<-r.release
+	}
+}
+
+func (r *tipRecorder) received() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	h := append([]int(nil), r.heights...)
+	sort.Ints(h)
+	return h
+}
+
+// waitFor polls cond until it's true, failing test after a while
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for start := time.Now(); !cond(); time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestTipStopWhileBlocked(t *testing.T) {
+	for _, parent := range []bool{false, true} {
+		name := "stop"
+		if parent {
+			name = "parent context cancelled"
+		}
+		t.Run(name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r := &tipRecorder{release: make(chan struct{})}
+			const workers = 2
+			tip := startTip(ctx, &pauser{}, nil, 100, 200, workers, r.work, nil, func(int) {})
+
+			// each worker holds one height and the channel is full, so queuing is blocked on sending the next one
+			waitFor(t, "blocked queuing", func() bool { return len(r.received()) == workers && len(tip.reqChan) == workers })
+			if parent {
+				cancel()
+			}
+			next := make(chan int)
+			go func() { next <- tip.stop() }()
+			time.Sleep(10 * time.Millisecond) // let stop cancel queuing while workers are still busy
+			close(r.release)
+
+			want := 100 + 2*workers
+			if got := <-next; got != want {
+				t.Fatalf("stop returned next height %d, want %d", got, want)
+			}
+			// all heights below the next one are processed exactly once, so backfill can continue from it
+			if got, want := r.received(), []int{100, 101, 102, 103}; !reflect.DeepEqual(got, want) {
+				t.Errorf("processed heights %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTipFollowsHeads(t *testing.T) {
+	r := &tipRecorder{release: make(chan struct{})}
+	close(r.release)
+	heads := make(chan int)
+	var mu sync.Mutex
+	var seen []int
+	tip := startTip(context.Background(), &pauser{}, nil, 100, 101, 1, r.work, heads, func(h int) {
+		mu.Lock()
+		seen = append(seen, h)
+		mu.Unlock()
+	})
+	waitFor(t, "initial heights", func() bool { return len(r.received()) == 2 })
+	heads <- 100 // not above head
+	heads <- 104
+	waitFor(t, "new heights", func() bool { return len(r.received()) == 5 })
+	if next := tip.stop(); next != 105 {
+		t.Errorf("stop returned next height %d, want 105", next)
+	}
+	if got, want := r.received(), []int{100, 101, 102, 103, 104}; !reflect.DeepEqual(got, want) {
+		t.Errorf("processed heights %v, want %v", got, want)
+	}
+	if want := []int{104}; !reflect.DeepEqual(seen, want) {
+		t.Errorf("got heads %v, want %v", seen, want)
+	}
+}
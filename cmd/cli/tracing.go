@@ -0,0 +1,279 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// otlp span kinds
+// ref: https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+const (
+	spanInternal = 1
+	spanClient   = 3
+)
+
+// tracer exports spans of heights' journey (fetching block, block results and transactions, queuing and persisting them) to opentelemetry collector, using otlp/http with json encoding
+// spans are exported in batches, in background, and are dropped (rather than slowing scraping down) if collector can't keep up
+// ref: https://opentelemetry.io/docs/specs/otlp/#otlphttp
+type tracer struct {
+	url      string
+	sample   float64 // fraction of heights traced
+	resource []otlpAttr
+	client   *http.Client
+	spans    chan *span
+	done     chan struct{}
+	dropped  int64
+}
+
+// span is a single timed operation, part of a trace
+// all span methods are no-ops on nil span (ie, if tracing is disabled or height is not sampled)
+type span struct {
+	tr      *tracer
+	traceID [16]byte
+	id      [8]byte
+	parent  [8]byte // zero for root span
+	name    string
+	kind    int
+	start   time.Time
+	end     time.Time
+	attrs   []otlpAttr
+	err     error
+}
+
+// newTracer returns tracer exporting spans of sampled fraction of heights to collector's otlp/http endpoint
+func newTracer(endpoint string, sample float64) *tracer {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	t := &tracer{
+		url:    url,
+		sample: sample,
+		resource: []otlpAttr{
+			attr("service.name", "cosmos-scraper"),
+			attr("service.version", version),
+			attr("service.instance.id", instanceID()),
+		},
+		client: &http.Client{Timeout: 10 * time.Second},
+		spans:  make(chan *span, 4096),
+		done:   make(chan struct{}),
+	}
+	go t.run(512, 5*time.Second)
+	stdLogger.Printf("exporting heights traces to %s (sampling ratio: %g)", url, sample)
+	return t
+}
+
+// root starts new trace with root span name, unless tracer is nil or trace is not sampled, in which case it returns nil
+func (t *tracer) root(name string) *span {
+	if t == nil || (t.sample < 1 && mrand.Float64() >= t.sample) {
+		return nil
+	}
+	s := &span{tr: t, name: name, kind: spanInternal, start: time.Now()}
+	_, _ = rand.Read(s.traceID[:])
+	_, _ = rand.Read(s.id[:])
+	return s
+}
+
+// child starts new span name of kind, as child of s
+func (s *span) child(name string, kind int) *span {
+	return s.childAt(name, kind, time.Now())
+}
+
+// childAt starts new span name of kind at start time, as child of s
+func (s *span) childAt(name string, kind int, start time.Time) *span {
+	if s == nil {
+		return nil
+	}
+	c := &span{tr: s.tr, traceID: s.traceID, parent: s.id, name: name, kind: kind, start: start}
+	_, _ = rand.Read(c.id[:])
+	return c
+}
+
+// set sets span attribute key to value (string, int, bool or float64)
+func (s *span) set(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, attr(key, value))
+}
+
+// finish ends span, with error status if err is not nil, and queues it for export
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.err = err
+	select {
+	case s.tr.spans <- s:
+	default:
+		atomic.AddInt64(&s.tr.dropped, 1)
+	}
+}
+
+// run exports finished spans in batches of up to size, at least every interval, until tracer is closed
+func (t *tracer) run(size int, interval time.Duration) {
+	defer close(t.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var batch []*span
+	for {
+		select {
+		case s, ok := <-t.spans:
+			if !ok {
+				t.export(batch)
+				return
+			}
+			if batch = append(batch, s); len(batch) < size {
+				continue
+			}
+		case <-ticker.C:
+		}
+		t.export(batch)
+		batch = nil
+		if n := atomic.SwapInt64(&t.dropped, 0); n > 0 {
+			stdLogger.Printf("warn: dropped %d spans (export queue full)", n)
+		}
+	}
+}
+
+// close exports remaining spans and stops tracer
+func (t *tracer) close() {
+	close(t.spans)
+	<-t.done
+}
+
+// export sends spans to collector, dropping them on error
+func (t *tracer) export(spans []*span) {
+	if len(spans) == 0 {
+		return
+	}
+	var req otlpRequest
+	rs := otlpResourceSpans{Resource: otlpResource{Attributes: t.resource}}
+	ss := otlpScopeSpans{Scope: otlpScope{Name: "cosmos-scraper", Version: version}}
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Attributes:        s.attrs,
+		}
+		if s.parent != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parent[:])
+		}
+		if s.err != nil {
+			o.Status = &otlpStatus{Code: 2, Message: s.err.Error()}
+		}
+		ss.Spans = append(ss.Spans, o)
+	}
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	req.ResourceSpans = []otlpResourceSpans{rs}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		stdLogger.Printf("warn: error encoding %d spans (dropping them): %v", len(spans), err)
+		return
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		stdLogger.Printf("warn: error exporting %d spans (dropping them): %v", len(spans), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		stdLogger.Printf("warn: error exporting %d spans (dropping them): %s", len(spans), resp.Status)
+	}
+}
+
+// otlp/json trace export request
+// ref: https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/collector/trace/v1/trace_service.proto
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttr `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type otlpSpan struct {
+	TraceID           string      `json:"traceId"`
+	SpanID            string      `json:"spanId"`
+	ParentSpanID      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []otlpAttr  `json:"attributes,omitempty"`
+	Status            *otlpStatus `json:"status,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 is error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttr struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+// attr returns otlp attribute key with value, encoded as per its type
+func attr(key string, value interface{}) otlpAttr {
+	var v map[string]interface{}
+	switch x := value.(type) {
+	case string:
+		v = map[string]interface{}{"stringValue": x}
+	case int:
+		v = map[string]interface{}{"intValue": strconv.Itoa(x)} // 64-bit ints are encoded as strings
+	case bool:
+		v = map[string]interface{}{"boolValue": x}
+	case float64:
+		v = map[string]interface{}{"doubleValue": x}
+	default:
+		v = map[string]interface{}{"stringValue": fmt.Sprint(x)}
+	}
+	return otlpAttr{Key: key, Value: v}
+}
@@ -0,0 +1,178 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// otlpCollector starts otlp/http collector mock, returning received trace export requests (as generic json)
+func otlpCollector(t *testing.T) (url string, requests func() []map[string]interface{}) {
+	var mu sync.Mutex
+	var reqs []map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/otlp/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			http.Error(w, "unsupported request", http.StatusUnsupportedMediaType)
+			return
+		}
+		var req map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		reqs = append(reqs, req)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, func() []map[string]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]map[string]interface{}(nil), reqs...)
+	}
+}
+
+// otlpAttrs returns otlp/json attributes as map of key to (single) typed value
+func otlpAttrs(t *testing.T, attrs interface{}) map[string]map[string]interface{} {
+	t.Helper()
+	m := map[string]map[string]interface{}{}
+	list, _ := attrs.([]interface{})
+	for _, a := range list {
+		a := a.(map[string]interface{})
+		value, _ := a["value"].(map[string]interface{})
+		if len(value) != 1 {
+			t.Errorf("attribute %v: want single typed value", a)
+		}
+		m[a["key"].(string)] = value
+	}
+	return m
+}
+
+func TestTracerExport(t *testing.T) {
+	url, requests := otlpCollector(t)
+	tr := newTracer(url+"/otlp/", 1)
+
+	root := tr.root("height")
+	root.set("height", 42)
+	fetch := root.child("fetch block", spanClient)
+	fetch.set("endpoint", "rpc")
+	fetch.set("cached", false)
+	fetch.set("size_mb", 0.5)
+	fetch.set("protocol", errors.New("grpc"))
+	fetch.finish(errors.New("429 Too Many Requests"))
+	root.finish(nil)
+	tr.close()
+
+	reqs := requests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d export requests, want 1", len(reqs))
+	}
+	rss := reqs[0]["resourceSpans"].([]interface{})
+	if len(rss) != 1 {
+		t.Fatalf("got %d resource spans, want 1", len(rss))
+	}
+	rs := rss[0].(map[string]interface{})
+	resource := otlpAttrs(t, rs["resource"].(map[string]interface{})["attributes"])
+	if resource["service.name"]["stringValue"] != "cosmos-scraper" || resource["service.instance.id"]["stringValue"] != instanceID() {
+		t.Errorf("got resource attributes %v, want service name and instance id", resource)
+	}
+	ss := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})
+	if scope := ss["scope"].(map[string]interface{}); scope["name"] != "cosmos-scraper" {
+		t.Errorf("got scope %v, want cosmos-scraper", scope)
+	}
+	spans := ss["spans"].([]interface{})
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2", len(spans))
+	}
+
+	// ids are hex-encoded (not base64, as with protojson), and times are decimal strings (as 64-bit ints)
+	traceID, spanID, nanos := regexp.MustCompile(`^[0-9a-f]{32}$`), regexp.MustCompile(`^[0-9a-f]{16}$`), regexp.MustCompile(`^[0-9]+$`)
+	bySpan := map[string]map[string]interface{}{}
+	for _, s := range spans {
+		s := s.(map[string]interface{})
+		bySpan[s["name"].(string)] = s
+		id, _ := s["spanId"].(string)
+		tid, _ := s["traceId"].(string)
+		start, _ := s["startTimeUnixNano"].(string)
+		end, _ := s["endTimeUnixNano"].(string)
+		if !traceID.MatchString(tid) || !spanID.MatchString(id) || !nanos.MatchString(start) || !nanos.MatchString(end) {
+			t.Errorf("span %s: malformed ids or times: %v", s["name"], s)
+		}
+		startNano, _ := strconv.ParseInt(start, 10, 64)
+		endNano, _ := strconv.ParseInt(end, 10, 64)
+		if startNano == 0 || endNano < startNano {
+			t.Errorf("span %s: got [%d..%d] times, want non-zero start before end", s["name"], startNano, endNano)
+		}
+	}
+	r, f := bySpan["height"], bySpan["fetch block"]
+	if r == nil || f == nil {
+		t.Fatalf("got spans %v, want height and fetch block", spans)
+	}
+	if _, ok := r["parentSpanId"]; ok || r["kind"] != 1.0 || r["status"] != nil {
+		t.Errorf("got root span %v, want internal span without parent and status", r)
+	}
+	if f["traceId"] != r["traceId"] || f["parentSpanId"] != r["spanId"] || f["kind"] != 3.0 {
+		t.Errorf("got child span %v, want client span of root's trace with root as parent", f)
+	}
+	if status, _ := f["status"].(map[string]interface{}); status["code"] != 2.0 || status["message"] != "429 Too Many Requests" {
+		t.Errorf("got child span status %v, want error with message", f["status"])
+	}
+	if attrs := otlpAttrs(t, r["attributes"]); attrs["height"]["intValue"] != "42" {
+		t.Errorf("got root attributes %v, want height as string-encoded int", attrs)
+	}
+	want := map[string]map[string]interface{}{
+		"endpoint": {"stringValue": "rpc"},
+		"cached":   {"boolValue": false},
+		"size_mb":  {"doubleValue": 0.5},
+		"protocol": {"stringValue": "grpc"},
+	}
+	if attrs := otlpAttrs(t, f["attributes"]); !reflect.DeepEqual(attrs, want) {
+		t.Errorf("got child attributes %v, want %v", attrs, want)
+	}
+}
+
+func TestTracerSampling(t *testing.T) {
+	var tr *tracer
+	if s := tr.root("height"); s != nil {
+		t.Error("got span from disabled tracer")
+	}
+	url, requests := otlpCollector(t)
+	tr = newTracer(url+"/otlp/v1/traces", 0)
+	s := tr.root("height")
+	if s != nil {
+		t.Error("got span from tracer with zero sampling ratio")
+	}
+	// spans of unsampled heights are no-ops
+	c := s.child("fetch block", spanClient)
+	c.set("endpoint", "rpc")
+	c.finish(nil)
+	s.finish(nil)
+	tr.close()
+	if reqs := requests(); len(reqs) != 0 {
+		t.Errorf("got %d export requests, want none", len(reqs))
+	}
+}
@@ -0,0 +1,314 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	tuiInterval   = 1 * time.Second // screen refresh interval
+	tuiWindow     = 10              // number of samples (ie, refresh intervals) throughput is averaged over
+	tuiMaxWorkers = 8               // max workers' activities shown per role (longest running first)
+	tuiMaxErrors  = 5               // max recent errors shown
+)
+
+// console is where stdout logging goes to: stdout, or terminal ui while it's running
+var console = &consoleWriter{w: os.Stdout}
+
+// consoleWriter writes to w, that can be switched
+type consoleWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (c *consoleWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.w.Write(p)
+}
+
+// set switches writer to w and returns previous one
+func (c *consoleWriter) set(w io.Writer) io.Writer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	prev := c.w
+	c.w = w
+	return prev
+}
+
+// recentLog keeps the last log record and the last tuiMaxErrors errors (and warnings) written to it
+type recentLog struct {
+	mu     sync.Mutex
+	last   string
+	errors []string
+}
+
+func (l *recentLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimSpace(string(p)), "\n") {
+		l.last = line
+		if s := strings.ToLower(line); strings.Contains(s, "error") || strings.Contains(s, "warn") {
+			if l.errors = append(l.errors, line); len(l.errors) > tuiMaxErrors {
+				l.errors = l.errors[1:]
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// activities tracks what running workers are doing
+type activities struct {
+	mu  sync.Mutex
+	ids map[string]int // last id assigned, by role
+	all map[*activity]bool
+}
+
+// workerActivities are activities of requests and persists workers, tracked only if terminal ui is enabled
+var workerActivities = &activities{ids: map[string]int{}, all: map[*activity]bool{}}
+
+// activity is what single worker is doing
+type activity struct {
+	as   *activities
+	role string
+	id   int
+
+	mu     sync.Mutex
+	doing  string // empty if idle
+	height int
+	since  time.Time
+}
+
+// track returns activity of new worker with role, or nil if terminal ui is disabled
+func (as *activities) track(role string) *activity {
+	if !tui {
+		return nil
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	as.ids[role]++
+	a := &activity{as: as, role: role, id: as.ids[role], since: time.Now()}
+	as.all[a] = true
+	return a
+}
+
+// set records that worker started doing something at height
+func (a *activity) set(doing string, height int) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.doing, a.height, a.since = doing, height, time.Now()
+}
+
+// idle records that worker is waiting for work
+func (a *activity) idle() {
+	a.set("", 0)
+}
+
+// done stops tracking activity of (stopped) worker
+func (a *activity) done() {
+	if a == nil {
+		return
+	}
+	a.as.mu.Lock()
+	defer a.as.mu.Unlock()
+	delete(a.as.all, a)
+}
+
+// activityState is snapshot of worker's activity
+type activityState struct {
+	role   string
+	id     int
+	doing  string
+	height int
+	since  time.Time
+}
+
+// snapshot returns current activities of workers with role, busy ones first (longest running first), and then idle ones
+func (as *activities) snapshot(role string) []activityState {
+	as.mu.Lock()
+	var ss []activityState
+	for a := range as.all {
+		if a.role != role {
+			continue
+		}
+		a.mu.Lock()
+		ss = append(ss, activityState{role: a.role, id: a.id, doing: a.doing, height: a.height, since: a.since})
+		a.mu.Unlock()
+	}
+	as.mu.Unlock()
+	sort.Slice(ss, func(i, j int) bool {
+		if bi, bj := ss[i].doing != "", ss[j].doing != ""; bi != bj {
+			return bi
+		}
+		if !ss[i].since.Equal(ss[j].since) {
+			return ss[i].since.Before(ss[j].since)
+		}
+		return ss[i].id < ss[j].id
+	})
+	return ss
+}
+
+// runTUI shows interactive terminal ui, refreshed every tuiInterval, until ctx cancelled
+// while it's running, stdout logging is shown only as the last record and recent errors
+// if stdout is not a terminal, ui is not shown and stdout logging is kept
+func runTUI(ctx context.Context, pg *progress, pz *pauser, queues func() (int, int)) {
+	if fi, err := os.Stdout.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		stdLogger.Println("warn: stdout is not a terminal: not showing terminal ui")
+		return
+	}
+	rl := &recentLog{}
+	prev := console.set(rl)
+	defer func() {
+		console.set(prev)
+		// leave the last screen as it is, with subsequent stdout logging below it
+		fmt.Fprintln(os.Stdout)
+	}()
+
+	started := time.Now()
+	first := pg.sample()
+	window := []progressSample{first}
+	t := time.NewTicker(tuiInterval)
+	defer t.Stop()
+	draw := func() {
+		fmt.Fprint(os.Stdout, "\033[H\033[2J"+renderTUI(first, window, started, pz.paused(), queues, rl))
+	}
+	for {
+		draw()
+		select {
+		case <-ctx.Done():
+			// show stop request
+			draw()
+			return
+		case <-t.C:
+		}
+		if window = append(window, pg.sample()); len(window) > tuiWindow+1 {
+			window = window[1:]
+		}
+	}
+}
+
+// renderTUI returns screen contents, with progress since first sample, throughput over window of samples, workers' activities and recent log
+func renderTUI(first progressSample, window []progressSample, started time.Time, paused bool, queues func() (int, int), rl *recentLog) string {
+	width := 80
+	if c, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && c > 20 {
+		width = c
+	}
+	var b strings.Builder
+	line := func(format string, a ...interface{}) {
+		s := fmt.Sprintf(format, a...)
+		if len(s) > width {
+			s = s[:width]
+		}
+		b.WriteString(s + "\n")
+	}
+
+	s, o := window[len(window)-1], window[0]
+	state := "scraping"
+	switch {
+	case atomic.LoadInt32(&stalled) == 1:
+		state = "stalled"
+	case paused:
+		state = "paused"
+	}
+	line("cosmos-scraper %s - %s for %s (ctrl-c to stop)", version, state, time.Since(started).Round(time.Second))
+	line("")
+
+	remaining := s.head - s.watermark
+	if remaining < 0 {
+		remaining = 0
+	}
+	done := 1.0
+	if total := s.head - first.watermark; total > 0 && remaining > 0 {
+		done = float64(s.watermark-first.watermark) / float64(total)
+	}
+	bar := width - 10
+	if bar > 60 {
+		bar = 60
+	}
+	filled := int(done * float64(bar))
+	line("[%s%s] %5.1f%%", strings.Repeat("#", filled), strings.Repeat("-", bar-filled), done*100)
+	line("height %d of %d (%d remaining)", s.watermark, s.head, remaining)
+
+	eta := "unknown (not catching up)"
+	var blocks, txs float64
+	if secs := s.at.Sub(o.at).Seconds(); secs > 0 {
+		blocks = float64(s.blocks-o.blocks) / secs
+		txs = float64(s.txs-o.txs) / secs
+		produced := 0
+		if o.head > 0 {
+			produced = s.head - o.head
+		}
+		if net := float64(s.watermark-o.watermark-produced) / secs; remaining == 0 {
+			eta = "caught up"
+		} else if net > 0 {
+			eta = time.Duration(float64(remaining) / net * float64(time.Second)).Round(time.Second).String()
+		}
+	}
+	line("throughput %.1f blocks/s, %.1f txs/s, eta %s", blocks, txs, eta)
+	line("stored since start: %d blocks, %d txs", s.blocks, s.txs)
+	req, per := queues()
+	line("queued: %d for requesters, %d for persisters", req, per)
+
+	for _, role := range []string{"requester", "persister"} {
+		ss := workerActivities.snapshot(role)
+		busy := 0
+		for _, a := range ss {
+			if a.doing != "" {
+				busy++
+			}
+		}
+		line("")
+		line("%ss: %d of %d busy", role, busy, len(ss))
+		for i, a := range ss {
+			if a.doing == "" {
+				break
+			}
+			if i == tuiMaxWorkers {
+				line("  ... and %d more", busy-i)
+				break
+			}
+			line("  #%-4d %s at %d (%s)", a.id, a.doing, a.height, time.Since(a.since).Round(100*time.Millisecond))
+		}
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	line("")
+	line("recent errors:")
+	if len(rl.errors) == 0 {
+		line("  none")
+	}
+	for _, e := range rl.errors {
+		line("  %s", e)
+	}
+	line("")
+	line("last log: %s", rl.last)
+	return b.String()
+}
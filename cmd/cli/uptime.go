@@ -0,0 +1,127 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// uptime tracks validators' signed and missed blocks from last commit signatures included in each block
+// signatures are stored per committed height in commit_signatures collection, and validator_uptime collection keeps per-validator totals, keyed by (hex) consensus address
+// totals are only updated when height's signatures are stored for the first time, so re-scraping the same height doesn't count it twice
+type uptime struct {
+	commits    *mongo.Collection
+	validators *mongo.Collection
+}
+
+// newUptime returns uptime storing data into db
+func newUptime(db *mongo.Database) *uptime {
+	return &uptime{commits: collection(db, "commit_signatures"), validators: collection(db, "validator_uptime")}
+}
+
+// track records last commit signatures from raw block
+func (u *uptime) track(ctx context.Context, raw []byte) error {
+	var b struct {
+		Block struct {
+			LastCommit struct {
+				Height     string `json:"height"`
+				Signatures []struct {
+					BlockIDFlag      json.RawMessage `json:"block_id_flag"` // number (rpc) or enum name (rest and grpc)
+					ValidatorAddress string          `json:"validator_address"`
+				} `json:"signatures"`
+			} `json:"last_commit"`
+		} `json:"block"`
+	}
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return fmt.Errorf("error unmarshalling block: %v", err)
+	}
+	h, err := strconv.Atoi(b.Block.LastCommit.Height)
+	if err != nil || h == 0 {
+		return nil // eg, first block has no last commit
+	}
+
+	signed, missed := []string{}, []string{}
+	for _, s := range b.Block.LastCommit.Signatures {
+		addr := fmt.Sprintf("%X", decodeHash(s.ValidatorAddress))
+		switch flag := string(s.BlockIDFlag); flag {
+		case "2", `"BLOCK_ID_FLAG_COMMIT"`, "3", `"BLOCK_ID_FLAG_NIL"`:
+			signed = append(signed, addr)
+		case "1", `"BLOCK_ID_FLAG_ABSENT"`:
+			missed = append(missed, addr)
+		}
+	}
+
+	res, err := u.commits.UpdateOne(ctx, bson.M{"_id": h}, bson.M{"$setOnInsert": bson.M{"signed": signed, "missed": missed}}, options.Update().SetUpsert(true))
+	if err != nil {
+		return fmt.Errorf("error storing commit signatures at height %d: %v", h, err)
+	}
+	if res.UpsertedCount == 0 {
+		return nil // already counted
+	}
+
+	now := time.Now().UTC()
+	for _, v := range []struct {
+		addrs []string
+		field string
+	}{{signed, "signed"}, {missed, "missed"}} {
+		for _, addr := range v.addrs {
+			update := bson.M{
+				"$inc": bson.M{v.field: 1},
+				"$max": bson.M{"last_" + v.field + "_height": h},
+				"$set": bson.M{"updated_at": now},
+			}
+			if err := updateWithRetry(ctx, u.validators, addr, update); err != nil {
+				return fmt.Errorf("error updating uptime of validator %s at height %d: %v", addr, h, err)
+			}
+		}
+	}
+	return nil
+}
+
+// signingInfoScraper stores validators' slashing signing infos (ie, missed blocks counters, jailing and tombstoning) every interval, until ctx cancelled
+// data is stored in signing_infos collection, keyed by validator consensus address, and updated with the latest values
+func signingInfoScraper(ctx context.Context, bcc bcSource, col *mongo.Collection, interval time.Duration) {
+	periodically(ctx, "signing infos", interval, func(ctx context.Context) error {
+		h, err := bcHeight(ctx, bcc, bcRetry)
+		if err != nil {
+			return err
+		}
+		infos, err := queryAll(ctx, bcc, "/cosmos/slashing/v1beta1/signing_infos", nil, "info", h, bcRetry)
+		if err != nil {
+			return err
+		}
+		extra := bson.M{"scraped_height": h, "scraped_at": time.Now().UTC()}
+		for _, raw := range infos {
+			addr, err := jsonID("address")(raw)
+			if err != nil {
+				return fmt.Errorf("error unmarshalling signing info %s: %v", string(raw), err)
+			}
+			if err := upsert(ctx, col, addr, raw, extra); err != nil {
+				return fmt.Errorf("error storing signing info %s: %v", addr, err)
+			}
+		}
+		return nil
+	})
+}
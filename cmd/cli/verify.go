@@ -0,0 +1,367 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// errInvalidBlock is returned by verifier for blocks failing verification
+var errInvalidBlock = errors.New("block verification failed")
+
+// verifier verifies scraped blocks following tendermint light client rules, using signed headers and validator sets from tendermint rpc:
+// block id must match signed header's hash, validator set must match header's validators hash and more than 2/3 of its voting power must have signed the commit
+// also, if previous height was verified, header's validators hash must match previous header's next validators hash (ie, sequential verification)
+// note: trust is anchored at the first verified height (ie, trust on first use) and only ed25519 validator keys are supported
+// ref: https://github.com/tendermint/spec/blob/master/spec/light-client/verification/verification_001_published.md
+type verifier struct {
+	rsc bcSource
+
+	mu       sync.Mutex
+	nextVals map[int][]byte // next validators hash of recently verified heights
+}
+
+// newVerifier returns verifier using tendermint rpc source rsc
+func newVerifier(rsc bcSource) *verifier {
+	return &verifier{rsc: rsc, nextVals: map[int][]byte{}}
+}
+
+// rpcHeader is tendermint block header as returned by rpc
+type rpcHeader struct {
+	Version struct {
+		Block string `json:"block"`
+		App   string `json:"app"`
+	} `json:"version"`
+	ChainID            string     `json:"chain_id"`
+	Height             string     `json:"height"`
+	Time               time.Time  `json:"time"`
+	LastBlockID        rpcBlockID `json:"last_block_id"`
+	LastCommitHash     string     `json:"last_commit_hash"`
+	DataHash           string     `json:"data_hash"`
+	ValidatorsHash     string     `json:"validators_hash"`
+	NextValidatorsHash string     `json:"next_validators_hash"`
+	ConsensusHash      string     `json:"consensus_hash"`
+	AppHash            string     `json:"app_hash"`
+	LastResultsHash    string     `json:"last_results_hash"`
+	EvidenceHash       string     `json:"evidence_hash"`
+	ProposerAddress    string     `json:"proposer_address"`
+}
+
+// rpcBlockID is tendermint block id as returned by rpc
+type rpcBlockID struct {
+	Hash  string `json:"hash"`
+	Parts struct {
+		Total int    `json:"total"`
+		Hash  string `json:"hash"`
+	} `json:"parts"`
+}
+
+// verify verifies block at height h given as raw json (as returned by bcSource), wrapping errInvalidBlock if verification fails
+func (v *verifier) verify(ctx context.Context, raw []byte, h int) error {
+	var b struct {
+		BlockID struct {
+			Hash string `json:"hash"`
+		} `json:"block_id"`
+	}
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return fmt.Errorf("error unmarshalling block at height %d: %v", h, err)
+	}
+
+	// ref: https://docs.tendermint.com/v0.34/rpc/#/Info/commit
+	res, err := queryAt(ctx, v.rsc, "/commit", url.Values{"height": {strconv.Itoa(h)}}, 0, bcRetry)
+	if err != nil {
+		return err
+	}
+	var c struct {
+		SignedHeader struct {
+			Header rpcHeader `json:"header"`
+			Commit struct {
+				Height     string     `json:"height"`
+				Round      int64      `json:"round"`
+				BlockID    rpcBlockID `json:"block_id"`
+				Signatures []struct {
+					BlockIDFlag      int       `json:"block_id_flag"`
+					ValidatorAddress string    `json:"validator_address"`
+					Timestamp        time.Time `json:"timestamp"`
+					Signature        string    `json:"signature"`
+				} `json:"signatures"`
+			} `json:"commit"`
+		} `json:"signed_header"`
+	}
+	if err := json.Unmarshal(res, &c); err != nil {
+		return fmt.Errorf("error unmarshalling commit at height %d - got response:\n%s: %v", h, string(res), err)
+	}
+	header, commit := c.SignedHeader.Header, c.SignedHeader.Commit
+
+	hash, err := headerHash(header)
+	if err != nil {
+		return fmt.Errorf("%w: error hashing header at height %d: %v", errInvalidBlock, h, err)
+	}
+	if commitHash := decodeHash(commit.BlockID.Hash); !bytes.Equal(hash, commitHash) {
+		return fmt.Errorf("%w: header hash %X at height %d does not match committed block hash %X", errInvalidBlock, hash, h, commitHash)
+	}
+	if blockHash := decodeHash(b.BlockID.Hash); !bytes.Equal(hash, blockHash) {
+		return fmt.Errorf("%w: block hash %X at height %d does not match signed header hash %X", errInvalidBlock, blockHash, h, hash)
+	}
+
+	vals, err := v.validators(ctx, h)
+	if err != nil {
+		return err
+	}
+	valsHash := merkleRoot(vals.encoded)
+	if !bytes.Equal(valsHash, decodeHash(header.ValidatorsHash)) {
+		return fmt.Errorf("%w: validator set hash %X at height %d does not match header's validators hash %s", errInvalidBlock, valsHash, h, header.ValidatorsHash)
+	}
+	v.mu.Lock()
+	prev, ok := v.nextVals[h-1]
+	v.mu.Unlock()
+	if ok && !bytes.Equal(prev, valsHash) {
+		return fmt.Errorf("%w: validators hash %X at height %d does not match previous header's next validators hash %X", errInvalidBlock, valsHash, h, prev)
+	}
+
+	// count voting power that signed the commit
+	var signed, total int64
+	for _, p := range vals.power {
+		total += p
+	}
+	for _, s := range commit.Signatures {
+		if s.BlockIDFlag != 2 { // only BlockIDFlagCommit votes count
+			continue
+		}
+		addr := decodeHash(s.ValidatorAddress)
+		i, ok := vals.index[string(addr)]
+		if !ok {
+			return fmt.Errorf("%w: commit at height %d signed by unknown validator %X", errInvalidBlock, h, addr)
+		}
+		sig, err := base64.StdEncoding.DecodeString(s.Signature)
+		if err != nil {
+			return fmt.Errorf("%w: error decoding signature by %X at height %d: %v", errInvalidBlock, addr, h, err)
+		}
+		msg := voteSignBytes(header.ChainID, h, commit.Round, commit.BlockID, s.Timestamp)
+		if !ed25519.Verify(vals.keys[i], msg, sig) {
+			return fmt.Errorf("%w: invalid signature by %X at height %d", errInvalidBlock, addr, h)
+		}
+		signed += vals.power[i]
+	}
+	// use big ints to avoid overflows with huge voting powers
+	if new(big.Int).Mul(big.NewInt(signed), big.NewInt(3)).Cmp(new(big.Int).Mul(big.NewInt(total), big.NewInt(2))) <= 0 {
+		return fmt.Errorf("%w: commit at height %d signed by only %d out of %d voting power", errInvalidBlock, h, signed, total)
+	}
+
+	v.mu.Lock()
+	v.nextVals[h] = decodeHash(header.NextValidatorsHash)
+	// only keep recent heights, as workers process heights roughly in order
+	delete(v.nextVals, h-2*maxReqWorkers)
+	v.mu.Unlock()
+
+	return nil
+}
+
+// validatorSet is validator set at height, in its original order
+type validatorSet struct {
+	encoded [][]byte // validators encoded for hashing
+	keys    []ed25519.PublicKey
+	power   []int64
+	index   map[string]int // validator index by address
+}
+
+// validators returns complete validator set at height h
+func (v *verifier) validators(ctx context.Context, h int) (*validatorSet, error) {
+	vs := validatorSet{index: map[string]int{}}
+	for page := 1; ; page++ {
+		// ref: https://docs.tendermint.com/v0.34/rpc/#/Info/validators
+		res, err := queryAt(ctx, v.rsc, "/validators", url.Values{"height": {strconv.Itoa(h)}, "page": {strconv.Itoa(page)}, "per_page": {"100"}}, 0, bcRetry)
+		if err != nil {
+			return nil, err
+		}
+		var r struct {
+			Validators []struct {
+				Address string `json:"address"`
+				PubKey  struct {
+					Type  string `json:"type"`
+					Value string `json:"value"`
+				} `json:"pub_key"`
+				VotingPower string `json:"voting_power"`
+			} `json:"validators"`
+			Total string `json:"total"`
+		}
+		if err := json.Unmarshal(res, &r); err != nil {
+			return nil, fmt.Errorf("error unmarshalling validators at height %d - got response:\n%s: %v", h, string(res), err)
+		}
+		for _, val := range r.Validators {
+			if val.PubKey.Type != "tendermint/PubKeyEd25519" {
+				return nil, fmt.Errorf("%w: unsupported validator %s key type %s at height %d", errInvalidBlock, val.Address, val.PubKey.Type, h)
+			}
+			key, err := base64.StdEncoding.DecodeString(val.PubKey.Value)
+			if err != nil || len(key) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("%w: invalid validator %s key at height %d", errInvalidBlock, val.Address, h)
+			}
+			power, err := strconv.ParseInt(val.VotingPower, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: invalid validator %s voting power at height %d: %v", errInvalidBlock, val.Address, h, err)
+			}
+			// SimpleValidator{pub_key: PublicKey{ed25519}, voting_power}
+			pk := protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), key)
+			b := protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), pk)
+			if power != 0 {
+				b = protowire.AppendVarint(protowire.AppendTag(b, 2, protowire.VarintType), uint64(power))
+			}
+			vs.index[string(decodeHash(val.Address))] = len(vs.keys)
+			vs.encoded = append(vs.encoded, b)
+			vs.keys = append(vs.keys, key)
+			vs.power = append(vs.power, power)
+		}
+		total, err := strconv.Atoi(r.Total)
+		if err != nil || len(vs.keys) >= total || len(r.Validators) == 0 {
+			break
+		}
+	}
+	return &vs, nil
+}
+
+// headerHash returns tendermint block header hash, ie merkle root of its proto-encoded fields
+// ref: https://github.com/tendermint/tendermint/blob/v0.34.x/types/block.go (Header.Hash)
+func headerHash(h rpcHeader) ([]byte, error) {
+	block, err := strconv.ParseUint(h.Version.Block, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block version %q: %v", h.Version.Block, err)
+	}
+	app, err := strconv.ParseUint(h.Version.App, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid app version %q: %v", h.Version.App, err)
+	}
+	height, err := strconv.ParseInt(h.Height, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid height %q: %v", h.Height, err)
+	}
+
+	var version []byte
+	version = appendVarint(version, 1, block)
+	version = appendVarint(version, 2, app)
+
+	return merkleRoot([][]byte{
+		version,
+		appendBytes(nil, 1, []byte(h.ChainID)),
+		appendVarint(nil, 1, uint64(height)),
+		timestamp(h.Time),
+		blockID(h.LastBlockID),
+		appendBytes(nil, 1, decodeHash(h.LastCommitHash)),
+		appendBytes(nil, 1, decodeHash(h.DataHash)),
+		appendBytes(nil, 1, decodeHash(h.ValidatorsHash)),
+		appendBytes(nil, 1, decodeHash(h.NextValidatorsHash)),
+		appendBytes(nil, 1, decodeHash(h.ConsensusHash)),
+		appendBytes(nil, 1, decodeHash(h.AppHash)),
+		appendBytes(nil, 1, decodeHash(h.LastResultsHash)),
+		appendBytes(nil, 1, decodeHash(h.EvidenceHash)),
+		appendBytes(nil, 1, decodeHash(h.ProposerAddress)),
+	}), nil
+}
+
+// voteSignBytes returns length-delimited proto-encoded CanonicalVote for precommit signed by validators
+// ref: https://github.com/tendermint/tendermint/blob/v0.34.x/types/vote.go (VoteSignBytes)
+func voteSignBytes(chainID string, height int, round int64, id rpcBlockID, ts time.Time) []byte {
+	var b []byte
+	b = appendVarint(b, 1, 2) // SIGNED_MSG_TYPE_PRECOMMIT
+	if height != 0 {
+		b = protowire.AppendFixed64(protowire.AppendTag(b, 2, protowire.Fixed64Type), uint64(height))
+	}
+	if round != 0 {
+		b = protowire.AppendFixed64(protowire.AppendTag(b, 3, protowire.Fixed64Type), uint64(round))
+	}
+	if id.Hash != "" || id.Parts.Total != 0 || id.Parts.Hash != "" { // canonical block id is nil for zero block id (ie, nil votes)
+		b = protowire.AppendBytes(protowire.AppendTag(b, 4, protowire.BytesType), blockID(id))
+	}
+	b = protowire.AppendBytes(protowire.AppendTag(b, 5, protowire.BytesType), timestamp(ts))
+	b = appendBytes(b, 6, []byte(chainID))
+	return protowire.AppendBytes(nil, b)
+}
+
+// blockID returns proto-encoded block id
+// note: canonical block id, used in votes, has the same encoding
+func blockID(id rpcBlockID) []byte {
+	var psh []byte
+	psh = appendVarint(psh, 1, uint64(id.Parts.Total))
+	psh = appendBytes(psh, 2, decodeHash(id.Parts.Hash))
+	b := appendBytes(nil, 1, decodeHash(id.Hash))
+	return protowire.AppendBytes(protowire.AppendTag(b, 2, protowire.BytesType), psh)
+}
+
+// timestamp returns proto-encoded timestamp
+func timestamp(t time.Time) []byte {
+	var b []byte
+	b = appendVarint(b, 1, uint64(t.Unix()))
+	return appendVarint(b, 2, uint64(t.Nanosecond()))
+}
+
+// appendVarint appends proto-encoded varint field num with value v to b, omitting default (zero) value
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	return protowire.AppendVarint(protowire.AppendTag(b, num, protowire.VarintType), v)
+}
+
+// appendBytes appends proto-encoded bytes field num with value v to b, omitting default (empty) value
+func appendBytes(b []byte, num protowire.Number, v []byte) []byte {
+	if len(v) == 0 {
+		return b
+	}
+	return protowire.AppendBytes(protowire.AppendTag(b, num, protowire.BytesType), v)
+}
+
+// merkleRoot returns root hash of rfc 6962 merkle tree of items, as used by tendermint
+// ref: https://github.com/tendermint/tendermint/blob/v0.34.x/crypto/merkle/tree.go
+func merkleRoot(items [][]byte) []byte {
+	switch len(items) {
+	case 0:
+		h := sha256.Sum256(nil)
+		return h[:]
+	case 1:
+		h := sha256.Sum256(append([]byte{0}, items[0]...))
+		return h[:]
+	}
+	k := 1 // largest power of 2 less than len(items)
+	for k*2 < len(items) {
+		k *= 2
+	}
+	h := sha256.Sum256(append(append([]byte{1}, merkleRoot(items[:k])...), merkleRoot(items[k:])...))
+	return h[:]
+}
+
+// decodeHash decodes hash or address given either hex-encoded (rpc) or base64-encoded (rest and grpc)
+func decodeHash(s string) []byte {
+	if b, err := hex.DecodeString(s); err == nil {
+		return b
+	}
+	b, _ := base64.StdEncoding.DecodeString(s)
+	return b
+}
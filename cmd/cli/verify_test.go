@@ -0,0 +1,359 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sha256Hex returns hex-encoded sha256 hash of s
+func sha256Hex(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+// ref: https://github.com/tendermint/tendermint/blob/v0.34.x/crypto/merkle/tree_test.go (TestHashFromByteSlices)
+func TestMerkleRoot(t *testing.T) {
+	tests := []struct {
+		name  string
+		items [][]byte
+		want  string
+	}{
+		{name: "empty", items: [][]byte{}, want: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{name: "single", items: [][]byte{{1, 2, 3}}, want: "054edec1d0211f624fed0cbca9d4f9400b0e491c43742af2c5b0abebf0c990d8"},
+		{name: "single blank", items: [][]byte{{}}, want: "6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d"},
+		{name: "two", items: [][]byte{{1, 2, 3}, {4, 5, 6}}, want: "82e6cfce00453804379b53962939eaa7906b39904be0813fcadd31b100773c4b"},
+		{name: "many", items: [][]byte{{1, 2}, {3, 4}, {5, 6}, {7, 8}, {9, 10}}, want: "f326493eceab4f2d9ffbc78c59432a0a005d6ea98392045c74df5d14a113be18"},
+	}
+	for _, tc := range tests {
+		if got := hex.EncodeToString(merkleRoot(tc.items)); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+// ref: https://github.com/tendermint/tendermint/blob/v0.34.x/types/block_test.go (TestHeaderHash)
+func TestHeaderHash(t *testing.T) {
+	var h rpcHeader
+	h.Version.Block, h.Version.App = "1", "2"
+	h.ChainID = "chainId"
+	h.Height = "3"
+	h.Time = time.Date(2019, 10, 13, 16, 14, 44, 0, time.UTC)
+	h.LastBlockID.Hash = strings.Repeat("00", 32)
+	h.LastBlockID.Parts.Total = 6
+	h.LastBlockID.Parts.Hash = strings.Repeat("00", 32)
+	h.LastCommitHash = sha256Hex("last_commit_hash")
+	h.DataHash = sha256Hex("data_hash")
+	h.ValidatorsHash = sha256Hex("validators_hash")
+	h.NextValidatorsHash = sha256Hex("next_validators_hash")
+	h.ConsensusHash = sha256Hex("consensus_hash")
+	h.AppHash = sha256Hex("app_hash")
+	h.LastResultsHash = sha256Hex("last_results_hash")
+	h.EvidenceHash = sha256Hex("evidence_hash")
+	h.ProposerAddress = sha256Hex("proposer_address")[:40] // address is truncated hash
+	hash, err := headerHash(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprintf("%X", hash), "F740121F553B5418C3EFBD343C2DBFE9E007BB67B0D020A0741374BAB65242A4"; got != want {
+		t.Errorf("got header hash %s, want %s", got, want)
+	}
+
+	// hashes are also accepted base64-encoded (as per rest and grpc)
+	raw, _ := hex.DecodeString(h.DataHash)
+	h.DataHash = base64.StdEncoding.EncodeToString(raw)
+	if b64, err := headerHash(h); err != nil || !bytes.Equal(b64, hash) {
+		t.Errorf("got header hash %X (error: %v) with base64-encoded hash, want %X", b64, err, hash)
+	}
+
+	h.Height = "x"
+	if _, err := headerHash(h); err == nil {
+		t.Error("expected error for invalid height")
+	}
+}
+
+// ref: https://github.com/tendermint/tendermint/blob/v0.34.x/types/vote_test.go (TestVoteSignBytesTestVectors)
+func TestVoteSignBytes(t *testing.T) {
+	zeroTime := []byte{0x2a, 0xb, 0x8, 0x80, 0x92, 0xb8, 0xc3, 0x98, 0xfe, 0xff, 0xff, 0xff, 0x1} // timestamp field of zero time
+	tests := []struct {
+		name    string
+		chainID string
+		id      rpcBlockID
+		ts      time.Time
+		want    []byte
+	}{
+		{
+			name: "precommit with height and round", // test vector 1
+			want: append([]byte{
+				0x21,     // length
+				0x8, 0x2, // type: precommit
+				0x11, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // height
+				0x19, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, // round
+			}, zeroTime...),
+		},
+		{
+			name:    "precommit with chain id", // test vector 4, with type
+			chainID: "test_chain_id",
+			want: append(append([]byte{
+				0x30,
+				0x8, 0x2,
+				0x11, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+				0x19, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+			}, zeroTime...), 0x32, 0xd, 0x74, 0x65, 0x73, 0x74, 0x5f, 0x63, 0x68, 0x61, 0x69, 0x6e, 0x5f, 0x69, 0x64),
+		},
+		{
+			name: "precommit for block",
+			id: func() rpcBlockID {
+				var id rpcBlockID
+				id.Hash = strings.Repeat("01", 2)
+				id.Parts.Total = 1
+				id.Parts.Hash = strings.Repeat("02", 2)
+				return id
+			}(),
+			ts: time.Unix(1, 2),
+			want: []byte{
+				0x28,
+				0x8, 0x2,
+				0x11, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+				0x19, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0,
+				0x22, 0xc, // canonical block id
+				0xa, 0x2, 0x1, 0x1, // hash
+				0x12, 0x6, 0x8, 0x1, 0x12, 0x2, 0x2, 0x2, // part set header
+				0x2a, 0x4, 0x8, 0x1, 0x10, 0x2, // timestamp
+			},
+		},
+	}
+	for _, tc := range tests {
+		if got := voteSignBytes(tc.chainID, 1, 1, tc.id, tc.ts); !bytes.Equal(got, tc.want) {
+			t.Errorf("%s:\ngot  %x\nwant %x", tc.name, got, tc.want)
+		}
+	}
+}
+
+// rpcFixture is tendermint rpc source serving commit and validators for verifier
+type rpcFixture struct {
+	commit     []byte
+	validators []byte
+}
+
+func (f *rpcFixture) block(string) ([]byte, error)            { return nil, errUnsupported }
+func (f *rpcFixture) txs(string, string, int) ([]byte, error) { return nil, errUnsupported }
+func (f *rpcFixture) blockResults(string) ([]byte, error)     { return nil, errUnsupported }
+
+func (f *rpcFixture) query(path string, _ url.Values, _ int) ([]byte, error) {
+	switch path {
+	case "/commit":
+		return f.commit, nil
+	case "/validators":
+		return f.validators, nil
+	}
+	return nil, errUnsupported
+}
+
+// testChain is signed header with commit by validators with given keys and voting powers
+type testChain struct {
+	keys   []ed25519.PrivateKey
+	powers []int64
+	header rpcHeader
+}
+
+// newTestChain returns test chain with n validators, each with voting power of 10, at height 5
+func newTestChain(t *testing.T, n int) *testChain {
+	c := &testChain{}
+	var vals []map[string]interface{}
+	for i := 0; i < n; i++ {
+		key := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{byte(i + 1)}, ed25519.SeedSize))
+		c.keys = append(c.keys, key)
+		c.powers = append(c.powers, 10)
+		vals = append(vals, map[string]interface{}{
+			"address":      c.address(i),
+			"pub_key":      map[string]string{"type": "tendermint/PubKeyEd25519", "value": base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))},
+			"voting_power": "10",
+		})
+	}
+	h := &c.header
+	h.Version.Block, h.Version.App = "11", "0"
+	h.ChainID = "test-chain"
+	h.Height = "5"
+	h.Time = time.Date(2022, 1, 2, 3, 4, 5, 6, time.UTC)
+	h.LastBlockID.Hash = sha256Hex("last_block")
+	h.LastBlockID.Parts.Total = 1
+	h.LastBlockID.Parts.Hash = sha256Hex("last_parts")
+	h.DataHash = sha256Hex("data")
+	h.ConsensusHash = sha256Hex("consensus")
+	h.AppHash = sha256Hex("app")
+	h.ProposerAddress = c.address(0)
+
+	// validators hash is taken from validator set as read by verifier
+	raw, err := json.Marshal(map[string]interface{}{"validators": vals, "total": fmt.Sprint(n)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vs, err := newVerifier(&rpcFixture{validators: raw}).validators(context.Background(), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ValidatorsHash = hex.EncodeToString(merkleRoot(vs.encoded))
+	h.NextValidatorsHash = h.ValidatorsHash
+	return c
+}
+
+// address returns address of validator i
+func (c *testChain) address(i int) string {
+	h := sha256.Sum256(c.keys[i].Public().(ed25519.PublicKey))
+	return fmt.Sprintf("%X", h[:20])
+}
+
+// fixture returns rpc source serving header with commit signed by validators as per signers, and raw block as per source
+// signers' values are block id flags (ie, 1 absent, 2 commit, 3 nil)
+func (c *testChain) fixture(t *testing.T, signers []int) (*rpcFixture, []byte) {
+	hash, err := headerHash(c.header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var id rpcBlockID
+	id.Hash = fmt.Sprintf("%X", hash)
+	id.Parts.Total = 1
+	id.Parts.Hash = sha256Hex("parts")
+
+	var sigs []map[string]interface{}
+	var vals []map[string]interface{}
+	for i, key := range c.keys {
+		vals = append(vals, map[string]interface{}{
+			"address":      c.address(i),
+			"pub_key":      map[string]string{"type": "tendermint/PubKeyEd25519", "value": base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))},
+			"voting_power": fmt.Sprint(c.powers[i]),
+		})
+		ts := c.header.Time.Add(time.Duration(i) * time.Millisecond)
+		sig := map[string]interface{}{"block_id_flag": signers[i], "validator_address": c.address(i), "timestamp": ts}
+		if signers[i] == 2 {
+			sig["signature"] = base64.StdEncoding.EncodeToString(ed25519.Sign(key, voteSignBytes(c.header.ChainID, 5, 0, id, ts)))
+		}
+		sigs = append(sigs, sig)
+	}
+	commit, err := json.Marshal(map[string]interface{}{
+		"signed_header": map[string]interface{}{
+			"header": c.header,
+			"commit": map[string]interface{}{"height": "5", "round": 0, "block_id": id, "signatures": sigs},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	validators, err := json.Marshal(map[string]interface{}{"validators": vals, "total": fmt.Sprint(len(vals))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := []byte(fmt.Sprintf(`{"block_id":{"hash":%q}}`, id.Hash))
+	return &rpcFixture{commit: commit, validators: validators}, block
+}
+
+func TestVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		signers []int
+		tamper  func(f *rpcFixture, block []byte) []byte // modifies fixture after signing, returning block
+		prev    string                                   // previous height's next validators hash, if verified: "match" or "other"
+		invalid bool
+	}{
+		{name: "all signed", signers: []int{2, 2, 2, 2}},
+		{name: "more than two thirds", signers: []int{2, 2, 2, 1}},
+		{name: "nil votes not counted", signers: []int{2, 2, 3, 3}, invalid: true},
+		{name: "half", signers: []int{2, 2, 1, 1}, invalid: true},
+		{name: "none", signers: []int{1, 1, 1, 1}, invalid: true},
+		{
+			name:    "block hash mismatch",
+			signers: []int{2, 2, 2, 2},
+			tamper: func(_ *rpcFixture, _ []byte) []byte {
+				return []byte(fmt.Sprintf(`{"block_id":{"hash":"%s"}}`, sha256Hex("other")))
+			},
+			invalid: true,
+		},
+		{
+			name:    "header modified",
+			signers: []int{2, 2, 2, 2},
+			tamper: func(f *rpcFixture, block []byte) []byte {
+				f.commit = bytes.Replace(f.commit, []byte(`"app_hash":"`+sha256Hex("app")), []byte(`"app_hash":"`+sha256Hex("evil")), 1)
+				return block
+			},
+			invalid: true,
+		},
+		{
+			name:    "signature modified",
+			signers: []int{2, 2, 2, 2},
+			tamper: func(f *rpcFixture, block []byte) []byte {
+				var c map[string]map[string]map[string]interface{}
+				json.Unmarshal(f.commit, &c)
+				sigs := c["signed_header"]["commit"]["signatures"].([]interface{})
+				sig := sigs[0].(map[string]interface{})
+				sig["timestamp"] = "2022-01-02T03:04:06Z" // signed for another timestamp
+				f.commit, _ = json.Marshal(c)
+				return block
+			},
+			invalid: true,
+		},
+		{
+			name:    "validator set mismatch",
+			signers: []int{2, 2, 2, 2},
+			tamper: func(f *rpcFixture, block []byte) []byte {
+				f.validators = bytes.Replace(f.validators, []byte(`"voting_power":"10"`), []byte(`"voting_power":"1000"`), 1)
+				return block
+			},
+			invalid: true,
+		},
+		{name: "sequential", signers: []int{2, 2, 2, 2}, prev: "match"},
+		{name: "sequential mismatch", signers: []int{2, 2, 2, 2}, prev: "other", invalid: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestChain(t, 4)
+			f, block := c.fixture(t, tc.signers)
+			if tc.tamper != nil {
+				block = tc.tamper(f, block)
+			}
+			v := newVerifier(f)
+			switch tc.prev {
+			case "match":
+				v.nextVals[4] = decodeHash(c.header.ValidatorsHash)
+			case "other":
+				v.nextVals[4] = decodeHash(sha256Hex("other"))
+			}
+			err := v.verify(context.Background(), block, 5)
+			if tc.invalid != (err != nil) {
+				t.Fatalf("got error %v, want invalid: %v", err, tc.invalid)
+			}
+			if err != nil && !errors.Is(err, errInvalidBlock) {
+				t.Errorf("got error %v, want %v", err, errInvalidBlock)
+			}
+			if err == nil && !bytes.Equal(v.nextVals[5], decodeHash(c.header.NextValidatorsHash)) {
+				t.Errorf("next validators hash not recorded")
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// build metadata, set at build time with ldflags, eg:
+// go build -ldflags "-X main.version=$(git describe --tags) -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" -o cli ./cmd/cli
+var (
+	version   = "v0.3.0-beta"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+// buildMetadata identifies exact build of scraper
+type buildMetadata struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+}
+
+// build returns build metadata of running scraper
+func build() buildMetadata {
+	return buildMetadata{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+}
+
+// String returns build metadata in single line, eg for logs and bug reports
+func (b buildMetadata) String() string {
+	return fmt.Sprintf("cosmos-scraper %s (commit %s, built %s with %s for %s)", b.Version, b.Commit, b.BuildDate, b.GoVersion, b.Platform)
+}
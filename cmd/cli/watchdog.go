@@ -0,0 +1,171 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stalled is set to 1 while scraper is stalled, and stalls counts stalls detected since start
+var (
+	stalled int32
+	stalls  int64
+)
+
+// watchdog detects scraper stalls, ie, watermark (last height with all lower heights processed) not advancing for timeout while lagging behind chain head
+// on stall, it logs alert with diagnostic state (queue depths, partially processed heights and recent errors), dumps goroutines to file and posts alert to webhook, if configured
+type watchdog struct {
+	pg      *progress
+	ss      *scrapeState
+	pz      *pauser
+	queues  func() (req, per int) // requesters' and persisters' queue depths
+	timeout time.Duration
+	errs    *recentLines
+
+	last  int       // last seen watermark
+	since time.Time // when watermark last advanced
+}
+
+// stallDiag is diagnostic state of stalled scraper
+type stallDiag struct {
+	Watermark     int      `json:"watermark"`
+	Head          int      `json:"head"`
+	StalledFor    string   `json:"stalled_for"`
+	ReqQueue      int      `json:"requesters_queue"`
+	PerQueue      int      `json:"persisters_queue"`
+	InFlight      []int    `json:"in_flight"`
+	LastErrors    []string `json:"last_errors,omitempty"`
+	GoroutineDump string   `json:"goroutine_dump,omitempty"`
+}
+
+// newWatchdog returns watchdog of scraper progress pg, with in-flight heights tracked by ss, queuing paused by pz and queue depths returned by queues
+// it also starts tracking errors and warnings logged by stdLogger
+func newWatchdog(pg *progress, ss *scrapeState, pz *pauser, queues func() (int, int), timeout time.Duration) *watchdog {
+	errs := &recentLines{max: 10, match: []string{"error", "warn"}, skip: "stall"} // not own alerts
+	stdLogger.SetOutput(io.MultiWriter(stdLogger.Writer(), errs))
+	s := pg.sample()
+	return &watchdog{pg: pg, ss: ss, pz: pz, queues: queues, timeout: timeout, errs: errs, last: s.watermark, since: time.Now()}
+}
+
+// run checks for stalls every quarter of timeout, until ctx cancelled
+func (w *watchdog) run(ctx context.Context) {
+	periodically(ctx, "stall watchdog", w.timeout/4, func(ctx context.Context) error {
+		w.check(ctx)
+		return nil
+	})
+}
+
+// check raises alert once scraper stalls, and logs once it recovers
+func (w *watchdog) check(ctx context.Context) {
+	s := w.pg.sample()
+	req, per := w.queues()
+	if s.watermark != w.last || ((s.watermark >= s.head || w.pz.paused()) && req == 0 && per == 0) {
+		// progressing, or no work queued (or queuing paused)
+		if atomic.CompareAndSwapInt32(&stalled, 1, 0) {
+			stdLogger.Printf("scraper recovered from stall: watermark advanced to %d", s.watermark)
+			resolve(ctx, "stall", fmt.Sprintf("scraper recovered from stall: watermark advanced to %d", s.watermark))
+		}
+		w.last, w.since = s.watermark, time.Now()
+		return
+	}
+	d := time.Since(w.since)
+	if d < w.timeout || !atomic.CompareAndSwapInt32(&stalled, 0, 1) {
+		return
+	}
+	atomic.AddInt64(&stalls, 1)
+
+	diag := stallDiag{
+		Watermark:  s.watermark,
+		Head:       s.head,
+		StalledFor: d.Round(time.Second).String(),
+		ReqQueue:   req,
+		PerQueue:   per,
+		InFlight:   w.ss.resume().pending,
+		LastErrors: w.errs.lines(),
+	}
+	if file, err := dumpGoroutines(); err != nil {
+		stdLogger.Printf("warn: %v", err)
+	} else {
+		diag.GoroutineDump = file
+	}
+	summary := fmt.Sprintf("scraper stalled: watermark %d hasn't advanced for %s while %d heights behind chain head", s.watermark, diag.StalledFor, s.head-s.watermark)
+	stdLogger.Printf("error: !!! %s !!!", summary)
+	stdLogger.Printf("stall diagnostics: requesters queue: %d, persisters queue: %d, partially processed heights: %v, goroutine dump: %s", req, per, diag.InFlight, diag.GoroutineDump)
+	for _, l := range diag.LastErrors {
+		stdLogger.Printf("stall diagnostics: recent error: %s", l)
+	}
+	alert(ctx, "stall", summary, diag)
+}
+
+// dumpGoroutines writes all goroutines' stacks to new file next to log file, and returns its name
+func dumpGoroutines() (string, error) {
+	file := fmt.Sprintf("%s.goroutines-%s", logFile, time.Now().UTC().Format("20060102T150405"))
+	f, err := os.Create(file)
+	if err != nil {
+		return "", fmt.Errorf("error creating goroutine dump file: %v", err)
+	}
+	defer f.Close()
+	if err := pprof.Lookup("goroutine").WriteTo(f, 2); err != nil {
+		return "", fmt.Errorf("error dumping goroutines: %v", err)
+	}
+	return file, nil
+}
+
+// recentLines is io.Writer keeping up to max most recent lines written containing any of match strings, but not skip string (case insensitive)
+type recentLines struct {
+	max   int
+	match []string
+	skip  string
+
+	mu  sync.Mutex
+	buf []string
+}
+
+// Write keeps matching lines from p
+func (r *recentLines) Write(p []byte) (int, error) {
+	for _, l := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		ll := strings.ToLower(l)
+		if r.skip != "" && strings.Contains(ll, r.skip) {
+			continue
+		}
+		for _, m := range r.match {
+			if strings.Contains(ll, m) {
+				r.mu.Lock()
+				if r.buf = append(r.buf, l); len(r.buf) > r.max {
+					r.buf = r.buf[len(r.buf)-r.max:]
+				}
+				r.mu.Unlock()
+				break
+			}
+		}
+	}
+	return len(p), nil
+}
+
+// lines returns kept lines, oldest first
+func (r *recentLines) lines() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.buf...)
+}
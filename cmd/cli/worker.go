@@ -18,30 +18,115 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
 type request struct {
-	height int
+	height  int
+	recheck bool // re-validate already stored (provisional) block
+	force   bool // scrape even if already recorded as stored in heights ledger (eg, if found missing in database)
+	quit    bool // stop worker receiving it (ie, when scaling workers down)
 }
 
 type persist struct {
 	height   int
 	datatype string
 	raw      []byte
-	col      *mongo.Collection
+	batch    []persist // block, block results and transactions at height to be stored atomically (for "batch" datatype)
+	txs      int       // number of transactions (for "transactions" datatype)
+	trace    *span     // height's root span, if traced
+	queued   time.Time // time sent to persisters, if traced
+	quit     bool      // stop worker receiving it (ie, when scaling workers down)
 }
 
 // reqWorker gets block from reqChan (based on specific height) and send it to perChan channel along with any transactions found in that block
-func reqWorker(ctx context.Context, bcc *bcClient, bxs, txs *mongo.Collection, reqChan <-chan request, perChan chan<- persist, napTime time.Duration) {
-	for r := range reqChan {
-		b, err := blockAt(ctx, bcc, fmt.Sprint(r.height), napTime)
+// if rsc is not nil, block results are also sent (before the transactions, that might be empty)
+// if vrf is not nil, blocks are verified first, and those failing verification are either skipped (as invalid) or only flagged, as per verifyBlocks
+// if cc is not nil, blocks' hash continuity is also checked
+// if evm is not nil, evm blocks, transactions and receipts are also scraped (and stored directly, before the block is sent)
+// if ut is not nil, validators' uptime is also tracked from blocks' last commit signatures
+// if dbAtomic is set, block, block results and transactions are sent together, as single batch, to be stored atomically
+// if lg is not nil, heights are recorded there as pending and fetched, and those already recorded as stored are skipped, unless forced
+// if tr is not nil, (sampled) heights are traced, with spans for node requests here and for queuing and storing in perWorker
+// bxs, txs and brs mongo collections are only used to re-validate stored blocks, if requested
+func reqWorker(ctx context.Context, bcc, rsc bcSource, vrf *verifier, cc *continuity, evm *evmClient, ut *uptime, lg *ledger, tr *tracer, bxs, txs, brs *mongo.Collection, reqChan <-chan request, perChan chan<- persist, rp retryPolicy) {
+	act := workerActivities.track("requester")
+	defer act.done()
+	for {
+		act.idle()
+		r, ok := <-reqChan
+		if !ok || r.quit {
+			return
+		}
+		var root *span      // height's root span, set once it's being scraped
+		var batch []persist // held back to be sent together, if dbAtomic is set
+		send := func(p persist) {
+			if root != nil {
+				p.trace, p.queued = root, time.Now()
+			}
+			if dbAtomic {
+				batch = append(batch, p)
+				return
+			}
+			perChan <- p
+		}
+		flush := func() {
+			if len(batch) > 0 {
+				perChan <- persist{height: r.height, datatype: "batch", batch: batch, trace: root, queued: time.Now()}
+			}
+		}
+
+		if r.recheck {
+			act.set("re-validating block", r.height)
+			if err := recheckAt(ctx, bcc, rsc, r.height, bxs, txs, brs, rp); err != nil {
+				if errors.Is(err, context.Canceled) {
+					continue // drain channel to shutdown, then exit
+				}
+				stdLogger.Panicf("error re-validating block at height %d: %v", r.height, err)
+			}
+			continue
+		}
+
+		if lg != nil {
+			if !r.force {
+				stored, err := lg.stored(ctx, r.height)
+				if err != nil {
+					if errors.Is(err, context.Canceled) {
+						continue // drain channel to shutdown, then exit
+					}
+					stdLogger.Panicf("error checking heights ledger: %v", err)
+				}
+				if stored {
+					bxsLogger.Printf("%d already stored (skipping)", r.height)
+					txsLogger.Printf("%d already stored (skipping)", r.height)
+					if rsc != nil {
+						brsLogger.Printf("%d already stored (skipping)", r.height)
+					}
+					continue
+				}
+			}
+			lg.pending(r.height)
+		}
+
+		if root = tr.root("scrape height"); root != nil {
+			root.set("height", r.height)
+			root.set("forced", r.force)
+		}
+		act.set("fetching block", r.height)
+		sp := root.child("fetch block", spanClient)
+		b, err := blockAt(ctx, bcc, fmt.Sprint(r.height), rp)
+		sp.finish(err)
 		if err != nil {
+			root.finish(err)
 			if errors.Is(err, context.Canceled) {
 				continue // drain channel to shutdown, then exit
 			}
@@ -49,53 +134,312 @@ func reqWorker(ctx context.Context, bcc *bcClient, bxs, txs *mongo.Collection, r
 			// example response: '400 Bad Request: { "code": 3, "message": "height 1 is not available, lowest height is 1995900: invalid request", "details": [ ]}'
 			// note: api/response might change in the future
 			if strings.Contains(err.Error(), fmt.Sprintf("height %d is not available", r.height)) {
+				prune(err)
+				errStats.count("node", err)
 				bxsLogger.Printf("%d unavailable (skipping): %v", r.height, err)
 				txsLogger.Printf("%d unavailable (skipping): %v", r.height, err)
+				if rsc != nil {
+					brsLogger.Printf("%d unavailable (skipping): %v", r.height, err)
+				}
+				continue
+			}
+			// skip blocks (and transactions) too large to process
+			if errors.Is(err, errTooLarge) {
+				errStats.count("node", err)
+				bxsLogger.Printf("%d oversized (skipping): %v", r.height, err)
+				txsLogger.Printf("%d oversized (skipping): %v", r.height, err)
+				if rsc != nil {
+					brsLogger.Printf("%d oversized (skipping): %v", r.height, err)
+				}
 				continue
 			}
 			stdLogger.Panicf("error getting block at height %d (unretryable): %v", r.height, err)
 		}
-		perChan <- persist{
+		if lg != nil {
+			lg.fetched(r.height)
+		}
+		if vrf != nil {
+			sp := root.child("verify block", spanClient)
+			err := vrf.verify(ctx, b, r.height)
+			sp.finish(err)
+			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					root.finish(err)
+					continue // drain channel to shutdown, then exit
+				}
+				if !errors.Is(err, errInvalidBlock) {
+					stdLogger.Panicf("error verifying block at height %d (unretryable): %v", r.height, err)
+				}
+				if verifyBlocks == "reject" {
+					// note: logHeight considers invalid blocks as processed
+					root.finish(err)
+					stdLogger.Printf("%d invalid (skipping): %v", r.height, err)
+					if rsc != nil {
+						brsLogger.Printf("%d invalid (skipping): %v", r.height, err)
+					}
+					continue
+				}
+				stdLogger.Printf("warn: block at height %d failed verification (storing anyway): %v", r.height, err)
+			}
+		}
+		if cc != nil {
+			if err := cc.check(ctx, r.height, b); err != nil {
+				if errors.Is(err, context.Canceled) {
+					root.finish(err)
+					continue // drain channel to shutdown, then exit
+				}
+				stdLogger.Panicf("error checking block hash continuity at height %d: %v", r.height, err)
+			}
+		}
+		if evm != nil {
+			sp := root.child("scrape evm data", spanClient)
+			err := evm.scrape(ctx, r.height, rp)
+			sp.finish(err)
+			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					root.finish(err)
+					continue // drain channel to shutdown, then exit
+				}
+				stdLogger.Panicf("error scraping evm data at height %d (unretryable): %v", r.height, err)
+			}
+		}
+		if ut != nil {
+			if err := ut.track(ctx, b); err != nil {
+				if errors.Is(err, context.Canceled) {
+					root.finish(err)
+					continue // drain channel to shutdown, then exit
+				}
+				stdLogger.Panicf("error tracking validators uptime at height %d: %v", r.height, err)
+			}
+		}
+		send(persist{
 			height:   r.height,
 			datatype: "block",
 			raw:      b,
-			col:      bxs,
+		})
+
+		if rsc != nil {
+			act.set("fetching block results", r.height)
+			sp := root.child("fetch block results", spanClient)
+			res, err := blockResultsAt(ctx, rsc, fmt.Sprint(r.height), rp)
+			sp.finish(err)
+			if err != nil {
+				if errors.Is(err, context.Canceled) {
+					root.finish(err)
+					continue // drain channel to shutdown, then exit
+				}
+				if !errors.Is(err, errTooLarge) {
+					stdLogger.Panicf("error getting block results at height %d (unretryable): %v", r.height, err)
+				}
+				errStats.count("node", err)
+				brsLogger.Printf("%d oversized (skipping): %v", r.height, err)
+			} else {
+				send(persist{
+					height:   r.height,
+					datatype: "block_results",
+					raw:      res,
+				})
+			}
 		}
 
 		// get only non-empty transactions
-		t, err := transactionsAt(ctx, bcc, fmt.Sprint(r.height), napTime)
+		n := numTxs(b)
+		act.set("fetching transactions", r.height)
+		sp = root.child("fetch transactions", spanClient)
+		sp.set("txs", n)
+		t, err := indexedTransactionsAt(ctx, bcc, r.height, n, rp)
+		sp.finish(err)
 		if err != nil {
+			if errors.Is(err, context.Canceled) {
+				root.finish(err)
+				continue // drain channel to shutdown, then exit
+			}
+			if errors.Is(err, errTooLarge) {
+				errStats.count("node", err)
+				txsLogger.Printf("%d oversized (skipping): %v", r.height, err)
+				flush()
+				root.finish(nil)
+				continue
+			}
 			stdLogger.Panicf("error getting transactions at height %d (unretryable): %v", r.height, err)
 		}
 		if t == nil {
 			txsLogger.Printf("%d empty (skipping)", r.height)
+			flush()
+			root.finish(nil)
 			continue
 		}
-		perChan <- persist{
+		send(persist{
 			height:   r.height,
 			datatype: "transactions",
 			raw:      t,
-			col:      txs,
+			txs:      n,
+		})
+		flush()
+		root.finish(nil)
+	}
+}
+
+// indexedTransactionsAt returns transactions at height, like transactionsAt, but if none are found while block has n > 0 transactions, it retries for up to txIndexGrace
+// that is to give node's tx indexer time to catch up with freshly produced blocks, instead of recording them as empty
+func indexedTransactionsAt(ctx context.Context, bcc bcSource, height, n int, rp retryPolicy) ([]byte, error) {
+	deadline := time.Now().Add(txIndexGrace)
+	for i := 1; ; i++ {
+		t, err := transactionsAt(ctx, bcc, fmt.Sprint(height), rp)
+		if err != nil || t != nil || n == 0 {
+			return t, err
+		}
+		d := rp.backoff(i)
+		if time.Now().Add(d).After(deadline) {
+			stdLogger.Printf("warn: no transactions found at height %d after %s, although block has %d (is node's tx indexer enabled?)", height, txIndexGrace, n)
+			return nil, nil
+		}
+		stdLogger.Printf("no transactions found at height %d, although block has %d (will retry in %s)", height, n, d)
+		if err := wait(ctx, d); err != nil {
+			return nil, err
 		}
 	}
 }
 
-// perWorker saves blocks and transactions from perChan channel
-func perWorker(ctx context.Context, perChan <-chan persist) {
-	for p := range perChan {
-		id, err := store(ctx, p.raw, p.col)
+// numTxs returns number of transactions in raw block
+func numTxs(raw []byte) int {
+	var b struct {
+		Block struct {
+			Data struct {
+				Txs []ignored `json:"txs"`
+			} `json:"data"`
+		} `json:"block"`
+	}
+	if err := json.Unmarshal(raw, &b); err != nil {
+		return 0
+	}
+	return len(b.Block.Data.Txs)
+}
+
+// pruned is the last height known to be pruned by node (ie, below its lowest available height), used to fast-forward past pruned blocks
+var pruned int64
+
+// lowestRe matches lowest available height in unavailable height errors
+var lowestRe = regexp.MustCompile(`lowest height is (\d+)`)
+
+// prune records heights below lowest available height found in err as pruned, logging the skipped range once, so the rest of it is not requested
+func prune(err error) {
+	m := lowestRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return
+	}
+	lowest, err := strconv.ParseInt(m[1], 10, 64)
+	if err != nil {
+		return
+	}
+	for {
+		p := atomic.LoadInt64(&pruned)
+		if lowest-1 <= p {
+			return
+		}
+		if atomic.CompareAndSwapInt64(&pruned, p, lowest-1) {
+			// note: logHeight considers all heights up to this one as processed
+			stdLogger.Printf("%d pruned (fast-forwarding to lowest available height %d)", lowest-1, lowest)
+			return
+		}
+	}
+}
+
+// perWorker saves blocks, transactions and block results (individually or in atomic batches) from perChan channel
+// if ibc is not nil, ibc packet events are also extracted from transactions and saved there
+// if dlq is not nil, data that failed to be stored is kept there (and logged as skipped) instead of stopping the scraper
+// data stored, but not published to sinks (see sinkError), is not kept as dead letter, so scraper is stopped and it's scraped again on restart
+func perWorker(ctx context.Context, perChan <-chan persist, st storage, ibc *mongo.Collection, dlq *deadLetters) {
+	act := workerActivities.track("persister")
+	defer act.done()
+	for {
+		act.idle()
+		b, ok := <-perChan
+		if !ok || b.quit {
+			return
+		}
+		act.set("storing "+b.datatype, b.height)
+		b.trace.childAt("queued for persister", spanInternal, b.queued).finish(nil)
+		sp := b.trace.child("store "+b.datatype, spanClient)
+		sp.set("db.system", dbType)
+		var id interface{}
+		var err error
+		start := time.Now()
+		switch b.datatype {
+		case "block":
+			id, err = st.storeBlock(ctx, b.height, b.raw)
+		case "transactions":
+			id, err = st.storeTxs(ctx, b.height, b.raw)
+		case "block_results":
+			id, err = st.storeBlockResults(ctx, b.height, b.raw)
+		case "batch":
+			id, err = st.storeHeight(ctx, b.height, b.batch)
+		default:
+			stdLogger.Panicf("error determining datatype in %v", b)
+		}
+		sp.finish(err)
+		if adaptiveWorkers && !errors.Is(err, context.Canceled) {
+			dbOps.observe(time.Since(start), err)
+		}
 		if err != nil {
 			if errors.Is(err, context.Canceled) {
 				continue // drain channel to shutdown, then exit
 			}
-			stdLogger.Panicf("error storing %s at height %d: %v", p.datatype, p.height, err)
+			var se *sinkError
+			if dlq == nil || errors.As(err, &se) {
+				stdLogger.Panicf("error storing %s at height %d: %v", b.datatype, b.height, err)
+			}
+		}
+		parts := []persist{b}
+		if b.datatype == "batch" {
+			parts = b.batch
+		}
+		for _, p := range parts {
+			if err != nil {
+				if derr := dlq.put(ctx, p, err); derr != nil {
+					stdLogger.Panicf("error storing %s at height %d: %v (and error keeping it as dead letter: %v)", p.datatype, p.height, err, derr)
+				}
+				errStats.count("database", err)
+				sentry.report("error", "dead letter", err.Error(), nil, map[string]interface{}{"height": p.height, "datatype": p.datatype, "payload_size": len(p.raw)})
+				logDeadLettered(p, err)
+				continue
+			}
+			logPersisted(ctx, p, id, ibc)
 		}
-		if p.datatype == "block" {
-			bxsLogger.Printf("%d -> %v", p.height, id)
-		} else if p.datatype == "transactions" {
-			txsLogger.Printf("%d -> %v", p.height, id)
-		} else {
-			stdLogger.Panicf("error determining datatype in %v", p)
+	}
+}
+
+// logDeadLettered logs datatype at height kept as dead letter due to err as skipped
+func logDeadLettered(p persist, err error) {
+	stdLogger.Printf("warn: error storing %s at height %d (keeping it as dead letter): %v", p.datatype, p.height, err)
+	switch p.datatype {
+	case "block":
+		bxsLogger.Printf("%d dead-lettered (skipping)", p.height)
+	case "transactions":
+		txsLogger.Printf("%d dead-lettered (skipping)", p.height)
+	default:
+		brsLogger.Printf("%d dead-lettered (skipping)", p.height)
+	}
+}
+
+// logPersisted logs stored datatype at height with its id, extracting ibc packet events from transactions first, if ibc is not nil
+func logPersisted(ctx context.Context, p persist, id interface{}, ibc *mongo.Collection) {
+	switch p.datatype {
+	case "block":
+		atomic.AddInt64(&storedBlocks, 1)
+		bxsLogger.Printf("%d -> %v", p.height, id)
+	case "transactions":
+		if ibc != nil {
+			if err := storeIBCPackets(ctx, p.raw, p.height, ibc); err != nil {
+				if errors.Is(err, context.Canceled) {
+					return // draining channel to shutdown
+				}
+				stdLogger.Panicf("error storing ibc packets at height %d: %v", p.height, err)
+			}
 		}
+		atomic.AddInt64(&storedTxs, int64(p.txs))
+		txsLogger.Printf("%d -> %v", p.height, id)
+	default:
+		brsLogger.Printf("%d -> %v", p.height, id)
 	}
 }
@@ -0,0 +1,49 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestNumTxs(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want int
+	}{
+		{raw: `{"block":{"data":{"txs":[]}}}`, want: 0},
+		{raw: `{"block":{"data":{"txs":null}}}`, want: 0},
+		{raw: `{"block":{"data":{}}}`, want: 0},
+		{raw: `{"block":{"data":{"txs":["CpIB","Cp]B",""]}}}`, want: 3},
+		{raw: `invalid`, want: 0},
+	}
+	for _, tc := range tests {
+		if got := numTxs([]byte(tc.raw)); got != tc.want {
+			t.Errorf("numTxs(%s) = %d, want %d", tc.raw, got, tc.want)
+		}
+	}
+
+	var txs []string
+	for i := 0; i < 1000; i++ {
+		txs = append(txs, fmt.Sprintf("%q", strings.Repeat("A", i)))
+	}
+	if got := numTxs([]byte(`{"block":{"data":{"txs":[` + strings.Join(txs, ",") + `]}}}`)); got != 1000 {
+		t.Errorf("numTxs = %d, want 1000", got)
+	}
+}
@@ -0,0 +1,152 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// subscribeHeads subscribes to node's new block events via tendermint rpc websocket and sends new block heights to returned channel
+// it uses NewBlockHeader events (header-only variant of NewBlock events) to avoid receiving full blocks that are fetched separately anyway
+// subscription is re-established, pausing for napTime between retries, whenever it drops or no events are received within timeout, unless ctx cancelled
+// returned channel only holds the latest height, so slow readers would not block the subscription
+// ref: https://docs.tendermint.com/v0.34/rpc/#/Websocket/subscribe
+func subscribeHeads(ctx context.Context, wsURL string, napTime, timeout time.Duration) <-chan int {
+	heads := make(chan int, 1)
+	go func() {
+		for ctx.Err() == nil {
+			if err := subscribe(ctx, wsURL, heads, timeout); err != nil && ctx.Err() == nil {
+				stdLogger.Printf("error subscribing to new blocks at %s (will fall back to polling and retry in %s): %v", wsURL, napTime, err)
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(napTime):
+			}
+		}
+	}()
+	return heads
+}
+
+// subscribe sends heights of new blocks to heads channel until subscription drops, no event is received within timeout (eg, on half-open connection) or ctx cancelled
+func subscribe(ctx context.Context, wsURL string, heads chan int, timeout time.Duration) error {
+	config, err := websocket.NewConfig(wsURL, "http://localhost/")
+	if err != nil {
+		return err
+	}
+	for k, v := range bcHeaders {
+		config.Header[k] = v
+	}
+	scheme, port := "http", "80"
+	if config.Location.Scheme == "wss" {
+		scheme, port = "https", "443"
+		if config.TlsConfig, err = bcTLSConfig(); err != nil {
+			return err
+		}
+	}
+	addr := config.Location.Host
+	if config.Location.Port() == "" {
+		addr = net.JoinHostPort(addr, port)
+	}
+	conn, err := bcDial(ctx, scheme, addr)
+	if err != nil {
+		return err
+	}
+	if config.TlsConfig != nil {
+		tlsConfig := config.TlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = config.Location.Hostname()
+		}
+		conn = tls.Client(conn, tlsConfig)
+	}
+	ws, err := websocket.NewClient(config, conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer ws.Close()
+
+	// unblock receive on cancel
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			ws.Close()
+		case <-done:
+		}
+	}()
+
+	if err := websocket.JSON.Send(ws, map[string]interface{}{
+		"jsonrpc": "2.0",
+		"method":  "subscribe",
+		"id":      0,
+		"params":  map[string]string{"query": "tm.event='NewBlockHeader'"},
+	}); err != nil {
+		return fmt.Errorf("error sending subscribe request: %v", err)
+	}
+	stdLogger.Printf("subscribed to new blocks at %s", wsURL)
+
+	for {
+		var ev struct {
+			Result struct {
+				Data struct {
+					Value struct {
+						Header struct {
+							Height string `json:"height"`
+						} `json:"header"`
+					} `json:"value"`
+				} `json:"data"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+				Data    string `json:"data"`
+			} `json:"error"`
+		}
+		if err := ws.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return fmt.Errorf("error setting read deadline: %v", err)
+		}
+		if err := websocket.JSON.Receive(ws, &ev); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				return fmt.Errorf("no events received in %s", timeout)
+			}
+			return fmt.Errorf("error receiving event: %v", err)
+		}
+		if ev.Error != nil {
+			return fmt.Errorf("error in event: %s: %s", ev.Error.Message, ev.Error.Data)
+		}
+		if ev.Result.Data.Value.Header.Height == "" {
+			continue // subscription confirmation
+		}
+		h, err := strconv.Atoi(ev.Result.Data.Value.Header.Height)
+		if err != nil {
+			return fmt.Errorf("error decoding event height %s: %v", ev.Result.Data.Value.Header.Height, err)
+		}
+		// replace any unread height with the latest one
+		select {
+		case <-heads:
+		default:
+		}
+		heads <- h
+	}
+}
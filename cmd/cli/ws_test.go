@@ -0,0 +1,103 @@
+/*
+Copyright © 2022 prezha
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// wsServer serves tendermint rpc websocket, confirming subscription and sending events, then keeping connection open without sending anything
+func wsServer(t *testing.T, events ...string) string {
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		var req map[string]interface{}
+		if err := websocket.JSON.Receive(ws, &req); err != nil || req["method"] != "subscribe" {
+			t.Errorf("got subscribe request %v, error: %v", req, err)
+			return
+		}
+		websocket.Message.Send(ws, `{"jsonrpc":"2.0","id":0,"result":{}}`)
+		for _, ev := range events {
+			websocket.Message.Send(ws, ev)
+		}
+		// silent until client closes connection, like half-open one
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http") + "/websocket"
+}
+
+// headEvent returns NewBlockHeader event for height
+func headEvent(height string) string {
+	return `{"jsonrpc":"2.0","id":0,"result":{"query":"tm.event='NewBlockHeader'","data":{"type":"tendermint/event/NewBlockHeader","value":{"header":{"height":"` + height + `"}}}}}`
+}
+
+func TestSubscribe(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []string
+		head   int // latest height, if any
+		err    string
+	}{
+		{name: "silent connection", events: []string{headEvent("5"), headEvent("6")}, head: 6, err: "no events received in 100ms"},
+		{name: "error event", events: []string{headEvent("5"), `{"jsonrpc":"2.0","id":0,"error":{"code":-32000,"message":"Server error","data":"subscription was cancelled"}}`}, head: 5, err: "error in event: Server error: subscription was cancelled"},
+		{name: "invalid height", events: []string{headEvent("x")}, err: "error decoding event height x"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			url, heads := wsServer(t, tc.events...), make(chan int, 1)
+			done := make(chan error)
+			go func() { done <- subscribe(context.Background(), url, heads, 100*time.Millisecond) }()
+			select {
+			case err := <-done:
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("got error %v, want %q", err, tc.err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("subscription not dropped")
+			}
+			// only the latest height is kept
+			var head int
+			select {
+			case head = <-heads:
+			default:
+			}
+			if head != tc.head {
+				t.Errorf("got head %d, want %d", head, tc.head)
+			}
+		})
+	}
+}
+
+func TestSubscribeCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	url, done := wsServer(t), make(chan error)
+	go func() { done <- subscribe(ctx, url, make(chan int, 1), time.Hour) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription not stopped after ctx cancelled")
+	}
+}